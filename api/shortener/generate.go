@@ -0,0 +1,5 @@
+// Package shortener holds the gRPC API of the service, generated from
+// shortener.proto.
+package shortener
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative shortener.proto
@@ -1,11 +1,27 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
+	"github.com/avtorsky/cuttlink/internal/canonical"
+	"github.com/avtorsky/cuttlink/internal/certs"
 	"github.com/avtorsky/cuttlink/internal/config"
+	"github.com/avtorsky/cuttlink/internal/metadata"
+	"github.com/avtorsky/cuttlink/internal/oidc"
+	"github.com/avtorsky/cuttlink/internal/policy"
+	"github.com/avtorsky/cuttlink/internal/ratelimit"
 	"github.com/avtorsky/cuttlink/internal/server"
 	"github.com/avtorsky/cuttlink/internal/storage"
+	"github.com/avtorsky/cuttlink/internal/workers"
 	"log"
+	"net/http"
+	"net/url"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/database/postgres"
@@ -20,8 +36,12 @@ func main() {
 		panic(err)
 	}
 
-	fileStorage, _ := storage.NewFile(cfg.FileStoragePath)
-	defer fileStorage.CloseFS()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// background tracks the workers writing to the storage, which is closed
+	// once they are done or the shutdown timeout passes.
+	background := newWorkerGroup()
 
 	var localStorage storage.Storager
 	switch {
@@ -42,23 +62,225 @@ func main() {
 			log.Fatalf("unable to migrate: %v", err)
 		}
 		localStorage, _ = storage.NewDB(db)
-		defer db.Close()
 
-	case fileStorage != nil && cfg.FileStoragePath != "":
-		localStorage, _ = storage.NewFileStorage(fileStorage)
+	case cfg.FileStoragePath != "":
+		fileStorage, err := storage.NewFile(cfg.FileStoragePath)
+		if err != nil {
+			log.Fatalf("unable to open file storage: %v", err)
+		}
+		localStorage, err = storage.NewFileStorage(fileStorage)
+		if err != nil {
+			log.Fatalf("unable to load file storage: %v", err)
+		}
 
 	default:
 		localStorage, _ = storage.NewInMemoryStorage()
 	}
 
-	localServer, err := server.New(
-		localStorage,
+	if flusher, ok := localStorage.(storage.HitFlusher); ok && cfg.HitFlushInterval > 0 {
+		background.Go("variant hits flusher", func() {
+			flusher.FlushHits(ctx, cfg.HitFlushInterval)
+		})
+	}
+
+	destinationPolicy, err := policy.NewEngine(policy.Policy{
+		BlockPrivateNetworks: &cfg.BlockPrivateNetworks,
+	})
+	if err != nil {
+		log.Fatalf("unable to init policy: %v", err)
+	}
+	if cfg.PolicyFile != "" {
+		if err := destinationPolicy.LoadFile(cfg.PolicyFile); err != nil {
+			log.Fatalf("unable to load policy: %v", err)
+		}
+		go destinationPolicy.Watch(ctx, cfg.PolicyReloadInterval)
+	}
+
+	normalizer, err := canonical.New(cfg.URLNormalization, cfg.TrackingParams)
+	if err != nil {
+		log.Fatalf("unable to init URL normalizer: %v", err)
+	}
+
+	if cfg.HealthCheckInterval > 0 {
+		healthWorker := workers.NewHealthWorker(localStorage, workers.HealthConfig{
+			Interval:     cfg.HealthCheckInterval,
+			Concurrency:  cfg.HealthCheckConcurrency,
+			HostInterval: cfg.HealthCheckHostInterval,
+			Timeout:      cfg.HealthCheckTimeout,
+			BlockPrivate: cfg.BlockPrivateNetworks,
+		})
+		background.Go("health worker", func() {
+			healthWorker.Run(ctx)
+		})
+	}
+
+	serverOptions := []server.ServerOption{
 		server.WithServerHost(cfg.ServerHost),
 		server.WithServiceHost(cfg.ServiceHost),
-	)
+		server.WithQueryPassthrough(cfg.QueryPassthrough),
+		server.WithPolicy(destinationPolicy),
+		server.WithNormalizer(normalizer),
+		server.WithTrustedProxies(cfg.TrustedProxies),
+		server.WithAdminToken(cfg.AdminToken),
+		server.WithGRPC(cfg.GRPCAddress),
+		server.WithLegacyErrors(cfg.LegacyErrors),
+		server.WithHTTPConfig(server.HTTPConfig{
+			ReadTimeout:       cfg.HTTPReadTimeout,
+			ReadHeaderTimeout: cfg.HTTPReadHeaderTimeout,
+			WriteTimeout:      cfg.HTTPWriteTimeout,
+			IdleTimeout:       cfg.HTTPIdleTimeout,
+			MaxHeaderBytes:    cfg.HTTPMaxHeaderBytes,
+			MaxBodyBytes:      cfg.HTTPMaxBodyBytes,
+			H2C:               cfg.HTTPH2C,
+		}),
+		server.WithSessions(server.SessionConfig{
+			Secrets:     cfg.SessionSecrets,
+			TTL:         cfg.SessionTTL,
+			Development: cfg.Development,
+		}),
+		server.WithRateLimits(server.RateLimits{
+			Create:   ratelimit.Limit{Rate: cfg.RateLimitCreate, Period: cfg.RateLimitPeriod, Burst: cfg.RateLimitCreateBurst},
+			Batch:    ratelimit.Limit{Rate: cfg.RateLimitBatch, Period: cfg.RateLimitPeriod, Burst: cfg.RateLimitBatchBurst},
+			Delete:   ratelimit.Limit{Rate: cfg.RateLimitDelete, Period: cfg.RateLimitPeriod, Burst: cfg.RateLimitDeleteBurst},
+			Redirect: ratelimit.Limit{Rate: cfg.RateLimitRedirect, Period: cfg.RateLimitPeriod, Burst: cfg.RateLimitRedirectBurst},
+			Login:    ratelimit.Limit{Rate: cfg.RateLimitLogin, Period: cfg.RateLimitPeriod, Burst: cfg.RateLimitLoginBurst},
+		}),
+	}
+	if auditLog, ok := localStorage.(storage.Auditor); ok {
+		serverOptions = append(serverOptions, server.WithAuditLog(auditLog))
+	}
+	if cfg.FetchMetadata {
+		fetcher := metadata.NewHTTPFetcher(metadata.HTTPFetcherConfig{
+			Timeout:      cfg.MetadataTimeout,
+			MaxBytes:     cfg.MetadataMaxBytes,
+			BlockPrivate: cfg.BlockPrivateNetworks,
+		})
+		serverOptions = append(serverOptions, server.WithMetadataFetcher(fetcher))
+	}
+	if cfg.OIDCIssuer != "" {
+		redirectURL := cfg.OIDCRedirectURL
+		if redirectURL == "" {
+			redirectURL = strings.TrimSuffix(cfg.ServiceHost, "/") + "/api/user/oidc/callback"
+		}
+		provider, err := oidc.Discover(ctx, oidc.Config{
+			Issuer:       cfg.OIDCIssuer,
+			ClientID:     cfg.OIDCClientID,
+			ClientSecret: cfg.OIDCClientSecret,
+			RedirectURL:  redirectURL,
+			Scopes:       cfg.OIDCScopes,
+		}, nil)
+		if err != nil {
+			log.Fatalf("unable to init OpenID Connect: %v", err)
+		}
+		serverOptions = append(serverOptions, server.WithOIDC(provider))
+	}
+
+	if cfg.TLSEnabled() {
+		minVersion, err := certs.ParseVersion(cfg.TLSMinVersion)
+		if err != nil {
+			log.Fatalf("unable to init TLS: %v", err)
+		}
+		tlsConfig := &tls.Config{MinVersion: minVersion}
+		if cfg.TLSCertFile != "" {
+			reloader, err := certs.NewReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+			if err != nil {
+				log.Fatalf("unable to load certificate: %v", err)
+			}
+			go reloader.Watch(ctx, cfg.TLSReloadInterval)
+			tlsConfig.GetCertificate = reloader.GetCertificate
+		} else {
+			host := ""
+			if u, err := url.Parse(cfg.ServiceHost); err == nil {
+				host = u.Hostname()
+			}
+			cert, err := certs.SelfSigned(host, "localhost", "127.0.0.1", "::1")
+			if err != nil {
+				log.Fatalf("unable to generate certificate: %v", err)
+			}
+			log.Printf("serving a self-signed certificate, for development only")
+			tlsConfig.Certificates = []tls.Certificate{*cert}
+		}
+		serverOptions = append(serverOptions,
+			server.WithTLS(tlsConfig),
+			server.WithHTTPSRedirect(cfg.TLSRedirectAddress),
+		)
+	}
+
+	localServer, err := server.New(localStorage, serverOptions...)
+	if errors.Is(err, server.ErrNoSessionSecret) {
+		log.Fatal("SESSION_SECRETS is required, set DEVELOPMENT=true to run with a throwaway secret")
+	}
 	if err != nil {
 		panic(err)
 	}
 
-	localServer.ListenAndServe()
+	go func() {
+		if err := localServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("unable to serve: %v", err)
+		}
+	}()
+	<-ctx.Done()
+	stop()
+
+	log.Printf("shutting down, waiting up to %s", cfg.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := localServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("unable to shut down gracefully: %v", err)
+	}
+	if abandoned := background.Wait(shutdownCtx); len(abandoned) > 0 {
+		log.Printf("shutdown timeout reached, abandoning %s", strings.Join(abandoned, ", "))
+	}
+	if err := localStorage.Close(); err != nil {
+		log.Printf("unable to close storage: %v", err)
+	}
+}
+
+// workerGroup is a WaitGroup that remembers which workers are still running.
+type workerGroup struct {
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	running map[string]bool
+}
+
+func newWorkerGroup() *workerGroup {
+	return &workerGroup{running: make(map[string]bool)}
+}
+
+func (g *workerGroup) Go(name string, fn func()) {
+	g.mu.Lock()
+	g.running[name] = true
+	g.mu.Unlock()
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		fn()
+		g.mu.Lock()
+		delete(g.running, name)
+		g.mu.Unlock()
+	}()
+}
+
+// Wait waits for the workers until ctx is done and returns the names of
+// those still running then.
+func (g *workerGroup) Wait(ctx context.Context) []string {
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	names := make([]string, 0, len(g.running))
+	for name := range g.running {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
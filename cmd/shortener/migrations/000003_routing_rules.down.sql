@@ -0,0 +1 @@
+ALTER TABLE cuttlink DROP COLUMN rules;
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE cuttlink ADD COLUMN rules JSONB NOT NULL DEFAULT '[]'::jsonb;
\ No newline at end of file
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS cuttlink_variant_hits;
+ALTER TABLE cuttlink DROP COLUMN variants;
\ No newline at end of file
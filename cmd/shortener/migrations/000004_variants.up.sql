@@ -0,0 +1,7 @@
+ALTER TABLE cuttlink ADD COLUMN variants JSONB NOT NULL DEFAULT '[]'::jsonb;
+CREATE TABLE IF NOT EXISTS cuttlink_variant_hits (
+	id INTEGER NOT NULL,
+	destination text NOT NULL,
+	hits BIGINT NOT NULL DEFAULT 0,
+	PRIMARY KEY (id, destination)
+);
\ No newline at end of file
@@ -0,0 +1,2 @@
+ALTER TABLE cuttlink DROP COLUMN utm;
+ALTER TABLE cuttlink DROP COLUMN query_mode;
\ No newline at end of file
@@ -0,0 +1,2 @@
+ALTER TABLE cuttlink ADD COLUMN query_mode VARCHAR(8) NOT NULL DEFAULT '';
+ALTER TABLE cuttlink ADD COLUMN utm JSONB NOT NULL DEFAULT '{}'::jsonb;
\ No newline at end of file
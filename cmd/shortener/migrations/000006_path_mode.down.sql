@@ -0,0 +1 @@
+ALTER TABLE cuttlink DROP COLUMN path_mode;
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE cuttlink ADD COLUMN path_mode VARCHAR(8) NOT NULL DEFAULT '';
\ No newline at end of file
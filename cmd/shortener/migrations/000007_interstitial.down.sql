@@ -0,0 +1,3 @@
+ALTER TABLE cuttlink DROP COLUMN title;
+ALTER TABLE cuttlink DROP COLUMN countdown;
+ALTER TABLE cuttlink DROP COLUMN interstitial;
\ No newline at end of file
@@ -0,0 +1,3 @@
+ALTER TABLE cuttlink ADD COLUMN interstitial BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE cuttlink ADD COLUMN countdown INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE cuttlink ADD COLUMN title text NOT NULL DEFAULT '';
\ No newline at end of file
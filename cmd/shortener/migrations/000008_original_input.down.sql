@@ -0,0 +1 @@
+ALTER TABLE cuttlink DROP COLUMN original_input;
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE cuttlink ADD COLUMN original_input text NOT NULL DEFAULT '';
\ No newline at end of file
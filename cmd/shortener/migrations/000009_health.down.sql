@@ -0,0 +1,3 @@
+ALTER TABLE cuttlink DROP COLUMN is_broken;
+ALTER TABLE cuttlink DROP COLUMN last_checked_at;
+ALTER TABLE cuttlink DROP COLUMN last_status;
\ No newline at end of file
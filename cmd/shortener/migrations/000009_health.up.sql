@@ -0,0 +1,3 @@
+ALTER TABLE cuttlink ADD COLUMN last_status INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE cuttlink ADD COLUMN last_checked_at TIMESTAMPTZ;
+ALTER TABLE cuttlink ADD COLUMN is_broken BOOLEAN NOT NULL DEFAULT FALSE;
\ No newline at end of file
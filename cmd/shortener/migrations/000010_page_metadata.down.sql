@@ -0,0 +1,3 @@
+ALTER TABLE cuttlink DROP COLUMN favicon_url;
+ALTER TABLE cuttlink DROP COLUMN page_description;
+ALTER TABLE cuttlink DROP COLUMN page_title;
\ No newline at end of file
@@ -0,0 +1,3 @@
+ALTER TABLE cuttlink ADD COLUMN page_title TEXT NOT NULL DEFAULT '';
+ALTER TABLE cuttlink ADD COLUMN page_description TEXT NOT NULL DEFAULT '';
+ALTER TABLE cuttlink ADD COLUMN favicon_url TEXT NOT NULL DEFAULT '';
\ No newline at end of file
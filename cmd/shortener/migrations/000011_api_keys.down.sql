@@ -0,0 +1 @@
+DROP TABLE IF EXISTS cuttlink_api_keys;
\ No newline at end of file
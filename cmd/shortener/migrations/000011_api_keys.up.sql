@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS cuttlink_api_keys (
+	id text PRIMARY KEY,
+	user_id VARCHAR(36) NOT NULL,
+	name text NOT NULL DEFAULT '',
+	prefix text NOT NULL,
+	hash text NOT NULL UNIQUE,
+	scope text NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	revoked_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS cuttlink_api_keys_user_id ON cuttlink_api_keys (user_id);
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS cuttlink_users;
\ No newline at end of file
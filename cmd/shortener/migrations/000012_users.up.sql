@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS cuttlink_users (
+	id VARCHAR(36) PRIMARY KEY,
+	username text NOT NULL,
+	email text NOT NULL,
+	password_hash text NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE UNIQUE INDEX IF NOT EXISTS cuttlink_users_username ON cuttlink_users (LOWER(username));
+CREATE UNIQUE INDEX IF NOT EXISTS cuttlink_users_email ON cuttlink_users (LOWER(email));
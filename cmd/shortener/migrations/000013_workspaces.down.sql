@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS cuttlink_workspace_members;
+DROP TABLE IF EXISTS cuttlink_workspaces;
+ALTER TABLE cuttlink DROP COLUMN IF EXISTS workspace_id;
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS cuttlink_workspaces (
+	id VARCHAR(36) PRIMARY KEY,
+	name text NOT NULL,
+	created_by VARCHAR(36) NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE TABLE IF NOT EXISTS cuttlink_workspace_members (
+	workspace_id VARCHAR(36) NOT NULL REFERENCES cuttlink_workspaces (id) ON DELETE CASCADE,
+	user_id VARCHAR(36) NOT NULL,
+	role text NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	PRIMARY KEY (workspace_id, user_id)
+);
+CREATE INDEX IF NOT EXISTS cuttlink_workspace_members_user_id ON cuttlink_workspace_members (user_id);
+ALTER TABLE cuttlink ADD COLUMN IF NOT EXISTS workspace_id VARCHAR(36) NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS cuttlink_workspace_id ON cuttlink (workspace_id);
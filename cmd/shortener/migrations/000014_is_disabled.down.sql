@@ -0,0 +1 @@
+ALTER TABLE cuttlink DROP COLUMN is_disabled;
@@ -0,0 +1 @@
+ALTER TABLE cuttlink ADD COLUMN is_disabled BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS cuttlink_transfers;
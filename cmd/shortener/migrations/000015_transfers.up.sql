@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS cuttlink_transfers (
+	id text PRIMARY KEY,
+	from_user_id VARCHAR(36) NOT NULL,
+	to_user_id VARCHAR(36) NOT NULL,
+	keys jsonb NOT NULL DEFAULT '[]',
+	token_hash text NOT NULL UNIQUE,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	expires_at TIMESTAMPTZ NOT NULL,
+	accepted_at TIMESTAMPTZ,
+	canceled_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS cuttlink_transfers_from_user_id ON cuttlink_transfers (from_user_id);
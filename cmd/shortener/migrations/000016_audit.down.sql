@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS cuttlink_audit;
+DROP FUNCTION IF EXISTS cuttlink_audit_append_only();
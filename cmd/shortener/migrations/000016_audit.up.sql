@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS cuttlink_audit (
+	id text PRIMARY KEY,
+	actor_id text NOT NULL,
+	action text NOT NULL,
+	keys jsonb NOT NULL DEFAULT '[]',
+	before jsonb,
+	after jsonb,
+	client_ip text NOT NULL DEFAULT '',
+	user_agent text NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS cuttlink_audit_actor_id ON cuttlink_audit (actor_id, created_at);
+CREATE OR REPLACE FUNCTION cuttlink_audit_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'cuttlink_audit is append-only';
+END;
+$$ LANGUAGE plpgsql;
+CREATE TRIGGER cuttlink_audit_append_only BEFORE UPDATE OR DELETE ON cuttlink_audit
+	FOR EACH ROW EXECUTE PROCEDURE cuttlink_audit_append_only();
@@ -0,0 +1,154 @@
+package canonical
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Steps of the normalisation, each one can be switched off in configuration.
+const (
+	StepHost     = "host"
+	StepPort     = "port"
+	StepIDN      = "idn"
+	StepFragment = "fragment"
+	StepQuery    = "query"
+	StepTracking = "tracking"
+	StepPath     = "path"
+)
+
+var (
+	AllSteps = []string{StepHost, StepPort, StepIDN, StepFragment, StepQuery, StepTracking, StepPath}
+
+	DefaultTrackingParams = []string{
+		"fbclid", "gclid", "dclid", "gbraid", "wbraid", "msclkid", "yclid",
+		"igshid", "mc_cid", "mc_eid", "_ga", "_gl", "_hsenc", "_hsmi",
+	}
+
+	defaultPorts = map[string]string{
+		"http":  "80",
+		"https": "443",
+		"ftp":   "21",
+	}
+)
+
+// Normalizer rewrites equivalent URLs into one canonical form, so that
+// https://Example.com:443/a?b=1&a=2#x and https://example.com/a?a=2&b=1 are
+// stored as the same destination.
+type Normalizer struct {
+	steps    map[string]bool
+	tracking map[string]bool
+}
+
+// New returns a normalizer running the given steps. Tracking parameters are
+// matched case-insensitively, nil means DefaultTrackingParams.
+func New(steps []string, trackingParams []string) (*Normalizer, error) {
+	n := &Normalizer{
+		steps:    make(map[string]bool),
+		tracking: make(map[string]bool),
+	}
+	for _, step := range steps {
+		step = strings.TrimSpace(strings.ToLower(step))
+		if step == "" || step == "none" {
+			continue
+		}
+		if !isKnownStep(step) {
+			return nil, fmt.Errorf("unknown normalization step %q", step)
+		}
+		n.steps[step] = true
+	}
+	if trackingParams == nil {
+		trackingParams = DefaultTrackingParams
+	}
+	for _, param := range trackingParams {
+		n.tracking[strings.ToLower(strings.TrimSpace(param))] = true
+	}
+
+	return n, nil
+}
+
+func (n *Normalizer) Normalize(rawURL string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return "", err
+	}
+
+	host, port := u.Hostname(), u.Port()
+	if n.steps[StepHost] {
+		host = strings.TrimSuffix(strings.ToLower(host), ".")
+	}
+	if n.steps[StepIDN] && host != "" && net.ParseIP(host) == nil {
+		ascii, err := idna.Lookup.ToASCII(host)
+		if err != nil {
+			return "", fmt.Errorf("invalid host %q: %w", host, err)
+		}
+		host = ascii
+	}
+	if n.steps[StepPort] && defaultPorts[u.Scheme] == port {
+		port = ""
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host = host + ":" + port
+	}
+	u.Host = host
+
+	if n.steps[StepPath] && u.Path == "" && u.Opaque == "" && u.Host != "" {
+		u.Path = "/"
+	}
+	if n.steps[StepFragment] {
+		u.Fragment = ""
+		u.RawFragment = ""
+	}
+	if n.steps[StepTracking] || n.steps[StepQuery] {
+		u.RawQuery = n.normalizeQuery(u.RawQuery)
+	}
+
+	return u.String(), nil
+}
+
+// normalizeQuery drops tracking parameters and sorts by name, keeping the
+// order of repeated values. Without the query step the original order stays.
+func (n *Normalizer) normalizeQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	pairs := strings.Split(rawQuery, "&")
+	kept := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		if pair == "" {
+			continue
+		}
+		name, _, _ := strings.Cut(pair, "=")
+		if decoded, err := url.QueryUnescape(name); err == nil {
+			name = decoded
+		}
+		if n.steps[StepTracking] && n.tracking[strings.ToLower(name)] {
+			continue
+		}
+		kept = append(kept, pair)
+	}
+	if n.steps[StepQuery] {
+		sort.SliceStable(kept, func(i, j int) bool {
+			a, _, _ := strings.Cut(kept[i], "=")
+			b, _, _ := strings.Cut(kept[j], "=")
+			return a < b
+		})
+	}
+	return strings.Join(kept, "&")
+}
+
+func isKnownStep(step string) bool {
+	for _, known := range AllSteps {
+		if known == step {
+			return true
+		}
+	}
+	return false
+}
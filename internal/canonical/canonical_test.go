@@ -0,0 +1,77 @@
+package canonical
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonical__Normalize(t *testing.T) {
+	n, err := New(AllSteps, nil)
+	assert.Nil(t, err)
+	tests := []struct {
+		name   string
+		url    string
+		result string
+	}{
+		{
+			name:   "host_port_fragment_query",
+			url:    "https://Example.com:443/a?b=1&a=2#x",
+			result: "https://example.com/a?a=2&b=1",
+		},
+		{
+			name:   "already_canonical",
+			url:    "https://example.com/a?a=2&b=1",
+			result: "https://example.com/a?a=2&b=1",
+		},
+		{
+			name:   "scheme_and_custom_port",
+			url:    "HTTP://EXAMPLE.com:8080",
+			result: "http://example.com:8080/",
+		},
+		{
+			name:   "tracking_params",
+			url:    "https://example.com/?fbclid=abc&utm_source=x&GCLID=1",
+			result: "https://example.com/?utm_source=x",
+		},
+		{
+			name:   "idn",
+			url:    "https://Пример.рф/путь",
+			result: "https://xn--e1afmkfd.xn--p1ai/%D0%BF%D1%83%D1%82%D1%8C",
+		},
+		{
+			name:   "repeated_values_keep_order",
+			url:    "https://example.com/?b=2&a=1&b=1",
+			result: "https://example.com/?a=1&b=2&b=1",
+		},
+		{
+			name:   "ipv6",
+			url:    "http://[::1]:80/",
+			result: "http://[::1]/",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := n.Normalize(tt.url)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.result, result, "normalized URLs should be equal")
+		})
+	}
+}
+
+func TestCanonical__Steps(t *testing.T) {
+	n, err := New([]string{StepHost}, []string{"ref"})
+	assert.Nil(t, err)
+	result, err := n.Normalize("https://Example.com:443/a?ref=x&b=1#top")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://example.com:443/a?ref=x&b=1#top", result)
+
+	n, err = New([]string{StepTracking}, []string{"ref"})
+	assert.Nil(t, err)
+	result, err = n.Normalize("https://example.com/a?ref=x&fbclid=1")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://example.com/a?fbclid=1", result)
+
+	_, err = New([]string{"lowercase"}, nil)
+	assert.NotNil(t, err)
+}
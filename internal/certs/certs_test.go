@@ -0,0 +1,88 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writePair(t *testing.T, dir string, host string) {
+	cert, err := SelfSigned(host)
+	assert.Nil(t, err)
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	assert.Nil(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "cert.pem"), certPEM, 0600))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "key.pem"), keyPEM, 0600))
+}
+
+func servedHost(t *testing.T, r *Reloader) string {
+	cert, err := r.GetCertificate(&tls.ClientHelloInfo{})
+	assert.Nil(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.Nil(t, err)
+	return leaf.DNSNames[0]
+}
+
+func TestReloader__Watch(t *testing.T) {
+	dir := t.TempDir()
+	writePair(t, dir, "old.example.com")
+	r, err := NewReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	assert.Nil(t, err)
+	assert.Equal(t, "old.example.com", servedHost(t, r))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Watch(ctx, 10*time.Millisecond)
+
+	later := time.Now().Add(time.Minute)
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "key.pem"), []byte("not a key"), 0600))
+	assert.Nil(t, os.Chtimes(filepath.Join(dir, "key.pem"), later, later))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, "old.example.com", servedHost(t, r), "a broken pair should keep the current certificate")
+
+	writePair(t, dir, "new.example.com")
+	later = later.Add(time.Minute)
+	assert.Nil(t, os.Chtimes(filepath.Join(dir, "cert.pem"), later, later))
+	assert.Nil(t, os.Chtimes(filepath.Join(dir, "key.pem"), later, later))
+	assert.Eventually(t, func() bool {
+		return servedHost(t, r) == "new.example.com"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestCerts__SelfSigned(t *testing.T) {
+	cert, err := SelfSigned("localhost", "127.0.0.1", "")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"localhost"}, cert.Leaf.DNSNames)
+	assert.Len(t, cert.Leaf.IPAddresses, 1)
+	assert.Nil(t, cert.Leaf.VerifyHostname("127.0.0.1"))
+	assert.NotNil(t, cert.Leaf.VerifyHostname("example.com"))
+}
+
+func TestCerts__ParseVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    uint16
+		wantErr bool
+	}{
+		{version: "1.2", want: tls.VersionTLS12},
+		{version: "1.3", want: tls.VersionTLS13},
+		{version: "TLS1.3", wantErr: true},
+		{version: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			got, err := ParseVersion(tt.version)
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
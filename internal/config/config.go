@@ -2,16 +2,75 @@ package config
 
 import (
 	"flag"
+	"strings"
+	"time"
 
 	"github.com/caarlos0/env/v6"
 )
 
 type Env struct {
-	ServerHost      string `env:"SERVER_ADDRESS" envDefault:":8080"`
-	ServiceHost     string `env:"BASE_URL" envDefault:"http://localhost:8080"`
-	FileStoragePath string `env:"FILE_STORAGE_PATH"`
-	DatabaseDSN     string `env:"DATABASE_DSN"`
-	MigrationsPath  string `env:"MIGRATIONS_PATH" envDefault:"file://./cmd/shortener/migrations"`
+	ServerHost              string        `env:"SERVER_ADDRESS" envDefault:":8080"`
+	ServiceHost             string        `env:"BASE_URL" envDefault:"http://localhost:8080"`
+	FileStoragePath         string        `env:"FILE_STORAGE_PATH"`
+	HitFlushInterval        time.Duration `env:"HIT_FLUSH_INTERVAL" envDefault:"10s"`
+	DatabaseDSN             string        `env:"DATABASE_DSN"`
+	MigrationsPath          string        `env:"MIGRATIONS_PATH" envDefault:"file://./cmd/shortener/migrations"`
+	QueryPassthrough        bool          `env:"QUERY_PASSTHROUGH" envDefault:"false"`
+	PolicyFile              string        `env:"POLICY_FILE"`
+	PolicyReloadInterval    time.Duration `env:"POLICY_RELOAD_INTERVAL" envDefault:"5s"`
+	BlockPrivateNetworks    bool          `env:"BLOCK_PRIVATE_NETWORKS" envDefault:"true"`
+	URLNormalization        []string      `env:"URL_NORMALIZATION" envSeparator:"," envDefault:"host,port,idn,fragment,query,tracking,path"`
+	TrackingParams          []string      `env:"TRACKING_PARAMS" envSeparator:","`
+	HealthCheckInterval     time.Duration `env:"HEALTH_CHECK_INTERVAL" envDefault:"1h"`
+	HealthCheckConcurrency  int           `env:"HEALTH_CHECK_CONCURRENCY" envDefault:"8"`
+	HealthCheckHostInterval time.Duration `env:"HEALTH_CHECK_HOST_INTERVAL" envDefault:"1s"`
+	HealthCheckTimeout      time.Duration `env:"HEALTH_CHECK_TIMEOUT" envDefault:"10s"`
+	FetchMetadata           bool          `env:"FETCH_METADATA" envDefault:"true"`
+	MetadataTimeout         time.Duration `env:"METADATA_TIMEOUT" envDefault:"5s"`
+	MetadataMaxBytes        int64         `env:"METADATA_MAX_BYTES" envDefault:"524288"`
+	RateLimitCreate         int           `env:"RATE_LIMIT_CREATE" envDefault:"60"`
+	RateLimitCreateBurst    int           `env:"RATE_LIMIT_CREATE_BURST" envDefault:"20"`
+	RateLimitBatch          int           `env:"RATE_LIMIT_BATCH" envDefault:"600"`
+	RateLimitBatchBurst     int           `env:"RATE_LIMIT_BATCH_BURST" envDefault:"200"`
+	RateLimitDelete         int           `env:"RATE_LIMIT_DELETE" envDefault:"30"`
+	RateLimitDeleteBurst    int           `env:"RATE_LIMIT_DELETE_BURST" envDefault:"10"`
+	RateLimitRedirect       int           `env:"RATE_LIMIT_REDIRECT" envDefault:"600"`
+	RateLimitRedirectBurst  int           `env:"RATE_LIMIT_REDIRECT_BURST" envDefault:"100"`
+	RateLimitLogin          int           `env:"RATE_LIMIT_LOGIN" envDefault:"10"`
+	RateLimitLoginBurst     int           `env:"RATE_LIMIT_LOGIN_BURST" envDefault:"5"`
+	RateLimitPeriod         time.Duration `env:"RATE_LIMIT_PERIOD" envDefault:"1m"`
+	TrustedProxies          []string      `env:"TRUSTED_PROXIES" envSeparator:","`
+	SessionSecrets          []string      `env:"SESSION_SECRETS" envSeparator:","`
+	SessionTTL              time.Duration `env:"SESSION_TTL" envDefault:"24h"`
+	Development             bool          `env:"DEVELOPMENT" envDefault:"false"`
+	OIDCIssuer              string        `env:"OIDC_ISSUER"`
+	OIDCClientID            string        `env:"OIDC_CLIENT_ID"`
+	OIDCClientSecret        string        `env:"OIDC_CLIENT_SECRET"`
+	OIDCRedirectURL         string        `env:"OIDC_REDIRECT_URL"`
+	OIDCScopes              []string      `env:"OIDC_SCOPES" envSeparator:"," envDefault:"openid,email,profile"`
+	AdminToken              string        `env:"ADMIN_TOKEN"`
+	TLSCertFile             string        `env:"TLS_CERT_FILE"`
+	TLSKeyFile              string        `env:"TLS_KEY_FILE"`
+	TLSSelfSigned           bool          `env:"TLS_SELF_SIGNED" envDefault:"false"`
+	TLSMinVersion           string        `env:"TLS_MIN_VERSION" envDefault:"1.2"`
+	TLSReloadInterval       time.Duration `env:"TLS_RELOAD_INTERVAL" envDefault:"1m"`
+	TLSRedirectAddress      string        `env:"TLS_REDIRECT_ADDRESS"`
+	HTTPReadTimeout         time.Duration `env:"HTTP_READ_TIMEOUT" envDefault:"30s"`
+	HTTPReadHeaderTimeout   time.Duration `env:"HTTP_READ_HEADER_TIMEOUT" envDefault:"5s"`
+	HTTPWriteTimeout        time.Duration `env:"HTTP_WRITE_TIMEOUT" envDefault:"30s"`
+	HTTPIdleTimeout         time.Duration `env:"HTTP_IDLE_TIMEOUT" envDefault:"2m"`
+	HTTPMaxHeaderBytes      int           `env:"HTTP_MAX_HEADER_BYTES" envDefault:"65536"`
+	HTTPMaxBodyBytes        int64         `env:"HTTP_MAX_BODY_BYTES" envDefault:"1048576"`
+	HTTPH2C                 bool          `env:"HTTP_H2C" envDefault:"false"`
+	ShutdownTimeout         time.Duration `env:"SHUTDOWN_TIMEOUT" envDefault:"30s"`
+	GRPCAddress             string        `env:"GRPC_ADDRESS"`
+	LegacyErrors            bool          `env:"LEGACY_ERRORS" envDefault:"false"`
+}
+
+// TLSEnabled reports whether HTTPS is served, from files or a self-signed
+// certificate.
+func (e Env) TLSEnabled() bool {
+	return e.TLSCertFile != "" || e.TLSSelfSigned
 }
 
 func SetEnvOptionPriority() (Env, error) {
@@ -25,6 +84,8 @@ func SetEnvOptionPriority() (Env, error) {
 	fileStoragePath := flag.String("f", config.FileStoragePath, "define file storage path")
 	databaseDSN := flag.String("d", config.DatabaseDSN, "define DSN connection")
 	migrationsPath := flag.String("m", config.MigrationsPath, "define DB migrations path")
+	policyFile := flag.String("p", config.PolicyFile, "define destination policy file path")
+	queryPassthrough := flag.Bool("q", config.QueryPassthrough, "define default query passthrough to destination URLs")
 	flag.Parse()
 
 	config.ServerHost = *serverHost
@@ -32,5 +93,10 @@ func SetEnvOptionPriority() (Env, error) {
 	config.FileStoragePath = *fileStoragePath
 	config.DatabaseDSN = *databaseDSN
 	config.MigrationsPath = *migrationsPath
+	config.QueryPassthrough = *queryPassthrough
+	config.PolicyFile = *policyFile
+	if config.TLSEnabled() && strings.HasPrefix(config.ServiceHost, "http://") {
+		config.ServiceHost = "https://" + strings.TrimPrefix(config.ServiceHost, "http://")
+	}
 	return config, nil
 }
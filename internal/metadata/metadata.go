@@ -0,0 +1,251 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+)
+
+const (
+	defaultTimeout  = 5 * time.Second
+	defaultMaxBytes = 512 * 1024
+	maxFieldLength  = 300
+	maxRedirects    = 10
+)
+
+var ErrNotHTML = errors.New("destination is not an HTML page")
+
+type Metadata struct {
+	Title         string
+	OGTitle       string
+	OGDescription string
+	FaviconURL    string
+}
+
+type Fetcher interface {
+	Fetch(ctx context.Context, rawURL string) (Metadata, error)
+}
+
+// HTTPFetcher reads at most MaxBytes of the page head. With BlockPrivate set
+// it refuses to connect to loopback, private and link-local addresses, also
+// when a public destination redirects there.
+type HTTPFetcher struct {
+	client   *http.Client
+	maxBytes int64
+}
+
+type HTTPFetcherConfig struct {
+	Timeout      time.Duration
+	MaxBytes     int64
+	BlockPrivate bool
+	UserAgent    string
+}
+
+type userAgentTransport struct {
+	http.RoundTripper
+	userAgent string
+}
+
+func (t userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.Header.Set("User-Agent", t.userAgent)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	return t.RoundTripper.RoundTrip(req)
+}
+
+func NewHTTPFetcher(config HTTPFetcherConfig) *HTTPFetcher {
+	if config.Timeout <= 0 {
+		config.Timeout = defaultTimeout
+	}
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = defaultMaxBytes
+	}
+	if config.UserAgent == "" {
+		config.UserAgent = "cuttlink-metadata/1.0"
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = GuardedDialer(config.Timeout, config.BlockPrivate).DialContext
+
+	return &HTTPFetcher{
+		client: &http.Client{
+			Timeout:       config.Timeout,
+			Transport:     userAgentTransport{transport, config.UserAgent},
+			CheckRedirect: CheckRedirect(config.BlockPrivate),
+		},
+		maxBytes: config.MaxBytes,
+	}
+}
+
+// GuardedDialer connects within timeout. With blockPrivate set it refuses
+// loopback, private, link-local and unspecified addresses; the check runs on
+// the resolved address, so it covers host names and redirects as well.
+func GuardedDialer(timeout time.Duration, blockPrivate bool) *net.Dialer {
+	dialer := &net.Dialer{Timeout: timeout}
+	if blockPrivate {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isBlockedIP(ip) {
+				return fmt.Errorf("connection to %s blocked", host)
+			}
+			return nil
+		}
+	}
+	return dialer
+}
+
+// CheckRedirect follows at most maxRedirects redirects, to http and https
+// URLs only. With blockPrivate set it also stops at redirects to localhost
+// and private IP literals before any connection is attempted.
+func CheckRedirect(blockPrivate bool) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("redirect to %s blocked", req.URL.Scheme)
+		}
+		if !blockPrivate {
+			return nil
+		}
+		host := strings.TrimSuffix(strings.ToLower(req.URL.Hostname()), ".")
+		if ip := net.ParseIP(host); host == "localhost" || strings.HasSuffix(host, ".localhost") || (ip != nil && isBlockedIP(ip)) {
+			return fmt.Errorf("redirect to %s blocked", host)
+		}
+		return nil
+	}
+}
+
+func isBlockedIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+}
+
+func (f *HTTPFetcher) Fetch(ctx context.Context, rawURL string) (Metadata, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return Metadata{}, err
+	}
+	res, err := f.client.Do(req)
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return Metadata{}, fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	contentType := res.Header.Get("Content-Type")
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil &&
+		mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return Metadata{}, ErrNotHTML
+	}
+
+	body, err := charset.NewReader(io.LimitReader(res.Body, f.maxBytes), contentType)
+	if err != nil {
+		return Metadata{}, err
+	}
+	return Parse(body, res.Request.URL)
+}
+
+// Parse extracts metadata from the document head. Relative favicon links are
+// resolved against base, and /favicon.ico is assumed when none is declared.
+func Parse(r io.Reader, base *url.URL) (Metadata, error) {
+	var meta Metadata
+	var favicon string
+	inTitle := false
+	z := html.NewTokenizer(r)
+
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			if !errors.Is(z.Err(), io.EOF) {
+				return meta, z.Err()
+			}
+			return finish(meta, favicon, base), nil
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			attrs := make(map[string]string)
+			for hasAttr {
+				var key, value []byte
+				key, value, hasAttr = z.TagAttr()
+				attrs[string(key)] = string(value)
+			}
+			switch string(name) {
+			case "title":
+				inTitle = meta.Title == "" && tt == html.StartTagToken
+			case "meta":
+				property := strings.ToLower(attrs["property"])
+				if property == "" {
+					property = strings.ToLower(attrs["name"])
+				}
+				switch property {
+				case "og:title":
+					meta.OGTitle = clean(attrs["content"])
+				case "og:description":
+					meta.OGDescription = clean(attrs["content"])
+				}
+			case "link":
+				rel := " " + strings.ToLower(attrs["rel"]) + " "
+				if favicon == "" && (strings.Contains(rel, " icon ") || strings.Contains(rel, " apple-touch-icon ")) {
+					favicon = attrs["href"]
+				}
+			case "body":
+				return finish(meta, favicon, base), nil
+			}
+
+		case html.TextToken:
+			if inTitle {
+				meta.Title = clean(string(z.Text()))
+			}
+
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "title":
+				inTitle = false
+			case "head":
+				return finish(meta, favicon, base), nil
+			}
+		}
+	}
+}
+
+func finish(meta Metadata, favicon string, base *url.URL) Metadata {
+	if base == nil {
+		return meta
+	}
+	if favicon == "" {
+		favicon = "/favicon.ico"
+	}
+	if ref, err := url.Parse(strings.TrimSpace(favicon)); err == nil {
+		resolved := base.ResolveReference(ref)
+		if resolved.Scheme == "http" || resolved.Scheme == "https" {
+			meta.FaviconURL = resolved.String()
+		}
+	}
+	return meta
+}
+
+func clean(value string) string {
+	value = strings.Join(strings.Fields(value), " ")
+	if utf8.RuneCountInString(value) <= maxFieldLength {
+		return value
+	}
+	return string([]rune(value)[:maxFieldLength])
+}
@@ -0,0 +1,143 @@
+package metadata
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetadata__Parse(t *testing.T) {
+	base, _ := url.Parse("https://example.com/articles/1")
+	tests := []struct {
+		name string
+		html string
+		want Metadata
+	}{
+		{
+			name: "title and open graph",
+			html: `<html><head><title> Article
+				| Example </title><meta property="og:title" content="Article">
+				<meta property="og:description" content="About things">
+				<link rel="icon" href="/static/icon.png"></head><body><title>ignored</title></body></html>`,
+			want: Metadata{
+				Title:         "Article | Example",
+				OGTitle:       "Article",
+				OGDescription: "About things",
+				FaviconURL:    "https://example.com/static/icon.png",
+			},
+		},
+		{
+			name: "default favicon",
+			html: `<title>Plain</title>`,
+			want: Metadata{
+				Title:      "Plain",
+				FaviconURL: "https://example.com/favicon.ico",
+			},
+		},
+		{
+			name: "shortcut icon relative to page",
+			html: `<head><link rel="Shortcut Icon" href="icon.ico"><meta name="og:title" content="Named"></head>`,
+			want: Metadata{
+				OGTitle:    "Named",
+				FaviconURL: "https://example.com/articles/icon.ico",
+			},
+		},
+		{
+			name: "javascript favicon is dropped",
+			html: `<head><link rel="icon" href="javascript:alert(1)"></head>`,
+			want: Metadata{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(strings.NewReader(tt.html), base)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestHTTPFetcher__Fetch(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cp1251":
+			w.Header().Set("Content-Type", "text/html; charset=windows-1251")
+			// "Привет" in windows-1251
+			w.Write([]byte("<title>\xcf\xf0\xe8\xe2\xe5\xf2</title>"))
+		case "/meta-charset":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<meta charset="iso-8859-1"><title>Caf` + "\xe9" + `</title>`))
+		case "/large":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html><head>" + strings.Repeat("<!-- padding -->", 1024) + "<title>Late</title>"))
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("\x89PNG"))
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+			w.Write([]byte("<title>Slow</title>"))
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	fetcher := NewHTTPFetcher(HTTPFetcherConfig{Timeout: 100 * time.Millisecond, MaxBytes: 4096})
+
+	meta, err := fetcher.Fetch(context.Background(), ts.URL+"/cp1251")
+	assert.Nil(t, err)
+	assert.Equal(t, "Привет", meta.Title)
+	assert.Equal(t, ts.URL+"/favicon.ico", meta.FaviconURL)
+
+	meta, err = fetcher.Fetch(context.Background(), ts.URL+"/meta-charset")
+	assert.Nil(t, err)
+	assert.Equal(t, "Café", meta.Title)
+
+	meta, err = fetcher.Fetch(context.Background(), ts.URL+"/large")
+	assert.Nil(t, err)
+	assert.Equal(t, "", meta.Title)
+
+	_, err = fetcher.Fetch(context.Background(), ts.URL+"/image")
+	assert.ErrorIs(t, err, ErrNotHTML)
+
+	_, err = fetcher.Fetch(context.Background(), ts.URL+"/slow")
+	assert.NotNil(t, err)
+
+	_, err = fetcher.Fetch(context.Background(), ts.URL+"/missing")
+	assert.NotNil(t, err)
+
+	blocking := NewHTTPFetcher(HTTPFetcherConfig{BlockPrivate: true})
+	_, err = blocking.Fetch(context.Background(), ts.URL+"/cp1251")
+	assert.NotNil(t, err)
+}
+
+func TestMetadata__CheckRedirect(t *testing.T) {
+	tests := []struct {
+		target  string
+		blocked bool
+	}{
+		{target: "https://example.com/next", blocked: false},
+		{target: "http://127.0.0.1:8080/admin", blocked: true},
+		{target: "http://localhost/metrics", blocked: true},
+		{target: "http://10.0.0.5/", blocked: true},
+		{target: "http://169.254.169.254/latest/meta-data/", blocked: true},
+		{target: "http://[::1]/", blocked: true},
+		{target: "ftp://example.com/file", blocked: true},
+	}
+	check := CheckRedirect(true)
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, tt.target, nil)
+			assert.Equal(t, tt.blocked, check(req, nil) != nil)
+		})
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://127.0.0.1/", nil)
+	assert.Nil(t, CheckRedirect(false)(req, nil), "private targets are allowed unless blocked")
+	assert.NotNil(t, CheckRedirect(false)(req, make([]*http.Request, maxRedirects)))
+}
@@ -0,0 +1,202 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+type publicKey struct {
+	alg string
+	key crypto.PublicKey
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// verifySignature returns the JWT payload once its signature checks out. An
+// unknown key id triggers one JWKS refresh, at most once per minute, so that
+// key rotation at the provider is picked up.
+func (p *Provider) verifySignature(ctx context.Context, raw string) ([]byte, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed", ErrInvalidToken)
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if key.alg != header.Alg {
+		return nil, fmt.Errorf("%w: algorithm %q not allowed for key", ErrInvalidToken, header.Alg)
+	}
+
+	digest := sha256Sum([]byte(parts[0] + "." + parts[1]))
+	switch pub := key.key.(type) {
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, signature); err != nil {
+			return nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+		}
+	case *ecdsa.PublicKey:
+		if len(signature) != 64 {
+			return nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+		}
+	default:
+		return nil, ErrUnknownKey
+	}
+
+	return payload, nil
+}
+
+func (p *Provider) key(ctx context.Context, kid string) (publicKey, error) {
+	if key, ok := p.cachedKey(kid); ok {
+		return key, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := lookupKey(p.keys, kid); ok {
+		return key, nil
+	}
+	if !p.keysFetched.IsZero() && p.now().Sub(p.keysFetched) < jwksRefreshDelay {
+		return publicKey{}, ErrUnknownKey
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJSON(ctx, p.client, p.endpoints.JWKSURI, &set); err != nil {
+		return publicKey{}, fmt.Errorf("oidc jwks: %w", err)
+	}
+	keys := make(map[string]publicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, err := parseKey(jwk); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	p.keys = keys
+	p.keysFetched = p.now()
+
+	if key, ok := lookupKey(p.keys, kid); ok {
+		return key, nil
+	}
+	return publicKey{}, ErrUnknownKey
+}
+
+func (p *Provider) cachedKey(kid string) (publicKey, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return lookupKey(p.keys, kid)
+}
+
+// lookupKey also accepts tokens without a key id when the set has one key.
+func lookupKey(keys map[string]publicKey, kid string) (publicKey, bool) {
+	if key, ok := keys[kid]; ok {
+		return key, true
+	}
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, true
+		}
+	}
+	return publicKey{}, false
+}
+
+func parseKey(jwk jsonWebKey) (publicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return publicKey{}, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return publicKey{}, err
+		}
+		if len(e) == 0 || len(e) > 4 {
+			return publicKey{}, fmt.Errorf("unsupported RSA exponent")
+		}
+		key := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+		if key.N.BitLen() < 2048 {
+			return publicKey{}, fmt.Errorf("RSA key too short")
+		}
+		return publicKey{alg: "RS256", key: key}, nil
+
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return publicKey{}, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return publicKey{}, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil {
+			return publicKey{}, err
+		}
+		key := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return publicKey{}, fmt.Errorf("EC point not on curve")
+		}
+		return publicKey{alg: "ES256", key: key}, nil
+	}
+	return publicKey{}, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
+
+func sha256Sum(data []byte) []byte {
+	h := crypto.SHA256.New()
+	h.Write(data)
+	return h.Sum(nil)
+}
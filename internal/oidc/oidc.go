@@ -0,0 +1,271 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	discoveryPath    = "/.well-known/openid-configuration"
+	jwksRefreshDelay = time.Minute
+	clockLeeway      = time.Minute
+	maxResponseBytes = 1 << 20
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid id token")
+	ErrUnknownKey   = errors.New("id token signed by unknown key")
+)
+
+// Config is the client registration at the identity provider.
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+// Claims are the ID token claims cuttlink uses.
+type Claims struct {
+	Issuer            string   `json:"iss"`
+	Subject           string   `json:"sub"`
+	Audience          audience `json:"aud"`
+	AuthorizedParty   string   `json:"azp"`
+	Expiry            int64    `json:"exp"`
+	IssuedAt          int64    `json:"iat"`
+	Nonce             string   `json:"nonce"`
+	Email             string   `json:"email"`
+	EmailVerified     bool     `json:"email_verified"`
+	Name              string   `json:"name"`
+	PreferredUsername string   `json:"preferred_username"`
+}
+
+type audience []string
+
+// UnmarshalJSON accepts both forms of "aud", a single string and an array.
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider runs the authorisation code flow with PKCE against a discovered
+// identity provider and verifies the ID tokens it returns.
+type Provider struct {
+	config    Config
+	endpoints discovery
+	client    *http.Client
+	now       func() time.Time
+
+	mu          sync.RWMutex
+	keys        map[string]publicKey
+	keysFetched time.Time
+}
+
+// Token is the response of the token endpoint.
+type Token struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	IDToken     string `json:"id_token"`
+}
+
+// Discover reads the provider metadata from the issuer. The advertised
+// issuer must match the configured one exactly.
+func Discover(ctx context.Context, config Config, client *http.Client) (*Provider, error) {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid"}
+	}
+	hasOpenID := false
+	for _, scope := range config.Scopes {
+		hasOpenID = hasOpenID || scope == "openid"
+	}
+	if !hasOpenID {
+		config.Scopes = append([]string{"openid"}, config.Scopes...)
+	}
+
+	var endpoints discovery
+	if err := getJSON(ctx, client, strings.TrimSuffix(config.Issuer, "/")+discoveryPath, &endpoints); err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	if endpoints.Issuer != config.Issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer %q does not match %q", endpoints.Issuer, config.Issuer)
+	}
+	if endpoints.AuthorizationEndpoint == "" || endpoints.TokenEndpoint == "" || endpoints.JWKSURI == "" {
+		return nil, errors.New("oidc discovery: incomplete provider metadata")
+	}
+
+	return &Provider{
+		config:    config,
+		endpoints: endpoints,
+		client:    client,
+		now:       time.Now,
+		keys:      make(map[string]publicKey),
+	}, nil
+}
+
+func (p *Provider) Issuer() string {
+	return p.config.Issuer
+}
+
+// AuthCodeURL is where the user agent is sent to log in.
+func (p *Provider) AuthCodeURL(state string, nonce string, verifier string) string {
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {strings.Join(p.config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {Challenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(p.endpoints.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return p.endpoints.AuthorizationEndpoint + separator + query.Encode()
+}
+
+// Exchange trades the authorisation code for tokens.
+func (p *Provider) Exchange(ctx context.Context, code string, verifier string) (*Token, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoints.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxResponseBytes))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc token endpoint: status %d: %s", res.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var token Token
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, err
+	}
+	if token.IDToken == "" {
+		return nil, errors.New("oidc token endpoint: no id_token in response")
+	}
+	return &token, nil
+}
+
+// Verify checks the signature of the ID token against the provider keys and
+// validates issuer, audience, expiry and nonce.
+func (p *Provider) Verify(ctx context.Context, rawIDToken string, nonce string) (*Claims, error) {
+	payload, err := p.verifySignature(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	now := p.now()
+	switch {
+	case claims.Issuer != p.config.Issuer:
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidToken, claims.Issuer)
+	case !claims.Audience.contains(p.config.ClientID):
+		return nil, fmt.Errorf("%w: not issued for this client", ErrInvalidToken)
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != p.config.ClientID:
+		return nil, fmt.Errorf("%w: unexpected authorized party", ErrInvalidToken)
+	case claims.Expiry == 0 || now.Add(-clockLeeway).Unix() >= claims.Expiry:
+		return nil, fmt.Errorf("%w: expired", ErrInvalidToken)
+	case claims.IssuedAt > now.Add(clockLeeway).Unix():
+		return nil, fmt.Errorf("%w: issued in the future", ErrInvalidToken)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: no subject", ErrInvalidToken)
+	case nonce != "" && claims.Nonce != nonce:
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidToken)
+	}
+
+	return &claims, nil
+}
+
+func (a audience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// NewVerifier returns a random PKCE code verifier, also usable for state
+// and nonce values.
+func NewVerifier() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Challenge is the S256 PKCE challenge of verifier.
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func getJSON(ctx context.Context, client *http.Client, rawURL string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: status %d", rawURL, res.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(res.Body, maxResponseBytes)).Decode(v)
+}
@@ -0,0 +1,136 @@
+package oidc
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/avtorsky/cuttlink/internal/oidc/oidctest"
+	"github.com/stretchr/testify/assert"
+)
+
+func newProvider(t *testing.T, idp *oidctest.Provider) *Provider {
+	p, err := Discover(context.Background(), Config{
+		Issuer:       idp.Issuer(),
+		ClientID:     oidctest.ClientID,
+		ClientSecret: oidctest.ClientSecret,
+		RedirectURL:  "http://localhost:8080/api/user/oidc/callback",
+		Scopes:       []string{"email"},
+	}, nil)
+	assert.Nil(t, err)
+	return p
+}
+
+func TestProvider__flow(t *testing.T) {
+	idp := oidctest.NewProvider()
+	defer idp.Close()
+	p := newProvider(t, idp)
+
+	verifier, err := NewVerifier()
+	assert.Nil(t, err)
+	authURL := p.AuthCodeURL("state-1", "nonce-1", verifier)
+	assert.Contains(t, authURL, "scope=openid+email")
+
+	client := http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	res, err := client.Get(authURL)
+	assert.Nil(t, err)
+	res.Body.Close()
+	callback, err := url.Parse(res.Header.Get("Location"))
+	assert.Nil(t, err)
+	assert.Equal(t, "state-1", callback.Query().Get("state"))
+	code := callback.Query().Get("code")
+
+	_, err = p.Exchange(context.Background(), code, "wrong-verifier")
+	assert.NotNil(t, err, "PKCE verifier should be checked")
+
+	res, err = client.Get(authURL)
+	assert.Nil(t, err)
+	res.Body.Close()
+	callback, _ = url.Parse(res.Header.Get("Location"))
+	token, err := p.Exchange(context.Background(), callback.Query().Get("code"), verifier)
+	assert.Nil(t, err)
+
+	claims, err := p.Verify(context.Background(), token.IDToken, "nonce-1")
+	assert.Nil(t, err)
+	assert.Equal(t, "employee-42", claims.Subject)
+	assert.Equal(t, "employee@corp.example", claims.Email)
+
+	_, err = p.Verify(context.Background(), token.IDToken, "other-nonce")
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestProvider__Verify(t *testing.T) {
+	idp := oidctest.NewProvider()
+	defer idp.Close()
+	p := newProvider(t, idp)
+
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss": idp.Issuer(),
+			"sub": "employee-42",
+			"aud": oidctest.ClientID,
+			"exp": time.Now().Add(time.Minute * 5).Unix(),
+			"iat": time.Now().Unix(),
+		}
+	}
+	tests := []struct {
+		name   string
+		modify func(claims map[string]interface{})
+		ok     bool
+	}{
+		{name: "valid", modify: func(map[string]interface{}) {}, ok: true},
+		{name: "audience list", modify: func(c map[string]interface{}) {
+			c["aud"] = []string{"other", oidctest.ClientID}
+			c["azp"] = oidctest.ClientID
+		}, ok: true},
+		{name: "audience list without azp", modify: func(c map[string]interface{}) {
+			c["aud"] = []string{"other", oidctest.ClientID}
+		}},
+		{name: "foreign audience", modify: func(c map[string]interface{}) { c["aud"] = "other" }},
+		{name: "foreign issuer", modify: func(c map[string]interface{}) { c["iss"] = "https://evil.example" }},
+		{name: "expired", modify: func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{name: "no expiry", modify: func(c map[string]interface{}) { delete(c, "exp") }},
+		{name: "issued in future", modify: func(c map[string]interface{}) { c["iat"] = time.Now().Add(time.Hour).Unix() }},
+		{name: "no subject", modify: func(c map[string]interface{}) { delete(c, "sub") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := valid()
+			tt.modify(claims)
+			_, err := p.Verify(context.Background(), idp.Sign(claims), "")
+			if tt.ok {
+				assert.Nil(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrInvalidToken)
+			}
+		})
+	}
+
+	token := idp.Sign(valid())
+	parts := strings.Split(token, ".")
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin"}`)) + "." + parts[2]
+	_, err := p.Verify(context.Background(), tampered, "")
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"test-key"}`)) + "." + parts[1] + "."
+	_, err = p.Verify(context.Background(), none, "")
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	unknown := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"rotated"}`)) + "." + parts[1] + "." + parts[2]
+	_, err = p.Verify(context.Background(), unknown, "")
+	assert.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestDiscover__issuerMismatch(t *testing.T) {
+	idp := oidctest.NewProvider()
+	defer idp.Close()
+
+	_, err := Discover(context.Background(), Config{Issuer: idp.Issuer() + "/"}, nil)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,170 @@
+// Package openapi holds the OpenAPI 3 document of the HTTP API and validates
+// requests and responses against it.
+package openapi
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+//go:embed openapi.json
+var spec []byte
+
+const schemaRefPrefix = "#/components/schemas/"
+
+var ginParams = regexp.MustCompile(`[:*]([^/]+)`)
+
+// Document is the part of an OpenAPI document needed for validation. The
+// document is served as written, so fields unknown here are kept.
+type Document struct {
+	OpenAPI    string              `json:"openapi"`
+	Paths      map[string]PathItem `json:"paths"`
+	Components Components          `json:"components"`
+}
+
+// PathItem maps lower-case HTTP methods to operations.
+type PathItem map[string]*Operation
+
+type Components struct {
+	Schemas map[string]*Schema `json:"schemas"`
+}
+
+type Operation struct {
+	OperationID string              `json:"operationId"`
+	Parameters  []Parameter         `json:"parameters"`
+	RequestBody *RequestBody        `json:"requestBody"`
+	Responses   map[string]Response `json:"responses"`
+}
+
+type Parameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required"`
+	Schema   *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type Response struct {
+	Content map[string]MediaType `json:"content"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Schema supports the keywords the document uses. Formats are descriptive
+// only, the handlers check URLs and dates themselves.
+type Schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 string             `json:"type"`
+	Nullable             bool               `json:"nullable"`
+	Enum                 []string           `json:"enum"`
+	Properties           map[string]*Schema `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties *Schema            `json:"additionalProperties"`
+	Items                *Schema            `json:"items"`
+	MinItems             *int               `json:"minItems"`
+	MaxItems             *int               `json:"maxItems"`
+	MinLength            *int               `json:"minLength"`
+	MaxLength            *int               `json:"maxLength"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+}
+
+// Spec returns the document as served on /api/openapi.json.
+func Spec() []byte {
+	return spec
+}
+
+// Load parses the embedded document and checks that its references resolve.
+func Load() (*Document, error) {
+	var doc Document
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return nil, fmt.Errorf("openapi document: %w", err)
+	}
+	for name, schema := range doc.Components.Schemas {
+		if err := doc.checkSchema(schema); err != nil {
+			return nil, fmt.Errorf("openapi document: schema %s: %w", name, err)
+		}
+	}
+	for path, item := range doc.Paths {
+		for method, op := range item {
+			if err := doc.checkOperation(op); err != nil {
+				return nil, fmt.Errorf("openapi document: %s %s: %w", strings.ToUpper(method), path, err)
+			}
+		}
+	}
+	return &doc, nil
+}
+
+// Operation returns the operation of the method on an OpenAPI path template,
+// or nil when the document doesn't describe it.
+func (d *Document) Operation(method string, path string) *Operation {
+	return d.Paths[path][strings.ToLower(method)]
+}
+
+// GinPath converts a gin route like /:id/*path to the template /{id}/{path}.
+func GinPath(path string) string {
+	return ginParams.ReplaceAllString(path, "{$1}")
+}
+
+func (d *Document) checkOperation(op *Operation) error {
+	for _, param := range op.Parameters {
+		if err := d.checkSchema(param.Schema); err != nil {
+			return err
+		}
+	}
+	if op.RequestBody != nil {
+		for _, media := range op.RequestBody.Content {
+			if err := d.checkSchema(media.Schema); err != nil {
+				return err
+			}
+		}
+	}
+	for _, response := range op.Responses {
+		for _, media := range response.Content {
+			if err := d.checkSchema(media.Schema); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *Document) checkSchema(schema *Schema) error {
+	if schema == nil {
+		return nil
+	}
+	if schema.Ref != "" {
+		_, err := d.resolve(schema)
+		return err
+	}
+	for _, property := range schema.Properties {
+		if err := d.checkSchema(property); err != nil {
+			return err
+		}
+	}
+	if err := d.checkSchema(schema.AdditionalProperties); err != nil {
+		return err
+	}
+	return d.checkSchema(schema.Items)
+}
+
+func (d *Document) resolve(schema *Schema) (*Schema, error) {
+	for seen := 0; schema.Ref != ""; seen++ {
+		name := strings.TrimPrefix(schema.Ref, schemaRefPrefix)
+		target, ok := d.Components.Schemas[name]
+		if !ok || name == schema.Ref || seen > len(d.Components.Schemas) {
+			return nil, fmt.Errorf("unresolved reference %q", schema.Ref)
+		}
+		schema = target
+	}
+	return schema, nil
+}
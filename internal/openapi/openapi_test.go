@@ -0,0 +1,120 @@
+package openapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenAPI__Load(t *testing.T) {
+	doc, err := Load()
+	assert.Nil(t, err)
+	assert.Equal(t, "3.0.3", doc.OpenAPI)
+	assert.NotNil(t, doc.Operation(http.MethodPost, "/api/shorten"))
+	assert.Nil(t, doc.Operation(http.MethodPut, "/api/shorten"))
+}
+
+func TestOpenAPI__GinPath(t *testing.T) {
+	assert.Equal(t, "/{id}", GinPath("/:id"))
+	assert.Equal(t, "/{id}/{path}", GinPath("/:id/*path"))
+	assert.Equal(t, "/api/workspaces/{id}/members/{user}", GinPath("/api/workspaces/:id/members/:user"))
+	assert.Equal(t, "/api/shorten", GinPath("/api/shorten"))
+}
+
+func TestDocument__ValidateBody(t *testing.T) {
+	doc, err := Load()
+	assert.Nil(t, err)
+	tests := []struct {
+		name        string
+		path        string
+		method      string
+		contentType string
+		body        string
+		want        string
+	}{
+		{name: "valid", path: "/api/shorten", method: http.MethodPost, contentType: "application/json", body: `{"url":"https://example.com"}`},
+		{name: "unknown properties", path: "/api/shorten", method: http.MethodPost, contentType: "application/json", body: `{"url":"https://example.com","tag":1}`},
+		{name: "charset", path: "/api/shorten", method: http.MethodPost, contentType: "application/json; charset=utf-8", body: `{}`, want: "body.url is required"},
+		{name: "missing", path: "/api/shorten", method: http.MethodPost, contentType: "application/json", body: ``, want: "body is required"},
+		{name: "malformed", path: "/api/shorten", method: http.MethodPost, contentType: "application/json", body: `{"url":`, want: "body must be valid JSON"},
+		{name: "type", path: "/api/shorten", method: http.MethodPost, contentType: "application/json", body: `{"url":42}`, want: "body.url must be a string"},
+		{name: "undeclared media type", path: "/api/shorten", method: http.MethodPost, contentType: "text/plain", body: `42`},
+		{name: "array item", path: "/api/shorten/batch", method: http.MethodPost, contentType: "application/json", body: `[{"original_url":"https://example.com"},{"correlation_id":"b"}]`, want: "body[1].original_url is required"},
+		{name: "max items", path: "/api/qr/batch", method: http.MethodPost, contentType: "application/json", body: `[` + strings.Repeat(`"k",`, 20) + `"k"]`, want: "body must contain at most 20 items"},
+		{name: "enum", path: "/api/user/keys", method: http.MethodPost, contentType: "application/json", body: `{"scope":"write"}`, want: `body.scope must be one of "", "full", "create", "read"`},
+		{name: "nullable", path: "/api/user/urls/{id}", method: http.MethodPatch, contentType: "application/json", body: `{"countdown":null,"title":null}`},
+		{name: "maximum", path: "/api/user/urls/{id}", method: http.MethodPatch, contentType: "application/json", body: `{"countdown":61}`, want: "body.countdown must be at most 60"},
+		{name: "integer", path: "/api/user/urls/{id}", method: http.MethodPatch, contentType: "application/json", body: `{"countdown":1.5}`, want: "body.countdown must be an integer"},
+		{name: "nested", path: "/api/user/urls/{id}", method: http.MethodPatch, contentType: "application/json", body: `{"rules":[{"window":{"from":9}}]}`, want: "body.rules[0].destination is required"},
+		{name: "additional properties", path: "/api/user/urls/{id}", method: http.MethodPatch, contentType: "application/json", body: `{"utm":{"utm_source":1}}`, want: "body.utm.utm_source must be a string"},
+		{name: "form", path: "/form-submit", method: http.MethodPost, contentType: "application/x-www-form-urlencoded", body: `link=https://example.com`, want: "body.url is required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			op := doc.Operation(tt.method, tt.path)
+			assert.NotNil(t, op)
+			err := doc.ValidateBody(op, tt.contentType, []byte(tt.body))
+			if tt.want == "" {
+				assert.Nil(t, err)
+				return
+			}
+			assert.EqualError(t, err, tt.want)
+		})
+	}
+}
+
+func TestDocument__ValidateParams(t *testing.T) {
+	doc, err := Load()
+	assert.Nil(t, err)
+	op := doc.Operation(http.MethodGet, "/api/admin/urls")
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{query: ""},
+		{query: "limit=10&offset=20&status=deleted&unknown=1"},
+		{query: "limit=ten", want: "query.limit must be an integer"},
+		{query: "limit=1.5", want: "query.limit must be an integer"},
+		{query: "limit=1001", want: "query.limit must be at most 1000"},
+		{query: "offset=-1", want: "query.offset must be at least 0"},
+		{query: "status=gone", want: `query.status must be one of "", "active", "deleted", "disabled"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/admin/urls?"+tt.query, nil)
+			err := doc.ValidateParams(op, r, func(string) string { return "" })
+			if tt.want == "" {
+				assert.Nil(t, err)
+				return
+			}
+			assert.EqualError(t, err, tt.want)
+		})
+	}
+
+	op = doc.Operation(http.MethodGet, "/api/qr/{id}")
+	r := httptest.NewRequest(http.MethodGet, "/api/qr/", nil)
+	assert.EqualError(t, doc.ValidateParams(op, r, func(string) string { return "" }), "path.id is required")
+}
+
+func TestDocument__ValidateResponse(t *testing.T) {
+	doc, err := Load()
+	assert.Nil(t, err)
+	op := doc.Operation(http.MethodPost, "/api/shorten")
+
+	assert.Nil(t, doc.ValidateResponse(op, http.StatusCreated, "application/json; charset=utf-8", []byte(`{"result":"http://localhost:8080/abc"}`)))
+	assert.EqualError(t, doc.ValidateResponse(op, http.StatusCreated, "application/json", []byte(`{"result":"x","extra":true}`)),
+		"response.extra is not documented")
+	assert.EqualError(t, doc.ValidateResponse(op, http.StatusCreated, "text/plain", []byte(`x`)),
+		"response of status 201 may not be text/plain")
+	assert.EqualError(t, doc.ValidateResponse(op, http.StatusTeapot, "", nil), "status 418 is not documented")
+	assert.Nil(t, doc.ValidateResponse(op, http.StatusBadRequest, "application/problem+json",
+		[]byte(`{"type":"about:blank","title":"Bad Request","status":400,"code":"invalid_request","field":"body.url"}`)))
+	assert.EqualError(t, doc.ValidateResponse(op, http.StatusBadRequest, "application/problem+json", []byte(`{"type":"about:blank","title":"Bad Request","status":400}`)),
+		"response.code is required")
+
+	op = doc.Operation(http.MethodGet, "/api/user/urls")
+	assert.Nil(t, doc.ValidateResponse(op, http.StatusNoContent, "application/json", nil))
+}
@@ -0,0 +1,348 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	mediaJSON = "application/json"
+	mediaForm = "application/x-www-form-urlencoded"
+)
+
+// ValidationError names the offending value, e.g. "body[0].original_url is
+// required" or "query.limit must be an integer".
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Field + " " + e.Reason
+}
+
+func invalid(field string, format string, args ...interface{}) error {
+	return &ValidationError{Field: field, Reason: fmt.Sprintf(format, args...)}
+}
+
+// ValidateParams checks the path, query and header parameters of the request.
+// Parameters the operation doesn't declare are ignored.
+func (d *Document) ValidateParams(op *Operation, r *http.Request, pathParam func(name string) string) error {
+	query := r.URL.Query()
+	for _, param := range op.Parameters {
+		var raw string
+		var present bool
+		switch param.In {
+		case "path":
+			raw = pathParam(param.Name)
+			present = raw != ""
+		case "query":
+			raw = query.Get(param.Name)
+			present = query.Has(param.Name) && raw != ""
+		case "header":
+			raw = r.Header.Get(param.Name)
+			present = raw != ""
+		default:
+			continue
+		}
+
+		field := param.In + "." + param.Name
+		if !present {
+			if param.Required {
+				return invalid(field, "is required")
+			}
+			continue
+		}
+		value, err := d.parseParam(param.Schema, raw, field)
+		if err != nil {
+			return err
+		}
+		if err := d.validate(param.Schema, value, field, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Document) parseParam(schema *Schema, raw string, field string) (interface{}, error) {
+	if schema == nil {
+		return raw, nil
+	}
+	schema, err := d.resolve(schema)
+	if err != nil {
+		return nil, err
+	}
+	switch schema.Type {
+	case "integer", "number":
+		if _, err := strconv.ParseFloat(raw, 64); err != nil {
+			return nil, invalid(field, "must be %s", article(schema.Type))
+		}
+		return json.Number(raw), nil
+	case "boolean":
+		value, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, invalid(field, "must be a boolean")
+		}
+		return value, nil
+	}
+	return raw, nil
+}
+
+// ValidateBody checks a JSON or form body against the schema of its media
+// type. Bodies in media types the operation doesn't declare are left to the
+// handler, which knows which ones it accepts.
+func (d *Document) ValidateBody(op *Operation, contentType string, body []byte) error {
+	if op.RequestBody == nil {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	media, ok := op.RequestBody.Content[mediaType]
+	if !ok || media.Schema == nil {
+		return nil
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		if op.RequestBody.Required {
+			return invalid("body", "is required")
+		}
+		return nil
+	}
+
+	switch mediaType {
+	case mediaJSON:
+		value, err := decodeJSON(body)
+		if err != nil {
+			return invalid("body", "must be valid JSON")
+		}
+		return d.validate(media.Schema, value, "body", false)
+	case mediaForm:
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return invalid("body", "must be a valid form")
+		}
+		value := make(map[string]interface{}, len(form))
+		for name := range form {
+			value[name] = form.Get(name)
+		}
+		return d.validate(media.Schema, value, "body", false)
+	}
+	return nil
+}
+
+// ValidateResponse checks that the status is documented and that a JSON body,
+// problems included, matches its schema. Unlike requests, responses may not carry properties
+// the schema doesn't list.
+func (d *Document) ValidateResponse(op *Operation, status int, contentType string, body []byte) error {
+	response, ok := op.Responses[strconv.Itoa(status)]
+	if !ok {
+		if response, ok = op.Responses["default"]; !ok {
+			return invalid("status", "%d is not documented", status)
+		}
+	}
+	if len(body) == 0 {
+		return nil
+	}
+	if len(response.Content) == 0 {
+		return invalid("response", "of status %d must be empty", status)
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return invalid("response", "has an invalid content type %q", contentType)
+	}
+	media, ok := response.Content[mediaType]
+	if !ok {
+		return invalid("response", "of status %d may not be %s", status, mediaType)
+	}
+	if !isJSON(mediaType) || media.Schema == nil {
+		return nil
+	}
+	value, err := decodeJSON(body)
+	if err != nil {
+		return invalid("response", "must be valid JSON")
+	}
+	return d.validate(media.Schema, value, "response", true)
+}
+
+// isJSON accepts application/json and structured syntax suffixes like
+// application/problem+json.
+func isJSON(mediaType string) bool {
+	return mediaType == mediaJSON || strings.HasSuffix(mediaType, "+json")
+}
+
+func decodeJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("trailing data after JSON value")
+	}
+	return value, nil
+}
+
+// validate checks a value decoded with json.Decoder.UseNumber. In strict
+// mode objects with declared properties may not have others.
+func (d *Document) validate(schema *Schema, value interface{}, field string, strict bool) error {
+	if schema == nil {
+		return nil
+	}
+	schema, err := d.resolve(schema)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		if schema.Nullable || schema.Type == "" {
+			return nil
+		}
+		return invalid(field, "must be %s", article(schema.Type))
+	}
+
+	switch schema.Type {
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			return invalid(field, "must be a string")
+		}
+		return validateString(schema, s, field)
+	case "integer", "number":
+		n, ok := value.(json.Number)
+		if !ok {
+			return invalid(field, "must be %s", article(schema.Type))
+		}
+		return validateNumber(schema, n, field)
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return invalid(field, "must be a boolean")
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return invalid(field, "must be an array")
+		}
+		if schema.MinItems != nil && len(items) < *schema.MinItems {
+			return invalid(field, "must contain at least %d items", *schema.MinItems)
+		}
+		if schema.MaxItems != nil && len(items) > *schema.MaxItems {
+			return invalid(field, "must contain at most %d items", *schema.MaxItems)
+		}
+		for i, item := range items {
+			if err := d.validate(schema.Items, item, fmt.Sprintf("%s[%d]", field, i), strict); err != nil {
+				return err
+			}
+		}
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return invalid(field, "must be an object")
+		}
+		return d.validateObject(schema, object, field, strict)
+	}
+	return nil
+}
+
+func (d *Document) validateObject(schema *Schema, object map[string]interface{}, field string, strict bool) error {
+	for _, name := range schema.Required {
+		if _, ok := object[name]; !ok {
+			return invalid(field+"."+name, "is required")
+		}
+	}
+
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		property, ok := schema.Properties[name]
+		switch {
+		case ok:
+		case schema.AdditionalProperties != nil:
+			property = schema.AdditionalProperties
+		case strict && len(schema.Properties) > 0:
+			return invalid(field+"."+name, "is not documented")
+		default:
+			continue
+		}
+		if err := d.validate(property, object[name], field+"."+name, strict); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateString(schema *Schema, s string, field string) error {
+	if len(schema.Enum) > 0 && !contains(schema.Enum, s) {
+		return invalid(field, "must be one of %s", quoteAll(schema.Enum))
+	}
+	length := utf8.RuneCountInString(s)
+	if schema.MinLength != nil && length < *schema.MinLength {
+		if *schema.MinLength == 1 {
+			return invalid(field, "must not be empty")
+		}
+		return invalid(field, "must be at least %d characters long", *schema.MinLength)
+	}
+	if schema.MaxLength != nil && length > *schema.MaxLength {
+		return invalid(field, "must be at most %d characters long", *schema.MaxLength)
+	}
+	return nil
+}
+
+func validateNumber(schema *Schema, n json.Number, field string) error {
+	if schema.Type == "integer" {
+		if _, err := n.Int64(); err != nil {
+			return invalid(field, "must be an integer")
+		}
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return invalid(field, "must be %s", article(schema.Type))
+	}
+	if schema.Minimum != nil && f < *schema.Minimum {
+		return invalid(field, "must be at least %s", formatNumber(*schema.Minimum))
+	}
+	if schema.Maximum != nil && f > *schema.Maximum {
+		return invalid(field, "must be at most %s", formatNumber(*schema.Maximum))
+	}
+	return nil
+}
+
+func article(schemaType string) string {
+	switch schemaType {
+	case "integer", "array", "object":
+		return "an " + schemaType
+	}
+	return "a " + schemaType
+}
+
+func formatNumber(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func quoteAll(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = strconv.Quote(v)
+	}
+	return strings.Join(quoted, ", ")
+}
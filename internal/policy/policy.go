@@ -0,0 +1,320 @@
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TypeExact    = "exact"
+	TypeWildcard = "wildcard"
+	TypeRegex    = "regex"
+
+	RulePrivateNetwork = "private_network"
+	RuleAllowlist      = "allowlist"
+)
+
+// Rule matches destination hosts. Type defaults to wildcard when the pattern
+// contains "*" and to exact otherwise. Name is reported back on rejection.
+type Rule struct {
+	Name    string `json:"name,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Pattern string `json:"pattern"`
+}
+
+// Policy is the on-disk policy format. Deny rules win over allow rules, and a
+// non-empty allowlist rejects every host it doesn't match.
+type Policy struct {
+	Allow                []Rule `json:"allow,omitempty"`
+	Deny                 []Rule `json:"deny,omitempty"`
+	BlockPrivateNetworks *bool  `json:"block_private_networks,omitempty"`
+}
+
+// Violation names the rule that rejected a destination.
+type Violation struct {
+	Rule    string `json:"rule"`
+	Pattern string `json:"pattern,omitempty"`
+	Host    string `json:"host"`
+	Reason  string `json:"reason"`
+}
+
+type Engine struct {
+	mu       sync.RWMutex
+	defaults Policy
+	current  compiled
+	path     string
+	modTime  time.Time
+	size     int64
+}
+
+type compiled struct {
+	allow        []matcher
+	deny         []matcher
+	blockPrivate bool
+}
+
+type matcher struct {
+	name    string
+	pattern string
+	match   func(host string) bool
+}
+
+func (v *Violation) Error() string {
+	if v.Pattern != "" {
+		return fmt.Sprintf("destination %s rejected by %s (%s): %s", v.Host, v.Rule, v.Pattern, v.Reason)
+	}
+	return fmt.Sprintf("destination %s rejected by %s: %s", v.Host, v.Rule, v.Reason)
+}
+
+// NewEngine returns an engine enforcing defaults until a policy file is loaded.
+// Settings omitted from the file fall back to defaults.
+func NewEngine(defaults Policy) (*Engine, error) {
+	current, err := compile(defaults, Policy{})
+	if err != nil {
+		return nil, err
+	}
+	return &Engine{
+		defaults: defaults,
+		current:  current,
+	}, nil
+}
+
+// LoadFile reads the policy from path and remembers it for Watch.
+func (e *Engine) LoadFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return fmt.Errorf("policy %s: %w", path, err)
+	}
+	current, err := compile(p, e.defaults)
+	if err != nil {
+		return fmt.Errorf("policy %s: %w", path, err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.current = current
+	e.path = path
+	e.modTime = info.ModTime()
+	e.size = info.Size()
+
+	return nil
+}
+
+// Watch reloads the policy file whenever its modification time or size
+// changes. A broken file is logged and the previous policy stays in force.
+func (e *Engine) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.mu.RLock()
+			path, modTime, size := e.path, e.modTime, e.size
+			e.mu.RUnlock()
+			if path == "" {
+				continue
+			}
+			info, err := os.Stat(path)
+			if err != nil || (info.ModTime().Equal(modTime) && info.Size() == size) {
+				continue
+			}
+			if err := e.LoadFile(path); err != nil {
+				log.Printf("unable to reload policy: %v", err)
+				continue
+			}
+			log.Printf("policy reloaded from %s", path)
+		}
+	}
+}
+
+// Check returns a *Violation when the destination is not allowed.
+func (e *Engine) Check(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	host := normalizeHost(u.Hostname())
+
+	e.mu.RLock()
+	p := e.current
+	e.mu.RUnlock()
+
+	if p.blockPrivate && isPrivateHost(host) {
+		return &Violation{
+			Rule:   RulePrivateNetwork,
+			Host:   host,
+			Reason: "loopback, private and link-local destinations are blocked",
+		}
+	}
+	for _, m := range p.deny {
+		if m.match(host) {
+			return &Violation{
+				Rule:    m.name,
+				Pattern: m.pattern,
+				Host:    host,
+				Reason:  "host matches denylist",
+			}
+		}
+	}
+	if len(p.allow) == 0 {
+		return nil
+	}
+	for _, m := range p.allow {
+		if m.match(host) {
+			return nil
+		}
+	}
+	return &Violation{
+		Rule:   RuleAllowlist,
+		Host:   host,
+		Reason: "host matches no allowlist entry",
+	}
+}
+
+func compile(p Policy, defaults Policy) (compiled, error) {
+	var c compiled
+	var err error
+	if c.allow, err = compileRules("allow", p.Allow); err != nil {
+		return c, err
+	}
+	if c.deny, err = compileRules("deny", p.Deny); err != nil {
+		return c, err
+	}
+	switch {
+	case p.BlockPrivateNetworks != nil:
+		c.blockPrivate = *p.BlockPrivateNetworks
+	case defaults.BlockPrivateNetworks != nil:
+		c.blockPrivate = *defaults.BlockPrivateNetworks
+	}
+	return c, nil
+}
+
+func compileRules(list string, rules []Rule) ([]matcher, error) {
+	result := make([]matcher, len(rules))
+	for i, rule := range rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("%s[%d]", list, i)
+		}
+		ruleType := rule.Type
+		if ruleType == "" {
+			ruleType = TypeExact
+			if strings.Contains(rule.Pattern, "*") {
+				ruleType = TypeWildcard
+			}
+		}
+		if rule.Pattern == "" {
+			return nil, fmt.Errorf("%s: empty pattern", name)
+		}
+
+		var match func(string) bool
+		switch ruleType {
+		case TypeExact:
+			pattern := normalizeHost(rule.Pattern)
+			match = func(host string) bool { return host == pattern }
+		case TypeWildcard:
+			quoted := regexp.QuoteMeta(normalizeHost(rule.Pattern))
+			re := regexp.MustCompile("^" + strings.ReplaceAll(quoted, `\*`, ".*") + "$")
+			match = re.MatchString
+		case TypeRegex:
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			match = re.MatchString
+		default:
+			return nil, fmt.Errorf("%s: unknown type %q", name, rule.Type)
+		}
+		result[i] = matcher{
+			name:    name,
+			pattern: rule.Pattern,
+			match:   match,
+		}
+	}
+	return result, nil
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// sharedAddressSpace is the carrier-grade NAT range of RFC 6598, which
+// net.IP does not count as private.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isPrivateHost reports loopback, private, shared, link-local and unspecified
+// IP literals, including the shorthand IPv4 forms browsers accept.
+func isPrivateHost(host string) bool {
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		if ip = parseIPv4Numbers(host); ip == nil {
+			return false
+		}
+	}
+	return ip.IsLoopback() || ip.IsPrivate() || sharedAddressSpace.Contains(ip) || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsUnspecified() || ip.IsInterfaceLocalMulticast()
+}
+
+// parseIPv4Numbers parses the inet_aton forms of IPv4 addresses: one to four
+// decimal, octal (0177) or hex (0x7f) numbers, the last filling the remaining
+// bytes, e.g. 127.1 or 2130706433. It returns nil for anything else.
+func parseIPv4Numbers(host string) net.IP {
+	parts := strings.Split(host, ".")
+	if len(parts) > 4 {
+		return nil
+	}
+	var n uint64
+	for i, part := range parts {
+		value, err := parseIPv4Number(part)
+		if err != nil {
+			return nil
+		}
+		bits := uint(8 * (4 - i))
+		if i < len(parts)-1 {
+			if value > 0xff {
+				return nil
+			}
+			bits = 8
+		}
+		if value >= 1<<bits {
+			return nil
+		}
+		n = n<<bits | value
+	}
+	return net.IPv4(byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+func parseIPv4Number(part string) (uint64, error) {
+	base := 10
+	switch {
+	case len(part) > 2 && (strings.HasPrefix(part, "0x") || strings.HasPrefix(part, "0X")):
+		part, base = part[2:], 16
+	case len(part) > 1 && part[0] == '0':
+		part, base = part[1:], 8
+	}
+	return strconv.ParseUint(part, base, 32)
+}
@@ -0,0 +1,95 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicy__Check(t *testing.T) {
+	block := true
+	engine, err := NewEngine(Policy{
+		Allow: []Rule{
+			{Pattern: "avtorskydeployed.online"},
+			{Pattern: "*.avtorskydeployed.online"},
+			{Name: "corp", Type: TypeRegex, Pattern: `^[a-z]+\.corp\.example$`},
+		},
+		Deny: []Rule{
+			{Pattern: "admin.avtorskydeployed.online"},
+		},
+		BlockPrivateNetworks: &block,
+	})
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name string
+		url  string
+		rule string
+	}{
+		{name: "allow_exact", url: "https://avtorskydeployed.online/"},
+		{name: "allow_wildcard", url: "https://yatube.avtorskydeployed.online/"},
+		{name: "allow_regex", url: "https://jira.corp.example/browse/X-1"},
+		{name: "deny_exact", url: "https://Admin.avtorskydeployed.online./", rule: "deny[0]"},
+		{name: "allowlist_miss", url: "https://example.com/", rule: RuleAllowlist},
+		{name: "loopback", url: "http://127.0.0.1:8080/", rule: RulePrivateNetwork},
+		{name: "loopback_decimal", url: "http://2130706433/", rule: RulePrivateNetwork},
+		{name: "loopback_short", url: "http://127.1/", rule: RulePrivateNetwork},
+		{name: "loopback_hex", url: "http://0x7f.0.0.1/", rule: RulePrivateNetwork},
+		{name: "loopback_hex_number", url: "http://0x7f000001/", rule: RulePrivateNetwork},
+		{name: "loopback_octal", url: "http://0177.0.0.1/", rule: RulePrivateNetwork},
+		{name: "private_short", url: "http://10.1/", rule: RulePrivateNetwork},
+		{name: "shared_address_space", url: "http://100.64.0.1/", rule: RulePrivateNetwork},
+		{name: "shared_address_space_end", url: "http://100.127.255.254/", rule: RulePrivateNetwork},
+		{name: "public_after_shared", url: "http://100.128.0.1/", rule: RuleAllowlist},
+		{name: "octal_overflow", url: "http://0400.0.0.1/", rule: RuleAllowlist},
+		{name: "private_v6", url: "http://[fd00::1]/", rule: RulePrivateNetwork},
+		{name: "link_local", url: "http://169.254.169.254/latest/meta-data", rule: RulePrivateNetwork},
+		{name: "localhost", url: "http://localhost/", rule: RulePrivateNetwork},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := engine.Check(tt.url)
+			if tt.rule == "" {
+				assert.Nil(t, err)
+				return
+			}
+			var violation *Violation
+			assert.True(t, errors.As(err, &violation))
+			assert.Equal(t, tt.rule, violation.Rule, "violated rules should be equal")
+		})
+	}
+}
+
+func TestPolicy__Reload(t *testing.T) {
+	file, err := os.CreateTemp("", "cuttlink-policy-*.json")
+	assert.Nil(t, err)
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(`{"deny": [{"pattern": "*.example.com"}]}`)
+	assert.Nil(t, err)
+	file.Close()
+
+	engine, err := NewEngine(Policy{})
+	assert.Nil(t, err)
+	assert.Nil(t, engine.LoadFile(file.Name()))
+	assert.NotNil(t, engine.Check("https://www.example.com/"))
+	assert.Nil(t, engine.Check("https://www.example.org/"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go engine.Watch(ctx, 10*time.Millisecond)
+
+	data := `{"deny": [{"name": "no-org", "pattern": "*.example.org"}]}`
+	assert.Nil(t, os.WriteFile(file.Name(), []byte(data), 0644))
+	assert.Eventually(t, func() bool {
+		return engine.Check("https://www.example.org/") != nil
+	}, time.Second, 10*time.Millisecond)
+	assert.Nil(t, engine.Check("https://www.example.com/"))
+
+	assert.Nil(t, os.WriteFile(file.Name(), []byte(`{"deny": [{"type": "regex", "pattern": "("}]}`), 0644))
+	time.Sleep(50 * time.Millisecond)
+	assert.NotNil(t, engine.Check("https://www.example.org/"), "broken policy should keep the previous one")
+}
@@ -0,0 +1,132 @@
+package qrcode
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"strings"
+
+	"rsc.io/qr"
+)
+
+const (
+	FormatPNG = "png"
+	FormatSVG = "svg"
+
+	DefaultSize   = 256
+	DefaultMargin = 4
+	DefaultLevel  = "M"
+
+	minSize   = 32
+	maxSize   = 1024
+	maxMargin = 32
+)
+
+var levels = map[string]qr.Level{
+	"L": qr.L,
+	"M": qr.M,
+	"Q": qr.Q,
+	"H": qr.H,
+}
+
+// Options controls the rendered code. Size is the image side in pixels and
+// Margin the quiet zone width in modules.
+type Options struct {
+	Format string
+	Size   int
+	Level  string
+	Margin int
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Format: FormatPNG,
+		Size:   DefaultSize,
+		Level:  DefaultLevel,
+		Margin: DefaultMargin,
+	}
+}
+
+func (o Options) Validate() error {
+	if o.Format != FormatPNG && o.Format != FormatSVG {
+		return fmt.Errorf("unknown format %q", o.Format)
+	}
+	if o.Size < minSize || o.Size > maxSize {
+		return fmt.Errorf("size must be within %d..%d", minSize, maxSize)
+	}
+	if _, ok := levels[strings.ToUpper(o.Level)]; !ok {
+		return fmt.Errorf("unknown error correction level %q", o.Level)
+	}
+	if o.Margin < 0 || o.Margin > maxMargin {
+		return fmt.Errorf("margin must be within 0..%d", maxMargin)
+	}
+	return nil
+}
+
+func (o Options) ContentType() string {
+	if o.Format == FormatSVG {
+		return "image/svg+xml"
+	}
+	return "image/png"
+}
+
+// Render encodes text as a QR code and writes it to w in the requested format.
+func Render(w io.Writer, text string, opts Options) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	code, err := qr.Encode(text, levels[strings.ToUpper(opts.Level)])
+	if err != nil {
+		return err
+	}
+
+	modules := code.Size + 2*opts.Margin
+	if opts.Format == FormatSVG {
+		return writeSVG(w, code, opts, modules)
+	}
+	if opts.Size < modules {
+		return errors.New("size too small for the encoded URL")
+	}
+	return writePNG(w, code, opts, modules)
+}
+
+func writePNG(w io.Writer, code *qr.Code, opts Options, modules int) error {
+	scale := opts.Size / modules
+	offset := (opts.Size-scale*modules)/2 + opts.Margin*scale
+
+	img := image.NewPaletted(image.Rect(0, 0, opts.Size, opts.Size), color.Palette{color.White, color.Black})
+	for y := 0; y < code.Size; y++ {
+		for x := 0; x < code.Size; x++ {
+			if !code.Black(x, y) {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetColorIndex(offset+x*scale+dx, offset+y*scale+dy, 1)
+				}
+			}
+		}
+	}
+
+	return png.Encode(w, img)
+}
+
+func writeSVG(w io.Writer, code *qr.Code, opts Options, modules int) error {
+	var path strings.Builder
+	for y := 0; y < code.Size; y++ {
+		for x := 0; x < code.Size; x++ {
+			if code.Black(x, y) {
+				fmt.Fprintf(&path, "M%d %dh1v1h-1z", x+opts.Margin, y+opts.Margin)
+			}
+		}
+	}
+
+	_, err := fmt.Fprintf(w,
+		`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+
+			`<rect width="100%%" height="100%%" fill="#fff"/><path fill="#000" d="%s"/></svg>`,
+		opts.Size, opts.Size, modules, modules, path.String())
+	return err
+}
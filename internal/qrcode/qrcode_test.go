@@ -0,0 +1,133 @@
+package qrcode
+
+import (
+	"bytes"
+	"fmt"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"rsc.io/qr"
+)
+
+const testURL = "http://localhost:8080/Ab3dE"
+
+func TestQRCode__Validate(t *testing.T) {
+	tests := []struct {
+		name string
+		opts func(o *Options)
+		ok   bool
+	}{
+		{
+			name: "defaults",
+			opts: func(o *Options) {},
+			ok:   true,
+		},
+		{
+			name: "svg_lowercase_level",
+			opts: func(o *Options) { o.Format, o.Level = FormatSVG, "h" },
+			ok:   true,
+		},
+		{
+			name: "unknown_format",
+			opts: func(o *Options) { o.Format = "gif" },
+		},
+		{
+			name: "size_too_small",
+			opts: func(o *Options) { o.Size = minSize - 1 },
+		},
+		{
+			name: "size_too_large",
+			opts: func(o *Options) { o.Size = maxSize + 1 },
+		},
+		{
+			name: "unknown_level",
+			opts: func(o *Options) { o.Level = "X" },
+		},
+		{
+			name: "negative_margin",
+			opts: func(o *Options) { o.Margin = -1 },
+		},
+		{
+			name: "margin_too_large",
+			opts: func(o *Options) { o.Margin = maxMargin + 1 },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			tt.opts(&opts)
+			if tt.ok {
+				assert.Nil(t, opts.Validate())
+			} else {
+				assert.NotNil(t, opts.Validate())
+			}
+		})
+	}
+}
+
+func TestQRCode__RenderPNG(t *testing.T) {
+	code, err := qr.Encode(testURL, qr.M)
+	assert.Nil(t, err)
+	opts := DefaultOptions()
+
+	var buf bytes.Buffer
+	assert.Nil(t, Render(&buf, testURL, opts))
+	img, err := png.Decode(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, opts.Size, img.Bounds().Dx(), "image sizes should be equal")
+	assert.Equal(t, opts.Size, img.Bounds().Dy(), "image sizes should be equal")
+
+	modules := code.Size + 2*opts.Margin
+	scale := opts.Size / modules
+	offset := (opts.Size-scale*modules)/2 + opts.Margin*scale
+	black := func(x, y int) bool {
+		r, _, _, _ := img.At(offset+x*scale, offset+y*scale).RGBA()
+		return r == 0
+	}
+	for y := 0; y < code.Size; y++ {
+		for x := 0; x < code.Size; x++ {
+			assert.Equal(t, code.Black(x, y), black(x, y), "module %d,%d should match the code", x, y)
+		}
+	}
+	r, _, _, _ := img.At(offset-1, offset-1).RGBA()
+	assert.NotZero(t, r, "the quiet zone should be white")
+}
+
+func TestQRCode__RenderSVG(t *testing.T) {
+	code, err := qr.Encode(testURL, qr.H)
+	assert.Nil(t, err)
+	opts := DefaultOptions()
+	opts.Format, opts.Level, opts.Margin = FormatSVG, "H", 2
+
+	var buf bytes.Buffer
+	assert.Nil(t, Render(&buf, testURL, opts))
+	svg := buf.String()
+	modules := code.Size + 2*opts.Margin
+	assert.Contains(t, svg, fmt.Sprintf(`viewBox="0 0 %d %d"`, modules, modules))
+	assert.True(t, strings.HasPrefix(svg, "<svg "))
+
+	dark := 0
+	for y := 0; y < code.Size; y++ {
+		for x := 0; x < code.Size; x++ {
+			if code.Black(x, y) {
+				dark++
+			}
+		}
+	}
+	assert.Equal(t, dark, strings.Count(svg, "h1v1h-1z"), "every dark module should be drawn")
+	assert.Contains(t, svg, fmt.Sprintf("M%d %dh1v1h-1z", opts.Margin, opts.Margin), "the finder corner should be offset by the margin")
+}
+
+func TestQRCode__RenderErrors(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Size, opts.Margin = minSize, maxMargin
+	assert.NotNil(t, Render(&bytes.Buffer{}, testURL, opts), "modules wider than the image should be rejected")
+
+	opts = DefaultOptions()
+	opts.Format = "gif"
+	assert.NotNil(t, Render(&bytes.Buffer{}, testURL, opts))
+
+	assert.NotNil(t, Render(&bytes.Buffer{}, strings.Repeat("x", 8000), DefaultOptions()), "text beyond the QR capacity should be rejected")
+}
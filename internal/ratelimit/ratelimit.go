@@ -0,0 +1,131 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const sweepInterval = time.Minute
+
+// Limit allows Rate requests per Period on average and bursts of up to Burst.
+// A zero Rate disables limiting.
+type Limit struct {
+	Rate   int
+	Period time.Duration
+	Burst  int
+}
+
+// Result describes the bucket after a request, in the shape of the
+// RateLimit-* response headers.
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// Limiter is a set of token buckets sharing one Limit, one bucket per key.
+type Limiter struct {
+	mu        sync.Mutex
+	limit     Limit
+	perSecond float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func New(limit Limit) *Limiter {
+	if limit.Period <= 0 {
+		limit.Period = time.Minute
+	}
+	if limit.Burst < 1 {
+		limit.Burst = limit.Rate
+	}
+	return &Limiter{
+		limit:     limit,
+		perSecond: float64(limit.Rate) / limit.Period.Seconds(),
+		buckets:   make(map[string]*bucket),
+		now:       time.Now,
+	}
+}
+
+func (l *Limiter) Enabled() bool {
+	return l != nil && l.limit.Rate > 0
+}
+
+func (l *Limiter) Burst() int {
+	return l.limit.Burst
+}
+
+// Window is how long an empty bucket takes to refill.
+func (l *Limiter) Window() time.Duration {
+	return l.duration(float64(l.limit.Burst))
+}
+
+// Allow takes cost tokens from the bucket of key. Requests costing more than
+// the burst take the whole burst, so that they wait for a full bucket rather
+// than never succeed.
+func (l *Limiter) Allow(key string, cost int) Result {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if cost > l.limit.Burst {
+		cost = l.limit.Burst
+	}
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.limit.Burst), updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = l.refill(b, now)
+	b.updated = now
+
+	result := Result{Limit: l.limit.Burst}
+	if float64(cost) <= b.tokens {
+		b.tokens -= float64(cost)
+		result.Allowed = true
+	} else {
+		result.RetryAfter = l.duration(float64(cost) - b.tokens)
+	}
+	result.Remaining = int(math.Floor(b.tokens))
+	result.Reset = l.duration(float64(l.limit.Burst) - b.tokens)
+
+	return result
+}
+
+func (l *Limiter) refill(b *bucket, now time.Time) float64 {
+	tokens := b.tokens + now.Sub(b.updated).Seconds()*l.perSecond
+	return math.Min(tokens, float64(l.limit.Burst))
+}
+
+func (l *Limiter) duration(tokens float64) time.Duration {
+	if tokens <= 0 {
+		return 0
+	}
+	return time.Duration(math.Ceil(tokens / l.perSecond * float64(time.Second)))
+}
+
+// sweep forgets buckets that have refilled completely, they are
+// indistinguishable from new ones.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if l.refill(b, now) >= float64(l.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
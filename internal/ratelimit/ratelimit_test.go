@@ -0,0 +1,65 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter__Allow(t *testing.T) {
+	now := time.Date(2023, 2, 1, 12, 0, 0, 0, time.UTC)
+	l := New(Limit{Rate: 60, Period: time.Minute, Burst: 3})
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		result := l.Allow("a", 1)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, 3, result.Limit)
+		assert.Equal(t, 2-i, result.Remaining)
+	}
+	result := l.Allow("a", 1)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, time.Second, result.RetryAfter)
+	assert.Equal(t, 3*time.Second, result.Reset)
+
+	assert.True(t, l.Allow("b", 1).Allowed, "buckets should be separate per key")
+
+	now = now.Add(1500 * time.Millisecond)
+	result = l.Allow("a", 1)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 0, result.Remaining)
+
+	result = l.Allow("a", 2)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, 1500*time.Millisecond, result.RetryAfter)
+
+	result = l.Allow("a", 4)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, 2500*time.Millisecond, result.RetryAfter, "cost above burst should wait for a full bucket")
+
+	result = l.Allow("c", 4)
+	assert.True(t, result.Allowed, "cost above burst should take the whole burst")
+	assert.Equal(t, 0, result.Remaining)
+}
+
+func TestLimiter__sweep(t *testing.T) {
+	now := time.Date(2023, 2, 1, 12, 0, 0, 0, time.UTC)
+	l := New(Limit{Rate: 1, Period: time.Second, Burst: 2})
+	l.now = func() time.Time { return now }
+
+	l.Allow("a", 2)
+	l.Allow("b", 1)
+	assert.Len(t, l.buckets, 2)
+
+	now = now.Add(2 * time.Minute)
+	l.Allow("c", 1)
+	assert.Len(t, l.buckets, 1)
+}
+
+func TestLimiter__Enabled(t *testing.T) {
+	var l *Limiter
+	assert.False(t, l.Enabled())
+	assert.False(t, New(Limit{}).Enabled())
+	assert.True(t, New(Limit{Rate: 1}).Enabled())
+}
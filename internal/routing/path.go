@@ -0,0 +1,134 @@
+package routing
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Path modes decide what happens to the path trailing the short key.
+// PathExact rejects trailing segments, PathTemplate substitutes them into
+// {1}, {2}, ... placeholders of the destination and PathPrefix appends them.
+// Placeholders may be percent-encoded, as in %7B1%7D.
+const (
+	PathExact    = ""
+	PathTemplate = "template"
+	PathPrefix   = "prefix"
+)
+
+var (
+	ErrMissingSegment  = errors.New("missing path segment")
+	ErrUnexpectedPath  = errors.New("unexpected path segments")
+	placeholderPattern = regexp.MustCompile(`(?:\{|%7[Bb])(\d+)(?:\}|%7[Dd])`)
+)
+
+// ValidatePathMode checks the mode against every destination the link may
+// redirect to; a template needs placeholders in at least one of them.
+func ValidatePathMode(mode string, destinations ...string) error {
+	switch mode {
+	case PathExact, PathPrefix:
+		return nil
+	case PathTemplate:
+		found := false
+		for _, destination := range destinations {
+			for _, match := range placeholderPattern.FindAllStringSubmatch(destination, -1) {
+				if n, _ := strconv.Atoi(match[1]); n < 1 {
+					return fmt.Errorf("invalid placeholder %s", match[0])
+				}
+				found = true
+			}
+		}
+		if !found {
+			return errors.New("template destination has no placeholders")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown path mode %q", mode)
+	}
+}
+
+// SplitPath breaks an escaped request path into unescaped segments, so that
+// an encoded slash stays inside its segment.
+func SplitPath(escapedPath string) ([]string, error) {
+	segments := make([]string, 0)
+	for _, item := range strings.Split(escapedPath, "/") {
+		if item == "" {
+			continue
+		}
+		segment, err := url.PathUnescape(item)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+// ExpandPath applies the path mode to destination. Substituted values are
+// escaped for the part of the URL they land in.
+func ExpandPath(destination string, mode string, segments []string) (string, error) {
+	switch mode {
+	case PathTemplate:
+		return expandTemplate(destination, segments)
+	case PathPrefix:
+		return expandPrefix(destination, segments), nil
+	default:
+		if len(segments) > 0 {
+			return "", ErrUnexpectedPath
+		}
+		return destination, nil
+	}
+}
+
+func expandTemplate(destination string, segments []string) (string, error) {
+	queryStart := strings.IndexAny(destination, "?#")
+	if queryStart < 0 {
+		queryStart = len(destination)
+	}
+
+	var b strings.Builder
+	last, used := 0, 0
+	for _, loc := range placeholderPattern.FindAllStringSubmatchIndex(destination, -1) {
+		n, _ := strconv.Atoi(destination[loc[2]:loc[3]])
+		if n < 1 || n > len(segments) {
+			return "", ErrMissingSegment
+		}
+		if n > used {
+			used = n
+		}
+		value := segments[n-1]
+		if loc[0] < queryStart {
+			value = url.PathEscape(value)
+		} else {
+			value = url.QueryEscape(value)
+		}
+		b.WriteString(destination[last:loc[0]])
+		b.WriteString(value)
+		last = loc[1]
+	}
+	b.WriteString(destination[last:])
+	if used < len(segments) {
+		return "", ErrUnexpectedPath
+	}
+
+	return b.String(), nil
+}
+
+func expandPrefix(destination string, segments []string) string {
+	if len(segments) == 0 {
+		return destination
+	}
+	base, rest := destination, ""
+	if i := strings.IndexAny(destination, "?#"); i >= 0 {
+		base, rest = destination[:i], destination[i:]
+	}
+
+	escaped := make([]string, len(segments))
+	for i, segment := range segments {
+		escaped[i] = url.PathEscape(segment)
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.Join(escaped, "/") + rest
+}
@@ -0,0 +1,92 @@
+package routing
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Query modes decide whether visitor query parameters reach the destination.
+// QueryDefault defers to the server-wide setting.
+const (
+	QueryDefault = ""
+	QueryMerge   = "merge"
+	QueryDrop    = "drop"
+)
+
+// UTM holds campaign parameters appended to the destination at redirect time.
+type UTM map[string]string
+
+func ValidateQueryMode(mode string) error {
+	switch mode {
+	case QueryDefault, QueryMerge, QueryDrop:
+		return nil
+	default:
+		return fmt.Errorf("unknown query mode %q", mode)
+	}
+}
+
+func (utm UTM) Validate() error {
+	for name, value := range utm {
+		if !strings.HasPrefix(name, "utm_") || len(name) == len("utm_") {
+			return fmt.Errorf("invalid utm parameter %q", name)
+		}
+		if value == "" {
+			return fmt.Errorf("empty utm parameter %q", name)
+		}
+	}
+	return nil
+}
+
+func (utm UTM) Value() (driver.Value, error) {
+	if utm == nil {
+		utm = UTM{}
+	}
+	return json.Marshal(utm)
+}
+
+func (utm *UTM) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*utm = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, utm)
+	case string:
+		return json.Unmarshal([]byte(v), utm)
+	default:
+		return fmt.Errorf("unsupported utm type %T", src)
+	}
+}
+
+// MergeQuery adds the link UTM parameters and, when passthrough is set, the
+// visitor query to destination. A parameter is taken from the first source
+// that defines it: link UTM, then the destination's own query, then the
+// visitor query. Visitors therefore can't override what the owner configured.
+func MergeQuery(destination string, utm UTM, incoming url.Values, passthrough bool) (string, error) {
+	if len(utm) == 0 && (!passthrough || len(incoming) == 0) {
+		return destination, nil
+	}
+	u, err := url.Parse(destination)
+	if err != nil {
+		return "", err
+	}
+
+	query := u.Query()
+	for name, value := range utm {
+		query.Set(name, value)
+	}
+	if passthrough {
+		for name, values := range incoming {
+			if _, ok := query[name]; ok {
+				continue
+			}
+			query[name] = values
+		}
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
@@ -0,0 +1,244 @@
+package routing
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	DeviceIOS     = "ios"
+	DeviceAndroid = "android"
+	DeviceDesktop = "desktop"
+	DeviceBot     = "bot"
+
+	clockLayout = "15:04"
+	dateLayout  = "2006-01-02"
+)
+
+var botMarkers = []string{
+	"bot", "crawler", "spider", "slurp", "curl", "wget",
+	"python-requests", "go-http-client", "facebookexternalhit", "preview",
+}
+
+// Rule sends a request to Destination when every condition set on it matches.
+type Rule struct {
+	Device      string  `json:"device,omitempty"`
+	Language    string  `json:"language,omitempty"`
+	Window      *Window `json:"window,omitempty"`
+	Destination string  `json:"destination"`
+}
+
+// Window limits a rule to a time of day (From/To, HH:MM) and/or a date range
+// (StartDate/EndDate, YYYY-MM-DD, inclusive) in the given IANA Timezone.
+type Window struct {
+	From      string `json:"from,omitempty"`
+	To        string `json:"to,omitempty"`
+	StartDate string `json:"start_date,omitempty"`
+	EndDate   string `json:"end_date,omitempty"`
+	Timezone  string `json:"timezone,omitempty"`
+}
+
+// Rules is an ordered list of rules, the first match wins.
+type Rules []Rule
+
+func (rs Rules) Validate() error {
+	for i, rule := range rs {
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (rs Rules) Match(r *http.Request, now time.Time) (string, bool) {
+	for _, rule := range rs {
+		if rule.Match(r, now) {
+			return rule.Destination, true
+		}
+	}
+	return "", false
+}
+
+func (rs Rules) Value() (driver.Value, error) {
+	if rs == nil {
+		rs = Rules{}
+	}
+	return json.Marshal(rs)
+}
+
+func (rs *Rules) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*rs = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, rs)
+	case string:
+		return json.Unmarshal([]byte(v), rs)
+	default:
+		return fmt.Errorf("unsupported rules type %T", src)
+	}
+}
+
+func (rule Rule) Validate() error {
+	u, err := url.Parse(rule.Destination)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return errors.New("invalid destination")
+	}
+	switch rule.Device {
+	case "", DeviceIOS, DeviceAndroid, DeviceDesktop, DeviceBot:
+	default:
+		return fmt.Errorf("unknown device %q", rule.Device)
+	}
+	if rule.Window != nil {
+		if err := rule.Window.Validate(); err != nil {
+			return err
+		}
+	}
+	if rule.Device == "" && rule.Language == "" && rule.Window == nil {
+		return errors.New("rule has no conditions")
+	}
+	return nil
+}
+
+func (rule Rule) Match(r *http.Request, now time.Time) bool {
+	if rule.Device != "" && rule.Device != DeviceClass(r.UserAgent()) {
+		return false
+	}
+	if rule.Language != "" && !AcceptsLanguage(r.Header.Get("Accept-Language"), rule.Language) {
+		return false
+	}
+	if rule.Window != nil && !rule.Window.Contains(now) {
+		return false
+	}
+	return true
+}
+
+func (w Window) Validate() error {
+	if (w.From == "") != (w.To == "") {
+		return errors.New("window needs both from and to")
+	}
+	if w.From != "" {
+		if _, err := clockMinutes(w.From); err != nil {
+			return fmt.Errorf("invalid window from %q", w.From)
+		}
+		if _, err := clockMinutes(w.To); err != nil {
+			return fmt.Errorf("invalid window to %q", w.To)
+		}
+	}
+	if w.StartDate != "" {
+		if _, err := time.Parse(dateLayout, w.StartDate); err != nil {
+			return fmt.Errorf("invalid window start_date %q", w.StartDate)
+		}
+	}
+	if w.EndDate != "" {
+		if _, err := time.Parse(dateLayout, w.EndDate); err != nil {
+			return fmt.Errorf("invalid window end_date %q", w.EndDate)
+		}
+	}
+	if _, err := time.LoadLocation(w.Timezone); err != nil {
+		return fmt.Errorf("invalid window timezone %q", w.Timezone)
+	}
+	if w.From == "" && w.StartDate == "" && w.EndDate == "" {
+		return errors.New("empty window")
+	}
+	return nil
+}
+
+// Contains reports whether now falls into the window. A From later than To
+// spans midnight, e.g. 22:00-06:00.
+func (w Window) Contains(now time.Time) bool {
+	loc, err := time.LoadLocation(w.Timezone)
+	if err != nil {
+		return false
+	}
+	now = now.In(loc)
+
+	date := now.Format(dateLayout)
+	if w.StartDate != "" && date < w.StartDate {
+		return false
+	}
+	if w.EndDate != "" && date > w.EndDate {
+		return false
+	}
+
+	if w.From == "" {
+		return true
+	}
+	from, err := clockMinutes(w.From)
+	if err != nil {
+		return false
+	}
+	to, err := clockMinutes(w.To)
+	if err != nil {
+		return false
+	}
+	clock := now.Hour()*60 + now.Minute()
+	if from <= to {
+		return clock >= from && clock < to
+	}
+	return clock >= from || clock < to
+}
+
+// clockMinutes returns the minutes since midnight of an HH:MM time, the hour
+// may be unpadded, e.g. 9:00.
+func clockMinutes(value string) (int, error) {
+	t, err := time.Parse(clockLayout, value)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// DeviceClass maps a User-Agent header to one of the Device* classes.
+func DeviceClass(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	for _, marker := range botMarkers {
+		if strings.Contains(ua, marker) {
+			return DeviceBot
+		}
+	}
+	switch {
+	case strings.Contains(ua, "iphone"), strings.Contains(ua, "ipad"), strings.Contains(ua, "ipod"):
+		return DeviceIOS
+	case strings.Contains(ua, "android"):
+		return DeviceAndroid
+	default:
+		return DeviceDesktop
+	}
+}
+
+// AcceptsLanguage reports whether an Accept-Language header lists lang with a
+// non-zero quality. "de" matches "de-AT", while "de-AT" only matches itself.
+func AcceptsLanguage(header string, lang string) bool {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	for _, item := range strings.Split(header, ",") {
+		parts := strings.Split(item, ";")
+		tag := strings.ToLower(strings.TrimSpace(parts[0]))
+		if tag == "" || isZeroQuality(parts[1:]) {
+			continue
+		}
+		if tag == lang || strings.HasPrefix(tag, lang+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+func isZeroQuality(params []string) bool {
+	for _, param := range params {
+		param = strings.TrimSpace(param)
+		if !strings.HasPrefix(param, "q=") {
+			continue
+		}
+		q := strings.TrimRight(strings.TrimPrefix(param, "q="), "0")
+		return q == "" || q == "." || q == "0."
+	}
+	return false
+}
@@ -0,0 +1,281 @@
+package routing
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouting__DeviceClass(t *testing.T) {
+	tests := []struct {
+		name      string
+		userAgent string
+		device    string
+	}{
+		{
+			name:      "iphone",
+			userAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 16_3 like Mac OS X) AppleWebKit/605.1.15",
+			device:    DeviceIOS,
+		},
+		{
+			name:      "android",
+			userAgent: "Mozilla/5.0 (Linux; Android 13; Pixel 7) AppleWebKit/537.36 Chrome/110.0 Mobile",
+			device:    DeviceAndroid,
+		},
+		{
+			name:      "desktop",
+			userAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:109.0) Gecko/20100101 Firefox/110.0",
+			device:    DeviceDesktop,
+		},
+		{
+			name:      "bot",
+			userAgent: "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			device:    DeviceBot,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.device, DeviceClass(tt.userAgent), "device classes should be equal")
+		})
+	}
+}
+
+func TestRouting__AcceptsLanguage(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(AcceptsLanguage("de-AT,de;q=0.9,en;q=0.5", "de"))
+	assert.True(AcceptsLanguage("en-US", "en"))
+	assert.False(AcceptsLanguage("en-US", "en-GB"))
+	assert.False(AcceptsLanguage("en, de;q=0", "de"))
+	assert.False(AcceptsLanguage("", "de"))
+}
+
+func TestRouting__WindowContains(t *testing.T) {
+	now := time.Date(2023, time.March, 15, 23, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		window Window
+		ok     bool
+	}{
+		{
+			name:   "inside_day_window",
+			window: Window{From: "09:00", To: "17:00", Timezone: "Europe/Moscow"},
+			ok:     false,
+		},
+		{
+			name:   "overnight_window",
+			window: Window{From: "22:00", To: "06:00"},
+			ok:     true,
+		},
+		{
+			name:   "unpadded_hour",
+			window: Window{From: "1:00", To: "12:00"},
+			ok:     false,
+		},
+		{
+			name:   "unpadded_hour_inside",
+			window: Window{From: "9:00", To: "23:45"},
+			ok:     true,
+		},
+		{
+			name:   "date_range",
+			window: Window{StartDate: "2023-03-01", EndDate: "2023-03-15"},
+			ok:     true,
+		},
+		{
+			name:   "date_range_in_timezone",
+			window: Window{StartDate: "2023-03-01", EndDate: "2023-03-15", Timezone: "Europe/Moscow"},
+			ok:     false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Nil(t, tt.window.Validate())
+			assert.Equal(t, tt.ok, tt.window.Contains(now), "window matches should be equal")
+		})
+	}
+}
+
+func TestRouting__RulesMatch(t *testing.T) {
+	rules := Rules{
+		{Device: DeviceIOS, Destination: "https://apps.apple.com/app"},
+		{Device: DeviceAndroid, Language: "de", Destination: "https://play.google.com/store?hl=de"},
+		{Device: DeviceAndroid, Destination: "https://play.google.com/store"},
+	}
+	assert.Nil(t, rules.Validate())
+
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Linux; Android 13)")
+	req.Header.Set("Accept-Language", "de-DE,de;q=0.9")
+	dst, ok := rules.Match(req, time.Now())
+	assert.True(t, ok)
+	assert.Equal(t, "https://play.google.com/store?hl=de", dst)
+
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64)")
+	_, ok = rules.Match(req, time.Now())
+	assert.False(t, ok)
+
+	assert.NotNil(t, Rules{{Destination: "https://example.com"}}.Validate())
+	assert.NotNil(t, Rules{{Device: "tv", Destination: "https://example.com"}}.Validate())
+	assert.NotNil(t, Rules{{Device: DeviceIOS, Destination: "example.com"}}.Validate())
+}
+
+func TestRouting__VariantsPick(t *testing.T) {
+	variants := Variants{
+		{Destination: "https://a.example.com", Weight: 70},
+		{Destination: "https://b.example.com", Weight: 30},
+	}
+	assert.Nil(t, variants.Validate())
+	assert.Equal(t, 100, variants.TotalWeight())
+	assert.Equal(t, "https://a.example.com", variants.Pick(0).Destination)
+	assert.Equal(t, "https://a.example.com", variants.Pick(69).Destination)
+	assert.Equal(t, "https://b.example.com", variants.Pick(70).Destination)
+	assert.Equal(t, "https://b.example.com", variants.Pick(99).Destination)
+
+	v, ok := variants.Lookup(variants[1].ID())
+	assert.True(t, ok)
+	assert.Equal(t, variants[1], v)
+	_, ok = variants.Lookup("unknown")
+	assert.False(t, ok)
+
+	assert.NotNil(t, Variants{{Destination: "https://a.example.com", Weight: 1}}.Validate())
+	assert.NotNil(t, Variants{variants[0], {Destination: "https://b.example.com", Weight: 0}}.Validate())
+	assert.NotNil(t, Variants{variants[0], variants[0]}.Validate())
+}
+
+func TestRouting__MergeQuery(t *testing.T) {
+	incoming := url.Values{
+		"ref":        {"newsletter"},
+		"lang":       {"en"},
+		"utm_source": {"visitor"},
+	}
+	utm := UTM{"utm_source": "print", "utm_campaign": "spring"}
+	tests := []struct {
+		name        string
+		destination string
+		utm         UTM
+		passthrough bool
+		result      string
+	}{
+		{
+			name:        "untouched",
+			destination: "https://example.com/a?b=1",
+			passthrough: false,
+			result:      "https://example.com/a?b=1",
+		},
+		{
+			name:        "passthrough",
+			destination: "https://example.com/a?lang=de",
+			passthrough: true,
+			result:      "https://example.com/a?lang=de&ref=newsletter&utm_source=visitor",
+		},
+		{
+			name:        "utm_only",
+			destination: "https://example.com/a?utm_source=web",
+			utm:         utm,
+			passthrough: false,
+			result:      "https://example.com/a?utm_campaign=spring&utm_source=print",
+		},
+		{
+			name:        "utm_and_passthrough",
+			destination: "https://example.com/a",
+			utm:         utm,
+			passthrough: true,
+			result:      "https://example.com/a?lang=en&ref=newsletter&utm_campaign=spring&utm_source=print",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := MergeQuery(tt.destination, tt.utm, incoming, tt.passthrough)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.result, result, "destinations should be equal")
+		})
+	}
+
+	assert.NotNil(t, UTM{"source": "print"}.Validate())
+	assert.NotNil(t, ValidateQueryMode("keep"))
+}
+
+func TestRouting__ExpandPath(t *testing.T) {
+	tests := []struct {
+		name        string
+		destination string
+		mode        string
+		path        string
+		result      string
+		err         error
+	}{
+		{
+			name:        "exact",
+			destination: "https://example.com/a",
+			mode:        PathExact,
+			path:        "",
+			result:      "https://example.com/a",
+		},
+		{
+			name:        "exact_unexpected_path",
+			destination: "https://example.com/a",
+			mode:        PathExact,
+			path:        "b",
+			err:         ErrUnexpectedPath,
+		},
+		{
+			name:        "template",
+			destination: "https://jira.example.com/browse/{1}",
+			mode:        PathTemplate,
+			path:        "PROJ-123",
+			result:      "https://jira.example.com/browse/PROJ-123",
+		},
+		{
+			name:        "template_encoded_placeholder",
+			destination: "https://jira.example.com/browse/%7B1%7D",
+			mode:        PathTemplate,
+			path:        "PROJ-123",
+			result:      "https://jira.example.com/browse/PROJ-123",
+		},
+		{
+			name:        "template_escaped",
+			destination: "https://example.com/{1}/search?q={2}",
+			mode:        PathTemplate,
+			path:        "a%2Fb/x%20y&z=1",
+			result:      "https://example.com/a%2Fb/search?q=x+y%26z%3D1",
+		},
+		{
+			name:        "template_missing_segment",
+			destination: "https://example.com/{1}/{2}",
+			mode:        PathTemplate,
+			path:        "a",
+			err:         ErrMissingSegment,
+		},
+		{
+			name:        "template_extra_segment",
+			destination: "https://example.com/{1}",
+			mode:        PathTemplate,
+			path:        "a/b",
+			err:         ErrUnexpectedPath,
+		},
+		{
+			name:        "prefix",
+			destination: "https://example.com/docs/?lang=en",
+			mode:        PathPrefix,
+			path:        "guide/intro%3F",
+			result:      "https://example.com/docs/guide/intro%3F?lang=en",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			segments, err := SplitPath(tt.path)
+			assert.Nil(t, err)
+			result, err := ExpandPath(tt.destination, tt.mode, segments)
+			assert.Equal(t, tt.err, err, "errors should be equal")
+			assert.Equal(t, tt.result, result, "destinations should be equal")
+		})
+	}
+
+	assert.Nil(t, ValidatePathMode(PathTemplate, "https://example.com", "https://example.com/{1}"))
+	assert.NotNil(t, ValidatePathMode(PathTemplate, "https://example.com"))
+	assert.NotNil(t, ValidatePathMode(PathTemplate, "https://example.com/{0}"))
+	assert.NotNil(t, ValidatePathMode("suffix", "https://example.com"))
+}
@@ -0,0 +1,98 @@
+package routing
+
+import (
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// Variant is one weighted destination of an A/B split.
+type Variant struct {
+	Destination string `json:"destination"`
+	Weight      int    `json:"weight"`
+}
+
+// Variants splits traffic between destinations proportionally to their weights.
+type Variants []Variant
+
+func (vs Variants) Validate() error {
+	seen := make(map[string]bool)
+	for i, v := range vs {
+		u, err := url.Parse(v.Destination)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("variant %d: invalid destination", i)
+		}
+		if v.Weight < 1 {
+			return fmt.Errorf("variant %d: weight must be positive", i)
+		}
+		if seen[v.Destination] {
+			return fmt.Errorf("variant %d: duplicate destination", i)
+		}
+		seen[v.Destination] = true
+	}
+	if len(vs) == 1 {
+		return errors.New("split needs at least two variants")
+	}
+	return nil
+}
+
+func (vs Variants) TotalWeight() int {
+	total := 0
+	for _, v := range vs {
+		total += v.Weight
+	}
+	return total
+}
+
+// Pick returns the variant covering n, where n is in [0, TotalWeight()).
+func (vs Variants) Pick(n int) Variant {
+	for _, v := range vs {
+		if n < v.Weight {
+			return v
+		}
+		n -= v.Weight
+	}
+	return vs[len(vs)-1]
+}
+
+// Lookup finds the variant previously handed out under the given ID.
+func (vs Variants) Lookup(id string) (Variant, bool) {
+	for _, v := range vs {
+		if v.ID() == id {
+			return v, true
+		}
+	}
+	return Variant{}, false
+}
+
+// ID is a short stable identifier of the variant used in sticky cookies, so
+// reordering or reweighting variants keeps visitors on their destination.
+func (v Variant) ID() string {
+	sum := sha256.Sum256([]byte(v.Destination))
+	return hex.EncodeToString(sum[:6])
+}
+
+func (vs Variants) Value() (driver.Value, error) {
+	if vs == nil {
+		vs = Variants{}
+	}
+	return json.Marshal(vs)
+}
+
+func (vs *Variants) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*vs = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, vs)
+	case string:
+		return json.Unmarshal([]byte(v), vs)
+	default:
+		return fmt.Errorf("unsupported variants type %T", src)
+	}
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/avtorsky/cuttlink/internal/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	minPasswordLength = 8
+	// bcrypt ignores everything past 72 bytes.
+	maxPasswordLength = 72
+)
+
+var (
+	usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{3,32}$`)
+
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+type RegisterRequest struct {
+	Username string `json:"username" binding:"required"`
+	Email    string `json:"email" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+type LoginRequest struct {
+	Login    string `json:"login" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+type AccountResponse struct {
+	ID          string `json:"id"`
+	Username    string `json:"username"`
+	Email       string `json:"email"`
+	ClaimedURLs int    `json:"claimed_urls"`
+}
+
+func (s *Server) register(ctx *gin.Context) {
+	if _, ok := getAPIKey(ctx); ok {
+		abortWithError(ctx, http.StatusForbidden, codeAPIKeyNotAllowed, "Not available with API keys")
+		return
+	}
+
+	var payload RegisterRequest
+	if err := ctx.ShouldBindJSON(&payload); err != nil {
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidPayload, "Invalid payload")
+		return
+	}
+	if !usernamePattern.MatchString(payload.Username) {
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidRequest, "Username must be 3 to 32 letters, digits, '.', '_' or '-'")
+		return
+	}
+	address, err := mail.ParseAddress(payload.Email)
+	if err != nil || address.Address != strings.TrimSpace(payload.Email) {
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidRequest, "Invalid email")
+		return
+	}
+	if len(payload.Password) < minPasswordLength || len(payload.Password) > maxPasswordLength {
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidRequest, "Password must be 8 to 72 bytes long")
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(payload.Password), bcrypt.DefaultCost)
+	if err != nil {
+		abortWithError(ctx, http.StatusInternalServerError, codeInternalError, "Internal server error")
+		return
+	}
+	user := storage.User{
+		ID:           uuid.New().String(),
+		Username:     payload.Username,
+		Email:        strings.ToLower(address.Address),
+		PasswordHash: string(hash),
+		CreatedAt:    time.Now().UTC().Truncate(time.Microsecond),
+	}
+	err = s.storage.CreateUser(ctx.Request.Context(), user)
+	if errors.Is(err, storage.ErrDuplicateUser) {
+		abortWithError(ctx, http.StatusConflict, codeAlreadyRegistered, "Username or email already registered")
+		return
+	}
+	if err != nil {
+		abortWithStorageError(ctx)
+		return
+	}
+
+	s.startAccountSession(ctx, http.StatusCreated, user)
+}
+
+// login checks the password against a dummy hash for unknown users too, so
+// that response time doesn't reveal which logins exist.
+func (s *Server) login(ctx *gin.Context) {
+	if _, ok := getAPIKey(ctx); ok {
+		abortWithError(ctx, http.StatusForbidden, codeAPIKeyNotAllowed, "Not available with API keys")
+		return
+	}
+
+	var payload LoginRequest
+	if err := ctx.ShouldBindJSON(&payload); err != nil {
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidPayload, "Invalid payload")
+		return
+	}
+
+	user, err := s.storage.GetUserByLogin(ctx.Request.Context(), strings.TrimSpace(payload.Login))
+	if err != nil && !errors.Is(err, storage.ErrUnknownUser) {
+		abortWithStorageError(ctx)
+		return
+	}
+	hash := getDummyHash()
+	if user != nil {
+		hash = []byte(user.PasswordHash)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(payload.Password)) != nil || user == nil {
+		abortWithError(ctx, http.StatusUnauthorized, codeInvalidCredentials, "Invalid login or password")
+		return
+	}
+
+	s.startAccountSession(ctx, http.StatusOK, *user)
+}
+
+func (s *Server) logout(ctx *gin.Context) {
+	if _, ok := getAPIKey(ctx); ok {
+		abortWithError(ctx, http.StatusForbidden, codeAPIKeyNotAllowed, "Not available with API keys")
+		return
+	}
+
+	token, _, err := s.sessions.issue()
+	if err != nil {
+		abortWithError(ctx, http.StatusInternalServerError, codeInternalError, "Internal server error")
+		return
+	}
+	s.sessions.setCookie(ctx, token)
+	ctx.Status(http.StatusNoContent)
+}
+
+// startAccountSession moves the links and API keys of an anonymous session to
+// the account and replaces the cookie with one of the account.
+func (s *Server) startAccountSession(ctx *gin.Context, status int, user storage.User) {
+	claimed := 0
+	if sessionID := ctx.GetString(sessionContextKey); sessionID != "" && !ctx.GetBool(accountContextKey) {
+		keys := s.sessionKeys(ctx, sessionID)
+		var err error
+		claimed, err = s.storage.ClaimSession(ctx.Request.Context(), sessionID, user.ID)
+		if err != nil {
+			log.Printf("unable to claim session %s for %s: %v", sessionID, user.ID, err)
+		} else {
+			s.audit(ctx, user.ID, storage.AuditClaim, keys,
+				auditEach(keys, gin.H{"user_id": sessionID}),
+				auditEach(keys, gin.H{"user_id": user.ID}))
+		}
+	}
+
+	token, _, err := s.sessions.issueFor(user.ID, true)
+	if err != nil {
+		abortWithError(ctx, http.StatusInternalServerError, codeInternalError, "Internal server error")
+		return
+	}
+	s.sessions.setCookie(ctx, token)
+	ctx.JSON(status, AccountResponse{
+		ID:          user.ID,
+		Username:    user.Username,
+		Email:       user.Email,
+		ClaimedURLs: claimed,
+	})
+}
+
+// sessionKeys lists the links of an anonymous session for the audit of the
+// claim, there is nothing to list while the audit log is off.
+func (s *Server) sessionKeys(ctx *gin.Context, sessionID string) []string {
+	if s.auditor == nil {
+		return nil
+	}
+	rows, _, err := s.storage.SearchURLs(ctx.Request.Context(), storage.URLQuery{UserID: sessionID, Limit: math.MaxInt32})
+	if err != nil {
+		log.Printf("unable to list links of session %s: %v", sessionID, err)
+		return nil
+	}
+	keys := make([]string, len(rows))
+	for i := range rows {
+		keys[i] = rows[i].Key
+	}
+	return keys
+}
+
+func getDummyHash() []byte {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("cuttlink"), bcrypt.DefaultCost)
+	})
+	return dummyHash
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/avtorsky/cuttlink/internal/storage"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	adminTokenHeader = "X-Admin-Token"
+	maxAdminPageSize = 1000
+)
+
+// AdminURL is everything operators see about a link, regardless of owner.
+type AdminURL struct {
+	Key         string     `json:"key"`
+	ShortURL    string     `json:"short_url"`
+	OriginalURL string     `json:"original_url"`
+	Destination string     `json:"destination"`
+	Owner       AdminOwner `json:"owner"`
+	WorkspaceID string     `json:"workspace_id,omitempty"`
+	Deleted     bool       `json:"deleted"`
+	Disabled    bool       `json:"disabled"`
+	Title       string     `json:"title,omitempty"`
+	PageTitle   string     `json:"page_title,omitempty"`
+	Description string     `json:"description,omitempty"`
+	FaviconURL  string     `json:"favicon_url,omitempty"`
+	Options     URLOptions `json:"options"`
+	Health      *URLHealth `json:"health,omitempty"`
+}
+
+// AdminOwner names the account behind a user id, anonymous sessions and
+// single sign-on users only have the id.
+type AdminOwner struct {
+	ID       string `json:"id"`
+	Username string `json:"username,omitempty"`
+	Email    string `json:"email,omitempty"`
+}
+
+type AdminURLList struct {
+	Total int        `json:"total"`
+	Items []AdminURL `json:"items"`
+}
+
+type AdminDeleteResponse struct {
+	Deleted int `json:"deleted"`
+}
+
+// WithAdminToken enables the /api/admin routes for requests carrying the
+// token in X-Admin-Token.
+func WithAdminToken(token string) ServerOption {
+	return func(s *Server) error {
+		s.adminToken = token
+		return nil
+	}
+}
+
+// adminAuthentication hides the admin routes entirely while no token is
+// configured. Tokens are compared by hash in constant time.
+func (s *Server) adminAuthentication() gin.HandlerFunc {
+	expected := sha256.Sum256([]byte(s.adminToken))
+	return func(ctx *gin.Context) {
+		if s.adminToken == "" {
+			abortWithError(ctx, http.StatusNotFound, codeNotConfigured, "Admin API is not configured")
+			return
+		}
+		actual := sha256.Sum256([]byte(ctx.GetHeader(adminTokenHeader)))
+		if subtle.ConstantTimeCompare(expected[:], actual[:]) != 1 {
+			abortWithError(ctx, http.StatusUnauthorized, codeInvalidAdminToken, "Invalid admin token")
+			return
+		}
+		ctx.Next()
+	}
+}
+
+func (s *Server) adminSearchURLs(ctx *gin.Context) {
+	query := storage.URLQuery{
+		Search:      ctx.Query("q"),
+		UserID:      ctx.Query("user_id"),
+		WorkspaceID: ctx.Query("workspace_id"),
+		Status:      ctx.Query("status"),
+	}
+	if !storage.ValidURLStatus(query.Status) {
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidRequest, "Status must be active, deleted or disabled")
+		return
+	}
+	var err error
+	if query.Limit, err = queryInt(ctx, "limit", 0, maxAdminPageSize); err != nil {
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidRequest, "Invalid limit")
+		return
+	}
+	if query.Offset, err = queryInt(ctx, "offset", 0, -1); err != nil {
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidRequest, "Invalid offset")
+		return
+	}
+
+	rows, total, err := s.storage.SearchURLs(ctx.Request.Context(), query)
+	if err != nil {
+		abortWithStorageError(ctx)
+		return
+	}
+	result := AdminURLList{Total: total, Items: make([]AdminURL, len(rows))}
+	for i := range rows {
+		result.Items[i] = s.newAdminURL(rows[i], storage.User{ID: rows[i].UUID})
+	}
+	ctx.JSON(http.StatusOK, result)
+}
+
+func (s *Server) adminGetURL(ctx *gin.Context) {
+	row, err := s.storage.GetURL(ctx.Request.Context(), ctx.Param("id"))
+	if err != nil {
+		abortWithError(ctx, http.StatusNotFound, codeUnknownKey, "Invalid key")
+		return
+	}
+	ctx.JSON(http.StatusOK, s.newAdminURL(*row, s.adminOwner(ctx, row.UUID)))
+}
+
+func (s *Server) adminDisableURL(ctx *gin.Context) {
+	s.adminSetURLDisabled(ctx, true)
+}
+
+func (s *Server) adminEnableURL(ctx *gin.Context) {
+	s.adminSetURLDisabled(ctx, false)
+}
+
+// adminSetURLDisabled audits only actual changes, so that repeated calls
+// don't clutter the history.
+func (s *Server) adminSetURLDisabled(ctx *gin.Context, disabled bool) {
+	key := ctx.Param("id")
+	row, err := s.storage.GetURL(ctx.Request.Context(), key)
+	if err == nil {
+		err = s.storage.SetURLDisabled(ctx.Request.Context(), key, disabled)
+	}
+	if errors.Is(err, storage.ErrInvalidKey) {
+		abortWithError(ctx, http.StatusNotFound, codeUnknownKey, "Invalid key")
+		return
+	}
+	if err != nil {
+		abortWithStorageError(ctx)
+		return
+	}
+	if row.IsDisabled != disabled {
+		action := storage.AuditDisable
+		if !disabled {
+			action = storage.AuditRestore
+		}
+		s.audit(ctx, adminActorID, action, []string{key},
+			storage.AuditState{key: gin.H{"disabled": row.IsDisabled}},
+			storage.AuditState{key: gin.H{"disabled": disabled}})
+	}
+	s.adminGetURL(ctx)
+}
+
+func (s *Server) adminDeleteUserURLs(ctx *gin.Context) {
+	deleted, err := s.storage.DeleteOwnerURLs(ctx.Request.Context(), ctx.Param("id"))
+	s.audit(ctx, adminActorID, storage.AuditDelete, deleted,
+		auditEach(deleted, gin.H{"deleted": false}),
+		auditEach(deleted, gin.H{"deleted": true}))
+	if err != nil {
+		abortWithStorageError(ctx)
+		return
+	}
+	ctx.JSON(http.StatusOK, AdminDeleteResponse{Deleted: len(deleted)})
+}
+
+func (s *Server) adminStats(ctx *gin.Context) {
+	stats, err := s.storage.GetURLStats(ctx.Request.Context())
+	if err != nil {
+		abortWithStorageError(ctx)
+		return
+	}
+	ctx.JSON(http.StatusOK, stats)
+}
+
+// adminOwner falls back to the bare id for owners without an account.
+func (s *Server) adminOwner(ctx *gin.Context, userID string) storage.User {
+	user, err := s.storage.GetUserByID(ctx.Request.Context(), userID)
+	if err != nil {
+		return storage.User{ID: userID}
+	}
+	return *user
+}
+
+func (s *Server) newAdminURL(row storage.Row, owner storage.User) AdminURL {
+	pair := s.newURLPair(row)
+	return AdminURL{
+		Key:         row.Key,
+		ShortURL:    pair.ShortURL,
+		OriginalURL: pair.OriginalURL,
+		Destination: row.Value,
+		Owner: AdminOwner{
+			ID:       owner.ID,
+			Username: owner.Username,
+			Email:    owner.Email,
+		},
+		WorkspaceID: row.WorkspaceID,
+		Deleted:     row.IsDeleted,
+		Disabled:    row.IsDisabled,
+		Title:       row.Title,
+		PageTitle:   row.PageTitle,
+		Description: row.PageDescription,
+		FaviconURL:  row.FaviconURL,
+		Options:     newURLOptions(row.Options),
+		Health:      pair.Health,
+	}
+}
+
+// queryInt parses a non-negative query parameter, max below zero means
+// unbounded.
+func queryInt(ctx *gin.Context, name string, fallback int, max int) (int, error) {
+	value := ctx.Query(name)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 || (max >= 0 && n > max) {
+		return 0, errors.New("invalid " + name)
+	}
+	return n, nil
+}
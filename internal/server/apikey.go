@@ -0,0 +1,213 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/avtorsky/cuttlink/internal/storage"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ScopeFull   = "full"
+	ScopeCreate = "create"
+	ScopeRead   = "read"
+
+	apiKeyContextKey = "apiKey"
+	apiKeyPrefix     = "clk_"
+	apiKeyPrefixLen  = len(apiKeyPrefix) + 8
+	maxAPIKeyName    = 100
+)
+
+type APIKeyRequest struct {
+	Name  string `json:"name"`
+	Scope string `json:"scope"`
+}
+
+// APIKeyResponse carries the secret in Key only right after creation.
+type APIKeyResponse struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Scope     string     `json:"scope"`
+	Prefix    string     `json:"prefix"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	Key       string     `json:"key,omitempty"`
+}
+
+func newAPIKeyResponse(key storage.APIKey) APIKeyResponse {
+	return APIKeyResponse{
+		ID:        key.ID,
+		Name:      key.Name,
+		Scope:     key.Scope,
+		Prefix:    key.Prefix,
+		CreatedAt: key.CreatedAt,
+		RevokedAt: key.RevokedAt,
+	}
+}
+
+// hashToken is what is stored in place of secret tokens.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// apiKeyAuthentication resolves "Authorization: Bearer" to the owner of the
+// key. Requests carrying a bearer token never fall back to the cookie.
+func apiKeyAuthentication(store storage.Storager) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		header := ctx.GetHeader("Authorization")
+		if header == "" {
+			ctx.Next()
+			return
+		}
+		scheme, token, _ := strings.Cut(header, " ")
+		token = strings.TrimSpace(token)
+		if !strings.EqualFold(scheme, "Bearer") || token == "" {
+			unauthorized(ctx)
+			return
+		}
+
+		key, err := store.GetAPIKeyByHash(ctx.Request.Context(), hashToken(token))
+		if err != nil && !errors.Is(err, storage.ErrUnknownAPIKey) {
+			abortWithStorageError(ctx)
+			return
+		}
+		if err != nil || key.IsRevoked() {
+			unauthorized(ctx)
+			return
+		}
+		ctx.Set(apiKeyContextKey, key)
+		ctx.Next()
+	}
+}
+
+func unauthorized(ctx *gin.Context) {
+	ctx.Header("WWW-Authenticate", `Bearer realm="cuttlink"`)
+	abortWithError(ctx, http.StatusUnauthorized, codeInvalidAPIKey, "Invalid API key")
+}
+
+func getAPIKey(ctx *gin.Context) (*storage.APIKey, bool) {
+	value, ok := ctx.Get(apiKeyContextKey)
+	if !ok {
+		return nil, false
+	}
+	key, ok := value.(*storage.APIKey)
+	return key, ok
+}
+
+// requireScope rejects API keys not allowed on the route. Cookie sessions
+// and full keys pass every scope.
+func requireScope(scope string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		key, ok := getAPIKey(ctx)
+		if !ok || key.Scope == ScopeFull || key.Scope == scope {
+			ctx.Next()
+			return
+		}
+		abortWithError(ctx, http.StatusForbidden, codeInsufficientScope, "API key scope does not allow this request")
+	}
+}
+
+func (s *Server) createAPIKey(ctx *gin.Context) {
+	sessionID, err := getUUID(ctx)
+	if err != nil {
+		return
+	}
+
+	var payload APIKeyRequest
+	if err := ctx.ShouldBindJSON(&payload); err != nil {
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidPayload, "Invalid payload")
+		return
+	}
+	if payload.Scope == "" {
+		payload.Scope = ScopeFull
+	}
+	if payload.Scope != ScopeFull && payload.Scope != ScopeCreate && payload.Scope != ScopeRead {
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidRequest, "Invalid scope")
+		return
+	}
+	if len([]rune(payload.Name)) > maxAPIKeyName {
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidRequest, "Name is too long")
+		return
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		abortWithError(ctx, http.StatusInternalServerError, codeInternalError, "Internal server error")
+		return
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		abortWithError(ctx, http.StatusInternalServerError, codeInternalError, "Internal server error")
+		return
+	}
+	token := apiKeyPrefix + secret
+	key := storage.APIKey{
+		ID:        id,
+		UserID:    sessionID,
+		Name:      payload.Name,
+		Prefix:    token[:apiKeyPrefixLen],
+		Hash:      hashToken(token),
+		Scope:     payload.Scope,
+		CreatedAt: time.Now().UTC().Truncate(time.Microsecond),
+	}
+	if err := s.storage.SetAPIKey(ctx.Request.Context(), key); err != nil {
+		abortWithStorageError(ctx)
+		return
+	}
+
+	response := newAPIKeyResponse(key)
+	response.Key = token
+	ctx.JSON(http.StatusCreated, response)
+}
+
+func (s *Server) getAPIKeys(ctx *gin.Context) {
+	sessionID, err := getUUID(ctx)
+	if err != nil {
+		return
+	}
+
+	keys, err := s.storage.GetUserAPIKeys(ctx.Request.Context(), sessionID)
+	if err != nil {
+		abortWithStorageError(ctx)
+		return
+	}
+	result := make([]APIKeyResponse, len(keys))
+	for i := range keys {
+		result[i] = newAPIKeyResponse(keys[i])
+	}
+	ctx.JSON(http.StatusOK, result)
+}
+
+func (s *Server) revokeAPIKey(ctx *gin.Context) {
+	sessionID, err := getUUID(ctx)
+	if err != nil {
+		return
+	}
+
+	err = s.storage.RevokeAPIKey(ctx.Request.Context(), ctx.Param("id"), sessionID)
+	switch {
+	case errors.Is(err, storage.ErrUnknownAPIKey):
+		abortWithError(ctx, http.StatusNotFound, codeUnknownAPIKey, "Invalid API key id")
+	case errors.Is(err, storage.ErrNotOwner):
+		abortWithError(ctx, http.StatusForbidden, codeNotOwner, "API key owned by another user")
+	case err != nil:
+		abortWithStorageError(ctx)
+	default:
+		ctx.Status(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/avtorsky/cuttlink/internal/storage"
+	"github.com/avtorsky/cuttlink/internal/workers"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	adminActorID     = "admin"
+	maxAuditPageSize = 1000
+)
+
+// WithAuditLog records every link mutation in the log and serves the
+// history of users on /api/user/audit.
+func WithAuditLog(auditor storage.Auditor) ServerOption {
+	return func(s *Server) error {
+		s.auditor = auditor
+		return nil
+	}
+}
+
+func (s *Server) getUserAudit(ctx *gin.Context) {
+	sessionID, err := getUUID(ctx)
+	if err != nil {
+		return
+	}
+	if s.auditor == nil {
+		abortWithError(ctx, http.StatusNotFound, codeNotConfigured, "Audit log is not configured")
+		return
+	}
+
+	limit, err := queryInt(ctx, "limit", 0, maxAuditPageSize)
+	if err != nil {
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidRequest, "Invalid limit")
+		return
+	}
+	offset, err := queryInt(ctx, "offset", 0, -1)
+	if err != nil {
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidRequest, "Invalid offset")
+		return
+	}
+
+	entries, err := s.auditor.GetUserAudit(ctx.Request.Context(), sessionID, limit, offset)
+	if err != nil {
+		abortWithStorageError(ctx)
+		return
+	}
+	ctx.JSON(http.StatusOK, entries)
+}
+
+// audit records a mutation made by the request. The change is already done,
+// so a failure to record it is only logged.
+func (s *Server) audit(ctx *gin.Context, actorID string, action string, keys []string, before storage.AuditState, after storage.AuditState) {
+	appendAudit(ctx.Request.Context(), s.auditor, storage.AuditEntry{
+		ActorID:   actorID,
+		Action:    action,
+		Keys:      keys,
+		Before:    before,
+		After:     after,
+		ClientIP:  ctx.ClientIP(),
+		UserAgent: ctx.Request.UserAgent(),
+	})
+}
+
+func appendAudit(ctx context.Context, auditor storage.Auditor, entry storage.AuditEntry) {
+	if auditor == nil || len(entry.Keys) == 0 {
+		return
+	}
+	entry.ID = uuid.New().String()
+	entry.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	if err := auditor.AppendAudit(ctx, entry); err != nil {
+		log.Printf("unable to audit %s of %v by %s: %v", entry.Action, entry.Keys, entry.ActorID, err)
+	}
+}
+
+// auditEach maps every key to the same state.
+func auditEach(keys []string, state interface{}) storage.AuditState {
+	result := make(storage.AuditState, len(keys))
+	for _, key := range keys {
+		result[key] = state
+	}
+	return result
+}
+
+// auditRemover audits the deletions of the removal worker. Keys the user may
+// not edit are skipped by the storage, so the entry lists only the links that
+// went from live to deleted.
+type auditRemover struct {
+	storage storage.Storager
+	auditor storage.Auditor
+}
+
+func (r auditRemover) UpdateBatchURL(ctx context.Context, task workers.RemovalTask) error {
+	if r.auditor == nil {
+		return r.storage.UpdateBatchURL(ctx, task)
+	}
+
+	live := make([]string, 0, len(task.Keys))
+	for _, key := range uniqueKeys(task.Keys) {
+		if row, err := r.storage.GetURL(ctx, key); err == nil && !row.IsDeleted {
+			live = append(live, key)
+		}
+	}
+	err := r.storage.UpdateBatchURL(ctx, task)
+
+	deleted := make([]string, 0, len(live))
+	for _, key := range live {
+		if row, err := r.storage.GetURL(ctx, key); err == nil && row.IsDeleted {
+			deleted = append(deleted, key)
+		}
+	}
+	appendAudit(ctx, r.auditor, storage.AuditEntry{
+		ActorID:   task.UUID,
+		Action:    storage.AuditDelete,
+		Keys:      deleted,
+		Before:    auditEach(deleted, gin.H{"deleted": false}),
+		After:     auditEach(deleted, gin.H{"deleted": true}),
+		ClientIP:  task.ClientIP,
+		UserAgent: task.UserAgent,
+	})
+	return err
+}
@@ -0,0 +1,353 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/avtorsky/cuttlink/api/shortener"
+	"github.com/avtorsky/cuttlink/internal/ratelimit"
+	"github.com/avtorsky/cuttlink/internal/storage"
+	"github.com/avtorsky/cuttlink/internal/workers"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const grpcSessionHeader = "session-token"
+
+// grpcScopes lists the API key scope each method needs. Methods missing here
+// are public and run without a session.
+var grpcScopes = map[string]string{
+	"/cuttlink.shortener.Shortener/Shorten":        ScopeCreate,
+	"/cuttlink.shortener.Shortener/ShortenBatch":   ScopeCreate,
+	"/cuttlink.shortener.Shortener/ListUserURLs":   ScopeRead,
+	"/cuttlink.shortener.Shortener/DeleteUserURLs": ScopeFull,
+}
+
+type grpcUserKey struct{}
+
+// grpcRateLimitKey carries the bucket key resolved by grpcAuthentication,
+// shaped like rateLimitKey.
+type grpcRateLimitKey struct{}
+
+// grpcSessionAgeKey carries when the session of the call was issued.
+type grpcSessionAgeKey struct{}
+
+// WithGRPC serves the gRPC API on address besides HTTP, with the same TLS
+// config, body limit and rate limits.
+func WithGRPC(address string) ServerOption {
+	return func(s *Server) error {
+		s.grpcHost = address
+		return nil
+	}
+}
+
+func (s *Server) newGRPCServer() *grpc.Server {
+	opts := []grpc.ServerOption{grpc.ChainUnaryInterceptor(s.grpcAuthentication, s.grpcRateLimit)}
+	if s.httpConfig.MaxBodyBytes > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(int(s.httpConfig.MaxBodyBytes)))
+	}
+	if s.tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(s.tlsConfig)))
+	}
+	srv := grpc.NewServer(opts...)
+	shortener.RegisterShortenerServer(srv, &grpcService{s: s})
+	return srv
+}
+
+// grpcAuthentication resolves the metadata like apiKeyAuthentication and
+// sessionAuthentication resolve the headers of HTTP requests.
+func (s *Server) grpcAuthentication(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	scope, ok := grpcScopes[info.FullMethod]
+	if !ok {
+		return handler(ctx, req)
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	if values := md.Get("authorization"); len(values) > 0 {
+		scheme, token, _ := strings.Cut(values[0], " ")
+		token = strings.TrimSpace(token)
+		if !strings.EqualFold(scheme, "Bearer") || token == "" {
+			return nil, status.Error(codes.Unauthenticated, "Invalid API key")
+		}
+		key, err := s.storage.GetAPIKeyByHash(ctx, hashToken(token))
+		if err != nil && !errors.Is(err, storage.ErrUnknownAPIKey) {
+			return nil, status.Error(codes.Internal, "Internal server I/O error")
+		}
+		if err != nil || key.IsRevoked() {
+			return nil, status.Error(codes.Unauthenticated, "Invalid API key")
+		}
+		if key.Scope != ScopeFull && key.Scope != scope {
+			return nil, status.Error(codes.PermissionDenied, "API key scope does not allow this request")
+		}
+		ctx = context.WithValue(ctx, grpcRateLimitKey{}, "apikey:"+key.ID)
+		return handler(context.WithValue(ctx, grpcUserKey{}, key.UserID), req)
+	}
+
+	if values := md.Get(grpcSessionHeader); len(values) > 0 {
+		sess, err := s.sessions.parse(values[0])
+		if err == nil {
+			ctx = context.WithValue(ctx, grpcRateLimitKey{}, "session:"+sess.ID)
+			ctx = context.WithValue(ctx, grpcSessionAgeKey{}, sess.IssuedAt)
+			return handler(context.WithValue(ctx, grpcUserKey{}, sess.ID), req)
+		}
+		if !errors.Is(err, ErrSessionExpired) {
+			return nil, status.Error(codes.Unauthenticated, "Invalid session")
+		}
+	}
+
+	token, sess, err := s.sessions.issue()
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Internal server error")
+	}
+	if err := grpc.SetHeader(ctx, metadata.Pairs(grpcSessionHeader, token)); err != nil {
+		return nil, status.Error(codes.Internal, "Internal server error")
+	}
+	return handler(context.WithValue(ctx, grpcUserKey{}, sess.ID), req)
+}
+
+// grpcRateLimit applies the limiters of the matching HTTP routes, so that
+// gRPC is no way around them. Calls without a known user share the bucket of
+// their peer.
+func (s *Server) grpcRateLimit(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	var limiter *ratelimit.Limiter
+	cost := 1
+	switch info.FullMethod {
+	case "/cuttlink.shortener.Shortener/Shorten":
+		limiter = s.limiters.create
+	case "/cuttlink.shortener.Shortener/ShortenBatch":
+		limiter = s.limiters.batch
+		if batch, ok := req.(*shortener.ShortenBatchRequest); ok && len(batch.Items) > 0 {
+			cost = len(batch.Items)
+		}
+	case "/cuttlink.shortener.Shortener/Expand":
+		limiter = s.limiters.redirect
+	case "/cuttlink.shortener.Shortener/DeleteUserURLs":
+		limiter = s.limiters.delete
+	}
+	if !limiter.Enabled() {
+		return handler(ctx, req)
+	}
+
+	key, ok := ctx.Value(grpcRateLimitKey{}).(string)
+	if issuedAt, isSession := ctx.Value(grpcSessionAgeKey{}).(time.Time); isSession && !sessionEstablished(issuedAt, limiter) {
+		ok = false
+	}
+	if !ok {
+		clientIP, _ := grpcClient(ctx)
+		key = "ip:" + clientIP
+	}
+	result := limiter.Allow(key, cost)
+	if result.Allowed {
+		return handler(ctx, req)
+	}
+	grpc.SetHeader(ctx, metadata.Pairs("retry-after", seconds(result.RetryAfter)))
+	return nil, status.Error(codes.ResourceExhausted, "Rate limit exceeded")
+}
+
+func grpcUser(ctx context.Context) (string, error) {
+	if id, ok := ctx.Value(grpcUserKey{}).(string); ok && id != "" {
+		return id, nil
+	}
+	return "", status.Error(codes.Unauthenticated, "request is not authenticated")
+}
+
+// grpcClient returns the client IP and user agent recorded by the audit log.
+func grpcClient(ctx context.Context) (string, string) {
+	var clientIP, userAgent string
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		clientIP = p.Addr.String()
+		if host, _, err := net.SplitHostPort(clientIP); err == nil {
+			clientIP = host
+		}
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("user-agent"); len(values) > 0 {
+			userAgent = values[0]
+		}
+	}
+	return clientIP, userAgent
+}
+
+// grpcService implements the Shortener service on top of the same storage
+// and workers as the HTTP handlers.
+type grpcService struct {
+	shortener.UnimplementedShortenerServer
+	s *Server
+}
+
+func (g *grpcService) audit(ctx context.Context, actorID string, action string, keys []string, after storage.AuditState) {
+	clientIP, userAgent := grpcClient(ctx)
+	appendAudit(ctx, g.s.auditor, storage.AuditEntry{
+		ActorID:   actorID,
+		Action:    action,
+		Keys:      keys,
+		After:     after,
+		ClientIP:  clientIP,
+		UserAgent: userAgent,
+	})
+}
+
+// canonicalize validates a submitted URL the way the JSON API does.
+func (g *grpcService) canonicalize(rawURL string) (string, error) {
+	if _, err := url.ParseRequestURI(rawURL); err != nil {
+		return "", status.Error(codes.InvalidArgument, "Invalid URL scheme")
+	}
+	if u, _ := url.Parse(rawURL); u.Host == "" {
+		return "", status.Error(codes.InvalidArgument, "Invalid URL host")
+	}
+	canonicalURL, err := g.s.normalizer.Normalize(rawURL)
+	if err != nil {
+		return "", status.Error(codes.InvalidArgument, "Invalid URL")
+	}
+	if err := g.s.policy.Check(canonicalURL); err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "Destination rejected by policy: %v", err)
+	}
+	return canonicalURL, nil
+}
+
+func (g *grpcService) Shorten(ctx context.Context, req *shortener.ShortenRequest) (*shortener.ShortenResponse, error) {
+	sessionID, err := grpcUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+	canonicalURL, err := g.canonicalize(req.Url)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := g.s.storage.SetURL(ctx, canonicalURL, req.Url, sessionID)
+	if err != nil {
+		var dbError *storage.DuplicateURLError
+		if errors.As(err, &dbError) {
+			return &shortener.ShortenResponse{ShortUrl: g.s.shortURL(dbError.Key)}, nil
+		}
+		return nil, status.Error(codes.Internal, "Internal server I/O error")
+	}
+
+	g.s.fetchMetadata(key, canonicalURL)
+	g.audit(ctx, sessionID, storage.AuditCreate, []string{key}, storage.AuditState{
+		key: gin.H{"original_url": req.Url, "destination": canonicalURL},
+	})
+	return &shortener.ShortenResponse{ShortUrl: g.s.shortURL(key), Created: true}, nil
+}
+
+func (g *grpcService) ShortenBatch(ctx context.Context, req *shortener.ShortenBatchRequest) (*shortener.ShortenBatchResponse, error) {
+	sessionID, err := grpcUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	size := len(req.Items)
+	if size > batchMaxItems {
+		return nil, status.Errorf(codes.InvalidArgument, "Batch must contain at most %d URLs", batchMaxItems)
+	}
+	urlBatch := make([]string, size)
+	originalBatch := make([]string, size)
+	for i, item := range req.Items {
+		canonicalURL, err := g.canonicalize(item.OriginalUrl)
+		if err != nil {
+			return nil, status.Errorf(status.Code(err), "%s: %s", item.CorrelationId, status.Convert(err).Message())
+		}
+		urlBatch[i] = canonicalURL
+		originalBatch[i] = item.OriginalUrl
+	}
+
+	keys, inserted, err := g.s.storage.SetBatchURL(ctx, urlBatch, originalBatch, sessionID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Internal server I/O error")
+	}
+
+	created := make(storage.AuditState, size)
+	createdKeys := make([]string, 0, size)
+	response := &shortener.ShortenBatchResponse{Items: make([]*shortener.BatchResult, size)}
+	for i, item := range req.Items {
+		g.s.fetchMetadata(keys[i], urlBatch[i])
+		if inserted[i] {
+			created[keys[i]] = gin.H{"original_url": originalBatch[i], "destination": urlBatch[i]}
+			createdKeys = append(createdKeys, keys[i])
+		}
+		response.Items[i] = &shortener.BatchResult{
+			CorrelationId: item.CorrelationId,
+			ShortUrl:      g.s.shortURL(keys[i]),
+		}
+	}
+	g.audit(ctx, sessionID, storage.AuditBatchCreate, createdKeys, created)
+	return response, nil
+}
+
+// Expand resolves a key to the URL it was created with. Unlike a redirect it
+// applies no rules, variants or query passthrough.
+func (g *grpcService) Expand(ctx context.Context, req *shortener.ExpandRequest) (*shortener.ExpandResponse, error) {
+	row, err := g.s.storage.GetURL(ctx, req.Key)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "Invalid key")
+	}
+	if row.IsDeleted {
+		return nil, status.Error(codes.NotFound, "Link deleted")
+	}
+	if row.IsDisabled {
+		return nil, status.Error(codes.NotFound, "Link disabled")
+	}
+	return &shortener.ExpandResponse{OriginalUrl: row.DisplayValue()}, nil
+}
+
+func (g *grpcService) ListUserURLs(ctx context.Context, req *shortener.ListUserURLsRequest) (*shortener.ListUserURLsResponse, error) {
+	sessionID, err := grpcUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := g.s.storage.GetUserURLs(ctx, sessionID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Internal server I/O error")
+	}
+	response := &shortener.ListUserURLsResponse{Urls: make([]*shortener.URL, len(rows))}
+	for i := range rows {
+		pair := g.s.newURLPair(rows[i])
+		response.Urls[i] = &shortener.URL{
+			ShortUrl:    pair.ShortURL,
+			OriginalUrl: pair.OriginalURL,
+			Title:       pair.Title,
+			WorkspaceId: pair.WorkspaceID,
+			Disabled:    pair.Disabled,
+		}
+	}
+	return response, nil
+}
+
+func (g *grpcService) DeleteUserURLs(ctx context.Context, req *shortener.DeleteUserURLsRequest) (*shortener.DeleteUserURLsResponse, error) {
+	sessionID, err := grpcUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	clientIP, userAgent := grpcClient(ctx)
+	task := workers.RemovalTask{
+		Keys:      req.Keys,
+		UUID:      sessionID,
+		ClientIP:  clientIP,
+		UserAgent: userAgent,
+	}
+	select {
+	case g.s.removalCh <- task:
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+	return &shortener.DeleteUserURLsResponse{}, nil
+}
+
+func (g *grpcService) Ping(ctx context.Context, req *shortener.PingRequest) (*shortener.PingResponse, error) {
+	if err := g.s.storage.Ping(ctx); err != nil {
+		return nil, status.Error(codes.Unavailable, "DSN out of service timeout")
+	}
+	return &shortener.PingResponse{}, nil
+}
@@ -1,7 +1,9 @@
 package server
 
 import (
+	"bytes"
 	"compress/gzip"
+	"errors"
 	"io"
 	"net/http"
 	"strings"
@@ -43,7 +45,10 @@ func compressMiddleware() gin.HandlerFunc {
 	}
 }
 
-func decompressMiddleware() gin.HandlerFunc {
+// decompressMiddleware expands gzip bodies. With a limit the body is expanded
+// upfront, so that bodies larger than maxBytes once expanded are rejected
+// before any handler reads them.
+func decompressMiddleware(maxBytes int64) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
 		if !strings.Contains(ctx.Request.Header.Get("Content-Encoding"), "gzip") {
 			ctx.Next()
@@ -52,11 +57,34 @@ func decompressMiddleware() gin.HandlerFunc {
 
 		gz, err := gzip.NewReader(ctx.Request.Body)
 		if err != nil {
-			http.Error(ctx.Writer, err.Error(), http.StatusInternalServerError)
+			abortWithProblem(ctx, Problem{
+				Status:        http.StatusBadRequest,
+				Code:          codeInvalidPayload,
+				Detail:        "Invalid gzip body",
+				legacyStatus:  http.StatusInternalServerError,
+				legacyMessage: err.Error(),
+				legacyText:    true,
+			})
+			return
+		}
+		if maxBytes <= 0 {
+			ctx.Request.Body = gz
+			ctx.Next()
 			return
 		}
 
-		ctx.Request.Body = gz
+		body, err := io.ReadAll(io.LimitReader(gz, maxBytes+1))
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge), int64(len(body)) > maxBytes:
+			abortWithError(ctx, http.StatusRequestEntityTooLarge, codeBodyTooLarge, "Request body too large")
+			return
+		case err != nil:
+			abortWithError(ctx, http.StatusBadRequest, codeInvalidPayload, "Invalid gzip body")
+			return
+		}
+		ctx.Request.Body = io.NopCloser(bytes.NewReader(body))
+		ctx.Request.ContentLength = int64(len(body))
 		ctx.Next()
 	}
 }
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HTTPConfig bounds the connections of the server, zero values leave a
+// bound off. MaxBodyBytes applies to request bodies both as sent and after
+// decompression.
+type HTTPConfig struct {
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	MaxBodyBytes      int64
+	H2C               bool
+}
+
+func WithHTTPConfig(config HTTPConfig) ServerOption {
+	return func(s *Server) error {
+		s.httpConfig = config
+		return nil
+	}
+}
+
+// bodyLimitMiddleware rejects bodies declared larger than maxBytes and cuts
+// off those that turn out larger while being read.
+func bodyLimitMiddleware(maxBytes int64) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if maxBytes <= 0 || ctx.Request.Body == nil {
+			ctx.Next()
+			return
+		}
+		if ctx.Request.ContentLength > maxBytes {
+			abortWithError(ctx, http.StatusRequestEntityTooLarge, codeBodyTooLarge, "Request body too large")
+			return
+		}
+		ctx.Request.Body = http.MaxBytesReader(ctx.Writer, ctx.Request.Body, maxBytes)
+		ctx.Next()
+	}
+}
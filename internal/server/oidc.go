@@ -0,0 +1,185 @@
+package server
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/avtorsky/cuttlink/internal/oidc"
+	"github.com/avtorsky/cuttlink/internal/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	oidcCookieName = "cloidc"
+	oidcFlowTTL    = 10 * time.Minute
+)
+
+// oidcFlow is kept in a signed cookie between the login redirect and the
+// callback, so that no server-side state is needed.
+type oidcFlow struct {
+	State     string `json:"state"`
+	Nonce     string `json:"nonce"`
+	Verifier  string `json:"verifier"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// WithOIDC enables login with an OpenID Connect provider.
+func WithOIDC(provider *oidc.Provider) ServerOption {
+	return func(s *Server) error {
+		s.oidc = provider
+		return nil
+	}
+}
+
+// oidcUserID maps the subject of a provider to a stable user id, so that
+// links survive across logins without a local user record.
+func oidcUserID(issuer string, subject string) string {
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte(issuer+"\x00"+subject)).String()
+}
+
+func (s *Server) oidcLogin(ctx *gin.Context) {
+	if s.oidc == nil {
+		abortWithError(ctx, http.StatusNotFound, codeNotConfigured, "OpenID Connect login is not configured")
+		return
+	}
+	if _, ok := getAPIKey(ctx); ok {
+		abortWithError(ctx, http.StatusForbidden, codeAPIKeyNotAllowed, "Not available with API keys")
+		return
+	}
+
+	var flow oidcFlow
+	for _, value := range []*string{&flow.State, &flow.Nonce, &flow.Verifier} {
+		v, err := oidc.NewVerifier()
+		if err != nil {
+			abortWithError(ctx, http.StatusInternalServerError, codeInternalError, "Internal server error")
+			return
+		}
+		*value = v
+	}
+	flow.ExpiresAt = s.sessions.now().Add(oidcFlowTTL).Unix()
+	payload, err := json.Marshal(flow)
+	if err != nil {
+		abortWithError(ctx, http.StatusInternalServerError, codeInternalError, "Internal server error")
+		return
+	}
+
+	s.sessions.setFlowCookie(ctx, oidcCookieName, s.sessions.seal(payload), oidcFlowTTL)
+	ctx.Redirect(http.StatusFound, s.oidc.AuthCodeURL(flow.State, flow.Nonce, flow.Verifier))
+}
+
+func (s *Server) oidcCallback(ctx *gin.Context) {
+	if s.oidc == nil {
+		abortWithError(ctx, http.StatusNotFound, codeNotConfigured, "OpenID Connect login is not configured")
+		return
+	}
+	if _, ok := getAPIKey(ctx); ok {
+		abortWithError(ctx, http.StatusForbidden, codeAPIKeyNotAllowed, "Not available with API keys")
+		return
+	}
+	if e := ctx.Query("error"); e != "" {
+		abortWithError(ctx, http.StatusUnauthorized, codeLoginRejected, "Login rejected by identity provider: "+e)
+		return
+	}
+
+	flow, err := s.oidcFlow(ctx)
+	if err != nil || !hmac.Equal([]byte(flow.State), []byte(ctx.Query("state"))) {
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidLogin, "Invalid or expired login attempt")
+		return
+	}
+	s.sessions.setFlowCookie(ctx, oidcCookieName, "", -1)
+
+	token, err := s.oidc.Exchange(ctx.Request.Context(), ctx.Query("code"), flow.Verifier)
+	if err != nil {
+		log.Printf("oidc code exchange failed: %v", err)
+		abortWithError(ctx, http.StatusBadGateway, codeProviderError, "Unable to complete login with identity provider")
+		return
+	}
+	claims, err := s.oidc.Verify(ctx.Request.Context(), token.IDToken, flow.Nonce)
+	if err != nil {
+		log.Printf("oidc id token rejected: %v", err)
+		abortWithError(ctx, http.StatusUnauthorized, codeLoginRejected, "Invalid identity token")
+		return
+	}
+
+	username := claims.PreferredUsername
+	if username == "" {
+		username = claims.Email
+	}
+	email := ""
+	if claims.EmailVerified {
+		email = strings.ToLower(claims.Email)
+	}
+	s.startAccountSession(ctx, http.StatusOK, storage.User{
+		ID:       oidcUserID(s.oidc.Issuer(), claims.Subject),
+		Username: username,
+		Email:    email,
+	})
+}
+
+func (s *Server) oidcFlow(ctx *gin.Context) (oidcFlow, error) {
+	var flow oidcFlow
+	value, err := ctx.Cookie(oidcCookieName)
+	if err != nil {
+		return flow, err
+	}
+	payload, err := s.sessions.open(value)
+	if err != nil {
+		return flow, err
+	}
+	if err := json.Unmarshal(payload, &flow); err != nil {
+		return flow, err
+	}
+	if s.sessions.now().Unix() >= flow.ExpiresAt {
+		return flow, ErrSessionExpired
+	}
+	return flow, nil
+}
+
+// seal signs an arbitrary payload with the current session secret.
+func (m *sessionManager) seal(payload []byte) string {
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(sign(m.keys[0], payload))
+}
+
+func (m *sessionManager) open(value string) ([]byte, error) {
+	encoded, encodedSignature, ok := strings.Cut(value, ".")
+	if !ok {
+		return nil, ErrSessionTampered
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrSessionTampered
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return nil, ErrSessionTampered
+	}
+	for _, key := range m.keys {
+		if hmac.Equal(sign(key, payload), signature) {
+			return payload, nil
+		}
+	}
+	return nil, ErrSessionTampered
+}
+
+func (m *sessionManager) setFlowCookie(ctx *gin.Context, name string, value string, ttl time.Duration) {
+	maxAge := int(ttl.Seconds())
+	if ttl < 0 {
+		maxAge = -1
+	}
+	http.SetCookie(ctx.Writer, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     m.path,
+		MaxAge:   maxAge,
+		Secure:   m.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
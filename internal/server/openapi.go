@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/avtorsky/cuttlink/internal/openapi"
+	"github.com/gin-gonic/gin"
+)
+
+// docsPage renders /api/openapi.json without third-party assets.
+const docsPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>cuttlink API</title>
+<style>
+body{font-family:sans-serif;max-width:60em;margin:2em auto;padding:0 1em;color:#222}
+h2{border-bottom:1px solid #ddd;padding-bottom:.2em;margin-top:2em}
+details{margin:.4em 0;border:1px solid #ddd;border-radius:4px}
+summary{cursor:pointer;padding:.5em}
+.method{display:inline-block;min-width:4.5em;font-weight:bold;text-transform:uppercase}
+.get{color:#1a5fb4}.post{color:#26a269}.patch{color:#c64600}.delete{color:#c01c28}
+.body{padding:0 1em 1em}
+code,pre{background:#f4f4f4;border-radius:4px}
+pre{padding:.5em;overflow-x:auto}
+table{border-collapse:collapse}td,th{text-align:left;padding:.2em .8em .2em 0;vertical-align:top}
+</style>
+</head>
+<body>
+<h1 id="title">cuttlink API</h1>
+<p id="description"></p>
+<p><a href="openapi.json">openapi.json</a></p>
+<div id="operations"></div>
+<script>
+(function(){
+function el(tag,cls,text){var e=document.createElement(tag);if(cls)e.className=cls;if(text!==undefined)e.textContent=text;return e;}
+function schema(doc,s){
+  if(!s)return "";
+  var seen={};
+  return JSON.stringify(s,function(k,v){
+    if(v&&typeof v==="object"&&v.$ref){var name=v.$ref.split("/").pop();if(seen[name])return name;seen[name]=true;var r=schema(doc,doc.components.schemas[name]);seen[name]=false;return JSON.parse(r);}
+    return v;
+  },2);
+}
+fetch("openapi.json").then(function(r){return r.json();}).then(function(doc){
+  document.getElementById("title").textContent=doc.info.title+" "+doc.info.version;
+  document.getElementById("description").textContent=doc.info.description||"";
+  var groups={};
+  Object.keys(doc.paths).forEach(function(path){
+    Object.keys(doc.paths[path]).forEach(function(method){
+      var op=doc.paths[path][method],tag=(op.tags||["other"])[0];
+      (groups[tag]=groups[tag]||[]).push({path:path,method:method,op:op});
+    });
+  });
+  var root=document.getElementById("operations");
+  (doc.tags||[]).forEach(function(tag){
+    if(!groups[tag.name])return;
+    root.appendChild(el("h2","",tag.description||tag.name));
+    groups[tag.name].forEach(function(item){
+      var d=el("details"),s=el("summary");
+      s.appendChild(el("span","method "+item.method,item.method));
+      s.appendChild(el("code","",item.path));
+      s.appendChild(document.createTextNode(" "+(item.op.summary||"")));
+      d.appendChild(s);
+      var b=el("div","body");
+      if(item.op.description)b.appendChild(el("p","",item.op.description));
+      if(item.op.parameters){
+        var t=el("table");
+        item.op.parameters.forEach(function(p){
+          var tr=el("tr");
+          tr.appendChild(el("td","",p.in+"."+p.name+(p.required?" *":"")));
+          tr.appendChild(el("td","",(p.schema&&p.schema.type)||""));
+          tr.appendChild(el("td","",p.description||""));
+          t.appendChild(tr);
+        });
+        b.appendChild(el("h4","","Parameters"));b.appendChild(t);
+      }
+      if(item.op.requestBody){
+        b.appendChild(el("h4","","Request body"));
+        Object.keys(item.op.requestBody.content).forEach(function(media){
+          b.appendChild(el("p","",media));
+          b.appendChild(el("pre","",schema(doc,item.op.requestBody.content[media].schema)));
+        });
+      }
+      b.appendChild(el("h4","","Responses"));
+      Object.keys(item.op.responses).forEach(function(status){
+        var r=item.op.responses[status];
+        b.appendChild(el("p","",status+" "+r.description+(r.content?" ("+Object.keys(r.content).join(", ")+")":"")));
+        var media=r.content&&r.content["application/json"];
+        if(media&&status<300)b.appendChild(el("pre","",schema(doc,media.schema)));
+      });
+      d.appendChild(b);
+      root.appendChild(d);
+    });
+  });
+});
+})();
+</script>
+</body>
+</html>
+`
+
+func (s *Server) getOpenAPI(ctx *gin.Context) {
+	ctx.Data(http.StatusOK, "application/json", openapi.Spec())
+}
+
+func (s *Server) getAPIDocs(ctx *gin.Context) {
+	ctx.Data(http.StatusOK, "text/html; charset=utf-8", []byte(docsPage))
+}
+
+// requestValidation rejects requests that don't match their operation in the
+// OpenAPI document with a message naming the offending field, before the
+// handler parses them.
+func requestValidation(doc *openapi.Document) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		op := doc.Operation(ctx.Request.Method, openapi.GinPath(ctx.FullPath()))
+		if op == nil {
+			ctx.Next()
+			return
+		}
+		if err := doc.ValidateParams(op, ctx.Request, ctx.Param); err != nil {
+			abortWithValidationError(ctx, err)
+			return
+		}
+		if op.RequestBody == nil || ctx.Request.Body == nil {
+			ctx.Next()
+			return
+		}
+
+		body, err := io.ReadAll(ctx.Request.Body)
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			abortWithError(ctx, http.StatusRequestEntityTooLarge, codeBodyTooLarge, "Request body too large")
+			return
+		case err != nil:
+			abortWithError(ctx, http.StatusBadRequest, codeInvalidPayload, "Invalid payload")
+			return
+		}
+		ctx.Request.Body = io.NopCloser(bytes.NewReader(body))
+		if err := doc.ValidateBody(op, ctx.GetHeader("Content-Type"), body); err != nil {
+			abortWithValidationError(ctx, err)
+			return
+		}
+		ctx.Next()
+	}
+}
+
+func abortWithValidationError(ctx *gin.Context, err error) {
+	p := Problem{Status: http.StatusBadRequest, Code: codeInvalidRequest, Detail: err.Error()}
+	var invalid *openapi.ValidationError
+	if errors.As(err, &invalid) {
+		p.Field = invalid.Field
+	}
+	abortWithProblem(ctx, p)
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"bytes"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	previewKeySuffix = "+"
+	maxCountdown     = 60
+	maxTitleLength   = 200
+)
+
+var previewTemplate = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+{{- if .Countdown}}
+<meta http-equiv="refresh" content="{{.Countdown}};url={{.Destination}}">
+{{- end}}
+<title>cuttlink: {{if .Title}}{{.Title}}{{else}}{{.Host}}{{end}}</title>
+<style>
+body{font-family:sans-serif;max-width:40em;margin:4em auto;padding:0 1em;color:#222}
+.url{word-break:break-all;background:#f4f4f4;padding:.5em;border-radius:4px}
+.host{font-size:1.4em;font-weight:bold}
+a.button{display:inline-block;margin-top:1em;padding:.6em 1.2em;background:#1a5fb4;color:#fff;text-decoration:none;border-radius:4px}
+</style>
+</head>
+<body>
+<p>{{.ShortURL}} leads to</p>
+{{- if .Title}}
+<h1>{{.Title}}</h1>
+{{- end}}
+<p class="host">{{.Host}}</p>
+<p class="url">{{.Destination}}</p>
+{{- if .Countdown}}
+<p>You will be redirected in <span id="countdown">{{.Countdown}}</span> seconds.</p>
+<script>
+(function(){var n={{.Countdown}},el=document.getElementById("countdown");
+setInterval(function(){if(n>0){n--;el.textContent=n;}},1000);})();
+</script>
+{{- end}}
+<a class="button" href="{{.Destination}}" rel="noopener noreferrer">Continue</a>
+</body>
+</html>
+`))
+
+type previewPage struct {
+	ShortURL    string
+	Destination string
+	Host        string
+	Title       string
+	Countdown   int
+}
+
+// renderPreview shows the destination instead of redirecting to it. The
+// countdown auto-redirect is left out when the visitor asked for the preview.
+func (s *Server) renderPreview(ctx *gin.Context, key string, destination string, title string, countdown int) {
+	u, err := url.Parse(destination)
+	if err != nil {
+		abortWithError(ctx, http.StatusInternalServerError, codeInternalError, "Invalid destination URL")
+		return
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		countdown = 0
+	}
+
+	var buf bytes.Buffer
+	page := previewPage{
+		ShortURL:    s.shortURL(key),
+		Destination: destination,
+		Host:        u.Hostname(),
+		Title:       title,
+		Countdown:   countdown,
+	}
+	if err := previewTemplate.Execute(&buf, page); err != nil {
+		log.Printf("unable to render preview for %s: %v", key, err)
+		abortWithError(ctx, http.StatusInternalServerError, codeInternalError, "Internal server error")
+		return
+	}
+	ctx.Header("Cache-Control", "no-store")
+	ctx.Data(http.StatusOK, "text/html; charset=utf-8", buf.Bytes())
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/avtorsky/cuttlink/internal/policy"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	problemContentType     = "application/problem+json"
+	legacyErrorsContextKey = "legacyErrors"
+)
+
+// Error codes of problems. Unlike the details they are stable, clients
+// should tell errors apart by them.
+const (
+	codeInvalidRequest     = "invalid_request"
+	codeInvalidPayload     = "invalid_payload"
+	codeInvalidContentType = "invalid_content_type"
+	codeBodyTooLarge       = "body_too_large"
+	codeInvalidURL         = "invalid_url"
+	codePolicyViolation    = "policy_violation"
+	codeInvalidOption      = "invalid_option"
+	codeInvalidPath        = "invalid_path"
+	codeUnknownKey         = "unknown_key"
+	codeLinkDeleted        = "link_deleted"
+	codeLinkDisabled       = "link_disabled"
+	codeInvalidAPIKey      = "invalid_api_key"
+	codeInvalidSession     = "invalid_session"
+	codeInvalidCredentials = "invalid_credentials"
+	codeInvalidAdminToken  = "invalid_admin_token"
+	codeInsufficientScope  = "insufficient_scope"
+	codeInsufficientRole   = "insufficient_role"
+	codeNotOwner           = "not_owner"
+	codeAPIKeyNotAllowed   = "api_key_not_allowed"
+	codeAlreadyRegistered  = "already_registered"
+	codeUnknownUser        = "unknown_user"
+	codeUnknownAPIKey      = "unknown_api_key"
+	codeUnknownWorkspace   = "unknown_workspace"
+	codeNotMember          = "not_member"
+	codeLastOwner          = "last_owner"
+	codeUnknownTransfer    = "unknown_transfer"
+	codeTransferClosed     = "transfer_closed"
+	codeInvalidLogin       = "invalid_login_attempt"
+	codeLoginRejected      = "login_rejected"
+	codeProviderError      = "identity_provider_error"
+	codeNotConfigured      = "not_configured"
+	codeRateLimited        = "rate_limited"
+	codeNotFound           = "not_found"
+	codeStorageError       = "storage_error"
+	codeStorageUnavailable = "storage_unavailable"
+	codeInternalError      = "internal_error"
+)
+
+// Problem is an RFC 7807 problem details object, the body of error responses
+// unless legacy errors are enabled. Field names the request value a
+// validation failed on, Violation and CorrelationID explain policy
+// rejections.
+type Problem struct {
+	Type          string            `json:"type"`
+	Title         string            `json:"title"`
+	Status        int               `json:"status"`
+	Code          string            `json:"code"`
+	Detail        string            `json:"detail,omitempty"`
+	Instance      string            `json:"instance,omitempty"`
+	Field         string            `json:"field,omitempty"`
+	Violation     *policy.Violation `json:"violation,omitempty"`
+	CorrelationID string            `json:"correlation_id,omitempty"`
+	Error         string            `json:"error,omitempty"`
+
+	// legacyStatus and legacyMessage replace Status and Detail for legacy
+	// clients where those used to differ.
+	legacyStatus  int
+	legacyMessage string
+	// legacyText answers legacy clients with plain text on API routes too.
+	legacyText bool
+}
+
+// WithLegacyErrors answers errors the way the server did before problems:
+// {"message"} on API routes and plain text otherwise, with the status codes
+// legacy clients expect.
+func WithLegacyErrors(enabled bool) ServerOption {
+	return func(s *Server) error {
+		s.legacyErrors = enabled
+		return nil
+	}
+}
+
+// errorFormat tells abortWithProblem which format the server answers with.
+func errorFormat(legacy bool) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.Set(legacyErrorsContextKey, legacy)
+		ctx.Next()
+	}
+}
+
+func legacyErrors(ctx *gin.Context) bool {
+	return ctx.GetBool(legacyErrorsContextKey)
+}
+
+// abortWithError answers with a problem of the status and code.
+func abortWithError(ctx *gin.Context, status int, code string, detail string) {
+	abortWithProblem(ctx, Problem{Status: status, Code: code, Detail: detail})
+}
+
+func abortWithProblem(ctx *gin.Context, p Problem) {
+	if legacyErrors(ctx) {
+		abortWithLegacyError(ctx, p)
+		return
+	}
+	p.Type = "about:blank"
+	p.Title = http.StatusText(p.Status)
+	p.Instance = ctx.Request.URL.Path
+	ctx.Header("Content-Type", problemContentType)
+	ctx.AbortWithStatusJSON(p.Status, p)
+}
+
+// abortWithLegacyError answers API routes with {"message"} and the others,
+// which are used by browsers and curl, with plain text.
+func abortWithLegacyError(ctx *gin.Context, p Problem) {
+	status, message := p.Status, p.Detail
+	if p.legacyStatus != 0 {
+		status = p.legacyStatus
+	}
+	if p.legacyMessage != "" {
+		message = p.legacyMessage
+	}
+	if p.legacyText || !isAPIRoute(ctx) {
+		ctx.String(status, message)
+		ctx.Abort()
+		return
+	}
+
+	body := gin.H{"message": message}
+	if p.Violation != nil {
+		body["violation"] = p.Violation
+	}
+	if p.CorrelationID != "" {
+		body["correlation_id"] = p.CorrelationID
+	}
+	if p.Error != "" {
+		body["error"] = p.Error
+	}
+	ctx.AbortWithStatusJSON(status, body)
+}
+
+func isAPIRoute(ctx *gin.Context) bool {
+	return strings.HasPrefix(ctx.Request.URL.Path, "/api/")
+}
+
+// abortWithPolicyError answers a destination rejected by the policy, the
+// correlation id names the offending item of batches.
+func abortWithPolicyError(ctx *gin.Context, err error, correlationID string) {
+	p := Problem{
+		Status:        http.StatusUnprocessableEntity,
+		Code:          codePolicyViolation,
+		Detail:        "Destination rejected by policy",
+		CorrelationID: correlationID,
+	}
+	if !errors.As(err, &p.Violation) {
+		p.Status, p.Code, p.Detail = http.StatusBadRequest, codeInvalidURL, "Invalid URL"
+		p.legacyStatus = http.StatusUnprocessableEntity
+	}
+	if !isAPIRoute(ctx) {
+		p.legacyMessage = err.Error()
+	}
+	abortWithProblem(ctx, p)
+}
+
+func abortWithContentTypeError(ctx *gin.Context) {
+	abortWithProblem(ctx, Problem{
+		Status:       http.StatusUnsupportedMediaType,
+		Code:         codeInvalidContentType,
+		Detail:       "Invalid Content-Type header",
+		legacyStatus: http.StatusInternalServerError,
+	})
+}
+
+func abortWithStorageError(ctx *gin.Context) {
+	abortWithError(ctx, http.StatusInternalServerError, codeStorageError, "Internal server I/O error")
+}
+
+// routeNotFound answers unknown routes, legacy clients get the plain text
+// of gin.
+func routeNotFound(ctx *gin.Context) {
+	if legacyErrors(ctx) {
+		ctx.String(http.StatusNotFound, "404 page not found")
+		return
+	}
+	abortWithError(ctx, http.StatusNotFound, codeNotFound, "Route not found")
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/avtorsky/cuttlink/internal/qrcode"
+	"github.com/gin-gonic/gin"
+)
+
+const qrBatchMaxKeys = 20
+
+func (s *Server) getQRCode(ctx *gin.Context) {
+	opts, err := parseQROptions(ctx)
+	if err != nil {
+		abortQR(ctx, http.StatusBadRequest, codeInvalidOption, err.Error())
+		return
+	}
+
+	key := ctx.Param("id")
+	row, err := s.storage.GetURL(ctx.Request.Context(), key)
+	if err != nil {
+		abortQR(ctx, http.StatusNotFound, codeUnknownKey, "Invalid key")
+		return
+	}
+	if row.IsDeleted {
+		abortQR(ctx, http.StatusGone, codeLinkDeleted, "Link deleted")
+		return
+	}
+	if row.IsDisabled {
+		abortQR(ctx, http.StatusGone, codeLinkDisabled, "Link disabled")
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := qrcode.Render(&buf, s.shortURL(key), opts); err != nil {
+		abortQR(ctx, http.StatusBadRequest, codeInvalidOption, err.Error())
+		return
+	}
+	ctx.Data(http.StatusOK, opts.ContentType(), buf.Bytes())
+}
+
+func (s *Server) getQRCodeBatch(ctx *gin.Context) {
+	opts, err := parseQROptions(ctx)
+	if err != nil {
+		abortQR(ctx, http.StatusBadRequest, codeInvalidOption, err.Error())
+		return
+	}
+
+	var keys []string
+	if err := json.NewDecoder(ctx.Request.Body).Decode(&keys); err != nil {
+		abortQR(ctx, http.StatusBadRequest, codeInvalidPayload, "URL keys parse error")
+		return
+	}
+	if len(keys) == 0 || len(keys) > qrBatchMaxKeys {
+		abortQR(ctx, http.StatusBadRequest, codeInvalidRequest, fmt.Sprintf("Batch must contain 1..%d keys", qrBatchMaxKeys))
+		return
+	}
+
+	// Deleted and disabled links are left out of the archive, their codes
+	// lead nowhere.
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		row, err := s.storage.GetURL(ctx.Request.Context(), key)
+		if err != nil {
+			abortQR(ctx, http.StatusNotFound, codeUnknownKey, fmt.Sprintf("Invalid key: %s", key))
+			return
+		}
+		if row.IsDeleted || row.IsDisabled {
+			continue
+		}
+		file, err := archive.Create(fmt.Sprintf("%s.%s", key, opts.Format))
+		if err != nil {
+			abortQR(ctx, http.StatusInternalServerError, codeStorageError, "Internal server I/O error")
+			return
+		}
+		if err := qrcode.Render(file, s.shortURL(key), opts); err != nil {
+			abortQR(ctx, http.StatusBadRequest, codeInvalidOption, err.Error())
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		abortQR(ctx, http.StatusInternalServerError, codeStorageError, "Internal server I/O error")
+		return
+	}
+
+	ctx.Header("Content-Disposition", `attachment; filename="qrcodes.zip"`)
+	ctx.Data(http.StatusOK, "application/zip", buf.Bytes())
+}
+
+func parseQROptions(ctx *gin.Context) (qrcode.Options, error) {
+	opts := qrcode.DefaultOptions()
+	opts.Format = ctx.DefaultQuery("format", opts.Format)
+	opts.Level = ctx.DefaultQuery("level", opts.Level)
+
+	var err error
+	if size := ctx.Query("size"); size != "" {
+		if opts.Size, err = strconv.Atoi(size); err != nil {
+			return opts, fmt.Errorf("invalid size %q", size)
+		}
+	}
+	if margin := ctx.Query("margin"); margin != "" {
+		if opts.Margin, err = strconv.Atoi(margin); err != nil {
+			return opts, fmt.Errorf("invalid margin %q", margin)
+		}
+	}
+
+	return opts, opts.Validate()
+}
+
+// abortQR answers legacy clients with the plain text the QR routes always
+// had, although they are API routes.
+func abortQR(ctx *gin.Context, status int, code string, detail string) {
+	abortWithProblem(ctx, Problem{Status: status, Code: code, Detail: detail, legacyText: true})
+}
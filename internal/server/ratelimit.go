@@ -0,0 +1,121 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/avtorsky/cuttlink/internal/ratelimit"
+	"github.com/gin-gonic/gin"
+)
+
+// RateLimits configures the token buckets per route class. Batch requests
+// take one token per URL, at most the burst.
+type RateLimits struct {
+	Create   ratelimit.Limit
+	Batch    ratelimit.Limit
+	Delete   ratelimit.Limit
+	Redirect ratelimit.Limit
+	Login    ratelimit.Limit
+}
+
+type limiters struct {
+	create   *ratelimit.Limiter
+	batch    *ratelimit.Limiter
+	delete   *ratelimit.Limiter
+	redirect *ratelimit.Limiter
+	login    *ratelimit.Limiter
+}
+
+func WithRateLimits(limits RateLimits) ServerOption {
+	return func(s *Server) error {
+		s.limiters = limiters{
+			create:   ratelimit.New(limits.Create),
+			batch:    ratelimit.New(limits.Batch),
+			delete:   ratelimit.New(limits.Delete),
+			redirect: ratelimit.New(limits.Redirect),
+			login:    ratelimit.New(limits.Login),
+		}
+		return nil
+	}
+}
+
+// WithTrustedProxies sets the proxies whose X-Forwarded-For is believed when
+// resolving the client IP. By default none are and the peer address is used.
+func WithTrustedProxies(proxies []string) ServerOption {
+	return func(s *Server) error {
+		s.trustedProxies = proxies
+		return nil
+	}
+}
+
+// rateLimitKey prefers the API key, then the session presented by the client.
+// New sessions, and those younger than the window of the limiter, share the
+// bucket of their IP, so that neither dropping the cookie nor fetching fresh
+// ones resets the limit.
+func rateLimitKey(ctx *gin.Context, limiter *ratelimit.Limiter) string {
+	if key, ok := getAPIKey(ctx); ok {
+		return "apikey:" + key.ID
+	}
+	sessionID := ctx.GetString(sessionContextKey)
+	if sessionID != "" && !ctx.GetBool(sessionNewContextKey) && sessionEstablished(ctx.GetTime(sessionAgeContextKey), limiter) {
+		return "session:" + sessionID
+	}
+	return "ip:" + ctx.ClientIP()
+}
+
+// sessionEstablished reports whether a session issued at issuedAt is older
+// than the time the bucket of limiter takes to refill. Younger ones would
+// start with a full bucket of their own.
+func sessionEstablished(issuedAt time.Time, limiter *ratelimit.Limiter) bool {
+	return time.Since(issuedAt) >= limiter.Window()
+}
+
+func rateLimitMiddleware(limiter *ratelimit.Limiter, cost func(ctx *gin.Context) int) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if !limiter.Enabled() {
+			ctx.Next()
+			return
+		}
+
+		n := 1
+		if cost != nil {
+			n = cost(ctx)
+		}
+		result := limiter.Allow(rateLimitKey(ctx, limiter), n)
+		header := ctx.Writer.Header()
+		header.Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+		header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		header.Set("RateLimit-Reset", seconds(result.Reset))
+		if result.Allowed {
+			ctx.Next()
+			return
+		}
+
+		header.Set("Retry-After", seconds(result.RetryAfter))
+		abortWithError(ctx, http.StatusTooManyRequests, codeRateLimited, "Rate limit exceeded")
+	}
+}
+
+// batchCost counts the URLs of a batch request and puts the body back for
+// the handler. Malformed bodies cost one token and fail in the handler.
+func batchCost(ctx *gin.Context) int {
+	body, err := io.ReadAll(ctx.Request.Body)
+	ctx.Request.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return 1
+	}
+	items := make([]json.RawMessage, 0)
+	if err := json.Unmarshal(body, &items); err != nil || len(items) == 0 {
+		return 1
+	}
+	return len(items)
+}
+
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
@@ -2,17 +2,34 @@ package server
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/avtorsky/cuttlink/internal/canonical"
+	"github.com/avtorsky/cuttlink/internal/metadata"
+	"github.com/avtorsky/cuttlink/internal/oidc"
+	"github.com/avtorsky/cuttlink/internal/openapi"
+	"github.com/avtorsky/cuttlink/internal/policy"
+	"github.com/avtorsky/cuttlink/internal/routing"
 	"github.com/avtorsky/cuttlink/internal/storage"
 	"github.com/avtorsky/cuttlink/internal/workers"
 	"io"
+	"log"
+	"math/big"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
 )
 
 type PayloadJSON struct {
@@ -24,8 +41,20 @@ type ResponseJSON struct {
 }
 
 type URLPair struct {
-	OriginalURL string `json:"original_url"`
-	ShortURL    string `json:"short_url"`
+	OriginalURL string     `json:"original_url"`
+	ShortURL    string     `json:"short_url"`
+	Title       string     `json:"title,omitempty"`
+	Description string     `json:"description,omitempty"`
+	FaviconURL  string     `json:"favicon_url,omitempty"`
+	WorkspaceID string     `json:"workspace_id,omitempty"`
+	Disabled    bool       `json:"disabled,omitempty"`
+	Health      *URLHealth `json:"health,omitempty"`
+}
+
+type URLHealth struct {
+	StatusCode int       `json:"status_code"`
+	CheckedAt  time.Time `json:"checked_at"`
+	Broken     bool      `json:"broken"`
 }
 
 type URLPairRequest struct {
@@ -38,12 +67,73 @@ type URLPairResponse struct {
 	ShortURL      string `json:"short_url"`
 }
 
+type URLOptions struct {
+	Rules        routing.Rules    `json:"rules"`
+	Variants     routing.Variants `json:"variants"`
+	QueryMode    string           `json:"query_mode"`
+	UTM          routing.UTM      `json:"utm"`
+	PathMode     string           `json:"path_mode"`
+	Interstitial bool             `json:"interstitial"`
+	Countdown    int              `json:"countdown"`
+	Title        string           `json:"title"`
+}
+
+type URLOptionsRequest struct {
+	Rules        *routing.Rules    `json:"rules"`
+	Variants     *routing.Variants `json:"variants"`
+	QueryMode    *string           `json:"query_mode"`
+	UTM          *routing.UTM      `json:"utm"`
+	PathMode     *string           `json:"path_mode"`
+	Interstitial *bool             `json:"interstitial"`
+	Countdown    *int              `json:"countdown"`
+	Title        *string           `json:"title"`
+}
+
+type VariantStats struct {
+	Destination string `json:"destination"`
+	Weight      int    `json:"weight"`
+	Hits        int64  `json:"hits"`
+}
+
+const (
+	variantCookiePrefix = "clab_"
+	variantCookieMaxAge = 30 * 86400
+
+	metadataQueueSize   = 100
+	metadataConcurrency = 4
+
+	// batchMaxItems caps batches of the HTTP and gRPC APIs alike.
+	batchMaxItems = 1000
+)
+
 type Server struct {
-	srv         *http.Server
-	storage     storage.Storager
-	serverHost  string
-	serviceHost string
-	removalCh   chan workers.RemovalTask
+	srv              *http.Server
+	storage          storage.Storager
+	serverHost       string
+	serviceHost      string
+	queryPassthrough bool
+	policy           *policy.Engine
+	normalizer       *canonical.Normalizer
+	fetcher          metadata.Fetcher
+	limiters         limiters
+	trustedProxies   []string
+	sessionConfig    SessionConfig
+	sessions         *sessionManager
+	oidc             *oidc.Provider
+	adminToken       string
+	httpConfig       HTTPConfig
+	tlsConfig        *tls.Config
+	redirectHost     string
+	redirectSrv      *http.Server
+	grpcHost         string
+	grpcSrv          *grpc.Server
+	openapi          *openapi.Document
+	legacyErrors     bool
+	stopWorkers      context.CancelFunc
+	workers          *sync.WaitGroup
+	auditor          storage.Auditor
+	removalCh        chan workers.RemovalTask
+	metadataCh       chan workers.MetadataTask
 }
 
 type ServerOption func(*Server) error
@@ -62,23 +152,58 @@ func WithServiceHost(bURL string) ServerOption {
 	}
 }
 
+func WithQueryPassthrough(enabled bool) ServerOption {
+	return func(s *Server) error {
+		s.queryPassthrough = enabled
+		return nil
+	}
+}
+
+func WithPolicy(engine *policy.Engine) ServerOption {
+	return func(s *Server) error {
+		s.policy = engine
+		return nil
+	}
+}
+
+func WithNormalizer(normalizer *canonical.Normalizer) ServerOption {
+	return func(s *Server) error {
+		s.normalizer = normalizer
+		return nil
+	}
+}
+
+// WithMetadataFetcher enables fetching page titles of new destinations.
+func WithMetadataFetcher(fetcher metadata.Fetcher) ServerOption {
+	return func(s *Server) error {
+		s.fetcher = fetcher
+		return nil
+	}
+}
+
 func New(storage storage.Storager, opts ...ServerOption) (Server, error) {
 	const (
 		defaultServerHost  = ":8080"
 		defaultServiceHost = "http://localhost:8080"
 	)
 
-	ctx := context.Background()
-	removalTasks := make(chan workers.RemovalTask, 10)
-	removalWorker := workers.New(storage, removalTasks)
-	go removalWorker.Run(ctx)
+	defaultPolicy, err := policy.NewEngine(policy.Policy{})
+	if err != nil {
+		return Server{}, err
+	}
+	defaultNormalizer, err := canonical.New(canonical.AllSteps, nil)
+	if err != nil {
+		return Server{}, err
+	}
 
 	s := Server{
 		srv:         nil,
 		storage:     storage,
 		serverHost:  defaultServerHost,
 		serviceHost: defaultServiceHost,
-		removalCh:   removalTasks,
+		policy:      defaultPolicy,
+		normalizer:  defaultNormalizer,
+		removalCh:   make(chan workers.RemovalTask, 10),
 	}
 
 	for _, opt := range opts {
@@ -87,35 +212,197 @@ func New(storage storage.Storager, opts ...ServerOption) (Server, error) {
 		}
 	}
 
+	s.sessions, err = newSessionManager(s.sessionConfig, s.serviceHost)
+	if err != nil {
+		return Server{}, err
+	}
+	s.openapi, err = openapi.Load()
+	if err != nil {
+		return Server{}, err
+	}
+
+	ctx, stopWorkers := context.WithCancel(context.Background())
+	s.stopWorkers, s.workers = stopWorkers, &sync.WaitGroup{}
+	removalWorker := workers.New(auditRemover{storage: storage, auditor: s.auditor}, s.removalCh)
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		removalWorker.Run(ctx)
+	}()
+
+	if s.fetcher != nil {
+		s.metadataCh = make(chan workers.MetadataTask, metadataQueueSize)
+		metadataWorker := workers.NewMetadataWorker(storage, s.fetcher, s.metadataCh, metadataConcurrency)
+		s.workers.Add(1)
+		go func() {
+			defer s.workers.Done()
+			metadataWorker.Run(ctx)
+		}()
+	}
+
 	gin.ForceConsoleColor()
 	r := gin.New()
 	r.Use(
 		gin.Logger(),
 		gin.Recovery(),
+		errorFormat(s.legacyErrors),
 		compressMiddleware(),
-		decompressMiddleware(),
-		cookieAuthentication(),
+		bodyLimitMiddleware(s.httpConfig.MaxBodyBytes),
+		decompressMiddleware(s.httpConfig.MaxBodyBytes),
+		apiKeyAuthentication(s.storage),
+		s.sessionAuthentication(),
+		requestValidation(s.openapi),
 	)
-	r.GET("/:id", s.redirect)
-	r.POST("/", s.createShortURL)
-	r.POST("/form-submit", s.createShortURLWebForm)
-	r.POST("/api/shorten", s.createShortURLJSON)
-	r.POST("/api/shorten/batch", s.createShortURLBatch)
-	r.GET("/api/user/urls", s.getUserURLs)
-	r.DELETE("/api/user/urls", s.deleteUserURLs)
+	if err := r.SetTrustedProxies(s.trustedProxies); err != nil {
+		return Server{}, err
+	}
+	limitCreate := rateLimitMiddleware(s.limiters.create, nil)
+	limitRedirect := rateLimitMiddleware(s.limiters.redirect, nil)
+	scopeCreate := requireScope(ScopeCreate)
+	scopeRead := requireScope(ScopeRead)
+	scopeFull := requireScope(ScopeFull)
+	r.GET("/:id", limitRedirect, s.redirect)
+	r.GET("/:id/*path", limitRedirect, s.redirect)
+	r.POST("/", scopeCreate, limitCreate, s.createShortURL)
+	r.POST("/form-submit", scopeCreate, limitCreate, s.createShortURLWebForm)
+	r.POST("/api/shorten", scopeCreate, limitCreate, s.createShortURLJSON)
+	r.POST("/api/shorten/batch", scopeCreate, rateLimitMiddleware(s.limiters.batch, batchCost), s.createShortURLBatch)
+	r.GET("/api/user/urls", scopeRead, s.getUserURLs)
+	r.DELETE("/api/user/urls", scopeFull, rateLimitMiddleware(s.limiters.delete, nil), s.deleteUserURLs)
+	r.GET("/api/user/urls/broken", scopeRead, s.getBrokenURLs)
+	r.PATCH("/api/user/urls/:id", scopeFull, s.updateURLOptions)
+	r.GET("/api/user/urls/:id/variants", scopeRead, s.getVariantStats)
+	limitLogin := rateLimitMiddleware(s.limiters.login, nil)
+	r.POST("/api/user/register", limitLogin, s.register)
+	r.POST("/api/user/login", limitLogin, s.login)
+	r.POST("/api/user/logout", s.logout)
+	r.GET("/api/user/oidc/login", limitLogin, s.oidcLogin)
+	r.GET("/api/user/oidc/callback", limitLogin, s.oidcCallback)
+	r.POST("/api/user/keys", scopeFull, s.createAPIKey)
+	r.GET("/api/user/keys", scopeFull, s.getAPIKeys)
+	r.DELETE("/api/user/keys/:id", scopeFull, s.revokeAPIKey)
+	r.POST("/api/workspaces", scopeFull, s.createWorkspace)
+	r.GET("/api/workspaces", scopeRead, s.getWorkspaces)
+	r.GET("/api/workspaces/:id/members", scopeRead, s.getWorkspaceMembers)
+	r.POST("/api/workspaces/:id/members", scopeFull, s.setWorkspaceMember)
+	r.DELETE("/api/workspaces/:id/members/:user", scopeFull, s.removeWorkspaceMember)
+	r.POST("/api/workspaces/:id/urls", scopeFull, s.moveWorkspaceURLs)
+	r.POST("/api/user/transfers", scopeFull, s.createTransfer)
+	r.POST("/api/user/transfers/accept", scopeFull, s.acceptTransfer)
+	r.DELETE("/api/user/transfers/:id", scopeFull, s.cancelTransfer)
+	r.GET("/api/user/audit", scopeFull, s.getUserAudit)
+	admin := r.Group("/api/admin", s.adminAuthentication())
+	admin.GET("/urls", s.adminSearchURLs)
+	admin.GET("/urls/:id", s.adminGetURL)
+	admin.POST("/urls/:id/disable", s.adminDisableURL)
+	admin.POST("/urls/:id/enable", s.adminEnableURL)
+	admin.DELETE("/users/:id/urls", s.adminDeleteUserURLs)
+	admin.GET("/stats", s.adminStats)
+	r.GET("/api/qr/:id", scopeRead, limitRedirect, s.getQRCode)
+	r.POST("/api/qr/batch", scopeRead, rateLimitMiddleware(s.limiters.batch, batchCost), s.getQRCodeBatch)
+	r.GET("/api/openapi.json", s.getOpenAPI)
+	r.GET("/api/docs", s.getAPIDocs)
 	r.GET("/ping", s.pingDSN)
+	r.NoRoute(routeNotFound)
 
+	var handler http.Handler = r
+	if s.httpConfig.H2C {
+		handler = h2c.NewHandler(r, &http2.Server{IdleTimeout: s.httpConfig.IdleTimeout})
+	}
 	srv := http.Server{
-		Addr:    s.serverHost,
-		Handler: r,
+		Addr:              s.serverHost,
+		Handler:           handler,
+		TLSConfig:         s.tlsConfig,
+		ReadTimeout:       s.httpConfig.ReadTimeout,
+		ReadHeaderTimeout: s.httpConfig.ReadHeaderTimeout,
+		WriteTimeout:      s.httpConfig.WriteTimeout,
+		IdleTimeout:       s.httpConfig.IdleTimeout,
+		MaxHeaderBytes:    s.httpConfig.MaxHeaderBytes,
+	}
+	if s.redirectHost != "" {
+		if s.tlsConfig == nil {
+			return Server{}, errors.New("HTTPS redirect requires TLS")
+		}
+		s.redirectSrv = &http.Server{
+			Addr:              s.redirectHost,
+			Handler:           httpsRedirect(s.serviceHost),
+			ReadHeaderTimeout: s.httpConfig.ReadHeaderTimeout,
+			IdleTimeout:       s.httpConfig.IdleTimeout,
+		}
+	}
+
+	if s.grpcHost != "" {
+		s.grpcSrv = s.newGRPCServer()
 	}
 
 	s.srv = &srv
 	return s, nil
 }
 
-func (s *Server) ListenAndServe() {
-	s.srv.ListenAndServe()
+// ListenAndServe serves HTTPS when TLS is configured, certificates come from
+// the TLS config, and plain HTTP otherwise. After Shutdown it returns
+// http.ErrServerClosed.
+func (s *Server) ListenAndServe() error {
+	if s.grpcSrv != nil {
+		lis, err := net.Listen("tcp", s.grpcHost)
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := s.grpcSrv.Serve(lis); err != nil {
+				log.Printf("unable to serve gRPC: %v", err)
+			}
+		}()
+	}
+	if s.redirectSrv != nil {
+		go func() {
+			if err := s.redirectSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("unable to serve HTTPS redirect: %v", err)
+			}
+		}()
+	}
+	if s.srv.TLSConfig != nil {
+		return s.srv.ListenAndServeTLS("", "")
+	}
+	return s.srv.ListenAndServe()
+}
+
+// Shutdown stops accepting connections and waits for the open ones, then
+// stops the workers once they have done the queued removals. Pending
+// metadata fetches are dropped. It gives up when ctx is done, the storage is
+// left for the caller to close.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.redirectSrv != nil {
+		s.redirectSrv.Shutdown(ctx)
+	}
+	err := s.srv.Shutdown(ctx)
+	if s.grpcSrv != nil {
+		stopped := make(chan struct{})
+		go func() {
+			s.grpcSrv.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			s.grpcSrv.Stop()
+		}
+	}
+	s.stopWorkers()
+
+	done := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	return err
 }
 
 func (s *Server) createShortURL(ctx *gin.Context) {
@@ -130,25 +417,40 @@ func (s *Server) createShortURL(ctx *gin.Context) {
 	case "application/x-gzip", "text/plain; charset=utf-8":
 		dataBytes, err := io.ReadAll(ctx.Request.Body)
 		if err != nil {
-			ctx.String(http.StatusInternalServerError, "Invalid payload")
+			abortWithProblem(ctx, Problem{
+				Status:       http.StatusBadRequest,
+				Code:         codeInvalidPayload,
+				Detail:       "Invalid payload",
+				legacyStatus: http.StatusInternalServerError,
+			})
 			return
 		}
 		baseURL = strings.TrimSpace(string(dataBytes))
 	default:
-		ctx.String(http.StatusInternalServerError, "Invalid Content-Type header")
+		abortWithContentTypeError(ctx)
 		return
 	}
 
 	u, _ := url.Parse(baseURL)
 	if u.Scheme == "" {
-		ctx.String(http.StatusBadRequest, "Invalid URL scheme")
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidURL, "Invalid URL scheme")
 		return
 	} else if u.Host == "" {
-		ctx.String(http.StatusBadRequest, "Invalid URL host")
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidURL, "Invalid URL host")
 		return
 	}
 
-	key, err := s.storage.SetURL(ctx.Request.Context(), baseURL, sessionID)
+	canonicalURL, err := s.normalizer.Normalize(baseURL)
+	if err != nil {
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidURL, "Invalid URL")
+		return
+	}
+	if err := s.policy.Check(canonicalURL); err != nil {
+		abortWithPolicyError(ctx, err, "")
+		return
+	}
+
+	key, err := s.storage.SetURL(ctx.Request.Context(), canonicalURL, baseURL, sessionID)
 	if err != nil {
 		ctx.Writer.Header().Set("Content-Type", "text/plain")
 		var dbError *storage.DuplicateURLError
@@ -157,10 +459,14 @@ func (s *Server) createShortURL(ctx *gin.Context) {
 			ctx.String(http.StatusConflict, shortURL)
 			return
 		}
-		ctx.String(http.StatusInternalServerError, "Internal server I/O error")
+		abortWithStorageError(ctx)
 		return
 	}
 
+	s.fetchMetadata(key, canonicalURL)
+	s.audit(ctx, sessionID, storage.AuditCreate, []string{key}, nil, storage.AuditState{
+		key: gin.H{"original_url": baseURL, "destination": canonicalURL},
+	})
 	shortURL := fmt.Sprintf("%s/%s", s.serviceHost, key)
 	ctx.Writer.Header().Set("Content-Type", "text/plain")
 	ctx.String(http.StatusCreated, shortURL)
@@ -178,31 +484,46 @@ func (s *Server) createShortURLWebForm(ctx *gin.Context) {
 	case "application/x-gzip":
 		dataBytes, err := io.ReadAll(ctx.Request.Body)
 		if err != nil {
-			ctx.String(http.StatusInternalServerError, "Invalid payload")
+			abortWithProblem(ctx, Problem{
+				Status:       http.StatusBadRequest,
+				Code:         codeInvalidPayload,
+				Detail:       "Invalid payload",
+				legacyStatus: http.StatusInternalServerError,
+			})
 			return
 		}
 		baseURL = strings.TrimSpace(string(dataBytes))
 	case "application/x-www-form-urlencoded":
 		baseURL = ctx.PostForm("url")
 	default:
-		ctx.String(http.StatusInternalServerError, "Invalid Content-Type header")
+		abortWithContentTypeError(ctx)
 		return
 	}
 
 	if baseURL == "" {
-		ctx.String(http.StatusBadRequest, "Invalid URL")
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidURL, "Invalid URL")
 		return
 	}
 	u, _ := url.Parse(baseURL)
 	if u.Scheme == "" {
-		ctx.String(http.StatusBadRequest, "Invalid URL scheme")
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidURL, "Invalid URL scheme")
 		return
 	} else if u.Host == "" {
-		ctx.String(http.StatusBadRequest, "Invalid URL host")
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidURL, "Invalid URL host")
+		return
+	}
+
+	canonicalURL, err := s.normalizer.Normalize(baseURL)
+	if err != nil {
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidURL, "Invalid URL")
+		return
+	}
+	if err := s.policy.Check(canonicalURL); err != nil {
+		abortWithPolicyError(ctx, err, "")
 		return
 	}
 
-	key, err := s.storage.SetURL(ctx.Request.Context(), baseURL, sessionID)
+	key, err := s.storage.SetURL(ctx.Request.Context(), canonicalURL, baseURL, sessionID)
 	if err != nil {
 		ctx.Writer.Header().Set("Content-Type", "application/x-www-form-urlencoded")
 		var dbError *storage.DuplicateURLError
@@ -211,10 +532,14 @@ func (s *Server) createShortURLWebForm(ctx *gin.Context) {
 			ctx.String(http.StatusConflict, shortURL)
 			return
 		}
-		ctx.String(http.StatusInternalServerError, "Internal server I/O error")
+		abortWithStorageError(ctx)
 		return
 	}
 
+	s.fetchMetadata(key, canonicalURL)
+	s.audit(ctx, sessionID, storage.AuditCreate, []string{key}, nil, storage.AuditState{
+		key: gin.H{"original_url": baseURL, "destination": canonicalURL},
+	})
 	shortURL := fmt.Sprintf("%s/%s", s.serviceHost, key)
 	ctx.Writer.Header().Set("Content-Type", "application/x-www-form-urlencoded")
 	ctx.String(http.StatusCreated, shortURL)
@@ -229,32 +554,34 @@ func (s *Server) createShortURLJSON(ctx *gin.Context) {
 
 	var payload PayloadJSON
 	if headerContentType != "application/json" {
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"message": "Invalid Content-Type header",
-		})
+		abortWithContentTypeError(ctx)
 		return
 	}
-	if err := ctx.BindJSON(&payload); err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{
-			"message": "Invalid URL",
-		})
+	if err := ctx.ShouldBindJSON(&payload); err != nil {
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidURL, "Invalid URL")
 		return
 	}
 	if _, err := url.ParseRequestURI(payload.URL); err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{
-			"message": "Invalid URL scheme",
-		})
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidURL, "Invalid URL scheme")
 		return
 	}
 	u, _ := url.Parse(payload.URL)
 	if u.Host == "" {
-		ctx.JSON(http.StatusBadRequest, gin.H{
-			"message": "Invalid URL host",
-		})
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidURL, "Invalid URL host")
 		return
 	}
 
-	key, err := s.storage.SetURL(ctx.Request.Context(), payload.URL, sessionID)
+	canonicalURL, err := s.normalizer.Normalize(payload.URL)
+	if err != nil {
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidURL, "Invalid URL")
+		return
+	}
+	if err := s.policy.Check(canonicalURL); err != nil {
+		abortWithPolicyError(ctx, err, "")
+		return
+	}
+
+	key, err := s.storage.SetURL(ctx.Request.Context(), canonicalURL, payload.URL, sessionID)
 	if err != nil {
 		ctx.Writer.Header().Set("Content-Type", "application/json")
 		var dbError *storage.DuplicateURLError
@@ -265,12 +592,14 @@ func (s *Server) createShortURLJSON(ctx *gin.Context) {
 			ctx.JSON(http.StatusConflict, shortURL)
 			return
 		}
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"message": "Internal server I/O error",
-		})
+		abortWithStorageError(ctx)
 		return
 	}
 
+	s.fetchMetadata(key, canonicalURL)
+	s.audit(ctx, sessionID, storage.AuditCreate, []string{key}, nil, storage.AuditState{
+		key: gin.H{"original_url": payload.URL, "destination": canonicalURL},
+	})
 	shortURL := ResponseJSON{
 		Result: fmt.Sprintf("%s/%s", s.serviceHost, key),
 	}
@@ -291,73 +620,165 @@ func (s *Server) createShortURLBatch(ctx *gin.Context) {
 		return
 	}
 	if headerContentType != "application/json" {
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"message": "Invalid Content-Type header",
-		})
+		abortWithContentTypeError(ctx)
 		return
 	}
 
 	request := make([]URLPairRequest, 0)
-	if err := ctx.BindJSON(&request); err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{
-			"message": "Invalid payload",
-		})
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidPayload, "Invalid payload")
 		return
 	}
 	size := len(request)
+	if size > batchMaxItems {
+		abortWithError(ctx, http.StatusRequestEntityTooLarge, codeBodyTooLarge, fmt.Sprintf("Batch must contain at most %d URLs", batchMaxItems))
+		return
+	}
 	urlBatch := make([]string, size)
+	originalBatch := make([]string, size)
 	for i := range request {
 		if _, err := url.ParseRequestURI(request[i].OriginalURL); err != nil {
-			ctx.JSON(http.StatusBadRequest, gin.H{
-				"message": "Invalid URL scheme",
-			})
+			abortWithError(ctx, http.StatusBadRequest, codeInvalidURL, "Invalid URL scheme")
 			return
 		}
 		u, _ := url.Parse(request[i].OriginalURL)
 		if u.Host == "" {
-			ctx.JSON(http.StatusBadRequest, gin.H{
-				"message": "Invalid URL host",
-			})
+			abortWithError(ctx, http.StatusBadRequest, codeInvalidURL, "Invalid URL host")
 			return
 		}
-		urlBatch[i] = request[i].OriginalURL
+		canonicalURL, err := s.normalizer.Normalize(request[i].OriginalURL)
+		if err != nil {
+			abortWithError(ctx, http.StatusBadRequest, codeInvalidURL, "Invalid URL")
+			return
+		}
+		if err := s.policy.Check(canonicalURL); err != nil {
+			abortWithPolicyError(ctx, err, request[i].CorrelationID)
+			return
+		}
+		urlBatch[i] = canonicalURL
+		originalBatch[i] = request[i].OriginalURL
 	}
 
-	urlBatch, err = s.storage.SetBatchURL(ctx.Request.Context(), urlBatch, sessionID)
+	keys, inserted, err := s.storage.SetBatchURL(ctx.Request.Context(), urlBatch, originalBatch, sessionID)
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{
-			"message": "Internal server I/O error",
-		})
+		abortWithStorageError(ctx)
 		return
 	}
 
+	created := make(storage.AuditState, size)
+	createdKeys := make([]string, 0, size)
 	response := make([]URLPairResponse, size)
 	for i := range request {
+		s.fetchMetadata(keys[i], urlBatch[i])
+		if inserted[i] {
+			created[keys[i]] = gin.H{"original_url": originalBatch[i], "destination": urlBatch[i]}
+			createdKeys = append(createdKeys, keys[i])
+		}
 		response[i] = URLPairResponse{
 			CorrelationID: request[i].CorrelationID,
-			ShortURL:      fmt.Sprintf("%s/%s", s.serviceHost, urlBatch[i]),
+			ShortURL:      fmt.Sprintf("%s/%s", s.serviceHost, keys[i]),
 		}
 	}
-	ctx.Writer.Header().Set("Content-Type", "application/json")
+	s.audit(ctx, sessionID, storage.AuditBatchCreate, createdKeys, nil, created)
 	if len(response) == 0 {
-		ctx.JSON(http.StatusNoContent, response)
+		ctx.Status(http.StatusNoContent)
+		return
 	}
 	ctx.JSON(http.StatusCreated, response)
 }
 
 func (s *Server) redirect(ctx *gin.Context) {
 	key := ctx.Param("id")
+	preview := strings.HasSuffix(key, previewKeySuffix)
+	key = strings.TrimSuffix(key, previewKeySuffix)
 	baseURL, err := s.storage.GetURL(ctx.Request.Context(), key)
 	if err != nil {
-		ctx.String(http.StatusBadRequest, "Invalid key")
+		abortWithProblem(ctx, Problem{
+			Status:       http.StatusNotFound,
+			Code:         codeUnknownKey,
+			Detail:       "Invalid key",
+			legacyStatus: http.StatusBadRequest,
+		})
 		return
 	}
 
 	if baseURL.IsDeleted {
-		ctx.AbortWithStatus(http.StatusGone)
+		if legacyErrors(ctx) {
+			ctx.AbortWithStatus(http.StatusGone)
+			return
+		}
+		abortWithError(ctx, http.StatusGone, codeLinkDeleted, "Link deleted")
+		return
+	}
+	if baseURL.IsDisabled {
+		abortWithError(ctx, http.StatusGone, codeLinkDisabled, "Link disabled")
 		return
 	}
-	ctx.Redirect(http.StatusTemporaryRedirect, baseURL.Value)
+	destination := baseURL.Value
+	if target, ok := baseURL.Rules.Match(ctx.Request, time.Now()); ok {
+		destination = target
+	} else if len(baseURL.Variants) > 0 {
+		destination = s.pickVariant(ctx, key, baseURL.Variants)
+	}
+
+	segments, err := trailingSegments(ctx.Request.URL)
+	if err != nil {
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidPath, "Invalid path")
+		return
+	}
+	destination, err = routing.ExpandPath(destination, baseURL.PathMode, segments)
+	switch {
+	case errors.Is(err, routing.ErrUnexpectedPath):
+		abortWithError(ctx, http.StatusNotFound, codeInvalidPath, "Invalid path")
+		return
+	case errors.Is(err, routing.ErrMissingSegment):
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidPath, "Missing path segment")
+		return
+	}
+
+	passthrough := s.queryPassthrough
+	switch baseURL.QueryMode {
+	case routing.QueryMerge:
+		passthrough = true
+	case routing.QueryDrop:
+		passthrough = false
+	}
+	destination, err = routing.MergeQuery(destination, baseURL.UTM, ctx.Request.URL.Query(), passthrough)
+	if err != nil {
+		abortWithError(ctx, http.StatusInternalServerError, codeInternalError, "Invalid destination URL")
+		return
+	}
+
+	if preview {
+		s.renderPreview(ctx, key, destination, baseURL.Title, 0)
+		return
+	}
+	if baseURL.Interstitial {
+		s.renderPreview(ctx, key, destination, baseURL.Title, baseURL.Countdown)
+		return
+	}
+	ctx.Redirect(http.StatusTemporaryRedirect, destination)
+}
+
+func (s *Server) pickVariant(ctx *gin.Context, key string, variants routing.Variants) string {
+	cookieName := variantCookiePrefix + key
+	variant, ok := routing.Variant{}, false
+	if id, err := ctx.Cookie(cookieName); err == nil {
+		variant, ok = variants.Lookup(id)
+	}
+	if !ok {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(variants.TotalWeight())))
+		if err != nil {
+			n = big.NewInt(0)
+		}
+		variant = variants.Pick(int(n.Int64()))
+		ctx.SetCookie(cookieName, variant.ID(), variantCookieMaxAge, "/", "", s.sessions.secure, true)
+	}
+
+	if err := s.storage.AddVariantHit(ctx.Request.Context(), key, variant.Destination); err != nil {
+		log.Printf("unable to record variant hit for %s: %v", key, err)
+	}
+	return variant.Destination
 }
 
 func (s *Server) getUserURLs(ctx *gin.Context) {
@@ -366,21 +787,39 @@ func (s *Server) getUserURLs(ctx *gin.Context) {
 		return
 	}
 
-	urlMap, err := s.storage.GetUserURLs(ctx.Request.Context(), sessionID)
-	result := make([]URLPair, len(urlMap))
-	if len(result) < 1 || err != nil {
-		ctx.JSON(http.StatusNoContent, result)
+	rows, err := s.storage.GetUserURLs(ctx.Request.Context(), sessionID)
+	if err != nil && !legacyErrors(ctx) {
+		abortWithStorageError(ctx)
+		return
+	}
+	if len(rows) < 1 || err != nil {
+		ctx.Status(http.StatusNoContent)
+		return
+	}
+	result := make([]URLPair, len(rows))
+	for item := range rows {
+		result[item] = s.newURLPair(rows[item])
+	}
+	ctx.JSON(http.StatusOK, result)
+}
+
+func (s *Server) getBrokenURLs(ctx *gin.Context) {
+	sessionID, err := getUUID(ctx)
+	if err != nil {
+		return
+	}
+
+	rows, err := s.storage.GetUserURLs(ctx.Request.Context(), sessionID)
+	if err != nil {
+		abortWithStorageError(ctx)
 		return
 	}
-	item := 0
-	for key, url := range urlMap {
-		result[item] = URLPair{
-			OriginalURL: url,
-			ShortURL:    fmt.Sprintf("%s/%s", s.serviceHost, key),
+	result := make([]URLPair, 0)
+	for item := range rows {
+		if rows[item].IsBroken {
+			result = append(result, s.newURLPair(rows[item]))
 		}
-		item++
 	}
-	ctx.Writer.Header().Set("Content-Type", "application/json")
 	ctx.JSON(http.StatusOK, result)
 }
 
@@ -392,22 +831,241 @@ func (s *Server) deleteUserURLs(ctx *gin.Context) {
 
 	var keys []string
 	if err := json.NewDecoder(ctx.Request.Body).Decode(&keys); err != nil {
-		ctx.String(http.StatusBadRequest, "URL keys parse error")
+		abortWithProblem(ctx, Problem{
+			Status:     http.StatusBadRequest,
+			Code:       codeInvalidPayload,
+			Detail:     "URL keys parse error",
+			legacyText: true,
+		})
 		return
 	}
 	s.removalCh <- workers.RemovalTask{
-		Keys: keys,
-		UUID: sessionID,
+		Keys:      keys,
+		UUID:      sessionID,
+		ClientIP:  ctx.ClientIP(),
+		UserAgent: ctx.Request.UserAgent(),
 	}
 	ctx.Status(http.StatusAccepted)
 }
 
+func (s *Server) updateURLOptions(ctx *gin.Context) {
+	sessionID, err := getUUID(ctx)
+	if err != nil {
+		return
+	}
+
+	key := ctx.Param("id")
+	var payload URLOptionsRequest
+	if err := ctx.ShouldBindJSON(&payload); err != nil {
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidPayload, "Invalid payload")
+		return
+	}
+
+	row, ok := s.authorizeURL(ctx, key, sessionID, storage.RoleEditor)
+	if !ok {
+		return
+	}
+
+	opts := row.Options
+	if payload.Rules != nil {
+		if err := payload.Rules.Validate(); err != nil {
+			abortWithError(ctx, http.StatusBadRequest, codeInvalidOption, fmt.Sprintf("Invalid rules: %s", err))
+			return
+		}
+		for _, rule := range *payload.Rules {
+			if err := s.policy.Check(rule.Destination); err != nil {
+				abortWithPolicyError(ctx, err, "")
+				return
+			}
+		}
+		opts.Rules = *payload.Rules
+	}
+	if payload.Variants != nil {
+		if err := payload.Variants.Validate(); err != nil {
+			abortWithError(ctx, http.StatusBadRequest, codeInvalidOption, fmt.Sprintf("Invalid variants: %s", err))
+			return
+		}
+		for _, variant := range *payload.Variants {
+			if err := s.policy.Check(variant.Destination); err != nil {
+				abortWithPolicyError(ctx, err, "")
+				return
+			}
+		}
+		opts.Variants = *payload.Variants
+	}
+	if payload.QueryMode != nil {
+		if err := routing.ValidateQueryMode(*payload.QueryMode); err != nil {
+			abortWithError(ctx, http.StatusBadRequest, codeInvalidOption, fmt.Sprintf("Invalid query mode: %s", err))
+			return
+		}
+		opts.QueryMode = *payload.QueryMode
+	}
+	if payload.UTM != nil {
+		if err := payload.UTM.Validate(); err != nil {
+			abortWithError(ctx, http.StatusBadRequest, codeInvalidOption, fmt.Sprintf("Invalid UTM: %s", err))
+			return
+		}
+		opts.UTM = *payload.UTM
+	}
+	if payload.PathMode != nil {
+		if err := routing.ValidatePathMode(*payload.PathMode, linkDestinations(row.Value, opts)...); err != nil {
+			abortWithError(ctx, http.StatusBadRequest, codeInvalidOption, fmt.Sprintf("Invalid path mode: %s", err))
+			return
+		}
+		opts.PathMode = *payload.PathMode
+	}
+	if payload.Interstitial != nil {
+		opts.Interstitial = *payload.Interstitial
+	}
+	if payload.Countdown != nil {
+		if *payload.Countdown < 0 || *payload.Countdown > maxCountdown {
+			abortWithError(ctx, http.StatusBadRequest, codeInvalidOption, fmt.Sprintf("Invalid countdown: must be within 0..%d seconds", maxCountdown))
+			return
+		}
+		opts.Countdown = *payload.Countdown
+	}
+	if payload.Title != nil {
+		if utf8.RuneCountInString(*payload.Title) > maxTitleLength {
+			abortWithError(ctx, http.StatusBadRequest, codeInvalidOption, fmt.Sprintf("Invalid title: longer than %d characters", maxTitleLength))
+			return
+		}
+		opts.Title = strings.TrimSpace(*payload.Title)
+	}
+
+	if err := s.storage.SetURLOptions(ctx.Request.Context(), key, sessionID, opts); err != nil {
+		abortWithStorageError(ctx)
+		return
+	}
+	s.audit(ctx, sessionID, storage.AuditEdit, []string{key},
+		storage.AuditState{key: newURLOptions(row.Options)},
+		storage.AuditState{key: newURLOptions(opts)})
+	ctx.JSON(http.StatusOK, newURLOptions(opts))
+}
+
+func (s *Server) getVariantStats(ctx *gin.Context) {
+	sessionID, err := getUUID(ctx)
+	if err != nil {
+		return
+	}
+
+	key := ctx.Param("id")
+	row, ok := s.authorizeURL(ctx, key, sessionID, storage.RoleViewer)
+	if !ok {
+		return
+	}
+
+	hits, err := s.storage.GetVariantHits(ctx.Request.Context(), key)
+	if err != nil {
+		abortWithStorageError(ctx)
+		return
+	}
+	result := make([]VariantStats, len(row.Variants))
+	for i, variant := range row.Variants {
+		result[i] = VariantStats{
+			Destination: variant.Destination,
+			Weight:      variant.Weight,
+			Hits:        hits[variant.Destination],
+		}
+	}
+	ctx.JSON(http.StatusOK, result)
+}
+
 func (s *Server) pingDSN(ctx *gin.Context) {
 	ctx.Writer.Header().Set("Content-Type", "text/plain")
 	err := s.storage.Ping(ctx)
 	if err != nil {
-		ctx.String(http.StatusInternalServerError, "DSN out of service timeout")
+		abortWithProblem(ctx, Problem{
+			Status:       http.StatusServiceUnavailable,
+			Code:         codeStorageUnavailable,
+			Detail:       "DSN out of service timeout",
+			legacyStatus: http.StatusInternalServerError,
+		})
 		return
 	}
 	ctx.String(http.StatusOK, "OK")
 }
+
+// fetchMetadata queues the destination for the metadata worker. The task is
+// dropped when the queue is full, the create request never waits for it.
+func (s *Server) fetchMetadata(key string, destination string) {
+	if s.metadataCh == nil {
+		return
+	}
+	select {
+	case s.metadataCh <- workers.MetadataTask{Key: key, URL: destination}:
+	default:
+		log.Printf("metadata queue full, skipping %s", key)
+	}
+}
+
+func (s *Server) shortURL(key string) string {
+	return fmt.Sprintf("%s/%s", s.serviceHost, key)
+}
+
+func (s *Server) newURLPair(row storage.Row) URLPair {
+	pair := URLPair{
+		OriginalURL: row.DisplayValue(),
+		ShortURL:    s.shortURL(row.Key),
+		Title:       row.Title,
+		Description: row.PageDescription,
+		FaviconURL:  row.FaviconURL,
+		WorkspaceID: row.WorkspaceID,
+		Disabled:    row.IsDisabled,
+	}
+	if pair.Title == "" {
+		pair.Title = row.PageTitle
+	}
+	if row.LastCheckedAt != nil {
+		pair.Health = &URLHealth{
+			StatusCode: row.LastStatus,
+			CheckedAt:  *row.LastCheckedAt,
+			Broken:     row.IsBroken,
+		}
+	}
+	return pair
+}
+
+func newURLOptions(opts storage.Options) URLOptions {
+	rules := opts.Rules
+	if rules == nil {
+		rules = routing.Rules{}
+	}
+	variants := opts.Variants
+	if variants == nil {
+		variants = routing.Variants{}
+	}
+	utm := opts.UTM
+	if utm == nil {
+		utm = routing.UTM{}
+	}
+	return URLOptions{
+		Rules:        rules,
+		Variants:     variants,
+		QueryMode:    opts.QueryMode,
+		UTM:          utm,
+		PathMode:     opts.PathMode,
+		Interstitial: opts.Interstitial,
+		Countdown:    opts.Countdown,
+		Title:        opts.Title,
+	}
+}
+
+func linkDestinations(value string, opts storage.Options) []string {
+	destinations := []string{value}
+	for _, rule := range opts.Rules {
+		destinations = append(destinations, rule.Destination)
+	}
+	for _, variant := range opts.Variants {
+		destinations = append(destinations, variant.Destination)
+	}
+	return destinations
+}
+
+// trailingSegments returns the path segments following the short key.
+func trailingSegments(u *url.URL) ([]string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(u.EscapedPath(), "/"), "/", 2)
+	if len(parts) < 2 {
+		return nil, nil
+	}
+	return routing.SplitPath(parts[1])
+}
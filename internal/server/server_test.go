@@ -1,59 +1,152 @@
 package server
 
 import (
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/avtorsky/cuttlink/api/shortener"
+	"github.com/avtorsky/cuttlink/internal/certs"
+	"github.com/avtorsky/cuttlink/internal/metadata"
+	"github.com/avtorsky/cuttlink/internal/oidc"
+	"github.com/avtorsky/cuttlink/internal/oidc/oidctest"
+	"github.com/avtorsky/cuttlink/internal/openapi"
+	"github.com/avtorsky/cuttlink/internal/policy"
+	"github.com/avtorsky/cuttlink/internal/ratelimit"
+	"github.com/avtorsky/cuttlink/internal/routing"
 	"github.com/avtorsky/cuttlink/internal/storage"
+	"github.com/avtorsky/cuttlink/internal/workers"
+	"image/png"
 	"io"
+	"net"
 	"net/http"
 	"net/http/cookiejar"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	grpcmetadata "google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
 )
 
 type TestServer struct {
 	*httptest.Server
 	storage  storage.Storager
+	sessions *sessionManager
 	filename string
 }
 
-func NewTestServer(t *testing.T) TestServer {
+// developmentSessions lets test servers start without session secrets.
+var developmentSessions = WithSessions(SessionConfig{Development: true})
+
+func NewTestServer(t *testing.T, opts ...ServerOption) TestServer {
 	file, err := os.CreateTemp("", "cuttlink-test-*.txt")
 	assert.Nil(t, err)
 	tfs, _ := storage.NewFile(file.Name())
 	ls, _ := storage.NewFileStorage(tfs)
-	s, err := New(ls)
+	s, err := New(ls, append([]ServerOption{WithAuditLog(ls), developmentSessions}, opts...)...)
 	assert.Nil(t, err)
 	gin.ForceConsoleColor()
 	r := gin.New()
 	r.Use(
 		gin.Logger(),
 		gin.Recovery(),
+		errorFormat(s.legacyErrors),
 		compressMiddleware(),
-		decompressMiddleware(),
-		cookieAuthentication(),
+		bodyLimitMiddleware(s.httpConfig.MaxBodyBytes),
+		decompressMiddleware(s.httpConfig.MaxBodyBytes),
+		apiKeyAuthentication(s.storage),
+		s.sessionAuthentication(),
+		requestValidation(s.openapi),
 	)
-	r.GET("/:id", s.redirect)
-	r.POST("/", s.createShortURL)
-	r.POST("/form-submit", s.createShortURLWebForm)
-	r.POST("/api/shorten", s.createShortURLJSON)
-	r.GET("/api/user/urls", s.getUserURLs)
+	limitCreate := rateLimitMiddleware(s.limiters.create, nil)
+	limitRedirect := rateLimitMiddleware(s.limiters.redirect, nil)
+	scopeCreate := requireScope(ScopeCreate)
+	scopeRead := requireScope(ScopeRead)
+	scopeFull := requireScope(ScopeFull)
+	r.GET("/:id", limitRedirect, s.redirect)
+	r.GET("/:id/*path", limitRedirect, s.redirect)
+	r.POST("/", scopeCreate, limitCreate, s.createShortURL)
+	r.POST("/form-submit", scopeCreate, limitCreate, s.createShortURLWebForm)
+	r.POST("/api/shorten", scopeCreate, limitCreate, s.createShortURLJSON)
+	r.POST("/api/shorten/batch", scopeCreate, rateLimitMiddleware(s.limiters.batch, batchCost), s.createShortURLBatch)
+	r.GET("/api/user/urls", scopeRead, s.getUserURLs)
+	r.DELETE("/api/user/urls", scopeFull, rateLimitMiddleware(s.limiters.delete, nil), s.deleteUserURLs)
+	r.GET("/api/user/urls/broken", scopeRead, s.getBrokenURLs)
+	r.PATCH("/api/user/urls/:id", scopeFull, s.updateURLOptions)
+	r.GET("/api/user/urls/:id/variants", scopeRead, s.getVariantStats)
+	limitLogin := rateLimitMiddleware(s.limiters.login, nil)
+	r.POST("/api/user/register", limitLogin, s.register)
+	r.POST("/api/user/login", limitLogin, s.login)
+	r.POST("/api/user/logout", s.logout)
+	r.GET("/api/user/oidc/login", limitLogin, s.oidcLogin)
+	r.GET("/api/user/oidc/callback", limitLogin, s.oidcCallback)
+	r.POST("/api/user/keys", scopeFull, s.createAPIKey)
+	r.GET("/api/user/keys", scopeFull, s.getAPIKeys)
+	r.DELETE("/api/user/keys/:id", scopeFull, s.revokeAPIKey)
+	r.POST("/api/workspaces", scopeFull, s.createWorkspace)
+	r.GET("/api/workspaces", scopeRead, s.getWorkspaces)
+	r.GET("/api/workspaces/:id/members", scopeRead, s.getWorkspaceMembers)
+	r.POST("/api/workspaces/:id/members", scopeFull, s.setWorkspaceMember)
+	r.DELETE("/api/workspaces/:id/members/:user", scopeFull, s.removeWorkspaceMember)
+	r.POST("/api/workspaces/:id/urls", scopeFull, s.moveWorkspaceURLs)
+	r.POST("/api/user/transfers", scopeFull, s.createTransfer)
+	r.POST("/api/user/transfers/accept", scopeFull, s.acceptTransfer)
+	r.DELETE("/api/user/transfers/:id", scopeFull, s.cancelTransfer)
+	r.GET("/api/user/audit", scopeFull, s.getUserAudit)
+	admin := r.Group("/api/admin", s.adminAuthentication())
+	admin.GET("/urls", s.adminSearchURLs)
+	admin.GET("/urls/:id", s.adminGetURL)
+	admin.POST("/urls/:id/disable", s.adminDisableURL)
+	admin.POST("/urls/:id/enable", s.adminEnableURL)
+	admin.DELETE("/users/:id/urls", s.adminDeleteUserURLs)
+	admin.GET("/stats", s.adminStats)
+	r.GET("/api/qr/:id", scopeRead, limitRedirect, s.getQRCode)
+	r.POST("/api/qr/batch", scopeRead, rateLimitMiddleware(s.limiters.batch, batchCost), s.getQRCodeBatch)
+	r.GET("/api/openapi.json", s.getOpenAPI)
+	r.GET("/api/docs", s.getAPIDocs)
+	r.NoRoute(routeNotFound)
 	ts := httptest.NewServer(r)
 	srv := TestServer{
 		Server:   ts,
 		storage:  ls,
+		sessions: s.sessions,
 		filename: file.Name(),
 	}
 	return srv
 }
 
+// newToken issues a session old enough to get rate limit buckets of its own.
+func (s *TestServer) newToken(t *testing.T) string {
+	token, _, err := s.sessions.issueAt(uuid.New().String(), false, time.Now().Add(-12*time.Hour))
+	assert.Nil(t, err)
+	return token
+}
+
+func (s *TestServer) sessionID(t *testing.T, token string) string {
+	sess, err := s.sessions.parse(token)
+	assert.Nil(t, err)
+	return sess.ID
+}
+
 func (s *TestServer) Close() {
 	s.Server.Close()
 	os.Remove(s.filename)
@@ -113,10 +206,10 @@ func TestServer__createShortURLWebForm(t *testing.T) {
 			value:       "https://yatube.avtorskydeployed.online/",
 		},
 		{
-			name:        "post_invalid_content_type_500",
+			name:        "post_invalid_content_type_415",
 			method:      http.MethodPost,
 			contentType: "application/json",
-			code:        500,
+			code:        415,
 			key:         "url",
 			value:       "https://yatube.avtorskydeployed.online/",
 		},
@@ -199,10 +292,10 @@ func TestServer__createShortURLJSON(t *testing.T) {
 			result:      response{Result: ""},
 		},
 		{
-			name:        "post_invalid_content_type_500",
+			name:        "post_invalid_content_type_415",
 			method:      http.MethodPost,
 			contentType: "application/xml",
-			code:        500,
+			code:        415,
 			data:        request{URL: "https://yatube.avtorskydeployed.online/"},
 			result:      response{Result: ""},
 		},
@@ -233,7 +326,7 @@ func TestServer__redirect(t *testing.T) {
 	ts := NewTestServer(t)
 	defer ts.Close()
 	baseURL := "https://yatube.avtorskydeployed.online"
-	key, err := ts.storage.SetURL(context.Background(), baseURL, "6a15c16b-b941-48b3-be78-8e539838d612")
+	key, err := ts.storage.SetURL(context.Background(), baseURL, "", "6a15c16b-b941-48b3-be78-8e539838d612")
 	assert.Nil(t, err)
 	client := http.Client{}
 	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
@@ -254,9 +347,9 @@ func TestServer__redirect(t *testing.T) {
 			location: baseURL,
 		},
 		{
-			name:     "get_invalid_key_400",
+			name:     "get_invalid_key_404",
 			method:   http.MethodGet,
-			code:     400,
+			code:     404,
 			shortURL: "/ID",
 			location: "",
 		},
@@ -340,7 +433,2265 @@ func TestServer__getUserURLs(t *testing.T) {
 	}
 
 	res, err = client.Get(aURL)
-	assert.Equal(http.StatusNoContent, res.StatusCode, "invalid http status code")
 	assert.Nil(err)
+	assert.Equal(http.StatusOK, res.StatusCode, "cookie session should list its URLs")
+	defer res.Body.Close()
+	listed := make([]row, 0)
+	assert.Nil(json.NewDecoder(res.Body).Decode(&listed))
+	assert.Equal(tests, listed)
+}
+
+func TestServer__redirectRules(t *testing.T) {
+	ts := NewTestServer(t)
+	defer ts.Close()
+	client := http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	assert := assert.New(t)
+	baseURL := "https://yatube.avtorskydeployed.online/"
+	token := ts.newToken(t)
+	sessionID := ts.sessionID(t, token)
+	key, err := ts.storage.SetURL(context.Background(), baseURL, "", sessionID)
+	assert.Nil(err)
+
+	rules := `{"rules":[
+		{"device":"ios","destination":"https://apps.apple.com/app/cuttlink"},
+		{"device":"android","language":"de","destination":"https://play.google.com/store?hl=de"},
+		{"device":"android","destination":"https://play.google.com/store"}
+	]}`
+	optsURL := fmt.Sprintf("%s/api/user/urls/%s", ts.URL, key)
+	optsTests := []struct {
+		name  string
+		token string
+		data  string
+		code  int
+	}{
+		{
+			name:  "patch_ok_200",
+			token: token,
+			data:  rules,
+			code:  200,
+		},
+		{
+			name:  "patch_invalid_device_400",
+			token: token,
+			data:  `{"rules":[{"device":"tv","destination":"https://example.com"}]}`,
+			code:  400,
+		},
+		{
+			name:  "patch_foreign_key_403",
+			token: ts.newToken(t),
+			data:  rules,
+			code:  403,
+		},
+	}
+	for _, tt := range optsTests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodPatch, optsURL, bytes.NewBufferString(tt.data))
+			req.Header.Set("Content-Type", "application/json")
+			req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: tt.token})
+			res, err := client.Do(req)
+			assert.Nil(err)
+			assert.Equal(tt.code, res.StatusCode, "http status codes should be equal")
+			defer res.Body.Close()
+		})
+	}
+
+	tests := []struct {
+		name      string
+		userAgent string
+		language  string
+		location  string
+	}{
+		{
+			name:      "ios",
+			userAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 16_3 like Mac OS X)",
+			location:  "https://apps.apple.com/app/cuttlink",
+		},
+		{
+			name:      "android_de",
+			userAgent: "Mozilla/5.0 (Linux; Android 13; Pixel 7)",
+			language:  "de-DE,de;q=0.9",
+			location:  "https://play.google.com/store?hl=de",
+		},
+		{
+			name:      "android",
+			userAgent: "Mozilla/5.0 (Linux; Android 13; Pixel 7)",
+			language:  "en-US",
+			location:  "https://play.google.com/store",
+		},
+		{
+			name:      "desktop_fallback",
+			userAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:109.0)",
+			location:  baseURL,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/%s", ts.URL, key), nil)
+			req.Header.Set("User-Agent", tt.userAgent)
+			req.Header.Set("Accept-Language", tt.language)
+			res, err := client.Do(req)
+			assert.Nil(err)
+			assert.Equal(http.StatusTemporaryRedirect, res.StatusCode, "http status codes should be equal")
+			assert.Equal(tt.location, res.Header.Get("Location"), "locations should be equal")
+			defer res.Body.Close()
+		})
+	}
+}
+
+func TestServer__redirectVariants(t *testing.T) {
+	ts := NewTestServer(t)
+	defer ts.Close()
+	client := http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	assert := assert.New(t)
+	token := ts.newToken(t)
+	sessionID := ts.sessionID(t, token)
+	key, err := ts.storage.SetURL(context.Background(), "https://yatube.avtorskydeployed.online/", "", sessionID)
+	assert.Nil(err)
+	variants := routing.Variants{
+		{Destination: "https://a.avtorskydeployed.online/", Weight: 70},
+		{Destination: "https://b.avtorskydeployed.online/", Weight: 30},
+	}
+	err = ts.storage.SetURLOptions(context.Background(), key, sessionID, storage.Options{Variants: variants})
+	assert.Nil(err)
+
+	shortURL := fmt.Sprintf("%s/%s", ts.URL, key)
+	res, err := client.Get(shortURL)
+	assert.Nil(err)
+	assert.Equal(http.StatusTemporaryRedirect, res.StatusCode, "http status codes should be equal")
+	location := res.Header.Get("Location")
+	assert.Contains([]string{variants[0].Destination, variants[1].Destination}, location)
+	var sticky *http.Cookie
+	for _, c := range res.Cookies() {
+		if c.Name == variantCookiePrefix+key {
+			sticky = c
+		}
+	}
+	assert.NotNil(sticky, "variant cookie should be set")
+	res.Body.Close()
+
+	for i := 0; i < 5; i++ {
+		req, _ := http.NewRequest(http.MethodGet, shortURL, nil)
+		req.AddCookie(sticky)
+		res, err := client.Do(req)
+		assert.Nil(err)
+		assert.Equal(location, res.Header.Get("Location"), "sticky variant should be served")
+		res.Body.Close()
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/api/user/urls/%s/variants", ts.URL, key), nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: token})
+	res, err = client.Do(req)
+	assert.Nil(err)
+	assert.Equal(http.StatusOK, res.StatusCode, "http status codes should be equal")
+	defer res.Body.Close()
+	stats := make([]VariantStats, 0)
+	assert.Nil(json.NewDecoder(res.Body).Decode(&stats))
+	assert.Len(stats, 2)
+	hits := make(map[string]int64)
+	for _, item := range stats {
+		hits[item.Destination] = item.Hits
+	}
+	assert.Equal(int64(6), hits[location], "every redirect should be counted")
+
+	tfs, err := storage.NewFile(ts.filename)
+	assert.Nil(err)
+	replayed, err := storage.NewFileStorage(tfs)
+	assert.Nil(err)
+	unflushed, err := replayed.GetVariantHits(context.Background(), key)
+	assert.Nil(err)
+	assert.Zero(unflushed[location], "hits should not be written on every redirect")
+	assert.Nil(tfs.CloseFS())
+
+	assert.Nil(ts.storage.Close())
+	tfs, err = storage.NewFile(ts.filename)
+	assert.Nil(err)
+	defer tfs.CloseFS()
+	replayed, err = storage.NewFileStorage(tfs)
+	assert.Nil(err)
+	flushed, err := replayed.GetVariantHits(context.Background(), key)
+	assert.Nil(err)
+	assert.Equal(int64(6), flushed[location], "hits should be written on close")
+}
+
+func TestServer__redirectQuery(t *testing.T) {
+	ts := NewTestServer(t)
+	defer ts.Close()
+	client := http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	sessionID := "6a15c16b-b941-48b3-be78-8e539838d612"
+	baseURL := "https://yatube.avtorskydeployed.online/?lang=ru"
+	tests := []struct {
+		name     string
+		opts     storage.Options
+		query    string
+		location string
+	}{
+		{
+			name:     "default_drop",
+			query:    "?ref=newsletter",
+			location: baseURL,
+		},
+		{
+			name:     "merge",
+			opts:     storage.Options{QueryMode: routing.QueryMerge},
+			query:    "?ref=newsletter&lang=en",
+			location: "https://yatube.avtorskydeployed.online/?lang=ru&ref=newsletter",
+		},
+		{
+			name:     "utm",
+			opts:     storage.Options{UTM: routing.UTM{"utm_source": "qr", "utm_medium": "print"}},
+			query:    "?ref=newsletter",
+			location: "https://yatube.avtorskydeployed.online/?lang=ru&utm_medium=print&utm_source=qr",
+		},
+		{
+			name: "utm_and_merge",
+			opts: storage.Options{
+				QueryMode: routing.QueryMerge,
+				UTM:       routing.UTM{"utm_source": "qr"},
+			},
+			query:    "?utm_source=visitor&ref=newsletter",
+			location: "https://yatube.avtorskydeployed.online/?lang=ru&ref=newsletter&utm_source=qr",
+		},
+	}
+	key, err := ts.storage.SetURL(context.Background(), baseURL, "", sessionID)
+	assert.Nil(t, err)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Nil(t, ts.storage.SetURLOptions(context.Background(), key, sessionID, tt.opts))
+			res, err := client.Get(fmt.Sprintf("%s/%s%s", ts.URL, key, tt.query))
+			assert.Nil(t, err)
+			assert.Equal(t, http.StatusTemporaryRedirect, res.StatusCode, "http status codes should be equal")
+			assert.Equal(t, tt.location, res.Header.Get("Location"), "locations should be equal")
+			defer res.Body.Close()
+		})
+	}
+}
+
+func TestServer__redirectPath(t *testing.T) {
+	ts := NewTestServer(t)
+	defer ts.Close()
+	client := http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	token := ts.newToken(t)
+	sessionID := ts.sessionID(t, token)
+	tests := []struct {
+		name     string
+		baseURL  string
+		mode     string
+		path     string
+		code     int
+		location string
+	}{
+		{
+			name:     "template_ok_307",
+			baseURL:  "https://jira.avtorskydeployed.online/browse/{1}",
+			mode:     "template",
+			path:     "/PROJ-123",
+			code:     307,
+			location: "https://jira.avtorskydeployed.online/browse/PROJ-123",
+		},
+		{
+			name:     "template_escaped_ok_307",
+			baseURL:  "https://jira.avtorskydeployed.online/search?q={1}",
+			mode:     "template",
+			path:     "/a%26b",
+			code:     307,
+			location: "https://jira.avtorskydeployed.online/search?q=a%26b",
+		},
+		{
+			name:    "template_missing_segment_400",
+			baseURL: "https://jira.avtorskydeployed.online/issues/{1}",
+			mode:    "template",
+			path:    "",
+			code:    400,
+		},
+		{
+			name:     "prefix_ok_307",
+			baseURL:  "https://yatube.avtorskydeployed.online/group",
+			mode:     "prefix",
+			path:     "/cats/posts",
+			code:     307,
+			location: "https://yatube.avtorskydeployed.online/group/cats/posts",
+		},
+		{
+			name:    "exact_trailing_path_404",
+			baseURL: "https://yatube.avtorskydeployed.online/",
+			mode:    "",
+			path:    "/cats",
+			code:    404,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := ts.storage.SetURL(context.Background(), tt.baseURL, "", sessionID)
+			assert.Nil(t, err)
+
+			data := fmt.Sprintf(`{"path_mode":"%s"}`, tt.mode)
+			req, _ := http.NewRequest(http.MethodPatch, fmt.Sprintf("%s/api/user/urls/%s", ts.URL, key), bytes.NewBufferString(data))
+			req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: token})
+			res, err := client.Do(req)
+			assert.Nil(t, err)
+			assert.Equal(t, http.StatusOK, res.StatusCode, "http status codes should be equal")
+			res.Body.Close()
+
+			res, err = client.Get(fmt.Sprintf("%s/%s%s", ts.URL, key, tt.path))
+			assert.Nil(t, err)
+			assert.Equal(t, tt.code, res.StatusCode, "http status codes should be equal")
+			assert.Equal(t, tt.location, res.Header.Get("Location"), "locations should be equal")
+			defer res.Body.Close()
+		})
+	}
+}
+
+func TestServer__getQRCode(t *testing.T) {
+	ts := NewTestServer(t)
+	defer ts.Close()
+	key, err := ts.storage.SetURL(context.Background(), "https://yatube.avtorskydeployed.online/", "", "6a15c16b-b941-48b3-be78-8e539838d612")
+	assert.Nil(t, err)
+	client := http.Client{}
+	tests := []struct {
+		name        string
+		path        string
+		code        int
+		contentType string
+	}{
+		{
+			name:        "get_png_ok_200",
+			path:        fmt.Sprintf("/api/qr/%s?size=300&level=H&margin=2", key),
+			code:        200,
+			contentType: "image/png",
+		},
+		{
+			name:        "get_svg_ok_200",
+			path:        fmt.Sprintf("/api/qr/%s?format=svg", key),
+			code:        200,
+			contentType: "image/svg+xml",
+		},
+		{
+			name: "get_invalid_format_400",
+			path: fmt.Sprintf("/api/qr/%s?format=gif", key),
+			code: 400,
+		},
+		{
+			name: "get_invalid_level_400",
+			path: fmt.Sprintf("/api/qr/%s?level=X", key),
+			code: 400,
+		},
+		{
+			name: "get_size_too_large_400",
+			path: fmt.Sprintf("/api/qr/%s?size=2048", key),
+			code: 400,
+		},
+		{
+			name: "get_invalid_key_404",
+			path: "/api/qr/ID",
+			code: 404,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := client.Get(fmt.Sprintf("%s%s", ts.URL, tt.path))
+			assert.Nil(t, err)
+			assert.Equal(t, tt.code, res.StatusCode, "http status codes should be equal")
+			defer res.Body.Close()
+
+			if tt.code == http.StatusOK {
+				assert.Equal(t, tt.contentType, res.Header.Get("Content-Type"), "content types should be equal")
+			}
+			if tt.contentType == "image/png" {
+				img, err := png.Decode(res.Body)
+				assert.Nil(t, err)
+				assert.Equal(t, 300, img.Bounds().Dx(), "image sizes should be equal")
+			}
+		})
+	}
+
+	res, err := client.Post(fmt.Sprintf("%s/api/qr/batch?format=svg", ts.URL), "application/json", bytes.NewBufferString(fmt.Sprintf(`["%s"]`, key)))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode, "http status codes should be equal")
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	assert.Nil(t, err)
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	assert.Nil(t, err)
+	assert.Len(t, archive.File, 1)
+	assert.Equal(t, fmt.Sprintf("%s.svg", key), archive.File[0].Name)
+
+	res, err = client.Post(fmt.Sprintf("%s/api/qr/batch", ts.URL), "application/json", bytes.NewBufferString(`["ID"]`))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode, "http status codes should be equal")
+	defer res.Body.Close()
+
+	keys := make([]string, qrBatchMaxKeys+1)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	payload, err := json.Marshal(keys)
+	assert.Nil(t, err)
+	res, err = client.Post(fmt.Sprintf("%s/api/qr/batch", ts.URL), "application/json", bytes.NewReader(payload))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode, "batches above the cap should be rejected")
 	defer res.Body.Close()
+
+	deleted, err := ts.storage.SetURL(context.Background(), "https://yatube.avtorskydeployed.online/deleted", "", "6a15c16b-b941-48b3-be78-8e539838d612")
+	assert.Nil(t, err)
+	assert.Nil(t, ts.storage.UpdateBatchURL(context.Background(), workers.RemovalTask{Keys: []string{deleted}, UUID: "6a15c16b-b941-48b3-be78-8e539838d612"}))
+	res, err = client.Get(fmt.Sprintf("%s/api/qr/%s", ts.URL, deleted))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusGone, res.StatusCode, "http status codes should be equal")
+	defer res.Body.Close()
+	res, err = client.Post(fmt.Sprintf("%s/api/qr/batch?format=svg", ts.URL), "application/json", bytes.NewBufferString(fmt.Sprintf(`["%s","%s"]`, key, deleted)))
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode, "http status codes should be equal")
+	defer res.Body.Close()
+	data, err = io.ReadAll(res.Body)
+	assert.Nil(t, err)
+	archive, err = zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	assert.Nil(t, err)
+	assert.Len(t, archive.File, 1, "deleted links should be skipped")
+	assert.Equal(t, fmt.Sprintf("%s.svg", key), archive.File[0].Name)
+}
+
+func TestServer__redirectPreview(t *testing.T) {
+	ts := NewTestServer(t)
+	defer ts.Close()
+	client := http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	sessionID := "6a15c16b-b941-48b3-be78-8e539838d612"
+	baseURL := "https://yatube.avtorskydeployed.online/group/cats"
+	plainKey, err := ts.storage.SetURL(context.Background(), baseURL, "", sessionID)
+	assert.Nil(t, err)
+	assert.Nil(t, ts.storage.SetURLOptions(context.Background(), plainKey, sessionID, storage.Options{Title: "Cats <3"}))
+	interstitialKey, err := ts.storage.SetURL(context.Background(), baseURL+"?from=qr", "", sessionID)
+	assert.Nil(t, err)
+	opts := storage.Options{Interstitial: true, Countdown: 5}
+	assert.Nil(t, ts.storage.SetURLOptions(context.Background(), interstitialKey, sessionID, opts))
+
+	tests := []struct {
+		name      string
+		path      string
+		code      int
+		contains  []string
+		countdown bool
+	}{
+		{
+			name: "plain_redirect_307",
+			path: fmt.Sprintf("/%s", plainKey),
+			code: 307,
+		},
+		{
+			name:     "preview_suffix_200",
+			path:     fmt.Sprintf("/%s+", plainKey),
+			code:     200,
+			contains: []string{baseURL, "yatube.avtorskydeployed.online", "Cats &lt;3", "Continue"},
+		},
+		{
+			name:      "interstitial_flag_200",
+			path:      fmt.Sprintf("/%s", interstitialKey),
+			code:      200,
+			contains:  []string{baseURL, `http-equiv="refresh"`},
+			countdown: true,
+		},
+		{
+			name:     "interstitial_preview_suffix_200",
+			path:     fmt.Sprintf("/%s+", interstitialKey),
+			code:     200,
+			contains: []string{baseURL},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := client.Get(fmt.Sprintf("%s%s", ts.URL, tt.path))
+			assert.Nil(t, err)
+			assert.Equal(t, tt.code, res.StatusCode, "http status codes should be equal")
+			defer res.Body.Close()
+			data, err := io.ReadAll(res.Body)
+			assert.Nil(t, err)
+			body := string(data)
+			for _, item := range tt.contains {
+				assert.Contains(t, body, item)
+			}
+			if tt.code == http.StatusOK {
+				assert.Equal(t, tt.countdown, strings.Contains(body, `http-equiv="refresh"`), "countdown presence should be equal")
+			}
+		})
+	}
+}
+
+func TestServer__createShortURLPolicy(t *testing.T) {
+	block := true
+	engine, err := policy.NewEngine(policy.Policy{
+		Deny:                 []policy.Rule{{Name: "no-explorer", Pattern: "explorer.avtorskydeployed.online"}},
+		BlockPrivateNetworks: &block,
+	})
+	assert.Nil(t, err)
+	ts := NewTestServer(t, WithPolicy(engine))
+	defer ts.Close()
+	client := http.Client{}
+
+	type violation struct {
+		Message   string           `json:"message"`
+		Violation policy.Violation `json:"violation"`
+	}
+
+	tests := []struct {
+		name        string
+		path        string
+		contentType string
+		data        string
+		code        int
+		rule        string
+	}{
+		{
+			name:        "json_ok_201",
+			path:        "/api/shorten",
+			contentType: "application/json",
+			data:        `{"url": "https://yatube.avtorskydeployed.online/"}`,
+			code:        201,
+		},
+		{
+			name:        "json_denylist_422",
+			path:        "/api/shorten",
+			contentType: "application/json",
+			data:        `{"url": "https://explorer.avtorskydeployed.online/"}`,
+			code:        422,
+			rule:        "no-explorer",
+		},
+		{
+			name:        "json_private_network_422",
+			path:        "/api/shorten",
+			contentType: "application/json",
+			data:        `{"url": "http://192.168.1.1/admin"}`,
+			code:        422,
+			rule:        policy.RulePrivateNetwork,
+		},
+		{
+			name:        "text_denylist_422",
+			path:        "/",
+			contentType: "text/plain; charset=utf-8",
+			data:        "https://explorer.avtorskydeployed.online/",
+			code:        422,
+		},
+		{
+			name:        "form_private_network_422",
+			path:        "/form-submit",
+			contentType: "application/x-www-form-urlencoded",
+			data:        "url=http%3A%2F%2F127.0.0.1%2F",
+			code:        422,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := client.Post(fmt.Sprintf("%s%s", ts.URL, tt.path), tt.contentType, bytes.NewBufferString(tt.data))
+			assert.Nil(t, err)
+			assert.Equal(t, tt.code, res.StatusCode, "http status codes should be equal")
+			defer res.Body.Close()
+
+			if tt.rule != "" {
+				body := violation{}
+				assert.Nil(t, json.NewDecoder(res.Body).Decode(&body))
+				assert.Equal(t, tt.rule, body.Violation.Rule, "violated rules should be equal")
+			}
+		})
+	}
+}
+
+func TestServer__createShortURLCanonical(t *testing.T) {
+	ts := NewTestServer(t)
+	defer ts.Close()
+	client := http.Client{}
+	token := ts.newToken(t)
+	rURL := fmt.Sprintf("%s/api/shorten", ts.URL)
+	tests := []struct {
+		name string
+		url  string
+		code int
+	}{
+		{
+			name: "post_ok_201",
+			url:  "https://Yatube.avtorskydeployed.online:443/posts?b=1&a=2#comments",
+			code: 201,
+		},
+		{
+			name: "post_equivalent_409",
+			url:  "https://yatube.avtorskydeployed.online/posts?a=2&b=1&fbclid=xyz",
+			code: 409,
+		},
+	}
+	shortURLs := make([]string, 0)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(PayloadJSON{URL: tt.url})
+			assert.Nil(t, err)
+			req, _ := http.NewRequest(http.MethodPost, rURL, bytes.NewBuffer(data))
+			req.Header.Set("Content-Type", "application/json")
+			req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: token})
+			res, err := client.Do(req)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.code, res.StatusCode, "http status codes should be equal")
+			defer res.Body.Close()
+			body := ResponseJSON{}
+			assert.Nil(t, json.NewDecoder(res.Body).Decode(&body))
+			shortURLs = append(shortURLs, body.Result)
+		})
+	}
+	assert.Equal(t, shortURLs[0], shortURLs[1], "equivalent URLs should share a key")
+
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	key := shortURLs[0][strings.LastIndex(shortURLs[0], "/")+1:]
+	res, err := client.Get(fmt.Sprintf("%s/%s", ts.URL, key))
+	assert.Nil(t, err)
+	assert.Equal(t, "https://yatube.avtorskydeployed.online/posts?a=2&b=1", res.Header.Get("Location"))
+	res.Body.Close()
+
+	rows, err := ts.storage.GetUserURLs(context.Background(), ts.sessionID(t, token))
+	assert.Nil(t, err)
+	assert.Len(t, rows, 1)
+	assert.Equal(t, key, rows[0].Key)
+	assert.Equal(t, tests[0].url, rows[0].DisplayValue(), "original input should be kept for display")
+}
+
+func TestServer__getBrokenURLs(t *testing.T) {
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer destination.Close()
+	ts := NewTestServer(t)
+	defer ts.Close()
+	token := ts.newToken(t)
+	sessionID := ts.sessionID(t, token)
+	_, err := ts.storage.SetURL(context.Background(), destination.URL+"/ok", "", sessionID)
+	assert.Nil(t, err)
+	brokenKey, err := ts.storage.SetURL(context.Background(), destination.URL+"/gone", "", sessionID)
+	assert.Nil(t, err)
+
+	worker := workers.NewHealthWorker(ts.storage, workers.HealthConfig{Interval: time.Hour, Concurrency: 2})
+	worker.RunOnce(context.Background())
+
+	client := http.Client{}
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/api/user/urls", ts.URL), nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: token})
+	res, err := client.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode, "http status codes should be equal")
+	defer res.Body.Close()
+	pairs := make([]URLPair, 0)
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&pairs))
+	assert.Len(t, pairs, 2)
+	for _, pair := range pairs {
+		assert.NotNil(t, pair.Health, "health should be exposed")
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, fmt.Sprintf("%s/api/user/urls/broken", ts.URL), nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: token})
+	res, err = client.Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode, "http status codes should be equal")
+	defer res.Body.Close()
+	broken := make([]URLPair, 0)
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&broken))
+	assert.Len(t, broken, 1)
+	assert.Equal(t, fmt.Sprintf("http://localhost:8080/%s", brokenKey), broken[0].ShortURL)
+	assert.Equal(t, http.StatusGone, broken[0].Health.StatusCode)
+	assert.True(t, broken[0].Health.Broken)
+}
+
+type failingFetcher struct{}
+
+func (failingFetcher) Fetch(ctx context.Context, rawURL string) (metadata.Metadata, error) {
+	return metadata.Metadata{}, errors.New("unreachable")
+}
+
+func TestServer__fetchMetadata(t *testing.T) {
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, `<html><head><title>Raw title</title>
+			<meta property="og:title" content="Readable title">
+			<meta property="og:description" content="Page summary">
+			<link rel="icon" href="/icon.svg"></head></html>`)
+	}))
+	defer destination.Close()
+
+	create := func(t *testing.T, ts TestServer, token string, target string) {
+		req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/api/shorten", ts.URL), strings.NewReader(fmt.Sprintf(`{"url":"%s"}`, target)))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: token})
+		res, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		defer res.Body.Close()
+		assert.Equal(t, http.StatusCreated, res.StatusCode, "http status codes should be equal")
+	}
+	list := func(t *testing.T, ts TestServer, token string) []URLPair {
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/api/user/urls", ts.URL), nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: token})
+		res, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		defer res.Body.Close()
+		pairs := make([]URLPair, 0)
+		json.NewDecoder(res.Body).Decode(&pairs)
+		return pairs
+	}
+
+	t.Run("fetched metadata is listed", func(t *testing.T) {
+		ts := NewTestServer(t, WithMetadataFetcher(metadata.NewHTTPFetcher(metadata.HTTPFetcherConfig{})))
+		defer ts.Close()
+		token := ts.newToken(t)
+		create(t, ts, token, destination.URL+"/article")
+
+		var pairs []URLPair
+		assert.Eventually(t, func() bool {
+			pairs = list(t, ts, token)
+			return len(pairs) == 1 && pairs[0].Title != ""
+		}, 2*time.Second, 20*time.Millisecond)
+		assert.Equal(t, "Readable title", pairs[0].Title)
+		assert.Equal(t, "Page summary", pairs[0].Description)
+		assert.Equal(t, destination.URL+"/icon.svg", pairs[0].FaviconURL)
+	})
+
+	t.Run("fetch failure keeps the link", func(t *testing.T) {
+		ts := NewTestServer(t, WithMetadataFetcher(failingFetcher{}))
+		defer ts.Close()
+		token := ts.newToken(t)
+		create(t, ts, token, destination.URL+"/unreachable")
+
+		pairs := list(t, ts, token)
+		assert.Len(t, pairs, 1)
+		assert.Equal(t, "", pairs[0].Title)
+	})
+}
+
+func TestServer__rateLimit(t *testing.T) {
+	ts := NewTestServer(t, WithRateLimits(RateLimits{
+		Create: ratelimit.Limit{Rate: 1, Period: time.Hour, Burst: 2},
+		Batch:  ratelimit.Limit{Rate: 1, Period: time.Hour, Burst: 3},
+	}))
+	defer ts.Close()
+	client := http.Client{}
+	shorten := func(token string, n int) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/api/shorten", ts.URL), strings.NewReader(fmt.Sprintf(`{"url":"https://example.com/rate/%s/%d"}`, token, n)))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: token})
+		}
+		res, err := client.Do(req)
+		assert.Nil(t, err)
+		res.Body.Close()
+		return res
+	}
+
+	token := ts.newToken(t)
+	for i := 0; i < 2; i++ {
+		res := shorten(token, i)
+		assert.Equal(t, http.StatusCreated, res.StatusCode, "http status codes should be equal")
+		assert.Equal(t, "2", res.Header.Get("RateLimit-Limit"))
+		assert.Equal(t, fmt.Sprint(1-i), res.Header.Get("RateLimit-Remaining"))
+	}
+	res := shorten(token, 2)
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode, "http status codes should be equal")
+	assert.Equal(t, "3600", res.Header.Get("Retry-After"))
+	assert.Equal(t, "0", res.Header.Get("RateLimit-Remaining"))
+
+	other := ts.newToken(t)
+	assert.Equal(t, http.StatusCreated, shorten(other, 0).StatusCode, "sessions should have separate buckets")
+
+	assert.Equal(t, http.StatusCreated, shorten("", 0).StatusCode)
+	assert.Equal(t, http.StatusCreated, shorten("", 1).StatusCode)
+	assert.Equal(t, http.StatusTooManyRequests, shorten("", 2).StatusCode, "anonymous requests should share the IP bucket")
+	for i := 0; i < 3; i++ {
+		res, err := client.Get(fmt.Sprintf("%s/api/openapi.json", ts.URL))
+		assert.Nil(t, err)
+		res.Body.Close()
+		var fresh string
+		for _, c := range res.Cookies() {
+			if c.Name == sessionCookieName {
+				fresh = c.Value
+			}
+		}
+		assert.NotEmpty(t, fresh)
+		assert.Equal(t, http.StatusTooManyRequests, shorten(fresh, 3+i).StatusCode, "fresh cookies should share the IP bucket")
+	}
+
+	batch := func(token string, n int) *http.Response {
+		items := make([]URLPairRequest, n)
+		for i := range items {
+			items[i] = URLPairRequest{CorrelationID: fmt.Sprint(i), OriginalURL: fmt.Sprintf("https://example.com/rate/batch/%d/%d", n, i)}
+		}
+		body, _ := json.Marshal(items)
+		req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/api/shorten/batch", ts.URL), bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: token})
+		res, err := client.Do(req)
+		assert.Nil(t, err)
+		res.Body.Close()
+		return res
+	}
+	assert.Equal(t, http.StatusCreated, batch(token, 2).StatusCode)
+	assert.Equal(t, http.StatusTooManyRequests, batch(token, 2).StatusCode, "batch should be weighted by size")
+	assert.Equal(t, http.StatusCreated, batch(other, 4).StatusCode, "batch above the burst should take the whole burst")
+	res = batch(other, 1)
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode, "http status codes should be equal")
+	assert.Equal(t, "3600", res.Header.Get("Retry-After"))
+}
+
+func TestServer__apiKeys(t *testing.T) {
+	ts := NewTestServer(t)
+	defer ts.Close()
+	client := http.Client{}
+	token := ts.newToken(t)
+	sessionID := ts.sessionID(t, token)
+	do := func(method string, path string, body string, auth func(req *http.Request)) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		auth(req)
+		res, err := client.Do(req)
+		assert.Nil(t, err)
+		return res
+	}
+	cookie := func(req *http.Request) {
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: token})
+	}
+	bearer := func(key string) func(req *http.Request) {
+		return func(req *http.Request) {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+	}
+	createKey := func(scope string) APIKeyResponse {
+		res := do(http.MethodPost, "/api/user/keys", fmt.Sprintf(`{"name":"ci","scope":"%s"}`, scope), cookie)
+		defer res.Body.Close()
+		assert.Equal(t, http.StatusCreated, res.StatusCode, "http status codes should be equal")
+		var key APIKeyResponse
+		assert.Nil(t, json.NewDecoder(res.Body).Decode(&key))
+		return key
+	}
+
+	full := createKey("")
+	assert.Equal(t, ScopeFull, full.Scope)
+	assert.True(t, strings.HasPrefix(full.Key, full.Prefix))
+	createOnly := createKey(ScopeCreate)
+	readOnly := createKey(ScopeRead)
+
+	res := do(http.MethodPost, "/api/shorten", `{"url":"https://example.com/api-key"}`, bearer(createOnly.Key))
+	res.Body.Close()
+	assert.Equal(t, http.StatusCreated, res.StatusCode, "http status codes should be equal")
+	assert.Empty(t, res.Header.Values("Set-Cookie"), "bearer requests should not get a session cookie")
+	rows, err := ts.storage.GetUserURLs(context.Background(), sessionID)
+	assert.Nil(t, err)
+	assert.Len(t, rows, 1, "link should belong to the key owner")
+
+	res = do(http.MethodGet, "/api/user/urls", "", bearer(createOnly.Key))
+	res.Body.Close()
+	assert.Equal(t, http.StatusForbidden, res.StatusCode, "http status codes should be equal")
+
+	res = do(http.MethodGet, "/api/user/urls", "", bearer(readOnly.Key))
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode, "http status codes should be equal")
+	res = do(http.MethodPost, "/api/shorten", `{"url":"https://example.com/api-key/read"}`, bearer(readOnly.Key))
+	res.Body.Close()
+	assert.Equal(t, http.StatusForbidden, res.StatusCode, "http status codes should be equal")
+
+	for _, key := range []APIKeyResponse{createOnly, readOnly} {
+		want := http.StatusOK
+		if key.Scope == ScopeCreate {
+			want = http.StatusForbidden
+		}
+		res = do(http.MethodGet, "/api/qr/"+rows[0].Key, "", bearer(key.Key))
+		res.Body.Close()
+		assert.Equal(t, want, res.StatusCode, "QR codes should need the read scope")
+		res = do(http.MethodPost, "/api/qr/batch", fmt.Sprintf(`["%s"]`, rows[0].Key), bearer(key.Key))
+		res.Body.Close()
+		assert.Equal(t, want, res.StatusCode, "QR batches should need the read scope")
+	}
+
+	res = do(http.MethodGet, "/api/user/keys", "", bearer(full.Key))
+	keys := make([]APIKeyResponse, 0)
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&keys))
+	res.Body.Close()
+	assert.Len(t, keys, 3)
+	for _, key := range keys {
+		assert.Empty(t, key.Key, "secrets should not be listed")
+	}
+
+	res = do(http.MethodDelete, "/api/user/keys/"+readOnly.ID, "", bearer("clk_unknown"))
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode, "http status codes should be equal")
+	assert.NotEmpty(t, res.Header.Get("WWW-Authenticate"))
+
+	other := ts.newToken(t)
+	res = do(http.MethodDelete, "/api/user/keys/"+readOnly.ID, "", func(req *http.Request) {
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: other})
+	})
+	res.Body.Close()
+	assert.Equal(t, http.StatusForbidden, res.StatusCode, "http status codes should be equal")
+
+	res = do(http.MethodDelete, "/api/user/keys/"+readOnly.ID, "", cookie)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode, "http status codes should be equal")
+	res = do(http.MethodGet, "/api/user/urls", "", bearer(readOnly.Key))
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode, "revoked keys should be rejected")
+
+	res = do(http.MethodDelete, "/api/user/keys/unknown", "", cookie)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode, "http status codes should be equal")
+
+	restored, err := storage.NewFile(ts.filename)
+	assert.Nil(t, err)
+	reloaded, err := storage.NewFileStorage(restored)
+	assert.Nil(t, err)
+	stored, err := reloaded.GetUserAPIKeys(context.Background(), sessionID)
+	assert.Nil(t, err)
+	assert.Len(t, stored, 3, "keys should survive a restart")
+	assert.True(t, stored[0].IsRevoked() || stored[1].IsRevoked() || stored[2].IsRevoked())
+	restoredRows, err := reloaded.GetUserURLs(context.Background(), sessionID)
+	assert.Nil(t, err)
+	assert.Len(t, restoredRows, 1, "key records should not be loaded as links")
+}
+
+func TestServer__sessions(t *testing.T) {
+	ts := NewTestServer(t, WithSessions(SessionConfig{Secrets: []string{"current", "previous"}, TTL: time.Hour}))
+	defer ts.Close()
+	client := http.Client{}
+	get := func(token string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/api/user/urls", ts.URL), nil)
+		if token != "" {
+			req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: token})
+		}
+		res, err := client.Do(req)
+		assert.Nil(t, err)
+		res.Body.Close()
+		return res
+	}
+
+	res := get("")
+	assert.Equal(t, http.StatusNoContent, res.StatusCode, "http status codes should be equal")
+	cookies := res.Cookies()
+	assert.Len(t, cookies, 1)
+	assert.Equal(t, "", cookies[0].Domain, "cookies should be host-only")
+	assert.False(t, cookies[0].Secure)
+	assert.True(t, cookies[0].HttpOnly)
+	assert.Equal(t, http.SameSiteLaxMode, cookies[0].SameSite)
+	assert.Equal(t, 3600, cookies[0].MaxAge)
+
+	token := cookies[0].Value
+	res = get(token)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode, "http status codes should be equal")
+	assert.Empty(t, res.Cookies(), "valid sessions should be kept")
+
+	tampered := []byte(token)
+	tampered[5] ^= 1
+	assert.Equal(t, http.StatusUnauthorized, get(string(tampered)).StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, get("secret42").StatusCode)
+
+	_, err := newSessionManager(SessionConfig{}, "http://localhost:8080")
+	assert.ErrorIs(t, err, ErrNoSessionSecret, "secrets should be required outside development")
+	ls, _ := storage.NewInMemoryStorage()
+	_, err = New(ls)
+	assert.ErrorIs(t, err, ErrNoSessionSecret)
+
+	previous, err := newSessionManager(SessionConfig{Secrets: []string{"previous"}}, "http://localhost:8080")
+	assert.Nil(t, err)
+	rotated, sess, err := previous.issue()
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusNoContent, get(rotated).StatusCode, "tokens of older secrets should be accepted")
+	assert.Equal(t, sess.ID, ts.sessionID(t, rotated))
+
+	retired, err := newSessionManager(SessionConfig{Secrets: []string{"retired"}}, "http://localhost:8080")
+	assert.Nil(t, err)
+	unknown, _, err := retired.issue()
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, get(unknown).StatusCode)
+
+	legacy := "5f2b4c1a9e8d7c6b5a4f3e2d1c0b9a8f"
+	for i, stale := range []string{string(tampered), unknown, legacy} {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/", strings.NewReader(fmt.Sprintf("https://example.com/stale/%d", i)))
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: stale})
+		res, err := client.Do(req)
+		assert.Nil(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusCreated, res.StatusCode, "public routes should replace invalid sessions")
+		assert.Len(t, res.Cookies(), 1)
+		assert.Equal(t, http.StatusOK, get(res.Cookies()[0].Value).StatusCode, "the new session should own the link")
+	}
+
+	previous.now = func() time.Time { return time.Now().Add(-25 * time.Hour) }
+	expired, _, err := previous.issue()
+	assert.Nil(t, err)
+	res = get(expired)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode, "expired sessions should be replaced")
+	assert.Len(t, res.Cookies(), 1)
+	assert.NotEqual(t, expired, res.Cookies()[0].Value)
+}
+
+func TestSessionManager__cookieAttributes(t *testing.T) {
+	tests := []struct {
+		baseURL string
+		path    string
+		secure  bool
+	}{
+		{baseURL: "http://localhost:8080", path: "/", secure: false},
+		{baseURL: "http://127.0.0.1:8080", path: "/", secure: false},
+		{baseURL: "https://cutt.example.com", path: "/", secure: true},
+		{baseURL: "https://example.com/s", path: "/s", secure: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.baseURL, func(t *testing.T) {
+			m, err := newSessionManager(SessionConfig{Secrets: []string{"secret"}}, tt.baseURL)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.path, m.path)
+			assert.Equal(t, tt.secure, m.secure)
+			assert.Equal(t, defaultSessionTTL, m.ttl)
+		})
+	}
+}
+
+func TestServer__accounts(t *testing.T) {
+	ts := NewTestServer(t)
+	defer ts.Close()
+	jar, _ := cookiejar.New(nil)
+	client := http.Client{Jar: jar}
+	post := func(path string, body string) *http.Response {
+		res, err := client.Post(ts.URL+path, "application/json", strings.NewReader(body))
+		assert.Nil(t, err)
+		return res
+	}
+	account := func(res *http.Response) AccountResponse {
+		defer res.Body.Close()
+		var account AccountResponse
+		assert.Nil(t, json.NewDecoder(res.Body).Decode(&account))
+		return account
+	}
+	listed := func() int {
+		res, err := client.Get(ts.URL + "/api/user/urls")
+		assert.Nil(t, err)
+		defer res.Body.Close()
+		pairs := make([]URLPair, 0)
+		json.NewDecoder(res.Body).Decode(&pairs)
+		return len(pairs)
+	}
+
+	post("/api/shorten", `{"url":"https://example.com/account/1"}`).Body.Close()
+	post("/api/shorten", `{"url":"https://example.com/account/2"}`).Body.Close()
+	assert.Equal(t, 2, listed())
+
+	res := post("/api/user/register", `{"username":"alice","email":"Alice@Example.com","password":"correct horse"}`)
+	assert.Equal(t, http.StatusCreated, res.StatusCode, "http status codes should be equal")
+	alice := account(res)
+	assert.Equal(t, 2, alice.ClaimedURLs)
+	assert.Equal(t, "alice@example.com", alice.Email)
+	assert.Equal(t, 2, listed(), "claimed links should stay visible")
+
+	res = post("/api/user/register", `{"username":"ALICE","email":"other@example.com","password":"correct horse"}`)
+	res.Body.Close()
+	assert.Equal(t, http.StatusConflict, res.StatusCode, "http status codes should be equal")
+	res = post("/api/user/register", `{"username":"bob","email":"not-an-email","password":"correct horse"}`)
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode, "http status codes should be equal")
+	res = post("/api/user/register", `{"username":"bob","email":"bob@example.com","password":"short"}`)
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode, "http status codes should be equal")
+
+	res = post("/api/user/logout", "")
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode, "http status codes should be equal")
+	assert.Equal(t, 0, listed(), "logged out session should be anonymous")
+
+	post("/api/shorten", `{"url":"https://example.com/account/3"}`).Body.Close()
+	res = post("/api/user/login", `{"login":"alice","password":"wrong password"}`)
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode, "http status codes should be equal")
+	res = post("/api/user/login", `{"login":"nobody","password":"correct horse"}`)
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode, "http status codes should be equal")
+
+	res = post("/api/user/login", `{"login":"ALICE@example.com","password":"correct horse"}`)
+	assert.Equal(t, http.StatusOK, res.StatusCode, "http status codes should be equal")
+	login := account(res)
+	assert.Equal(t, alice.ID, login.ID)
+	assert.Equal(t, 1, login.ClaimedURLs)
+	assert.Equal(t, 3, listed())
+
+	res = post("/api/user/register", `{"username":"bob","email":"bob@example.com","password":"correct horse"}`)
+	assert.Equal(t, http.StatusCreated, res.StatusCode, "http status codes should be equal")
+	assert.Equal(t, 0, account(res).ClaimedURLs, "account sessions should not be claimed")
+	assert.Equal(t, 0, listed())
+
+	rows, err := ts.storage.GetUserURLs(context.Background(), alice.ID)
+	assert.Nil(t, err)
+	assert.Len(t, rows, 3)
+}
+
+func TestServer__oidc(t *testing.T) {
+	idp := oidctest.NewProvider()
+	defer idp.Close()
+	const redirectURL = "http://cuttlink.test/api/user/oidc/callback"
+	provider, err := oidc.Discover(context.Background(), oidc.Config{
+		Issuer:       idp.Issuer(),
+		ClientID:     oidctest.ClientID,
+		ClientSecret: oidctest.ClientSecret,
+		RedirectURL:  redirectURL,
+	}, nil)
+	assert.Nil(t, err)
+	ts := NewTestServer(t, WithOIDC(provider))
+	defer ts.Close()
+
+	jar, _ := cookiejar.New(nil)
+	client := http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if strings.HasPrefix(req.URL.String(), redirectURL) {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	// login follows the provider redirects and returns the callback response.
+	login := func() *http.Response {
+		res, err := client.Get(ts.URL + "/api/user/oidc/login")
+		assert.Nil(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusFound, res.StatusCode, "http status codes should be equal")
+		callback := strings.Replace(res.Header.Get("Location"), "http://cuttlink.test", ts.URL, 1)
+		res, err = client.Get(callback)
+		assert.Nil(t, err)
+		return res
+	}
+
+	res, err := client.Post(ts.URL+"/api/shorten", "application/json", strings.NewReader(`{"url":"https://example.com/oidc"}`))
+	assert.Nil(t, err)
+	res.Body.Close()
+
+	res = login()
+	assert.Equal(t, http.StatusOK, res.StatusCode, "http status codes should be equal")
+	var account AccountResponse
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&account))
+	res.Body.Close()
+	assert.Equal(t, oidcUserID(idp.Issuer(), "employee-42"), account.ID)
+	assert.Equal(t, "employee@corp.example", account.Email)
+	assert.Equal(t, 1, account.ClaimedURLs)
+
+	rows, err := ts.storage.GetUserURLs(context.Background(), account.ID)
+	assert.Nil(t, err)
+	assert.Len(t, rows, 1, "links should belong to the subject")
+
+	res, err = client.Get(ts.URL + "/api/user/oidc/callback?code=replayed&state=forged")
+	assert.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode, "callbacks without a login attempt should be rejected")
+
+	idp.Modify = func(claims map[string]interface{}) { claims["nonce"] = "replayed" }
+	res = login()
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode, "tokens with a foreign nonce should be rejected")
+
+	idp.Modify = func(claims map[string]interface{}) { claims["aud"] = "other-client" }
+	res = login()
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode, "tokens for other clients should be rejected")
+
+	unconfigured := NewTestServer(t)
+	defer unconfigured.Close()
+	res, err = http.Get(unconfigured.URL + "/api/user/oidc/login")
+	assert.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode, "http status codes should be equal")
+}
+
+func TestServer__workspaceRemovalsRace(t *testing.T) {
+	file, err := os.CreateTemp("", "cuttlink-test-*.txt")
+	assert.Nil(t, err)
+	defer os.Remove(file.Name())
+	tfs, err := storage.NewFile(file.Name())
+	assert.Nil(t, err)
+	fileStorage, err := storage.NewFileStorage(tfs)
+	assert.Nil(t, err)
+	defer fileStorage.Close()
+	memoryStorage, err := storage.NewInMemoryStorage()
+	assert.Nil(t, err)
+
+	for name, ls := range map[string]storage.Storager{"file": fileStorage, "memory": memoryStorage} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			workspace := storage.Workspace{ID: "race", Name: "Race", CreatedBy: "owner", CreatedAt: time.Now().UTC()}
+			assert.Nil(t, ls.CreateWorkspace(ctx, workspace))
+			keys := make([]string, 20)
+			for i := range keys {
+				keys[i], err = ls.SetURL(ctx, fmt.Sprintf("https://example.com/race/%s/%d", name, i), "", "owner")
+				assert.Nil(t, err)
+			}
+			_, err = ls.MoveURLs(ctx, keys, workspace.ID, "owner")
+			assert.Nil(t, err)
+
+			editor := storage.Member{WorkspaceID: workspace.ID, UserID: "editor", Role: storage.RoleEditor, CreatedAt: time.Now().UTC()}
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					assert.Nil(t, ls.SetWorkspaceMember(ctx, editor))
+					assert.Nil(t, ls.RemoveWorkspaceMember(ctx, workspace.ID, editor.UserID))
+				}
+			}()
+			for _, key := range keys {
+				assert.Nil(t, ls.UpdateBatchURL(ctx, workers.RemovalTask{Keys: []string{key}, UUID: editor.UserID}))
+			}
+			wg.Wait()
+
+			assert.Nil(t, ls.SetWorkspaceMember(ctx, editor))
+			assert.Nil(t, ls.UpdateBatchURL(ctx, workers.RemovalTask{Keys: keys, UUID: editor.UserID}))
+			for _, key := range keys {
+				row, err := ls.GetURL(ctx, key)
+				assert.Nil(t, err)
+				assert.True(t, row.IsDeleted, "editors should delete workspace links")
+			}
+		})
+	}
+}
+
+func TestServer__workspaces(t *testing.T) {
+	ts := NewTestServer(t)
+	defer ts.Close()
+	type user struct {
+		client *http.Client
+		id     string
+	}
+	do := func(u user, method string, path string, body string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		res, err := u.client.Do(req)
+		assert.Nil(t, err)
+		return res
+	}
+	decode := func(res *http.Response, v interface{}) {
+		defer res.Body.Close()
+		assert.Nil(t, json.NewDecoder(res.Body).Decode(v))
+	}
+	register := func(name string) user {
+		jar, _ := cookiejar.New(nil)
+		u := user{client: &http.Client{Jar: jar}}
+		var account AccountResponse
+		decode(do(u, http.MethodPost, "/api/user/register",
+			fmt.Sprintf(`{"username":"%s","email":"%s@example.com","password":"correct horse"}`, name, name)), &account)
+		u.id = account.ID
+		return u
+	}
+	shorten := func(u user, url string) string {
+		var result map[string]string
+		decode(do(u, http.MethodPost, "/api/shorten", fmt.Sprintf(`{"url":"%s"}`, url)), &result)
+		return result["result"][strings.LastIndex(result["result"], "/")+1:]
+	}
+	listed := func(u user) int {
+		res := do(u, http.MethodGet, "/api/user/urls", "")
+		defer res.Body.Close()
+		pairs := make([]URLPair, 0)
+		json.NewDecoder(res.Body).Decode(&pairs)
+		return len(pairs)
+	}
+	status := func(res *http.Response) int {
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	alice, bob, carol, mallory := register("alice"), register("bob"), register("carol"), register("mallory")
+	shared := shorten(alice, "https://example.com/team/shared")
+	private := shorten(alice, "https://example.com/team/private")
+
+	res := do(alice, http.MethodPost, "/api/workspaces", `{"name":"Team"}`)
+	assert.Equal(t, http.StatusCreated, res.StatusCode, "http status codes should be equal")
+	var workspace WorkspaceResponse
+	decode(res, &workspace)
+	assert.Equal(t, "owner", workspace.Role)
+	base := "/api/workspaces/" + workspace.ID
+
+	assert.Equal(t, http.StatusOK, status(do(alice, http.MethodPost, base+"/members", `{"login":"bob","role":"editor"}`)))
+	assert.Equal(t, http.StatusOK, status(do(alice, http.MethodPost, base+"/members", fmt.Sprintf(`{"user_id":"%s","role":"viewer"}`, carol.id))))
+	assert.Equal(t, http.StatusNotFound, status(do(alice, http.MethodPost, base+"/members", `{"login":"nobody","role":"viewer"}`)))
+	assert.Equal(t, http.StatusBadRequest, status(do(alice, http.MethodPost, base+"/members", `{"login":"bob","role":"admin"}`)))
+	assert.Equal(t, http.StatusForbidden, status(do(bob, http.MethodPost, base+"/members", `{"login":"mallory","role":"owner"}`)),
+		"only owners should invite")
+	assert.Equal(t, http.StatusNotFound, status(do(mallory, http.MethodGet, base+"/members", "")),
+		"workspaces should be hidden from non-members")
+
+	var members []MemberResponse
+	decode(do(carol, http.MethodGet, base+"/members", ""), &members)
+	assert.Len(t, members, 3)
+
+	var moved MoveURLsResponse
+	decode(do(bob, http.MethodPost, base+"/urls", fmt.Sprintf(`["%s"]`, shared)), &moved)
+	assert.Empty(t, moved.Moved, "links of other users should not be moved")
+	decode(do(alice, http.MethodPost, base+"/urls", fmt.Sprintf(`["%s"]`, shared)), &moved)
+	assert.Equal(t, []string{shared}, moved.Moved)
+	assert.Equal(t, http.StatusForbidden, status(do(carol, http.MethodPost, base+"/urls", fmt.Sprintf(`["%s"]`, shared))))
+
+	assert.Equal(t, 2, listed(alice))
+	assert.Equal(t, 1, listed(bob))
+	assert.Equal(t, 1, listed(carol))
+	assert.Equal(t, 0, listed(mallory))
+
+	patch := func(u user, key string) int {
+		return status(do(u, http.MethodPatch, "/api/user/urls/"+key, `{"title":"Team page"}`))
+	}
+	assert.Equal(t, http.StatusOK, patch(bob, shared), "editors should edit workspace links")
+	assert.Equal(t, http.StatusForbidden, patch(carol, shared), "viewers should not edit workspace links")
+	assert.Equal(t, http.StatusForbidden, patch(bob, private), "private links should stay private")
+	assert.Equal(t, http.StatusOK, status(do(carol, http.MethodGet, "/api/user/urls/"+shared+"/variants", "")))
+
+	assert.Equal(t, http.StatusConflict, status(do(alice, http.MethodDelete, base+"/members/"+alice.id, "")),
+		"the last owner should not leave")
+	assert.Equal(t, http.StatusOK, status(do(alice, http.MethodPost, base+"/members", `{"login":"bob","role":"owner"}`)))
+	assert.Equal(t, http.StatusNoContent, status(do(alice, http.MethodDelete, base+"/members/"+alice.id, "")))
+	assert.Equal(t, 1, listed(alice), "links should stay with the workspace")
+	assert.Equal(t, http.StatusOK, patch(bob, shared), "links should outlive the membership of their creator")
+
+	assert.Equal(t, http.StatusConflict, status(do(bob, http.MethodPost, base+"/members", fmt.Sprintf(`{"user_id":"%s","role":"editor"}`, bob.id))),
+		"the last owner should not step down")
+
+	jar, _ := cookiejar.New(nil)
+	anonymous := user{client: &http.Client{Jar: jar}}
+	res = do(anonymous, http.MethodPost, "/api/workspaces", `{"name":"Claimed"}`)
+	var claimed WorkspaceResponse
+	decode(res, &claimed)
+	assert.Equal(t, http.StatusOK, status(do(anonymous, http.MethodPost, "/api/workspaces/"+claimed.ID+"/members", `{"login":"carol","role":"viewer"}`)))
+	assert.Equal(t, http.StatusOK, status(do(anonymous, http.MethodPost, "/api/user/login", `{"login":"carol","password":"correct horse"}`)))
+	decode(do(anonymous, http.MethodGet, "/api/workspaces/"+claimed.ID+"/members", ""), &members)
+	assert.Len(t, members, 1, "the session membership should be merged into the account")
+	assert.Equal(t, carol.id, members[0].UserID)
+	assert.Equal(t, storage.RoleOwner, members[0].Role, "the higher role should be kept")
+
+	assert.Nil(t, ts.storage.UpdateBatchURL(context.Background(), workers.RemovalTask{Keys: []string{shared}, UUID: carol.id}))
+	assert.Equal(t, 1, listed(carol), "viewers should not delete workspace links")
+	assert.Nil(t, ts.storage.UpdateBatchURL(context.Background(), workers.RemovalTask{Keys: []string{shared}, UUID: bob.id}))
+	assert.Equal(t, 0, listed(carol))
+
+	tfs, err := storage.NewFile(ts.filename)
+	assert.Nil(t, err)
+	defer tfs.CloseFS()
+	replayed, err := storage.NewFileStorage(tfs)
+	assert.Nil(t, err)
+	role, err := replayed.GetWorkspaceRole(context.Background(), workspace.ID, bob.id)
+	assert.Nil(t, err)
+	assert.Equal(t, storage.RoleOwner, role)
+	_, err = replayed.GetWorkspaceRole(context.Background(), workspace.ID, alice.id)
+	assert.ErrorIs(t, err, storage.ErrNotMember)
+	row, err := replayed.GetURL(context.Background(), shared)
+	assert.Nil(t, err)
+	assert.Equal(t, workspace.ID, row.WorkspaceID)
+	replayedMembers, err := replayed.GetWorkspaceMembers(context.Background(), claimed.ID)
+	assert.Nil(t, err)
+	assert.Len(t, replayedMembers, 1, "dropped session memberships should stay dropped")
+	assert.Equal(t, storage.RoleOwner, replayedMembers[0].Role)
+}
+
+func TestServer__admin(t *testing.T) {
+	const token = "operator-secret"
+	ts := NewTestServer(t, WithAdminToken(token))
+	defer ts.Close()
+	client := http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	admin := func(method string, path string, token string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+"/api/admin"+path, nil)
+		req.Header.Set(adminTokenHeader, token)
+		res, err := client.Do(req)
+		assert.Nil(t, err)
+		return res
+	}
+	decode := func(res *http.Response, v interface{}) {
+		defer res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode, "http status codes should be equal")
+		assert.Nil(t, json.NewDecoder(res.Body).Decode(v))
+	}
+
+	spammer, _, err := ts.storage.SetBatchURL(context.Background(),
+		[]string{"https://spam.example/a", "https://spam.example/b"}, []string{"", ""}, "spammer")
+	assert.Nil(t, err)
+	other, err := ts.storage.SetURL(context.Background(), "https://example.com/docs", "", "other")
+	assert.Nil(t, err)
+
+	res := admin(http.MethodGet, "/stats", "")
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode, "http status codes should be equal")
+	res = admin(http.MethodGet, "/stats", "wrong")
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode, "http status codes should be equal")
+
+	var list AdminURLList
+	decode(admin(http.MethodGet, "/urls?q=SPAM.example", token), &list)
+	assert.Equal(t, 2, list.Total)
+	assert.Equal(t, "spammer", list.Items[0].Owner.ID)
+	decode(admin(http.MethodGet, "/urls?user_id=other", token), &list)
+	assert.Equal(t, 1, list.Total)
+	decode(admin(http.MethodGet, "/urls?limit=1&offset=1", token), &list)
+	assert.Equal(t, 3, list.Total)
+	assert.Len(t, list.Items, 1)
+	res = admin(http.MethodGet, "/urls?status=unknown", token)
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode, "http status codes should be equal")
+
+	var link AdminURL
+	decode(admin(http.MethodPost, "/urls/"+other+"/disable", token), &link)
+	assert.True(t, link.Disabled)
+	res, err = client.Get(ts.URL + "/" + other)
+	assert.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusGone, res.StatusCode, "disabled links should not redirect")
+	decode(admin(http.MethodPost, "/urls/"+other+"/enable", token), &link)
+	assert.False(t, link.Disabled)
+	res, err = client.Get(ts.URL + "/" + other)
+	assert.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusTemporaryRedirect, res.StatusCode, "enabled links should redirect")
+	res = admin(http.MethodPost, "/urls/404/disable", token)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode, "http status codes should be equal")
+
+	var deleted AdminDeleteResponse
+	decode(admin(http.MethodDelete, "/users/spammer/urls", token), &deleted)
+	assert.Equal(t, 2, deleted.Deleted)
+	decode(admin(http.MethodGet, "/urls/"+spammer[0], token), &link)
+	assert.True(t, link.Deleted)
+
+	var stats storage.URLStats
+	decode(admin(http.MethodGet, "/stats", token), &stats)
+	assert.Equal(t, storage.URLStats{Backend: "file", Total: 3, Active: 1, Deleted: 2, Owners: 2}, stats)
+
+	unconfigured := NewTestServer(t)
+	defer unconfigured.Close()
+	res, err = http.Get(unconfigured.URL + "/api/admin/stats")
+	assert.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode, "admin routes should be hidden without a token")
+
+	memory, _ := storage.NewInMemoryStorage()
+	memory.SetURL(context.Background(), "https://example.com/memory", "", "someone")
+	memory.SetURLDisabled(context.Background(), "2", true)
+	stats, err = memory.GetURLStats(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, storage.URLStats{Backend: "memory", Total: 1, Disabled: 1, Owners: 1}, stats)
+}
+
+func TestServer__transfers(t *testing.T) {
+	ts := NewTestServer(t)
+	defer ts.Close()
+	type user struct {
+		client *http.Client
+		id     string
+	}
+	do := func(u user, method string, path string, body string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		res, err := u.client.Do(req)
+		assert.Nil(t, err)
+		return res
+	}
+	register := func(name string) user {
+		jar, _ := cookiejar.New(nil)
+		u := user{client: &http.Client{Jar: jar}}
+		res := do(u, http.MethodPost, "/api/user/register",
+			fmt.Sprintf(`{"username":"%s","email":"%s@example.com","password":"correct horse"}`, name, name))
+		defer res.Body.Close()
+		var account AccountResponse
+		assert.Nil(t, json.NewDecoder(res.Body).Decode(&account))
+		u.id = account.ID
+		return u
+	}
+	offer := func(u user, body string) (int, TransferResponse) {
+		res := do(u, http.MethodPost, "/api/user/transfers", body)
+		defer res.Body.Close()
+		var transfer TransferResponse
+		json.NewDecoder(res.Body).Decode(&transfer)
+		return res.StatusCode, transfer
+	}
+	accept := func(u user, token string) int {
+		res := do(u, http.MethodPost, "/api/user/transfers/accept", fmt.Sprintf(`{"token":"%s"}`, token))
+		res.Body.Close()
+		return res.StatusCode
+	}
+	owner := func(key string) string {
+		row, err := ts.storage.GetURL(context.Background(), key)
+		assert.Nil(t, err)
+		return row.UUID
+	}
+
+	alice, bob, mallory := register("alice"), register("bob"), register("mallory")
+	keys := make([]string, 3)
+	for i := range keys {
+		key, err := ts.storage.SetURL(context.Background(), fmt.Sprintf("https://example.com/campaign/%d", i), "", alice.id)
+		assert.Nil(t, err)
+		keys[i] = key
+	}
+
+	status, _ := offer(bob, fmt.Sprintf(`{"keys":["%s"],"user_id":"%s"}`, keys[0], bob.id))
+	assert.Equal(t, http.StatusBadRequest, status, "transfers to oneself should be rejected")
+	status, _ = offer(bob, fmt.Sprintf(`{"keys":["%s"],"login":"mallory"}`, keys[0]))
+	assert.Equal(t, http.StatusForbidden, status, "only owners should offer links")
+
+	status, transfer := offer(alice, fmt.Sprintf(`{"keys":["%s","%s","%s"],"login":"bob"}`, keys[0], keys[1], keys[0]))
+	assert.Equal(t, http.StatusCreated, status, "http status codes should be equal")
+	assert.Equal(t, []string{keys[0], keys[1]}, transfer.Keys)
+	assert.Equal(t, bob.id, transfer.ToUserID)
+	assert.Equal(t, alice.id, owner(keys[0]), "links should move only once accepted")
+
+	assert.Equal(t, http.StatusNotFound, accept(mallory, transfer.Token), "tokens should only work for the recipient")
+	assert.Equal(t, http.StatusNotFound, accept(bob, "clt_forged"))
+	assert.Equal(t, http.StatusOK, accept(bob, transfer.Token))
+	assert.Equal(t, http.StatusGone, accept(bob, transfer.Token), "tokens should be single use")
+	assert.Equal(t, bob.id, owner(keys[0]))
+	assert.Equal(t, bob.id, owner(keys[1]))
+	assert.Equal(t, alice.id, owner(keys[2]))
+
+	_, partial := offer(alice, fmt.Sprintf(`{"keys":["%s"],"user_id":"%s"}`, keys[2], bob.id))
+	assert.Nil(t, ts.storage.UpdateBatchURL(context.Background(), workers.RemovalTask{Keys: []string{keys[2]}, UUID: alice.id}))
+	assert.Equal(t, http.StatusConflict, accept(bob, partial.Token), "deleted links should fail the whole transfer")
+	assert.Equal(t, alice.id, owner(keys[2]))
+
+	_, cancelled := offer(bob, fmt.Sprintf(`{"keys":["%s"],"user_id":"%s"}`, keys[0], alice.id))
+	res := do(mallory, http.MethodDelete, "/api/user/transfers/"+cancelled.ID, "")
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode, "only the sender should cancel")
+	res = do(bob, http.MethodDelete, "/api/user/transfers/"+cancelled.ID, "")
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode, "http status codes should be equal")
+	assert.Equal(t, http.StatusGone, accept(alice, cancelled.Token))
+
+	tfs, err := storage.NewFile(ts.filename)
+	assert.Nil(t, err)
+	defer tfs.CloseFS()
+	replayed, err := storage.NewFileStorage(tfs)
+	assert.Nil(t, err)
+	rows, err := replayed.GetUserURLs(context.Background(), bob.id)
+	assert.Nil(t, err)
+	assert.Len(t, rows, 2)
+	_, err = replayed.AcceptTransfer(context.Background(), hashToken(transfer.Token), bob.id, time.Now())
+	assert.ErrorIs(t, err, storage.ErrTransferClosed)
+}
+
+func TestServer__audit(t *testing.T) {
+	ts := NewTestServer(t)
+	defer ts.Close()
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+	do := func(method string, path string, body string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "cuttlink-audit-test")
+		res, err := client.Do(req)
+		assert.Nil(t, err)
+		return res
+	}
+	history := func() []storage.AuditEntry {
+		res := do(http.MethodGet, "/api/user/audit", "")
+		defer res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode, "http status codes should be equal")
+		entries := make([]storage.AuditEntry, 0)
+		assert.Nil(t, json.NewDecoder(res.Body).Decode(&entries))
+		return entries
+	}
+
+	res := do(http.MethodPost, "/api/shorten", `{"url":"https://example.com/audit"}`)
+	var created ResponseJSON
+	json.NewDecoder(res.Body).Decode(&created)
+	res.Body.Close()
+	key := created.Result[strings.LastIndex(created.Result, "/")+1:]
+	sessionID := ""
+	for _, cookie := range jar.Cookies(res.Request.URL) {
+		if cookie.Name == sessionCookieName {
+			sessionID = ts.sessionID(t, cookie.Value)
+		}
+	}
+	res = do(http.MethodPost, "/api/shorten/batch",
+		`[{"correlation_id":"1","original_url":"https://example.com/a"},{"correlation_id":"2","original_url":"https://example.com/b"},{"correlation_id":"3","original_url":"https://example.com/audit"}]`)
+	res.Body.Close()
+	res = do(http.MethodPatch, "/api/user/urls/"+key, `{"title":"Audited"}`)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode, "http status codes should be equal")
+	res = do(http.MethodDelete, "/api/user/urls", fmt.Sprintf(`["%s","missing"]`, key))
+	res.Body.Close()
+	assert.Equal(t, http.StatusAccepted, res.StatusCode, "http status codes should be equal")
+
+	var entries []storage.AuditEntry
+	for i := 0; i < 50; i++ {
+		if entries = history(); len(entries) == 4 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Len(t, entries, 4, "the async deletion should be audited")
+	actions := make([]string, len(entries))
+	for i, entry := range entries {
+		actions[i] = entry.Action
+		assert.Equal(t, sessionID, entry.ActorID)
+		assert.Equal(t, "127.0.0.1", entry.ClientIP)
+		assert.Equal(t, "cuttlink-audit-test", entry.UserAgent)
+	}
+	assert.Equal(t, []string{storage.AuditDelete, storage.AuditEdit, storage.AuditBatchCreate, storage.AuditCreate}, actions)
+	assert.Equal(t, storage.KeyList{key}, entries[0].Keys, "only deleted links should be listed")
+	assert.Equal(t, map[string]interface{}{"deleted": false}, entries[0].Before[key])
+	assert.Equal(t, map[string]interface{}{"deleted": true}, entries[0].After[key])
+	assert.Equal(t, "Audited", entries[1].After[key].(map[string]interface{})["title"])
+	assert.Len(t, entries[2].Keys, 2, "deduplicated items should not be audited as created")
+	assert.NotContains(t, entries[2].Keys, key)
+	assert.Nil(t, entries[3].Before, "creations should have no previous state")
+	assert.Equal(t, "https://example.com/audit", entries[3].After[key].(map[string]interface{})["destination"])
+
+	res = do(http.MethodGet, "/api/user/audit?limit=1&offset=1", "")
+	page := make([]storage.AuditEntry, 0)
+	json.NewDecoder(res.Body).Decode(&page)
+	res.Body.Close()
+	assert.Len(t, page, 1)
+	assert.Equal(t, storage.AuditEdit, page[0].Action)
+	res = do(http.MethodGet, "/api/user/audit?limit=-1", "")
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode, "http status codes should be equal")
+
+	res = do(http.MethodPost, "/api/user/register", `{"username":"auditor","email":"auditor@example.com","password":"correct horse"}`)
+	var account AccountResponse
+	json.NewDecoder(res.Body).Decode(&account)
+	res.Body.Close()
+	entries = history()
+	assert.Len(t, entries, 1, "the account should start its own history")
+	assert.Equal(t, storage.AuditClaim, entries[0].Action)
+	assert.Equal(t, account.ID, entries[0].ActorID)
+	assert.Len(t, entries[0].Keys, 3)
+	assert.Equal(t, map[string]interface{}{"user_id": sessionID}, entries[0].Before[key])
+
+	data, err := os.ReadFile(ts.filename)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(data), `"record":"audit"`, "the history should be kept apart from links")
+	tfs, err := storage.NewFile(ts.filename)
+	assert.Nil(t, err)
+	replayed, err := storage.NewFileStorage(tfs)
+	assert.Nil(t, err)
+	defer replayed.Close()
+	replayedEntries, err := replayed.GetUserAudit(context.Background(), sessionID, 0, 0)
+	assert.Nil(t, err)
+	assert.Len(t, replayedEntries, 4)
+}
+
+func TestServer__tls(t *testing.T) {
+	ls, _ := storage.NewInMemoryStorage()
+	_, err := New(ls, developmentSessions, WithHTTPSRedirect(":0"))
+	assert.NotNil(t, err, "the redirect listener should require TLS")
+
+	cert, err := certs.SelfSigned("127.0.0.1")
+	assert.Nil(t, err)
+	s, err := New(ls,
+		developmentSessions,
+		WithServiceHost("https://short.example.com"),
+		WithTLS(&tls.Config{MinVersion: tls.VersionTLS13, Certificates: []tls.Certificate{*cert}}),
+		WithHTTPSRedirect(":0"),
+	)
+	assert.Nil(t, err)
+	ts := httptest.NewUnstartedServer(s.srv.Handler)
+	ts.TLS = s.srv.TLSConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	res, err := client.Get(ts.URL + "/api/user/urls")
+	assert.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode, "http status codes should be equal")
+	assert.NotEmpty(t, res.Cookies())
+	for _, cookie := range res.Cookies() {
+		assert.True(t, cookie.Secure, "cookies should follow the https base URL")
+	}
+
+	legacy := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, MaxVersion: tls.VersionTLS12}}}
+	_, err = legacy.Get(ts.URL + "/api/user/urls")
+	assert.NotNil(t, err, "versions below the minimum should be rejected")
+
+	w := httptest.NewRecorder()
+	s.redirectSrv.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://short.example.com/abc?x=1", nil))
+	assert.Equal(t, http.StatusPermanentRedirect, w.Code, "http status codes should be equal")
+	assert.Equal(t, "https://short.example.com/abc?x=1", w.Header().Get("Location"))
+}
+
+func TestServer__bodyLimit(t *testing.T) {
+	ts := NewTestServer(t, WithHTTPConfig(HTTPConfig{MaxBodyBytes: 1024}))
+	defer ts.Close()
+	post := func(body []byte, gzipped bool) int {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/api/shorten", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if gzipped {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		res, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	compress := func(body []byte) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(body)
+		gz.Close()
+		return buf.Bytes()
+	}
+	long := []byte(`{"url":"https://example.com/` + strings.Repeat("a", 100000) + `"}`)
+	short := []byte(`{"url":"https://example.com/small"}`)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post(long, false), "http status codes should be equal")
+	assert.Less(t, len(compress(long)), 1024)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post(compress(long), true), "the limit should apply after decompression")
+	assert.Equal(t, http.StatusCreated, post(compress(short), true), "http status codes should be equal")
+
+	unlimited := NewTestServer(t)
+	defer unlimited.Close()
+	items := make([]string, batchMaxItems+1)
+	for i := range items {
+		items[i] = fmt.Sprintf(`{"correlation_id":"%d","original_url":"https://example.com/%d"}`, i, i)
+	}
+	res, err := http.Post(unlimited.URL+"/api/shorten/batch", "application/json", strings.NewReader("["+strings.Join(items, ",")+"]"))
+	assert.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode, "batches should be capped without a body limit too")
+}
+
+func TestServer__h2c(t *testing.T) {
+	ls, _ := storage.NewInMemoryStorage()
+	s, err := New(ls, developmentSessions, WithHTTPConfig(HTTPConfig{H2C: true, ReadHeaderTimeout: time.Second}))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Second, s.srv.ReadHeaderTimeout)
+	ts := httptest.NewServer(s.srv.Handler)
+	defer ts.Close()
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network string, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	res, err := client.Get(ts.URL + "/api/user/urls")
+	assert.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, 2, res.ProtoMajor, "prior knowledge h2c should be served")
+	assert.Equal(t, http.StatusNoContent, res.StatusCode, "http status codes should be equal")
+}
+
+func TestServer__shutdown(t *testing.T) {
+	file, err := os.CreateTemp("", "cuttlink-test-*.txt")
+	assert.Nil(t, err)
+	defer os.Remove(file.Name())
+	tfs, _ := storage.NewFile(file.Name())
+	ls, _ := storage.NewFileStorage(tfs)
+	s, err := New(ls, developmentSessions)
+	assert.Nil(t, err)
+
+	keys := make([]string, cap(s.removalCh))
+	for i := range keys {
+		keys[i], err = ls.SetURL(context.Background(), fmt.Sprintf("https://example.com/%d", i), "", "owner")
+		assert.Nil(t, err)
+		s.removalCh <- workers.RemovalTask{Keys: []string{keys[i]}, UUID: "owner"}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, s.Shutdown(ctx))
+	assert.Nil(t, ls.Close())
+
+	tfs, err = storage.NewFile(file.Name())
+	assert.Nil(t, err)
+	defer tfs.CloseFS()
+	replayed, err := storage.NewFileStorage(tfs)
+	assert.Nil(t, err)
+	for _, key := range keys {
+		row, err := replayed.GetURL(context.Background(), key)
+		assert.Nil(t, err)
+		assert.True(t, row.IsDeleted, "queued removals should be done before shutdown returns")
+	}
+}
+
+// newGRPCTestClient serves the gRPC API of a new server over an in-memory
+// listener until the test ends.
+func newGRPCTestClient(t *testing.T, ls storage.Storager, opts ...ServerOption) (Server, shortener.ShortenerClient) {
+	s, err := New(ls, append([]ServerOption{developmentSessions, WithGRPC("bufconn")}, opts...)...)
+	assert.Nil(t, err)
+	lis := bufconn.Listen(1 << 20)
+	go s.grpcSrv.Serve(lis)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+
+	conn, err := grpc.Dial("bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	assert.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return s, shortener.NewShortenerClient(conn)
+}
+
+func TestServer__grpc(t *testing.T) {
+	ls, _ := storage.NewInMemoryStorage()
+	s, client := newGRPCTestClient(t, ls)
+	ctx := context.Background()
+
+	var header grpcmetadata.MD
+	created, err := client.Shorten(ctx, &shortener.ShortenRequest{Url: "https://example.com/grpc"}, grpc.Header(&header))
+	assert.Nil(t, err)
+	assert.True(t, created.Created)
+	assert.Len(t, header.Get("session-token"), 1, "anonymous calls should be given a session")
+	session := grpcmetadata.AppendToOutgoingContext(ctx, "session-token", header.Get("session-token")[0])
+
+	duplicate, err := client.Shorten(session, &shortener.ShortenRequest{Url: "https://example.com/grpc"})
+	assert.Nil(t, err)
+	assert.False(t, duplicate.Created)
+	assert.Equal(t, created.ShortUrl, duplicate.ShortUrl)
+	_, err = client.Shorten(session, &shortener.ShortenRequest{Url: "example.com"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	batch, err := client.ShortenBatch(session, &shortener.ShortenBatchRequest{Items: []*shortener.BatchItem{
+		{CorrelationId: "a", OriginalUrl: "https://example.com/a"},
+		{CorrelationId: "b", OriginalUrl: "https://example.com/b"},
+	}})
+	assert.Nil(t, err)
+	assert.Len(t, batch.Items, 2)
+	assert.Equal(t, "b", batch.Items[1].CorrelationId)
+
+	list, err := client.ListUserURLs(session, &shortener.ListUserURLsRequest{})
+	assert.Nil(t, err)
+	assert.Len(t, list.Urls, 3, "links should belong to the session")
+
+	key := created.ShortUrl[strings.LastIndex(created.ShortUrl, "/")+1:]
+	expanded, err := client.Expand(ctx, &shortener.ExpandRequest{Key: key})
+	assert.Nil(t, err)
+	assert.Equal(t, "https://example.com/grpc", expanded.OriginalUrl)
+	_, err = client.Expand(ctx, &shortener.ExpandRequest{Key: "unknown"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = client.DeleteUserURLs(session, &shortener.DeleteUserURLsRequest{Keys: []string{key}})
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		_, err := client.Expand(ctx, &shortener.ExpandRequest{Key: key})
+		return status.Code(err) == codes.NotFound
+	}, time.Second, 10*time.Millisecond)
+
+	sessionID, err := s.sessions.parse(header.Get("session-token")[0])
+	assert.Nil(t, err)
+	assert.Nil(t, ls.SetAPIKey(ctx, storage.APIKey{
+		ID: "read", UserID: sessionID.ID, Hash: hashToken("clk_read"), Scope: ScopeRead,
+	}))
+	bearer := grpcmetadata.AppendToOutgoingContext(ctx, "authorization", "Bearer clk_read")
+	list, err = client.ListUserURLs(bearer, &shortener.ListUserURLsRequest{})
+	assert.Nil(t, err)
+	assert.Len(t, list.Urls, 2, "the key should act for its owner")
+	_, err = client.Shorten(bearer, &shortener.ShortenRequest{Url: "https://example.com/read"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = client.ListUserURLs(grpcmetadata.AppendToOutgoingContext(ctx, "authorization", "Bearer clk_unknown"), &shortener.ListUserURLsRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = client.ListUserURLs(grpcmetadata.AppendToOutgoingContext(ctx, "session-token", "tampered"), &shortener.ListUserURLsRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	items := make([]*shortener.BatchItem, batchMaxItems+1)
+	for i := range items {
+		items[i] = &shortener.BatchItem{CorrelationId: strconv.Itoa(i), OriginalUrl: fmt.Sprintf("https://example.com/%d", i)}
+	}
+	_, err = client.ShortenBatch(session, &shortener.ShortenBatchRequest{Items: items})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "batches should be capped like over HTTP")
+}
+
+func TestServer__grpcRateLimits(t *testing.T) {
+	ls, _ := storage.NewInMemoryStorage()
+	s, client := newGRPCTestClient(t, ls, WithRateLimits(RateLimits{
+		Create:   ratelimit.Limit{Rate: 1, Period: time.Hour, Burst: 2},
+		Batch:    ratelimit.Limit{Rate: 1, Period: time.Hour, Burst: 3},
+		Redirect: ratelimit.Limit{Rate: 1, Period: time.Hour, Burst: 1},
+	}))
+	ctx := context.Background()
+
+	var header grpcmetadata.MD
+	created, err := client.Shorten(ctx, &shortener.ShortenRequest{Url: "https://example.com/limited/1"}, grpc.Header(&header))
+	assert.Nil(t, err)
+	key := created.ShortUrl[strings.LastIndex(created.ShortUrl, "/")+1:]
+	fresh := grpcmetadata.AppendToOutgoingContext(ctx, "session-token", header.Get("session-token")[0])
+	_, err = client.Shorten(fresh, &shortener.ShortenRequest{Url: "https://example.com/limited/2"})
+	assert.Nil(t, err)
+	_, err = client.Shorten(fresh, &shortener.ShortenRequest{Url: "https://example.com/limited/3"})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "fresh sessions should share the bucket of their peer")
+
+	token, _, err := s.sessions.issueAt(uuid.New().String(), false, time.Now().Add(-12*time.Hour))
+	assert.Nil(t, err)
+	session := grpcmetadata.AppendToOutgoingContext(ctx, "session-token", token)
+	for i := 3; i <= 4; i++ {
+		_, err = client.Shorten(session, &shortener.ShortenRequest{Url: fmt.Sprintf("https://example.com/limited/%d", i)})
+		assert.Nil(t, err)
+	}
+	_, err = client.Shorten(session, &shortener.ShortenRequest{Url: "https://example.com/limited/5"}, grpc.Header(&header))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "sessions should have their own bucket")
+	assert.Len(t, header.Get("retry-after"), 1)
+
+	batch := &shortener.ShortenBatchRequest{Items: []*shortener.BatchItem{
+		{CorrelationId: "a", OriginalUrl: "https://example.com/limited/a"},
+		{CorrelationId: "b", OriginalUrl: "https://example.com/limited/b"},
+	}}
+	_, err = client.ShortenBatch(session, batch)
+	assert.Nil(t, err)
+	_, err = client.ShortenBatch(session, batch)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "batches should take a token per URL")
+
+	_, err = client.Expand(ctx, &shortener.ExpandRequest{Key: key})
+	assert.Nil(t, err)
+	_, err = client.Expand(ctx, &shortener.ExpandRequest{Key: key})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "anonymous calls should share the bucket of their peer")
+}
+
+func TestServer__openapiContract(t *testing.T) {
+	file, err := os.CreateTemp("", "cuttlink-test-*.txt")
+	assert.Nil(t, err)
+	defer os.Remove(file.Name())
+	tfs, _ := storage.NewFile(file.Name())
+	ls, _ := storage.NewFileStorage(tfs)
+	s, err := New(ls, developmentSessions, WithAuditLog(ls), WithAdminToken("contract"))
+	assert.Nil(t, err)
+	engine := s.srv.Handler.(*gin.Engine)
+	doc := s.openapi
+
+	undocumented := make(map[string]bool)
+	for path, item := range doc.Paths {
+		for method := range item {
+			undocumented[strings.ToUpper(method)+" "+path] = true
+		}
+	}
+	for _, route := range engine.Routes() {
+		path := openapi.GinPath(route.Path)
+		op := doc.Operation(route.Method, path)
+		if !assert.NotNil(t, op, "%s %s should be documented", route.Method, route.Path) {
+			continue
+		}
+		assert.True(t, strings.HasSuffix(route.Handler, "."+op.OperationID+"-fm"),
+			"%s %s is served by %s, not %s", route.Method, route.Path, route.Handler, op.OperationID)
+		delete(undocumented, route.Method+" "+path)
+	}
+	assert.Empty(t, undocumented, "documented operations should be served")
+
+	ts := httptest.NewServer(engine)
+	defer ts.Close()
+	newClient := func() *http.Client {
+		jar, _ := cookiejar.New(nil)
+		return &http.Client{Jar: jar, CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}}
+	}
+	exercised := make(map[string]bool)
+	call := func(client *http.Client, method string, path string, target string, contentType string, body string) (int, []byte) {
+		req, _ := http.NewRequest(method, ts.URL+target, strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if strings.HasPrefix(path, "/api/admin/") {
+			req.Header.Set(adminTokenHeader, "contract")
+		}
+		res, err := client.Do(req)
+		assert.Nil(t, err)
+		defer res.Body.Close()
+		data, err := io.ReadAll(res.Body)
+		assert.Nil(t, err)
+
+		op := doc.Operation(method, path)
+		if assert.NotNil(t, op, "%s %s should be documented", method, path) {
+			err := doc.ValidateResponse(op, res.StatusCode, res.Header.Get("Content-Type"), data)
+			assert.Nil(t, err, "%s %s answered %d %s", method, target, res.StatusCode, data)
+		}
+		exercised[method+" "+path] = true
+		return res.StatusCode, data
+	}
+	decode := func(data []byte, v interface{}) {
+		assert.Nil(t, json.Unmarshal(data, v), "body should be JSON: %s", data)
+	}
+	invalid := func(data []byte, field string) {
+		var problem Problem
+		decode(data, &problem)
+		assert.Equal(t, codeInvalidRequest, problem.Code)
+		assert.Equal(t, field, problem.Field)
+	}
+	keyOf := func(shortURL []byte) string {
+		return string(shortURL[bytes.LastIndexByte(shortURL, '/')+1:])
+	}
+	owner, recipient := newClient(), newClient()
+
+	code, data := call(owner, http.MethodPost, "/", "/", "text/plain; charset=utf-8", "https://example.com/contract/text")
+	assert.Equal(t, http.StatusCreated, code)
+	textKey := keyOf(data)
+	code, _ = call(owner, http.MethodPost, "/", "/", "text/plain; charset=utf-8", "https://example.com/contract/text")
+	assert.Equal(t, http.StatusConflict, code)
+	code, _ = call(owner, http.MethodPost, "/form-submit", "/form-submit", "application/x-www-form-urlencoded", "url=https%3A%2F%2Fexample.com%2Fcontract%2Fform")
+	assert.Equal(t, http.StatusCreated, code)
+	code, data = call(owner, http.MethodPost, "/form-submit", "/form-submit", "application/x-www-form-urlencoded", "link=https%3A%2F%2Fexample.com")
+	assert.Equal(t, http.StatusBadRequest, code)
+	invalid(data, "body.url")
+
+	code, data = call(owner, http.MethodPost, "/api/shorten", "/api/shorten", "application/json", `{"url":"https://example.com/contract/json"}`)
+	assert.Equal(t, http.StatusCreated, code)
+	var shortened ResponseJSON
+	decode(data, &shortened)
+	key := keyOf([]byte(shortened.Result))
+	code, data = call(owner, http.MethodPost, "/api/shorten", "/api/shorten", "application/json", `{"url":42}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	invalid(data, "body.url")
+	code, _ = call(owner, http.MethodPost, "/api/shorten", "/api/shorten", "application/xml", `<url/>`)
+	assert.Equal(t, http.StatusUnsupportedMediaType, code)
+	code, data = call(owner, http.MethodPost, "/api/shorten/batch", "/api/shorten/batch", "application/json",
+		`[{"correlation_id":"a","original_url":"https://example.com/contract/a"}]`)
+	assert.Equal(t, http.StatusCreated, code)
+	var batch []URLPairResponse
+	decode(data, &batch)
+	batchKey := keyOf([]byte(batch[0].ShortURL))
+
+	code, _ = call(owner, http.MethodGet, "/api/user/urls", "/api/user/urls", "", "")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = call(owner, http.MethodGet, "/api/user/urls/broken", "/api/user/urls/broken", "", "")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = call(owner, http.MethodPatch, "/api/user/urls/{id}", "/api/user/urls/"+key, "application/json", `{"title":"Contract","countdown":0}`)
+	assert.Equal(t, http.StatusOK, code)
+	code, data = call(owner, http.MethodPatch, "/api/user/urls/{id}", "/api/user/urls/"+key, "application/json", `{"countdown":99}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	invalid(data, "body.countdown")
+	code, _ = call(owner, http.MethodGet, "/api/user/urls/{id}/variants", "/api/user/urls/"+key+"/variants", "", "")
+	assert.Equal(t, http.StatusOK, code)
+
+	code, _ = call(owner, http.MethodGet, "/{id}", "/"+key, "", "")
+	assert.Equal(t, http.StatusTemporaryRedirect, code)
+	code, _ = call(owner, http.MethodGet, "/{id}", "/unknown", "", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = call(owner, http.MethodGet, "/{id}/{path}", "/"+key+"/extra/path", "", "")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, data = call(owner, http.MethodPost, "/api/user/keys", "/api/user/keys", "application/json", `{"name":"contract"}`)
+	assert.Equal(t, http.StatusCreated, code)
+	var apiKey APIKeyResponse
+	decode(data, &apiKey)
+	code, _ = call(owner, http.MethodGet, "/api/user/keys", "/api/user/keys", "", "")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = call(owner, http.MethodDelete, "/api/user/keys/{id}", "/api/user/keys/"+apiKey.ID, "", "")
+	assert.Equal(t, http.StatusNoContent, code)
+
+	code, data = call(recipient, http.MethodPost, "/api/user/register", "/api/user/register", "application/json",
+		`{"username":"recipient","email":"recipient@example.com","password":"contract-secret"}`)
+	assert.Equal(t, http.StatusCreated, code)
+	var account AccountResponse
+	decode(data, &account)
+	code, _ = call(recipient, http.MethodPost, "/api/user/logout", "/api/user/logout", "", "")
+	assert.Equal(t, http.StatusNoContent, code)
+	code, _ = call(recipient, http.MethodPost, "/api/user/login", "/api/user/login", "application/json",
+		`{"login":"recipient","password":"contract-secret"}`)
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = call(recipient, http.MethodGet, "/api/user/oidc/login", "/api/user/oidc/login", "", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = call(recipient, http.MethodGet, "/api/user/oidc/callback", "/api/user/oidc/callback?code=c&state=s", "", "")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, data = call(owner, http.MethodPost, "/api/workspaces", "/api/workspaces", "application/json", `{"name":"contract"}`)
+	assert.Equal(t, http.StatusCreated, code)
+	var workspace WorkspaceResponse
+	decode(data, &workspace)
+	code, _ = call(owner, http.MethodGet, "/api/workspaces", "/api/workspaces", "", "")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = call(owner, http.MethodPost, "/api/workspaces/{id}/members", "/api/workspaces/"+workspace.ID+"/members", "application/json",
+		fmt.Sprintf(`{"user_id":"%s","role":"viewer"}`, account.ID))
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = call(owner, http.MethodGet, "/api/workspaces/{id}/members", "/api/workspaces/"+workspace.ID+"/members", "", "")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = call(owner, http.MethodDelete, "/api/workspaces/{id}/members/{user}", "/api/workspaces/"+workspace.ID+"/members/"+account.ID, "", "")
+	assert.Equal(t, http.StatusNoContent, code)
+	code, _ = call(owner, http.MethodPost, "/api/workspaces/{id}/urls", "/api/workspaces/"+workspace.ID+"/urls", "application/json",
+		fmt.Sprintf(`["%s"]`, key))
+	assert.Equal(t, http.StatusOK, code)
+
+	code, data = call(owner, http.MethodPost, "/api/user/transfers", "/api/user/transfers", "application/json",
+		fmt.Sprintf(`{"keys":["%s"],"login":"recipient"}`, textKey))
+	assert.Equal(t, http.StatusCreated, code)
+	var transfer TransferResponse
+	decode(data, &transfer)
+	code, _ = call(recipient, http.MethodPost, "/api/user/transfers/accept", "/api/user/transfers/accept", "application/json",
+		fmt.Sprintf(`{"token":"%s"}`, transfer.Token))
+	assert.Equal(t, http.StatusOK, code)
+	code, data = call(owner, http.MethodPost, "/api/user/transfers", "/api/user/transfers", "application/json",
+		fmt.Sprintf(`{"keys":["%s"],"login":"recipient"}`, batchKey))
+	assert.Equal(t, http.StatusCreated, code)
+	decode(data, &transfer)
+	code, _ = call(owner, http.MethodDelete, "/api/user/transfers/{id}", "/api/user/transfers/"+transfer.ID, "", "")
+	assert.Equal(t, http.StatusNoContent, code)
+	code, _ = call(owner, http.MethodGet, "/api/user/audit", "/api/user/audit?limit=100", "", "")
+	assert.Equal(t, http.StatusOK, code)
+	code, data = call(owner, http.MethodGet, "/api/user/audit", "/api/user/audit?limit=all", "", "")
+	assert.Equal(t, http.StatusBadRequest, code)
+	invalid(data, "query.limit")
+
+	code, _ = call(owner, http.MethodGet, "/api/qr/{id}", "/api/qr/"+key+"?format=svg", "", "")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = call(owner, http.MethodPost, "/api/qr/batch", "/api/qr/batch", "application/json", fmt.Sprintf(`["%s"]`, key))
+	assert.Equal(t, http.StatusOK, code)
+
+	admin := newClient()
+	code, _ = call(admin, http.MethodGet, "/api/admin/urls", "/api/admin/urls?status=active&limit=10", "", "")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = call(admin, http.MethodGet, "/api/admin/urls/{id}", "/api/admin/urls/"+key, "", "")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = call(admin, http.MethodPost, "/api/admin/urls/{id}/disable", "/api/admin/urls/"+key+"/disable", "", "")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = call(admin, http.MethodPost, "/api/admin/urls/{id}/enable", "/api/admin/urls/"+key+"/enable", "", "")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = call(admin, http.MethodGet, "/api/admin/stats", "/api/admin/stats", "", "")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = call(admin, http.MethodDelete, "/api/admin/users/{id}/urls", "/api/admin/users/"+account.ID+"/urls", "", "")
+	assert.Equal(t, http.StatusOK, code)
+
+	code, _ = call(owner, http.MethodDelete, "/api/user/urls", "/api/user/urls", "application/json", fmt.Sprintf(`["%s"]`, batchKey))
+	assert.Equal(t, http.StatusAccepted, code)
+	code, _ = call(owner, http.MethodGet, "/api/openapi.json", "/api/openapi.json", "", "")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = call(owner, http.MethodGet, "/api/docs", "/api/docs", "", "")
+	assert.Equal(t, http.StatusOK, code)
+	call(owner, http.MethodGet, "/ping", "/ping", "", "")
+
+	for path, item := range doc.Paths {
+		for method := range item {
+			assert.True(t, exercised[strings.ToUpper(method)+" "+path], "%s %s should be exercised", strings.ToUpper(method), path)
+		}
+	}
+}
+
+func TestServer__problems(t *testing.T) {
+	ts := NewTestServer(t)
+	defer ts.Close()
+	key, err := ts.storage.SetURL(context.Background(), "https://example.com/deleted", "", "6a15c16b-b941-48b3-be78-8e539838d612")
+	assert.Nil(t, err)
+	assert.Nil(t, ts.storage.UpdateBatchURL(context.Background(), workers.RemovalTask{
+		Keys: []string{key},
+		UUID: "6a15c16b-b941-48b3-be78-8e539838d612",
+	}))
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        string
+		status      int
+		code        string
+	}{
+		{name: "content_type", method: http.MethodPost, path: "/", contentType: "application/json", body: "https://example.com", status: 415, code: codeInvalidContentType},
+		{name: "content_type_json", method: http.MethodPost, path: "/api/shorten", contentType: "text/plain", body: "https://example.com", status: 415, code: codeInvalidContentType},
+		{name: "validation", method: http.MethodPost, path: "/api/shorten", contentType: "application/json", body: `{}`, status: 400, code: codeInvalidRequest},
+		{name: "unknown_key", method: http.MethodGet, path: "/unknown", status: 404, code: codeUnknownKey},
+		{name: "deleted", method: http.MethodGet, path: "/" + key, status: 410, code: codeLinkDeleted},
+		{name: "qr_unknown_key", method: http.MethodGet, path: "/api/qr/unknown", status: 404, code: codeUnknownKey},
+		{name: "unknown_route", method: http.MethodPut, path: "/api/shorten", status: 404, code: codeNotFound},
+		{name: "admin_not_configured", method: http.MethodGet, path: "/api/admin/stats", status: 404, code: codeNotConfigured},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, ts.URL+tt.path, strings.NewReader(tt.body))
+			assert.Nil(t, err)
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			res, err := http.DefaultClient.Do(req)
+			assert.Nil(t, err)
+			defer res.Body.Close()
+
+			assert.Equal(t, tt.status, res.StatusCode, "http status codes should be equal")
+			assert.Equal(t, problemContentType, res.Header.Get("Content-Type"))
+			var problem Problem
+			assert.Nil(t, json.NewDecoder(res.Body).Decode(&problem))
+			assert.Equal(t, Problem{
+				Type:     "about:blank",
+				Title:    http.StatusText(tt.status),
+				Status:   tt.status,
+				Code:     tt.code,
+				Detail:   problem.Detail,
+				Instance: tt.path,
+				Field:    problem.Field,
+			}, problem)
+			assert.NotEmpty(t, problem.Detail)
+		})
+	}
+
+	res, err := http.Get(ts.URL + "/api/user/urls")
+	assert.Nil(t, err)
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	assert.Equal(t, http.StatusNoContent, res.StatusCode, "http status codes should be equal")
+	assert.Empty(t, body)
+}
+
+func TestServer__legacyErrors(t *testing.T) {
+	ts := NewTestServer(t, WithLegacyErrors(true))
+	defer ts.Close()
+	key, err := ts.storage.SetURL(context.Background(), "https://example.com/deleted", "", "6a15c16b-b941-48b3-be78-8e539838d612")
+	assert.Nil(t, err)
+	assert.Nil(t, ts.storage.UpdateBatchURL(context.Background(), workers.RemovalTask{
+		Keys: []string{key},
+		UUID: "6a15c16b-b941-48b3-be78-8e539838d612",
+	}))
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        string
+		status      int
+		want        string
+	}{
+		{name: "content_type", method: http.MethodPost, path: "/", contentType: "application/json", body: "https://example.com", status: 500, want: "Invalid Content-Type header"},
+		{name: "content_type_json", method: http.MethodPost, path: "/api/shorten", contentType: "text/plain", body: "https://example.com", status: 500, want: `{"message":"Invalid Content-Type header"}`},
+		{name: "validation", method: http.MethodPost, path: "/api/shorten", contentType: "application/json", body: `{}`, status: 400, want: `{"message":"body.url is required"}`},
+		{name: "unknown_key", method: http.MethodGet, path: "/unknown", status: 400, want: "Invalid key"},
+		{name: "deleted", method: http.MethodGet, path: "/" + key, status: 410},
+		{name: "qr_unknown_key", method: http.MethodGet, path: "/api/qr/unknown", status: 404, want: "Invalid key"},
+		{name: "unknown_route", method: http.MethodPut, path: "/api/shorten", status: 404, want: "404 page not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, ts.URL+tt.path, strings.NewReader(tt.body))
+			assert.Nil(t, err)
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			res, err := http.DefaultClient.Do(req)
+			assert.Nil(t, err)
+			defer res.Body.Close()
+			body, err := io.ReadAll(res.Body)
+			assert.Nil(t, err)
+
+			assert.Equal(t, tt.status, res.StatusCode, "http status codes should be equal")
+			assert.NotEqual(t, problemContentType, res.Header.Get("Content-Type"))
+			if strings.HasPrefix(tt.want, "{") {
+				assert.JSONEq(t, tt.want, string(body))
+			} else if tt.want != "" || tt.status == http.StatusGone {
+				assert.Equal(t, tt.want, string(body))
+			}
+		})
+	}
 }
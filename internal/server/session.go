@@ -2,73 +2,244 @@ package server
 
 import (
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
-	"encoding/hex"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"log"
 	"net/http"
-	"strings"
+	"net/url"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 )
 
 const (
-	sessionCookieName   = "cluid"
-	sessionCookieMaxAge = 86400
-	uuidHashKey         = "secret42"
+	sessionCookieName    = "cluid"
+	sessionContextKey    = "sessionID"
+	sessionNewContextKey = "sessionIssued"
+	sessionAgeContextKey = "sessionIssuedAt"
+	accountContextKey    = "sessionAccount"
+	defaultSessionTTL    = 24 * time.Hour
+	sessionPayloadLen    = 16 + 8 + 8 + 1
+	sessionFlagAccount   = 1
 )
 
-func generateCookieToken() string {
-	id, err := uuid.New().MarshalBinary()
+var (
+	ErrSessionTampered = errors.New("session token signature mismatch")
+	ErrSessionExpired  = errors.New("session token expired")
+	ErrNoSessionSecret = errors.New("no session secret configured")
+)
+
+// SessionConfig holds the signing secrets, newest first. Tokens are signed
+// with the first secret and accepted with any of them, so a secret can be
+// rotated by prepending its successor and dropping it after TTL. Only
+// Development allows starting without secrets, with a random one that does
+// not survive a restart.
+type SessionConfig struct {
+	Secrets     []string
+	TTL         time.Duration
+	Development bool
+}
+
+type session struct {
+	ID        string
+	Account   bool
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+// sessionManager issues and verifies session tokens of the form
+// base64url(uuid || issued at || expires at || flags || HMAC-SHA256).
+type sessionManager struct {
+	keys   [][]byte
+	ttl    time.Duration
+	path   string
+	secure bool
+	now    func() time.Time
+}
+
+func WithSessions(config SessionConfig) ServerOption {
+	return func(s *Server) error {
+		s.sessionConfig = config
+		return nil
+	}
+}
+
+// newSessionManager derives the cookie attributes from the service URL:
+// cookies are host-only, scoped to its path and Secure for https.
+func newSessionManager(config SessionConfig, serviceHost string) (*sessionManager, error) {
+	u, err := url.Parse(serviceHost)
 	if err != nil {
-		return ""
+		return nil, err
+	}
+	m := &sessionManager{
+		ttl:    config.TTL,
+		path:   u.Path,
+		secure: u.Scheme == "https",
+		now:    time.Now,
+	}
+	if m.path == "" {
+		m.path = "/"
+	}
+	if m.ttl <= 0 {
+		m.ttl = defaultSessionTTL
 	}
-	h := hmac.New(sha256.New, []byte(uuidHashKey))
-	h.Write(id)
-	sign := h.Sum(nil)
-	token := append(id, sign...)
 
-	return hex.EncodeToString(token)
+	for _, secret := range config.Secrets {
+		if secret != "" {
+			m.keys = append(m.keys, []byte(secret))
+		}
+	}
+	if len(m.keys) == 0 {
+		if !config.Development {
+			return nil, ErrNoSessionSecret
+		}
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		m.keys = [][]byte{key}
+		log.Print("no session secret configured, sessions will not survive a restart")
+	}
+
+	return m, nil
+}
+
+func (m *sessionManager) issue() (string, session, error) {
+	return m.issueFor(uuid.New().String(), false)
+}
+
+// issueFor starts a session of the given user. Account sessions belong to a
+// registered user and are never claimed by another login.
+func (m *sessionManager) issueFor(id string, account bool) (string, session, error) {
+	return m.issueAt(id, account, m.now())
 }
 
-func validateCookieToken(token string) bool {
-	data, err := hex.DecodeString(token)
-	if err != nil || len(data) < 32 {
-		return false
+func (m *sessionManager) issueAt(id string, account bool, now time.Time) (string, session, error) {
+	parsed, err := uuid.Parse(id)
+	if err != nil {
+		return "", session{}, err
+	}
+	now = now.UTC().Truncate(time.Second)
+	sess := session{
+		ID:        parsed.String(),
+		Account:   account,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(m.ttl),
+	}
+
+	payload := make([]byte, sessionPayloadLen)
+	copy(payload, parsed[:])
+	binary.BigEndian.PutUint64(payload[16:], uint64(sess.IssuedAt.Unix()))
+	binary.BigEndian.PutUint64(payload[24:], uint64(sess.ExpiresAt.Unix()))
+	if account {
+		payload[32] = sessionFlagAccount
 	}
-	id := data[:16]
-	h := hmac.New(sha256.New, []byte(uuidHashKey))
-	h.Write(id)
-	sign := h.Sum(nil)
+	token := append(payload, sign(m.keys[0], payload)...)
 
-	return hmac.Equal(sign, data[:16])
+	return base64.RawURLEncoding.EncodeToString(token), sess, nil
 }
 
-func cookieAuthentication() gin.HandlerFunc {
+func (m *sessionManager) parse(token string) (session, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(data) != sessionPayloadLen+sha256.Size {
+		return session{}, ErrSessionTampered
+	}
+	payload, signature := data[:sessionPayloadLen], data[sessionPayloadLen:]
+
+	valid := false
+	for _, key := range m.keys {
+		if hmac.Equal(sign(key, payload), signature) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return session{}, ErrSessionTampered
+	}
+
+	id, err := uuid.FromBytes(payload[:16])
+	if err != nil {
+		return session{}, ErrSessionTampered
+	}
+	sess := session{
+		ID:        id.String(),
+		IssuedAt:  time.Unix(int64(binary.BigEndian.Uint64(payload[16:])), 0).UTC(),
+		ExpiresAt: time.Unix(int64(binary.BigEndian.Uint64(payload[24:])), 0).UTC(),
+		Account:   payload[32]&sessionFlagAccount != 0,
+	}
+	if !m.now().Before(sess.ExpiresAt) {
+		return sess, ErrSessionExpired
+	}
+
+	return sess, nil
+}
+
+func (m *sessionManager) setCookie(ctx *gin.Context, token string) {
+	http.SetCookie(ctx.Writer, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     m.path,
+		MaxAge:   int(m.ttl.Seconds()),
+		Secure:   m.secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func sign(key []byte, payload []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+// sessionAuthentication resolves the cluid cookie to a session. Requests
+// without one, or with an expired one, are given a new session. Cookies that
+// fail verification are rejected on API routes and replaced on the public
+// ones, so redirects keep working for visitors with stale cookies.
+func (s *Server) sessionAuthentication() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		cookie, err := ctx.Cookie(sessionCookieName)
-		if validateCookieToken(cookie) {
-			http.Error(ctx.Writer, err.Error(), http.StatusUnauthorized)
-			return
-		} else if err != nil {
-			token := generateCookieToken()
-			ctx.SetCookie(sessionCookieName, token, sessionCookieMaxAge, "/", "localhost", false, true)
+		if _, ok := getAPIKey(ctx); ok {
 			ctx.Next()
+			return
+		}
+
+		if token, err := ctx.Cookie(sessionCookieName); err == nil {
+			sess, err := s.sessions.parse(token)
+			if err == nil {
+				ctx.Set(sessionContextKey, sess.ID)
+				ctx.Set(sessionAgeContextKey, sess.IssuedAt)
+				ctx.Set(accountContextKey, sess.Account)
+				ctx.Next()
+				return
+			}
+			if !errors.Is(err, ErrSessionExpired) && isAPIRoute(ctx) {
+				abortWithError(ctx, http.StatusUnauthorized, codeInvalidSession, "Invalid session")
+				return
+			}
 		}
+
+		token, sess, err := s.sessions.issue()
+		if err != nil {
+			abortWithError(ctx, http.StatusInternalServerError, codeInternalError, "Internal server error")
+			return
+		}
+		s.sessions.setCookie(ctx, token)
+		ctx.Set(sessionContextKey, sess.ID)
+		ctx.Set(sessionNewContextKey, true)
 		ctx.Next()
 	}
 }
 
 func getUUID(ctx *gin.Context) (string, error) {
-	token, err := ctx.Cookie(sessionCookieName)
-	if err != nil {
-		h := ctx.Writer.Header().Values("Set-Cookie")[0]
-		c := strings.Split(h, ";")[0]
-		t := strings.Split(c, "=")[1]
-		d, _ := hex.DecodeString(t)
-		i, _ := uuid.FromBytes(d[:16])
-		return i.String(), nil
-	}
-	data, _ := hex.DecodeString(token)
-	id, _ := uuid.FromBytes(data[:16])
-	return id.String(), nil
+	if key, ok := getAPIKey(ctx); ok {
+		return key.UserID, nil
+	}
+	if id := ctx.GetString(sessionContextKey); id != "" {
+		return id, nil
+	}
+	return "", errors.New("request is not authenticated")
 }
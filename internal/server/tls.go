@@ -0,0 +1,31 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strings"
+)
+
+// WithTLS serves HTTPS with the config, which provides the certificates.
+func WithTLS(config *tls.Config) ServerOption {
+	return func(s *Server) error {
+		s.tlsConfig = config
+		return nil
+	}
+}
+
+// WithHTTPSRedirect listens for plain HTTP on address and redirects every
+// request to the same path under BASE_URL. It requires WithTLS.
+func WithHTTPSRedirect(address string) ServerOption {
+	return func(s *Server) error {
+		s.redirectHost = address
+		return nil
+	}
+}
+
+func httpsRedirect(baseURL string) http.Handler {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, baseURL+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
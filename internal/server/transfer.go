@@ -0,0 +1,204 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/avtorsky/cuttlink/internal/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const (
+	transferTokenPrefix = "clt_"
+	transferTTL         = 7 * 24 * time.Hour
+	maxTransferKeys     = 1000
+)
+
+// TransferRequest names the recipient by user id, or by username or email
+// of an account.
+type TransferRequest struct {
+	Keys   []string `json:"keys" binding:"required"`
+	UserID string   `json:"user_id"`
+	Login  string   `json:"login"`
+}
+
+type AcceptTransferRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// TransferResponse carries the one-time token only right after creation,
+// the sender passes it on to the recipient.
+type TransferResponse struct {
+	ID         string     `json:"id"`
+	Keys       []string   `json:"keys"`
+	FromUserID string     `json:"from_user_id"`
+	ToUserID   string     `json:"to_user_id"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	AcceptedAt *time.Time `json:"accepted_at,omitempty"`
+	Token      string     `json:"token,omitempty"`
+}
+
+func (s *Server) createTransfer(ctx *gin.Context) {
+	sessionID, err := getUUID(ctx)
+	if err != nil {
+		return
+	}
+
+	var payload TransferRequest
+	if err := ctx.ShouldBindJSON(&payload); err != nil || (payload.Login == "") == (payload.UserID == "") {
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidPayload, "Invalid payload, expected keys and either login or user_id")
+		return
+	}
+	keys := uniqueKeys(payload.Keys)
+	if len(keys) == 0 || len(keys) > maxTransferKeys {
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidRequest, "Keys must list 1 to 1000 links")
+		return
+	}
+
+	recipient := payload.UserID
+	if payload.Login != "" {
+		user, err := s.storage.GetUserByLogin(ctx.Request.Context(), strings.TrimSpace(payload.Login))
+		if errors.Is(err, storage.ErrUnknownUser) {
+			abortWithError(ctx, http.StatusNotFound, codeUnknownUser, "Unknown user")
+			return
+		}
+		if err != nil {
+			abortWithStorageError(ctx)
+			return
+		}
+		recipient = user.ID
+	} else if parsed, err := uuid.Parse(recipient); err != nil {
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidRequest, "Invalid user id")
+		return
+	} else {
+		recipient = parsed.String()
+	}
+	if recipient == sessionID {
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidRequest, "Links already belong to the recipient")
+		return
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		abortWithError(ctx, http.StatusInternalServerError, codeInternalError, "Internal server error")
+		return
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		abortWithError(ctx, http.StatusInternalServerError, codeInternalError, "Internal server error")
+		return
+	}
+	token := transferTokenPrefix + secret
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	transfer := storage.Transfer{
+		ID:         id,
+		FromUserID: sessionID,
+		ToUserID:   recipient,
+		Keys:       keys,
+		TokenHash:  hashToken(token),
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(transferTTL),
+	}
+	err = s.storage.CreateTransfer(ctx.Request.Context(), transfer)
+	if !s.transferError(ctx, err) {
+		return
+	}
+
+	response := newTransferResponse(transfer)
+	response.Token = token
+	ctx.JSON(http.StatusCreated, response)
+}
+
+// acceptTransfer moves the links to the recipient, all of them or none if
+// any has changed hands or was deleted since the transfer was offered.
+func (s *Server) acceptTransfer(ctx *gin.Context) {
+	sessionID, err := getUUID(ctx)
+	if err != nil {
+		return
+	}
+
+	var payload AcceptTransferRequest
+	if err := ctx.ShouldBindJSON(&payload); err != nil {
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidPayload, "Invalid payload")
+		return
+	}
+
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	transfer, err := s.storage.AcceptTransfer(ctx.Request.Context(), hashToken(payload.Token), sessionID, now)
+	if !s.transferError(ctx, err) {
+		return
+	}
+	s.audit(ctx, sessionID, storage.AuditTransfer, transfer.Keys,
+		auditEach(transfer.Keys, gin.H{"user_id": transfer.FromUserID}),
+		auditEach(transfer.Keys, gin.H{"user_id": transfer.ToUserID}))
+	ctx.JSON(http.StatusOK, newTransferResponse(*transfer))
+}
+
+func (s *Server) cancelTransfer(ctx *gin.Context) {
+	sessionID, err := getUUID(ctx)
+	if err != nil {
+		return
+	}
+
+	err = s.storage.CancelTransfer(ctx.Request.Context(), ctx.Param("id"), sessionID, time.Now().UTC())
+	if !s.transferError(ctx, err) {
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// transferError answers the storage errors of transfers, it reports whether
+// the request may go on.
+func (s *Server) transferError(ctx *gin.Context, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, storage.ErrUnknownTransfer):
+		abortWithError(ctx, http.StatusNotFound, codeUnknownTransfer, "Unknown transfer")
+	case errors.Is(err, storage.ErrTransferClosed):
+		abortWithError(ctx, http.StatusGone, codeTransferClosed, "Transfer already accepted, cancelled or expired")
+	case errors.Is(err, storage.ErrInvalidKey):
+		abortWithProblem(ctx, Problem{
+			Status: http.StatusConflict,
+			Code:   codeUnknownKey,
+			Detail: "Invalid or deleted key",
+			Error:  err.Error(),
+		})
+	case errors.Is(err, storage.ErrNotOwner):
+		abortWithProblem(ctx, Problem{
+			Status: http.StatusForbidden,
+			Code:   codeNotOwner,
+			Detail: "Key not owned by the sender outside of workspaces",
+			Error:  err.Error(),
+		})
+	default:
+		abortWithStorageError(ctx)
+	}
+	return false
+}
+
+func newTransferResponse(transfer storage.Transfer) TransferResponse {
+	return TransferResponse{
+		ID:         transfer.ID,
+		Keys:       transfer.Keys,
+		FromUserID: transfer.FromUserID,
+		ToUserID:   transfer.ToUserID,
+		ExpiresAt:  transfer.ExpiresAt,
+		AcceptedAt: transfer.AcceptedAt,
+	}
+}
+
+func uniqueKeys(keys []string) []string {
+	seen := make(map[string]bool, len(keys))
+	result := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if key != "" && !seen[key] {
+			seen[key] = true
+			result = append(result, key)
+		}
+	}
+	return result
+}
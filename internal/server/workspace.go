@@ -0,0 +1,296 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/avtorsky/cuttlink/internal/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const maxWorkspaceName = 100
+
+type WorkspaceRequest struct {
+	Name string `json:"name" binding:"required"`
+}
+
+type WorkspaceResponse struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// MemberRequest invites a user by username or email, or by user id for
+// users without a local account, e.g. from single sign-on.
+type MemberRequest struct {
+	Login  string `json:"login"`
+	UserID string `json:"user_id"`
+	Role   string `json:"role" binding:"required"`
+}
+
+type MemberResponse struct {
+	UserID    string    `json:"user_id"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type MoveURLsResponse struct {
+	Moved []string `json:"moved"`
+}
+
+func (s *Server) createWorkspace(ctx *gin.Context) {
+	sessionID, err := getUUID(ctx)
+	if err != nil {
+		return
+	}
+
+	var payload WorkspaceRequest
+	if err := ctx.ShouldBindJSON(&payload); err != nil {
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidPayload, "Invalid payload")
+		return
+	}
+	name := strings.TrimSpace(payload.Name)
+	if name == "" || utf8.RuneCountInString(name) > maxWorkspaceName {
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidRequest, "Name must be 1 to 100 characters long")
+		return
+	}
+
+	workspace := storage.Workspace{
+		ID:        uuid.New().String(),
+		Name:      name,
+		CreatedBy: sessionID,
+		CreatedAt: time.Now().UTC().Truncate(time.Microsecond),
+		Role:      storage.RoleOwner,
+	}
+	if err := s.storage.CreateWorkspace(ctx.Request.Context(), workspace); err != nil {
+		abortWithStorageError(ctx)
+		return
+	}
+	ctx.JSON(http.StatusCreated, newWorkspaceResponse(workspace))
+}
+
+func (s *Server) getWorkspaces(ctx *gin.Context) {
+	sessionID, err := getUUID(ctx)
+	if err != nil {
+		return
+	}
+
+	workspaces, err := s.storage.GetUserWorkspaces(ctx.Request.Context(), sessionID)
+	if err != nil {
+		abortWithStorageError(ctx)
+		return
+	}
+	result := make([]WorkspaceResponse, len(workspaces))
+	for i := range workspaces {
+		result[i] = newWorkspaceResponse(workspaces[i])
+	}
+	ctx.JSON(http.StatusOK, result)
+}
+
+func (s *Server) getWorkspaceMembers(ctx *gin.Context) {
+	sessionID, err := getUUID(ctx)
+	if err != nil {
+		return
+	}
+	workspaceID := ctx.Param("id")
+	if !s.authorizeWorkspace(ctx, workspaceID, sessionID, storage.RoleViewer) {
+		return
+	}
+
+	members, err := s.storage.GetWorkspaceMembers(ctx.Request.Context(), workspaceID)
+	if err != nil {
+		abortWithStorageError(ctx)
+		return
+	}
+	result := make([]MemberResponse, len(members))
+	for i := range members {
+		result[i] = newMemberResponse(members[i])
+	}
+	ctx.JSON(http.StatusOK, result)
+}
+
+// setWorkspaceMember invites a user or changes their role. Only owners manage
+// members, and the last owner can't step down.
+func (s *Server) setWorkspaceMember(ctx *gin.Context) {
+	sessionID, err := getUUID(ctx)
+	if err != nil {
+		return
+	}
+	workspaceID := ctx.Param("id")
+	if !s.authorizeWorkspace(ctx, workspaceID, sessionID, storage.RoleOwner) {
+		return
+	}
+
+	var payload MemberRequest
+	if err := ctx.ShouldBindJSON(&payload); err != nil || (payload.Login == "") == (payload.UserID == "") {
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidPayload, "Invalid payload, expected either login or user_id and a role")
+		return
+	}
+	if !storage.ValidRole(payload.Role) {
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidRequest, "Role must be owner, editor or viewer")
+		return
+	}
+
+	userID := payload.UserID
+	if payload.Login != "" {
+		user, err := s.storage.GetUserByLogin(ctx.Request.Context(), strings.TrimSpace(payload.Login))
+		if errors.Is(err, storage.ErrUnknownUser) {
+			abortWithError(ctx, http.StatusNotFound, codeUnknownUser, "Unknown user")
+			return
+		}
+		if err != nil {
+			abortWithStorageError(ctx)
+			return
+		}
+		userID = user.ID
+	} else if parsed, err := uuid.Parse(userID); err != nil {
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidRequest, "Invalid user id")
+		return
+	} else {
+		userID = parsed.String()
+	}
+
+	member := storage.Member{
+		WorkspaceID: workspaceID,
+		UserID:      userID,
+		Role:        payload.Role,
+		CreatedAt:   time.Now().UTC().Truncate(time.Microsecond),
+	}
+	err = s.storage.SetWorkspaceMember(ctx.Request.Context(), member)
+	switch {
+	case errors.Is(err, storage.ErrLastOwner):
+		abortWithError(ctx, http.StatusConflict, codeLastOwner, "Workspace must keep at least one owner")
+		return
+	case err != nil:
+		abortWithStorageError(ctx)
+		return
+	}
+	ctx.JSON(http.StatusOK, newMemberResponse(member))
+}
+
+// removeWorkspaceMember is open to owners and to members leaving on their own.
+func (s *Server) removeWorkspaceMember(ctx *gin.Context) {
+	sessionID, err := getUUID(ctx)
+	if err != nil {
+		return
+	}
+	workspaceID, userID := ctx.Param("id"), ctx.Param("user")
+	required := storage.RoleOwner
+	if userID == sessionID {
+		required = storage.RoleViewer
+	}
+	if !s.authorizeWorkspace(ctx, workspaceID, sessionID, required) {
+		return
+	}
+
+	err = s.storage.RemoveWorkspaceMember(ctx.Request.Context(), workspaceID, userID)
+	switch {
+	case errors.Is(err, storage.ErrNotMember):
+		abortWithError(ctx, http.StatusNotFound, codeNotMember, "Not a member of the workspace")
+	case errors.Is(err, storage.ErrLastOwner):
+		abortWithError(ctx, http.StatusConflict, codeLastOwner, "Workspace must keep at least one owner")
+	case err != nil:
+		abortWithStorageError(ctx)
+	default:
+		ctx.Status(http.StatusNoContent)
+	}
+}
+
+// moveWorkspaceURLs moves links into the workspace. Links the user may not
+// edit are skipped, the response lists the moved ones.
+func (s *Server) moveWorkspaceURLs(ctx *gin.Context) {
+	sessionID, err := getUUID(ctx)
+	if err != nil {
+		return
+	}
+	workspaceID := ctx.Param("id")
+	if !s.authorizeWorkspace(ctx, workspaceID, sessionID, storage.RoleEditor) {
+		return
+	}
+
+	var keys []string
+	if err := ctx.ShouldBindJSON(&keys); err != nil {
+		abortWithError(ctx, http.StatusBadRequest, codeInvalidPayload, "URL keys parse error")
+		return
+	}
+	previous := make(map[string]string, len(keys))
+	for _, key := range keys {
+		if row, err := s.storage.GetURL(ctx.Request.Context(), key); err == nil {
+			previous[key] = row.WorkspaceID
+		}
+	}
+	moved, err := s.storage.MoveURLs(ctx.Request.Context(), keys, workspaceID, sessionID)
+	if err != nil {
+		abortWithStorageError(ctx)
+		return
+	}
+	before := make(storage.AuditState, len(moved))
+	for _, key := range moved {
+		before[key] = gin.H{"workspace_id": previous[key]}
+	}
+	s.audit(ctx, sessionID, storage.AuditMove, moved, before, auditEach(moved, gin.H{"workspace_id": workspaceID}))
+	ctx.JSON(http.StatusOK, MoveURLsResponse{Moved: moved})
+}
+
+// authorizeWorkspace answers with 404 for unknown workspaces and those the
+// user is not a member of, and with 403 when their role is insufficient.
+func (s *Server) authorizeWorkspace(ctx *gin.Context, workspaceID string, userID string, required string) bool {
+	role, err := s.storage.GetWorkspaceRole(ctx.Request.Context(), workspaceID, userID)
+	switch {
+	case errors.Is(err, storage.ErrUnknownWorkspace), errors.Is(err, storage.ErrNotMember):
+		abortWithError(ctx, http.StatusNotFound, codeUnknownWorkspace, "Unknown workspace")
+		return false
+	case err != nil:
+		abortWithStorageError(ctx)
+		return false
+	case !storage.RoleAllows(role, required):
+		abortWithError(ctx, http.StatusForbidden, codeInsufficientRole, "Workspace role does not allow this request")
+		return false
+	}
+	return true
+}
+
+// authorizeURL loads the link and checks the role of the user for it, which
+// is owner for their own links and the membership role for workspace links.
+func (s *Server) authorizeURL(ctx *gin.Context, key string, userID string, required string) (*storage.Row, bool) {
+	row, err := s.storage.GetURL(ctx.Request.Context(), key)
+	if err != nil {
+		abortWithError(ctx, http.StatusNotFound, codeUnknownKey, "Invalid key")
+		return nil, false
+	}
+	role, err := s.storage.GetURLRole(ctx.Request.Context(), key, userID)
+	switch {
+	case errors.Is(err, storage.ErrNotOwner):
+		abortWithError(ctx, http.StatusForbidden, codeNotOwner, "Key owned by another user")
+		return nil, false
+	case err != nil:
+		abortWithStorageError(ctx)
+		return nil, false
+	case !storage.RoleAllows(role, required):
+		abortWithError(ctx, http.StatusForbidden, codeInsufficientRole, "Workspace role does not allow this request")
+		return nil, false
+	}
+	return row, true
+}
+
+func newWorkspaceResponse(workspace storage.Workspace) WorkspaceResponse {
+	return WorkspaceResponse{
+		ID:        workspace.ID,
+		Name:      workspace.Name,
+		Role:      workspace.Role,
+		CreatedAt: workspace.CreatedAt,
+	}
+}
+
+func newMemberResponse(member storage.Member) MemberResponse {
+	return MemberResponse{
+		UserID:    member.UserID,
+		Role:      member.Role,
+		CreatedAt: member.CreatedAt,
+	}
+}
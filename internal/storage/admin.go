@@ -0,0 +1,319 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+const (
+	URLStatusActive   = "active"
+	URLStatusDeleted  = "deleted"
+	URLStatusDisabled = "disabled"
+
+	defaultURLQueryLimit = 100
+)
+
+// URLQuery selects links across all users for operators. Search matches the
+// key, the destination, the submitted URL and the titles, ignoring case.
+type URLQuery struct {
+	Search      string
+	UserID      string
+	WorkspaceID string
+	Status      string
+	Limit       int
+	Offset      int
+}
+
+// URLStats are the totals of a backend. Active links are neither deleted
+// nor disabled.
+type URLStats struct {
+	Backend  string `json:"backend" db:"-"`
+	Total    int    `json:"total" db:"total"`
+	Active   int    `json:"active" db:"active"`
+	Deleted  int    `json:"deleted" db:"deleted"`
+	Disabled int    `json:"disabled" db:"disabled"`
+	Owners   int    `json:"owners" db:"owners"`
+}
+
+func ValidURLStatus(status string) bool {
+	switch status {
+	case "", URLStatusActive, URLStatusDeleted, URLStatusDisabled:
+		return true
+	}
+	return false
+}
+
+func (ms *InMemoryStorage) SearchURLs(ctx context.Context, query URLQuery) ([]Row, int, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	rows, total := searchURLs(ms.urls, query)
+	return rows, total, nil
+}
+
+func (ms *InMemoryStorage) SetURLDisabled(ctx context.Context, key string, disabled bool) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	row, ok := ms.urls[key]
+	if !ok {
+		return ErrInvalidKey
+	}
+	row.IsDisabled = disabled
+	ms.urls[key] = row
+
+	return nil
+}
+
+func (ms *InMemoryStorage) DeleteOwnerURLs(ctx context.Context, userID string) ([]string, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	deleted := make([]string, 0)
+	for key, row := range ms.urls {
+		if row.UUID == userID && !row.IsDeleted {
+			row.IsDeleted = true
+			ms.urls[key] = row
+			deleted = append(deleted, key)
+		}
+	}
+	return deleted, nil
+}
+
+func (ms *InMemoryStorage) GetURLStats(ctx context.Context) (URLStats, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	return urlStats("memory", ms.urls), nil
+}
+
+func (fs *FileStorage) SearchURLs(ctx context.Context, query URLQuery) ([]Row, int, error) {
+	fs.RLock()
+	defer fs.RUnlock()
+
+	rows, total := searchURLs(fs.urls, query)
+	return rows, total, nil
+}
+
+func (fs *FileStorage) SetURLDisabled(ctx context.Context, key string, disabled bool) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	row, ok := fs.urls[key]
+	if !ok {
+		return ErrInvalidKey
+	}
+	row.IsDisabled = disabled
+	fs.urls[key] = row
+
+	return fs.storage.InsertFS(row)
+}
+
+func (fs *FileStorage) DeleteOwnerURLs(ctx context.Context, userID string) ([]string, error) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	deleted := make([]string, 0)
+	for key, row := range fs.urls {
+		if row.UUID != userID || row.IsDeleted {
+			continue
+		}
+		row.IsDeleted = true
+		fs.urls[key] = row
+		if err := fs.storage.InsertFS(row); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, key)
+	}
+	return deleted, nil
+}
+
+func (fs *FileStorage) GetURLStats(ctx context.Context) (URLStats, error) {
+	fs.RLock()
+	defer fs.RUnlock()
+
+	return urlStats("file", fs.urls), nil
+}
+
+func (db *DB) SearchURLs(ctx context.Context, query URLQuery) ([]Row, int, error) {
+	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
+	defer cancel()
+
+	conditions := make([]string, 0)
+	args := make([]interface{}, 0)
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if query.Search != "" {
+		p := arg("%" + escapeLike(query.Search) + "%")
+		conditions = append(conditions, fmt.Sprintf(`(id::text ILIKE %[1]s OR original_url ILIKE %[1]s
+			OR original_input ILIKE %[1]s OR title ILIKE %[1]s OR page_title ILIKE %[1]s)`, p))
+	}
+	if query.UserID != "" {
+		conditions = append(conditions, "user_id="+arg(query.UserID))
+	}
+	if query.WorkspaceID != "" {
+		conditions = append(conditions, "workspace_id="+arg(query.WorkspaceID))
+	}
+	switch query.Status {
+	case URLStatusActive:
+		conditions = append(conditions, "is_deleted=FALSE AND is_disabled=FALSE")
+	case URLStatusDeleted:
+		conditions = append(conditions, "is_deleted=TRUE")
+	case URLStatusDisabled:
+		conditions = append(conditions, "is_disabled=TRUE")
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	if err := db.storage.GetContext(ctxDB, &total, "SELECT COUNT(*) FROM cuttlink"+where, args...); err != nil {
+		return nil, 0, err
+	}
+	limit, offset := urlQueryPage(query)
+	q := "SELECT * FROM cuttlink" + where + " ORDER BY id LIMIT " + arg(limit) + " OFFSET " + arg(offset)
+	items := make([]Row, 0)
+	if err := db.storage.SelectContext(ctxDB, &items, q, args...); err != nil {
+		return nil, 0, err
+	}
+
+	return items, total, nil
+}
+
+func (db *DB) SetURLDisabled(ctx context.Context, key string, disabled bool) error {
+	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
+	defer cancel()
+
+	result, err := db.storage.ExecContext(ctxDB, "UPDATE cuttlink SET is_disabled=$1 WHERE id=$2", disabled, key)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrInvalidKey
+	}
+	return err
+}
+
+func (db *DB) DeleteOwnerURLs(ctx context.Context, userID string) ([]string, error) {
+	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
+	defer cancel()
+
+	query := "UPDATE cuttlink SET is_deleted=TRUE WHERE user_id=$1 AND is_deleted=FALSE RETURNING id"
+	deleted := make([]string, 0)
+	if err := db.storage.SelectContext(ctxDB, &deleted, query, userID); err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+func (db *DB) GetURLStats(ctx context.Context) (URLStats, error) {
+	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
+	defer cancel()
+
+	query := `SELECT COUNT(*) AS total,
+		COUNT(*) FILTER (WHERE is_deleted=FALSE AND is_disabled=FALSE) AS active,
+		COUNT(*) FILTER (WHERE is_deleted=TRUE) AS deleted,
+		COUNT(*) FILTER (WHERE is_disabled=TRUE) AS disabled,
+		COUNT(DISTINCT user_id) AS owners
+		FROM cuttlink`
+	var stats URLStats
+	if err := db.storage.GetContext(ctxDB, &stats, query); err != nil {
+		return stats, err
+	}
+	stats.Backend = "postgres"
+
+	return stats, nil
+}
+
+func (q URLQuery) matches(row Row) bool {
+	if q.UserID != "" && row.UUID != q.UserID {
+		return false
+	}
+	if q.WorkspaceID != "" && row.WorkspaceID != q.WorkspaceID {
+		return false
+	}
+	switch q.Status {
+	case URLStatusActive:
+		if row.IsDeleted || row.IsDisabled {
+			return false
+		}
+	case URLStatusDeleted:
+		if !row.IsDeleted {
+			return false
+		}
+	case URLStatusDisabled:
+		if !row.IsDisabled {
+			return false
+		}
+	}
+	if q.Search == "" {
+		return true
+	}
+	search := strings.ToLower(q.Search)
+	for _, field := range []string{row.Key, row.Value, row.Original, row.Title, row.PageTitle} {
+		if strings.Contains(strings.ToLower(field), search) {
+			return true
+		}
+	}
+	return false
+}
+
+func searchURLs(urls map[string]Row, query URLQuery) ([]Row, int) {
+	data := make([]Row, 0)
+	for _, row := range urls {
+		if query.matches(row) {
+			data = append(data, row)
+		}
+	}
+	sortRows(data)
+
+	total := len(data)
+	limit, offset := urlQueryPage(query)
+	if offset >= total {
+		return make([]Row, 0), total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	return data[offset:end], total
+}
+
+func urlQueryPage(query URLQuery) (int, int) {
+	limit, offset := query.Limit, query.Offset
+	if limit <= 0 {
+		limit = defaultURLQueryLimit
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	return limit, offset
+}
+
+func urlStats(backend string, urls map[string]Row) URLStats {
+	stats := URLStats{Backend: backend}
+	owners := make(map[string]struct{})
+	for _, row := range urls {
+		stats.Total++
+		switch {
+		case row.IsDeleted:
+			stats.Deleted++
+		case !row.IsDisabled:
+			stats.Active++
+		}
+		if row.IsDisabled {
+			stats.Disabled++
+		}
+		owners[row.UUID] = struct{}{}
+	}
+	stats.Owners = len(owners)
+	return stats
+}
+
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+)
+
+const apiKeyRecord = "api_key"
+
+var ErrUnknownAPIKey = errors.New("unknown api key")
+
+// APIKey is a long-lived credential of a user. Only the SHA-256 of the
+// secret is kept, Prefix is its first characters for telling keys apart.
+type APIKey struct {
+	ID        string     `db:"id" json:"id"`
+	UserID    string     `db:"user_id" json:"user_id"`
+	Name      string     `db:"name" json:"name"`
+	Prefix    string     `db:"prefix" json:"prefix"`
+	Hash      string     `db:"hash" json:"hash"`
+	Scope     string     `db:"scope" json:"scope"`
+	CreatedAt time.Time  `db:"created_at" json:"created_at"`
+	RevokedAt *time.Time `db:"revoked_at" json:"revoked_at,omitempty"`
+}
+
+func (k APIKey) IsRevoked() bool {
+	return k.RevokedAt != nil
+}
+
+func (ms *InMemoryStorage) SetAPIKey(ctx context.Context, key APIKey) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	ms.apiKeys[key.ID] = key
+	return nil
+}
+
+func (ms *InMemoryStorage) GetAPIKeyByHash(ctx context.Context, hash string) (*APIKey, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	return findAPIKey(ms.apiKeys, hash)
+}
+
+func (ms *InMemoryStorage) GetUserAPIKeys(ctx context.Context, userID string) ([]APIKey, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	return userAPIKeys(ms.apiKeys, userID), nil
+}
+
+func (ms *InMemoryStorage) RevokeAPIKey(ctx context.Context, id string, userID string) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	key, err := revokeAPIKey(ms.apiKeys, id, userID)
+	if err != nil {
+		return err
+	}
+	ms.apiKeys[id] = key
+	return nil
+}
+
+func (fs *FileStorage) SetAPIKey(ctx context.Context, key APIKey) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	fs.apiKeys[key.ID] = key
+	return fs.storage.InsertRecord(apiKeyRecord, key)
+}
+
+func (fs *FileStorage) GetAPIKeyByHash(ctx context.Context, hash string) (*APIKey, error) {
+	fs.RLock()
+	defer fs.RUnlock()
+
+	return findAPIKey(fs.apiKeys, hash)
+}
+
+func (fs *FileStorage) GetUserAPIKeys(ctx context.Context, userID string) ([]APIKey, error) {
+	fs.RLock()
+	defer fs.RUnlock()
+
+	return userAPIKeys(fs.apiKeys, userID), nil
+}
+
+func (fs *FileStorage) RevokeAPIKey(ctx context.Context, id string, userID string) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	key, err := revokeAPIKey(fs.apiKeys, id, userID)
+	if err != nil {
+		return err
+	}
+	fs.apiKeys[id] = key
+	return fs.storage.InsertRecord(apiKeyRecord, key)
+}
+
+func (db *DB) SetAPIKey(ctx context.Context, key APIKey) error {
+	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
+	defer cancel()
+
+	query := `INSERT INTO cuttlink_api_keys(id, user_id, name, prefix, hash, scope, created_at)
+		VALUES(:id, :user_id, :name, :prefix, :hash, :scope, :created_at)`
+	_, err := db.storage.NamedExecContext(ctxDB, query, key)
+	return err
+}
+
+func (db *DB) GetAPIKeyByHash(ctx context.Context, hash string) (*APIKey, error) {
+	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
+	defer cancel()
+
+	query := "SELECT * FROM cuttlink_api_keys WHERE hash=$1"
+	var key APIKey
+	if err := db.storage.GetContext(ctxDB, &key, query, hash); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUnknownAPIKey
+		}
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+func (db *DB) GetUserAPIKeys(ctx context.Context, userID string) ([]APIKey, error) {
+	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
+	defer cancel()
+
+	query := "SELECT * FROM cuttlink_api_keys WHERE user_id=$1 ORDER BY created_at, id"
+	items := make([]APIKey, 0)
+	if err := db.storage.SelectContext(ctxDB, &items, query, userID); err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+func (db *DB) RevokeAPIKey(ctx context.Context, id string, userID string) error {
+	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
+	defer cancel()
+
+	var owner string
+	query := "SELECT user_id FROM cuttlink_api_keys WHERE id=$1"
+	if err := db.storage.GetContext(ctxDB, &owner, query, id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUnknownAPIKey
+		}
+		return err
+	}
+	if owner != userID {
+		return ErrNotOwner
+	}
+
+	query = "UPDATE cuttlink_api_keys SET revoked_at=COALESCE(revoked_at, NOW()) WHERE id=$1"
+	_, err := db.storage.ExecContext(ctxDB, query, id)
+	return err
+}
+
+// loadAPIKeys replays the key records, later records of a key replace
+// earlier ones.
+func loadAPIKeys(fs *File) (map[string]APIKey, error) {
+	records, err := fs.LoadRecords(apiKeyRecord)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]APIKey)
+	for _, record := range records {
+		var key APIKey
+		if err := json.Unmarshal(record, &key); err == nil {
+			keys[key.ID] = key
+		}
+	}
+	return keys, nil
+}
+
+func findAPIKey(keys map[string]APIKey, hash string) (*APIKey, error) {
+	for _, key := range keys {
+		if key.Hash == hash {
+			return &key, nil
+		}
+	}
+	return nil, ErrUnknownAPIKey
+}
+
+func userAPIKeys(keys map[string]APIKey, userID string) []APIKey {
+	data := make([]APIKey, 0)
+	for _, key := range keys {
+		if key.UserID == userID {
+			data = append(data, key)
+		}
+	}
+	sort.Slice(data, func(i, j int) bool {
+		if data[i].CreatedAt.Equal(data[j].CreatedAt) {
+			return data[i].ID < data[j].ID
+		}
+		return data[i].CreatedAt.Before(data[j].CreatedAt)
+	})
+	return data
+}
+
+func revokeAPIKey(keys map[string]APIKey, id string, userID string) (APIKey, error) {
+	key, ok := keys[id]
+	if !ok {
+		return key, ErrUnknownAPIKey
+	}
+	if key.UserID != userID {
+		return key, ErrNotOwner
+	}
+	if key.RevokedAt == nil {
+		now := time.Now().UTC()
+		key.RevokedAt = &now
+	}
+	return key, nil
+}
@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	AuditCreate      = "create"
+	AuditBatchCreate = "batch_create"
+	AuditEdit        = "edit"
+	AuditDelete      = "delete"
+	AuditDisable     = "disable"
+	AuditRestore     = "restore"
+	AuditMove        = "move"
+	AuditTransfer    = "transfer"
+	AuditClaim       = "claim"
+
+	auditRecord     = "audit"
+	auditFileSuffix = ".audit"
+
+	defaultAuditLimit = 100
+)
+
+// Auditor keeps the append-only history of link mutations. Entries are never
+// changed once appended.
+type Auditor interface {
+	AppendAudit(ctx context.Context, entry AuditEntry) error
+	GetUserAudit(ctx context.Context, actorID string, limit int, offset int) ([]AuditEntry, error)
+}
+
+// AuditEntry records who changed which links and how. Before and After map
+// each affected key to the fields that changed, creations have no Before.
+type AuditEntry struct {
+	ID        string     `db:"id" json:"id"`
+	ActorID   string     `db:"actor_id" json:"actor_id"`
+	Action    string     `db:"action" json:"action"`
+	Keys      KeyList    `db:"keys" json:"keys"`
+	Before    AuditState `db:"before" json:"before,omitempty"`
+	After     AuditState `db:"after" json:"after,omitempty"`
+	ClientIP  string     `db:"client_ip" json:"client_ip"`
+	UserAgent string     `db:"user_agent" json:"user_agent"`
+	CreatedAt time.Time  `db:"created_at" json:"created_at"`
+}
+
+// AuditState is a JSON object, stored as jsonb.
+type AuditState map[string]interface{}
+
+func (state AuditState) Value() (driver.Value, error) {
+	if state == nil {
+		return nil, nil
+	}
+	return json.Marshal(state)
+}
+
+func (state *AuditState) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*state = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, state)
+	case string:
+		return json.Unmarshal([]byte(v), state)
+	default:
+		return fmt.Errorf("unsupported audit state type %T", src)
+	}
+}
+
+// AppendAudit writes to a file of its own next to the links, so that the
+// history neither slows down loading links nor waits for link writes.
+func (fs *FileStorage) AppendAudit(ctx context.Context, entry AuditEntry) error {
+	fs.auditLock.Lock()
+	defer fs.auditLock.Unlock()
+
+	return fs.audit.InsertRecord(auditRecord, entry)
+}
+
+// GetUserAudit reads the history from its file on every call, it is not
+// needed to serve links and so is not kept in memory. Lines are appended
+// whole, so reading needs no lock.
+func (fs *FileStorage) GetUserAudit(ctx context.Context, actorID string, limit int, offset int) ([]AuditEntry, error) {
+	records, err := fs.audit.LoadRecords(auditRecord)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]AuditEntry, 0)
+	for i := len(records) - 1; i >= 0; i-- {
+		var entry AuditEntry
+		if err := json.Unmarshal(records[i], &entry); err == nil && entry.ActorID == actorID {
+			entries = append(entries, entry)
+		}
+	}
+
+	limit, offset = auditPage(limit, offset)
+	if offset >= len(entries) {
+		return make([]AuditEntry, 0), nil
+	}
+	end := offset + limit
+	if end > len(entries) {
+		end = len(entries)
+	}
+	return entries[offset:end], nil
+}
+
+func (db *DB) AppendAudit(ctx context.Context, entry AuditEntry) error {
+	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
+	defer cancel()
+
+	query := `INSERT INTO cuttlink_audit(id, actor_id, action, keys, before, after, client_ip, user_agent, created_at)
+		VALUES(:id, :actor_id, :action, :keys, :before, :after, :client_ip, :user_agent, :created_at)`
+	_, err := db.storage.NamedExecContext(ctxDB, query, entry)
+	return err
+}
+
+func (db *DB) GetUserAudit(ctx context.Context, actorID string, limit int, offset int) ([]AuditEntry, error) {
+	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
+	defer cancel()
+
+	limit, offset = auditPage(limit, offset)
+	query := `SELECT * FROM cuttlink_audit WHERE actor_id=$1
+		ORDER BY created_at DESC, id DESC LIMIT $2 OFFSET $3`
+	entries := make([]AuditEntry, 0)
+	if err := db.storage.SelectContext(ctxDB, &entries, query, actorID, limit, offset); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func auditPage(limit int, offset int) (int, int) {
+	if limit <= 0 {
+		limit = defaultAuditLimit
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	return limit, offset
+}
@@ -2,11 +2,15 @@ package storage
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
+	"io"
 	"os"
 )
 
-const bufMaxBytes = 1024
+// bufReadBytes sizes the read buffer, lines longer than it are still read
+// whole so that no single record can make a file unreadable.
+const bufReadBytes = 64 * 1024
 
 type File struct {
 	file     *os.File
@@ -26,46 +30,133 @@ func NewFile(filename string) (*File, error) {
 }
 
 func (f *File) CloseFS() error {
+	if err := f.file.Sync(); err != nil {
+		f.file.Close()
+		return err
+	}
 	return f.file.Close()
 }
 
-func (f *File) LoadFS() ([]Row, error) {
-	file, err := os.OpenFile(f.filename, os.O_RDONLY|os.O_CREATE, 0777)
-	if err != nil {
-		return nil, err
-	}
+// Record is an entity other than a link kept in the same append-only file.
+// Lines without a record kind are link rows.
+type Record struct {
+	Kind string          `json:"record"`
+	Data json.RawMessage `json:"data"`
+}
 
-	scanner := bufio.NewScanner(file)
-	buf := make([]byte, bufMaxBytes)
-	scanner.Buffer(buf, bufMaxBytes)
+func (f *File) LoadFS() ([]Row, error) {
 	data := make([]Row, 0)
-	
-	for scanner.Scan() {
-		rawRow := scanner.Bytes()
+	err := f.scan(func(line []byte) {
+		var record Record
+		if err := json.Unmarshal(line, &record); err == nil && record.Kind != "" {
+			return
+		}
 		var row Row
-		err := json.Unmarshal(rawRow, &row)
-		if err == nil {
+		if err := json.Unmarshal(line, &row); err == nil {
 			data = append(data, row)
 		}
-	}
-	if err := scanner.Err(); err != nil {
+	})
+	if err != nil {
 		return nil, err
 	}
-	if err := file.Close(); err != nil {
+
+	return data, nil
+}
+
+// LoadRecords returns the data of every record of kind in insertion order.
+func (f *File) LoadRecords(kind string) ([]json.RawMessage, error) {
+	data := make([]json.RawMessage, 0)
+	err := f.scan(func(line []byte) {
+		var record Record
+		if err := json.Unmarshal(line, &record); err == nil && record.Kind == kind {
+			data = append(data, record.Data)
+		}
+	})
+	if err != nil {
 		return nil, err
 	}
 
 	return data, nil
 }
 
+func (f *File) scan(fn func(line []byte)) error {
+	file, err := os.OpenFile(f.filename, os.O_RDONLY|os.O_CREATE, 0777)
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReaderSize(file, bufReadBytes)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if line = bytes.TrimSuffix(line, []byte{'\n'}); len(line) > 0 {
+			fn(line)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	return file.Close()
+}
+
 func (f *File) InsertFS(value Row) error {
 	data, err := json.Marshal(value)
 	if err != nil {
 		return err
 	}
 
+	return f.write(data)
+}
+
+func (f *File) InsertRecord(kind string, value interface{}) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(Record{Kind: kind, Data: raw})
+	if err != nil {
+		return err
+	}
+
+	return f.write(data)
+}
+
+// InsertBatch appends the rows and records of kind with a single write, so
+// that changes spanning several lines reach the file together.
+func (f *File) InsertBatch(rows []Row, kind string, values ...interface{}) error {
+	data := make([]byte, 0)
+	for _, row := range rows {
+		line, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	for _, value := range values {
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		line, err := json.Marshal(Record{Kind: kind, Data: raw})
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	return f.write(data[:len(data)-1])
+}
+
+func (f *File) write(data []byte) error {
 	data = append(data, '\n')
-	_, err = f.file.Write(data)
+	_, err := f.file.Write(data)
 	if err != nil {
 		return err
 	}
@@ -73,6 +164,6 @@ func (f *File) InsertFS(value Row) error {
 	if err != nil {
 		return err
 	}
-	
+
 	return nil
 }
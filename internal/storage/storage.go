@@ -2,9 +2,14 @@ package storage
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"fmt"
+	"github.com/avtorsky/cuttlink/internal/metadata"
+	"github.com/avtorsky/cuttlink/internal/routing"
 	"github.com/avtorsky/cuttlink/internal/workers"
+	"log"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -15,11 +20,50 @@ import (
 
 const dbResponseTimeout = 10 * time.Second
 
+var (
+	ErrInvalidKey   = errors.New("invalid key")
+	ErrNotOwner     = errors.New("key owned by another user")
+	ErrDuplicateURL = errors.New("duplicate url")
+)
+
 type Row struct {
-	Key       string `db:"id"`
-	UUID      string `db:"user_id"`
-	Value     string `db:"original_url"`
-	IsDeleted bool   `db:"is_deleted"`
+	Key         string `db:"id"`
+	UUID        string `db:"user_id"`
+	WorkspaceID string `db:"workspace_id"`
+	Value       string `db:"original_url"`
+	Original    string `db:"original_input"`
+	IsDeleted   bool   `db:"is_deleted"`
+	IsDisabled  bool   `db:"is_disabled"`
+	Options
+	Health
+	Page
+	VariantHits map[string]int64 `db:"-"`
+}
+
+// Health is the last result of the destination health check.
+type Health struct {
+	LastStatus    int        `db:"last_status"`
+	LastCheckedAt *time.Time `db:"last_checked_at"`
+	IsBroken      bool       `db:"is_broken"`
+}
+
+// Page is what the destination says about itself, fetched after creation.
+type Page struct {
+	PageTitle       string `db:"page_title"`
+	PageDescription string `db:"page_description"`
+	FaviconURL      string `db:"favicon_url"`
+}
+
+// Options holds the per-link redirect settings managed by the link owner.
+type Options struct {
+	Rules        routing.Rules    `db:"rules"`
+	Variants     routing.Variants `db:"variants"`
+	QueryMode    string           `db:"query_mode"`
+	UTM          routing.UTM      `db:"utm"`
+	PathMode     string           `db:"path_mode"`
+	Interstitial bool             `db:"interstitial"`
+	Countdown    int              `db:"countdown"`
+	Title        string           `db:"title"`
 }
 
 type DuplicateURLError struct {
@@ -29,37 +73,99 @@ type DuplicateURLError struct {
 
 type Storager interface {
 	GetURL(ctx context.Context, key string) (*Row, error)
-	GetUserURLs(ctx context.Context, sessionID string) (map[string]string, error)
-	SetURL(ctx context.Context, url string, sessionID string) (string, error)
-	SetBatchURL(ctx context.Context, urlBatch []string, sessionID string) ([]string, error)
+	GetUserURLs(ctx context.Context, sessionID string) ([]Row, error)
+	SetURL(ctx context.Context, url string, original string, sessionID string) (string, error)
+	SetBatchURL(ctx context.Context, urlBatch []string, originalBatch []string, sessionID string) ([]string, []bool, error)
+	SetURLOptions(ctx context.Context, key string, sessionID string, opts Options) error
+	AddVariantHit(ctx context.Context, key string, destination string) error
+	GetVariantHits(ctx context.Context, key string) (map[string]int64, error)
 	UpdateBatchURL(ctx context.Context, task workers.RemovalTask) error
+	GetHealthTargets(ctx context.Context) ([]workers.HealthTarget, error)
+	SetURLHealth(ctx context.Context, key string, status workers.HealthStatus) error
+	SetURLMetadata(ctx context.Context, key string, meta metadata.Metadata) error
+	SetAPIKey(ctx context.Context, key APIKey) error
+	GetAPIKeyByHash(ctx context.Context, hash string) (*APIKey, error)
+	GetUserAPIKeys(ctx context.Context, userID string) ([]APIKey, error)
+	RevokeAPIKey(ctx context.Context, id string, userID string) error
+	CreateWorkspace(ctx context.Context, workspace Workspace) error
+	GetUserWorkspaces(ctx context.Context, userID string) ([]Workspace, error)
+	GetWorkspaceRole(ctx context.Context, workspaceID string, userID string) (string, error)
+	GetWorkspaceMembers(ctx context.Context, workspaceID string) ([]Member, error)
+	SetWorkspaceMember(ctx context.Context, member Member) error
+	RemoveWorkspaceMember(ctx context.Context, workspaceID string, userID string) error
+	GetURLRole(ctx context.Context, key string, userID string) (string, error)
+	MoveURLs(ctx context.Context, keys []string, workspaceID string, userID string) ([]string, error)
+	SearchURLs(ctx context.Context, query URLQuery) ([]Row, int, error)
+	SetURLDisabled(ctx context.Context, key string, disabled bool) error
+	DeleteOwnerURLs(ctx context.Context, userID string) ([]string, error)
+	GetURLStats(ctx context.Context) (URLStats, error)
+	CreateTransfer(ctx context.Context, transfer Transfer) error
+	AcceptTransfer(ctx context.Context, tokenHash string, userID string, now time.Time) (*Transfer, error)
+	CancelTransfer(ctx context.Context, id string, userID string, now time.Time) error
+	CreateUser(ctx context.Context, user User) error
+	GetUserByLogin(ctx context.Context, login string) (*User, error)
+	GetUserByID(ctx context.Context, id string) (*User, error)
+	ClaimSession(ctx context.Context, sessionID string, userID string) (int, error)
 	Ping(ctx context.Context) error
 	Close() error
 }
 
 type InMemoryStorage struct {
 	sync.RWMutex
-	urls    map[string]Row
-	counter int
+	urls       map[string]Row
+	index      map[string]string
+	apiKeys    map[string]APIKey
+	users      map[string]User
+	workspaces map[string]Workspace
+	members    map[string]map[string]Member
+	transfers  map[string]Transfer
+	counter    int
 }
 
 type FileStorage struct {
 	sync.RWMutex
-	urls    map[string]Row
-	counter int
-	storage *File
+	urls       map[string]Row
+	index      map[string]string
+	apiKeys    map[string]APIKey
+	users      map[string]User
+	workspaces map[string]Workspace
+	members    map[string]map[string]Member
+	transfers  map[string]Transfer
+	counter    int
+	storage    *File
+	audit      *File
+	auditLock  sync.Mutex
+	// hits holds the keys whose variant hits are not written yet, see
+	// FlushHits.
+	hits map[string]bool
 }
 
 type DB struct {
 	sync.RWMutex
 	storage *sqlx.DB
+	// hits holds the variant hits not written yet by key and destination,
+	// see FlushHits.
+	hits     map[string]map[string]int64
+	hitsLock sync.Mutex
+}
+
+// HitFlusher is implemented by storages that count variant hits in memory
+// and write them in batches.
+type HitFlusher interface {
+	FlushHits(ctx context.Context, interval time.Duration)
 }
 
 func NewInMemoryStorage() (*InMemoryStorage, error) {
 	data := make(map[string]Row)
 	return &InMemoryStorage{
-		urls:    data,
-		counter: 1,
+		urls:       data,
+		index:      make(map[string]string),
+		apiKeys:    make(map[string]APIKey),
+		users:      make(map[string]User),
+		workspaces: make(map[string]Workspace),
+		members:    make(map[string]map[string]Member),
+		transfers:  make(map[string]Transfer),
+		counter:    1,
 	}, nil
 }
 
@@ -70,19 +176,49 @@ func NewFileStorage(fs *File) (*FileStorage, error) {
 	}
 
 	data := make(map[string]Row)
+	index := make(map[string]string)
 	for item := range store {
 		data[store[item].Key] = store[item]
+		index[store[item].Value] = store[item].Key
+	}
+	apiKeys, err := loadAPIKeys(fs)
+	if err != nil {
+		return nil, err
+	}
+	users, err := loadUsers(fs)
+	if err != nil {
+		return nil, err
+	}
+	workspaces, members, err := loadWorkspaces(fs)
+	if err != nil {
+		return nil, err
+	}
+	transfers, err := loadTransfers(fs)
+	if err != nil {
+		return nil, err
+	}
+	audit, err := NewFile(fs.filename + auditFileSuffix)
+	if err != nil {
+		return nil, err
 	}
 
 	return &FileStorage{
-		urls:    data,
-		counter: peekIntegerFromStack(store),
-		storage: fs,
+		urls:       data,
+		index:      index,
+		apiKeys:    apiKeys,
+		users:      users,
+		workspaces: workspaces,
+		members:    members,
+		transfers:  transfers,
+		counter:    peekIntegerFromStack(store),
+		storage:    fs,
+		audit:      audit,
+		hits:       make(map[string]bool),
 	}, nil
 }
 
 func NewDB(db *sqlx.DB) (*DB, error) {
-	return &DB{storage: db}, nil
+	return &DB{storage: db, hits: make(map[string]map[string]int64)}, nil
 }
 
 func (e *DuplicateURLError) Error() string {
@@ -106,55 +242,128 @@ func (ms *InMemoryStorage) GetURL(ctx context.Context, key string) (*Row, error)
 
 	row, ok := ms.urls[key]
 	if !ok {
-		return nil, errors.New("invalid key")
+		return nil, ErrInvalidKey
 	}
 
-	return &Row{
-		Value:     row.Value,
-		IsDeleted: row.IsDeleted,
-	}, nil
+	return &row, nil
 }
 
-func (ms *InMemoryStorage) GetUserURLs(ctx context.Context, sessionID string) (map[string]string, error) {
-	data := make(map[string]string)
+func (ms *InMemoryStorage) GetUserURLs(ctx context.Context, sessionID string) ([]Row, error) {
+	ms.RLock()
+	defer ms.RUnlock()
 
+	data := make([]Row, 0)
 	for _, row := range ms.urls {
-		if row.UUID == sessionID {
-			data[row.Key] = row.Value
+		if linkRole(row, sessionID, ms.members) != "" && !row.IsDeleted {
+			data = append(data, row)
 		}
 	}
+	sortRows(data)
 
 	return data, nil
 }
 
-func (ms *InMemoryStorage) SetURL(ctx context.Context, url string, sessionID string) (string, error) {
+func (ms *InMemoryStorage) SetURL(ctx context.Context, url string, original string, sessionID string) (string, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	if key, ok := ms.index[url]; ok {
+		return "", NewDuplicateURLError(key, ErrDuplicateURL)
+	}
+	row := ms.insert(url, original, sessionID)
+
+	return row.Key, nil
+}
+
+// SetBatchURL reports for every item whether its link was inserted, items
+// deduplicated to an existing link are not.
+func (ms *InMemoryStorage) SetBatchURL(ctx context.Context, urlBatch []string, originalBatch []string, sessionID string) ([]string, []bool, error) {
 	ms.Lock()
 	defer ms.Unlock()
 
+	result := make([]string, len(urlBatch))
+	inserted := make([]bool, len(urlBatch))
+	for item, url := range urlBatch {
+		if key, ok := ms.index[url]; ok {
+			result[item] = key
+			continue
+		}
+		result[item] = ms.insert(url, originalBatch[item], sessionID).Key
+		inserted[item] = true
+	}
+
+	return result, inserted, nil
+}
+
+func (ms *InMemoryStorage) insert(url string, original string, sessionID string) Row {
 	ms.counter++
 	key := strconv.Itoa(ms.counter)
 	row := Row{
 		Key:       key,
 		UUID:      sessionID,
 		Value:     url,
+		Original:  original,
 		IsDeleted: false,
 	}
 	ms.urls[key] = row
+	ms.index[url] = key
+
+	return row
+}
+
+func (ms *InMemoryStorage) SetURLOptions(ctx context.Context, key string, sessionID string, opts Options) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	row, ok := ms.urls[key]
+	if !ok {
+		return ErrInvalidKey
+	}
+	if !RoleAllows(linkRole(row, sessionID, ms.members), RoleEditor) {
+		return ErrNotOwner
+	}
+	row.Options = opts
+	ms.urls[key] = row
+
+	return nil
+}
+
+func (ms *InMemoryStorage) AddVariantHit(ctx context.Context, key string, destination string) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	row, ok := ms.urls[key]
+	if !ok {
+		return ErrInvalidKey
+	}
+	row.VariantHits = addHit(row.VariantHits, destination)
+	ms.urls[key] = row
 
-	return key, nil
+	return nil
 }
 
-func (ms *InMemoryStorage) SetBatchURL(ctx context.Context, urlBatch []string, sessionID string) ([]string, error) {
-	return nil, errors.New("in-memory storage invalid method")
+func (ms *InMemoryStorage) GetVariantHits(ctx context.Context, key string) (map[string]int64, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	row, ok := ms.urls[key]
+	if !ok {
+		return nil, ErrInvalidKey
+	}
+
+	return copyHits(row.VariantHits), nil
 }
 
 func (ms *InMemoryStorage) UpdateBatchURL(ctx context.Context, task workers.RemovalTask) error {
+	ms.Lock()
+	defer ms.Unlock()
+
 	for _, key := range task.Keys {
 		row, ok := ms.urls[key]
 		if !ok {
-			return errors.New("invalid key")
+			return ErrInvalidKey
 		}
-		if row.UUID != task.UUID {
+		if !RoleAllows(linkRole(row, task.UUID, ms.members), RoleEditor) {
 			continue
 		}
 		row.IsDeleted = true
@@ -163,12 +372,54 @@ func (ms *InMemoryStorage) UpdateBatchURL(ctx context.Context, task workers.Remo
 	return nil
 }
 
+func (ms *InMemoryStorage) GetHealthTargets(ctx context.Context) ([]workers.HealthTarget, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	data := make([]workers.HealthTarget, 0)
+	for _, row := range ms.urls {
+		if !row.IsDeleted {
+			data = append(data, healthTargets(row)...)
+		}
+	}
+
+	return data, nil
+}
+
+func (ms *InMemoryStorage) SetURLHealth(ctx context.Context, key string, status workers.HealthStatus) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	row, ok := ms.urls[key]
+	if !ok {
+		return ErrInvalidKey
+	}
+	row.Health = newHealth(status)
+	ms.urls[key] = row
+
+	return nil
+}
+
+func (ms *InMemoryStorage) SetURLMetadata(ctx context.Context, key string, meta metadata.Metadata) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	row, ok := ms.urls[key]
+	if !ok {
+		return ErrInvalidKey
+	}
+	row.Page = newPage(meta)
+	ms.urls[key] = row
+
+	return nil
+}
+
 func (ms *InMemoryStorage) Ping(ctx context.Context) error {
 	return errors.New("in-memory storage invalid method")
 }
 
 func (ms *InMemoryStorage) Close() error {
-	return errors.New("in-memory storage invalid method")
+	return nil
 }
 
 func (fs *FileStorage) GetURL(ctx context.Context, key string) (*Row, error) {
@@ -177,58 +428,164 @@ func (fs *FileStorage) GetURL(ctx context.Context, key string) (*Row, error) {
 
 	row, ok := fs.urls[key]
 	if !ok {
-		return nil, errors.New("invalid key")
+		return nil, ErrInvalidKey
 	}
 
-	return &Row{
-		Value:     row.Value,
-		IsDeleted: row.IsDeleted,
-	}, nil
+	return &row, nil
 }
 
-func (fs *FileStorage) GetUserURLs(ctx context.Context, sessionID string) (map[string]string, error) {
-	data := make(map[string]string)
+func (fs *FileStorage) GetUserURLs(ctx context.Context, sessionID string) ([]Row, error) {
+	fs.RLock()
+	defer fs.RUnlock()
 
+	data := make([]Row, 0)
 	for _, row := range fs.urls {
-		if row.UUID == sessionID {
-			data[row.Key] = row.Value
+		if linkRole(row, sessionID, fs.members) != "" && !row.IsDeleted {
+			data = append(data, row)
 		}
 	}
+	sortRows(data)
 
 	return data, nil
 }
 
-func (fs *FileStorage) SetURL(ctx context.Context, url string, sessionID string) (string, error) {
+func (fs *FileStorage) SetURL(ctx context.Context, url string, original string, sessionID string) (string, error) {
 	fs.Lock()
 	defer fs.Unlock()
 
+	if key, ok := fs.index[url]; ok {
+		return "", NewDuplicateURLError(key, ErrDuplicateURL)
+	}
+	row, err := fs.insert(url, original, sessionID)
+	if err != nil {
+		return "", err
+	}
+
+	return row.Key, nil
+}
+
+func (fs *FileStorage) SetBatchURL(ctx context.Context, urlBatch []string, originalBatch []string, sessionID string) ([]string, []bool, error) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	result := make([]string, len(urlBatch))
+	inserted := make([]bool, len(urlBatch))
+	for item, url := range urlBatch {
+		if key, ok := fs.index[url]; ok {
+			result[item] = key
+			continue
+		}
+		row, err := fs.insert(url, originalBatch[item], sessionID)
+		if err != nil {
+			return nil, nil, err
+		}
+		result[item] = row.Key
+		inserted[item] = true
+	}
+
+	return result, inserted, nil
+}
+
+func (fs *FileStorage) insert(url string, original string, sessionID string) (Row, error) {
 	fs.counter++
 	key := strconv.Itoa(fs.counter)
 	row := Row{
 		Key:       key,
 		UUID:      sessionID,
 		Value:     url,
+		Original:  original,
 		IsDeleted: false,
 	}
 	fs.urls[key] = row
-	if err := fs.storage.InsertFS(row); err != nil {
-		return "", err
+	fs.index[url] = key
+
+	return row, fs.storage.InsertFS(row)
+}
+
+func (fs *FileStorage) SetURLOptions(ctx context.Context, key string, sessionID string, opts Options) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	row, ok := fs.urls[key]
+	if !ok {
+		return ErrInvalidKey
+	}
+	if !RoleAllows(linkRole(row, sessionID, fs.members), RoleEditor) {
+		return ErrNotOwner
+	}
+	row.Options = opts
+	fs.urls[key] = row
+
+	return fs.storage.InsertFS(row)
+}
+
+func (fs *FileStorage) AddVariantHit(ctx context.Context, key string, destination string) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	row, ok := fs.urls[key]
+	if !ok {
+		return ErrInvalidKey
+	}
+	row.VariantHits = addHit(row.VariantHits, destination)
+	fs.urls[key] = row
+	fs.hits[key] = true
+
+	return nil
+}
+
+// FlushHits writes the variant hits counted since the last flush every
+// interval until ctx is done. Close writes the remaining ones.
+func (fs *FileStorage) FlushHits(ctx context.Context, interval time.Duration) {
+	flushEvery(ctx, interval, func() error {
+		fs.Lock()
+		defer fs.Unlock()
+		return fs.flushHits()
+	})
+}
+
+// flushHits writes the rows with unwritten hits with a single write, the
+// caller holds the lock.
+func (fs *FileStorage) flushHits() error {
+	if len(fs.hits) == 0 {
+		return nil
 	}
+	rows := make([]Row, 0, len(fs.hits))
+	for key := range fs.hits {
+		if row, ok := fs.urls[key]; ok {
+			rows = append(rows, row)
+		}
+	}
+	if err := fs.storage.InsertBatch(rows, ""); err != nil {
+		return err
+	}
+	fs.hits = make(map[string]bool)
 
-	return key, nil
+	return nil
 }
 
-func (fs *FileStorage) SetBatchURL(ctx context.Context, urlBatch []string, sessionID string) ([]string, error) {
-	return nil, errors.New("file storage invalid method")
+func (fs *FileStorage) GetVariantHits(ctx context.Context, key string) (map[string]int64, error) {
+	fs.RLock()
+	defer fs.RUnlock()
+
+	row, ok := fs.urls[key]
+	if !ok {
+		return nil, ErrInvalidKey
+	}
+
+	return copyHits(row.VariantHits), nil
 }
 
 func (fs *FileStorage) UpdateBatchURL(ctx context.Context, task workers.RemovalTask) error {
+	fs.Lock()
+	defer fs.Unlock()
+
 	for _, key := range task.Keys {
 		row, ok := fs.urls[key]
 		if !ok {
-			return errors.New("invalid key")
+			return ErrInvalidKey
 		}
-		if row.UUID != task.UUID {
+		if !RoleAllows(linkRole(row, task.UUID, fs.members), RoleEditor) {
 			continue
 		}
 		row.IsDeleted = true
@@ -240,57 +597,113 @@ func (fs *FileStorage) UpdateBatchURL(ctx context.Context, task workers.RemovalT
 	return nil
 }
 
+func (fs *FileStorage) GetHealthTargets(ctx context.Context) ([]workers.HealthTarget, error) {
+	fs.RLock()
+	defer fs.RUnlock()
+
+	data := make([]workers.HealthTarget, 0)
+	for _, row := range fs.urls {
+		if !row.IsDeleted {
+			data = append(data, healthTargets(row)...)
+		}
+	}
+
+	return data, nil
+}
+
+// SetURLHealth only appends to the file when the outcome changes, so that
+// periodic checks of healthy links don't grow it.
+func (fs *FileStorage) SetURLHealth(ctx context.Context, key string, status workers.HealthStatus) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	row, ok := fs.urls[key]
+	if !ok {
+		return ErrInvalidKey
+	}
+	changed := row.LastStatus != status.StatusCode || row.IsBroken != status.IsBroken
+	row.Health = newHealth(status)
+	fs.urls[key] = row
+	if changed {
+		return fs.storage.InsertFS(row)
+	}
+	return nil
+}
+
+func (fs *FileStorage) SetURLMetadata(ctx context.Context, key string, meta metadata.Metadata) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	row, ok := fs.urls[key]
+	if !ok {
+		return ErrInvalidKey
+	}
+	row.Page = newPage(meta)
+	fs.urls[key] = row
+
+	return fs.storage.InsertFS(row)
+}
+
 func (fs *FileStorage) Ping(ctx context.Context) error {
 	return errors.New("file storage invalid method")
 }
 
+// Close waits for writes in progress, writes the unflushed variant hits,
+// then syncs and closes the files.
 func (fs *FileStorage) Close() error {
-	return fs.storage.CloseFS()
+	fs.Lock()
+	defer fs.Unlock()
+	fs.auditLock.Lock()
+	defer fs.auditLock.Unlock()
+
+	flushErr := fs.flushHits()
+	if err := fs.audit.CloseFS(); err != nil {
+		fs.storage.CloseFS()
+		return err
+	}
+	if err := fs.storage.CloseFS(); err != nil {
+		return err
+	}
+	return flushErr
 }
 
 func (db *DB) GetURL(ctx context.Context, key string) (*Row, error) {
 	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
 	defer cancel()
 
-	query := "SELECT original_url, is_deleted FROM cuttlink WHERE id=$1"
+	query := "SELECT * FROM cuttlink WHERE id=$1"
 	var row Row
 	if err := db.storage.GetContext(ctxDB, &row, query, key); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidKey
+		}
 		return nil, err
 	}
 
-	return &Row{
-		Value:     row.Value,
-		IsDeleted: row.IsDeleted,
-	}, nil
+	return &row, nil
 }
 
-func (db *DB) GetUserURLs(ctx context.Context, sessionID string) (map[string]string, error) {
+func (db *DB) GetUserURLs(ctx context.Context, sessionID string) ([]Row, error) {
 	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
 	defer cancel()
 
-	query := "SELECT id, user_id, original_url FROM cuttlink WHERE user_id=$1 AND is_deleted=FALSE ORDER BY id"
+	query := "SELECT * FROM cuttlink WHERE is_deleted=FALSE AND " + dbVisibleTo("$1") + " ORDER BY id"
 	items := make([]Row, 0)
 	err := db.storage.SelectContext(ctxDB, &items, query, sessionID)
 	if err != nil {
 		return nil, err
 	}
 
-	data := make(map[string]string)
-	for item := range items {
-		row := items[item]
-		data[fmt.Sprint(row.Key)] = row.Value
-	}
-
-	return data, nil
+	return items, nil
 }
 
-func (db *DB) SetURL(ctx context.Context, url string, sessionID string) (string, error) {
+func (db *DB) SetURL(ctx context.Context, url string, original string, sessionID string) (string, error) {
 	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
 	defer cancel()
 
-	query := "INSERT INTO cuttlink(user_id, original_url) VALUES($1, $2) RETURNING id"
+	query := "INSERT INTO cuttlink(user_id, original_url, original_input) VALUES($1, $2, $3) RETURNING id"
 	var id string
-	err := db.storage.GetContext(ctxDB, &id, query, sessionID, url)
+	err := db.storage.GetContext(ctxDB, &id, query, sessionID, url, original)
 	if err != nil && strings.Contains(err.Error(), "duplicate key value violates unique constraint") {
 		var row Row
 		q := "SELECT * FROM cuttlink WHERE original_url=$1"
@@ -305,52 +718,167 @@ func (db *DB) SetURL(ctx context.Context, url string, sessionID string) (string,
 	return id, nil
 }
 
-func (db *DB) SetBatchURL(ctx context.Context, urlBatch []string, sessionID string) ([]string, error) {
+func (db *DB) SetBatchURL(ctx context.Context, urlBatch []string, originalBatch []string, sessionID string) ([]string, []bool, error) {
 	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
 	defer cancel()
 
 	if len(urlBatch) == 0 {
-		return make([]string, 0), nil
+		return make([]string, 0), make([]bool, 0), nil
 	}
-	data := make([]map[string]interface{}, len(urlBatch))
+	positions := make(map[string][]int)
+	data := make([]map[string]interface{}, 0, len(urlBatch))
 	for item := range urlBatch {
-		data[item] = map[string]interface{}{
-			"user_id":      sessionID,
-			"original_url": urlBatch[item],
+		if _, ok := positions[urlBatch[item]]; !ok {
+			data = append(data, map[string]interface{}{
+				"user_id":        sessionID,
+				"original_url":   urlBatch[item],
+				"original_input": originalBatch[item],
+			})
 		}
+		positions[urlBatch[item]] = append(positions[urlBatch[item]], item)
 	}
 
 	tx, err := db.storage.Begin()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer tx.Rollback()
-	query := "INSERT INTO cuttlink(user_id, original_url) VALUES(:user_id, :original_url) RETURNING id"
+	query := `INSERT INTO cuttlink(user_id, original_url, original_input) VALUES(:user_id, :original_url, :original_input)
+		ON CONFLICT (original_url) DO UPDATE SET original_url = EXCLUDED.original_url RETURNING id, original_url, xmax = 0 AS inserted`
 	rows, err := db.storage.NamedQueryContext(ctxDB, query, data)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if err := tx.Commit(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	result := make([]string, len(urlBatch))
-	item := 0
+	inserted := make([]bool, len(urlBatch))
 	for rows.Next() {
-		var id string
-		err = rows.Scan(&id)
+		var id, url string
+		var isNew bool
+		err = rows.Scan(&id, &url, &isNew)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+		for _, item := range positions[url] {
+			result[item] = id
 		}
-		result[item] = id
-		item++
+		inserted[positions[url][0]] = isNew
 	}
 	err = rows.Err()
 	if err != nil {
+		return nil, nil, err
+	}
+
+	return result, inserted, nil
+}
+
+func (db *DB) SetURLOptions(ctx context.Context, key string, sessionID string, opts Options) error {
+	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
+	defer cancel()
+
+	role, err := db.GetURLRole(ctxDB, key, sessionID)
+	if err != nil {
+		return err
+	}
+	if !RoleAllows(role, RoleEditor) {
+		return ErrNotOwner
+	}
+
+	query := `UPDATE cuttlink SET rules=$1, variants=$2, query_mode=$3, utm=$4, path_mode=$5,
+		interstitial=$6, countdown=$7, title=$8 WHERE id=$9`
+	_, err = db.storage.ExecContext(ctxDB, query, opts.Rules, opts.Variants, opts.QueryMode, opts.UTM, opts.PathMode,
+		opts.Interstitial, opts.Countdown, opts.Title, key)
+	return err
+}
+
+// AddVariantHit only counts the hit in memory, so that redirects don't wait
+// for a write. FlushHits writes the counts.
+func (db *DB) AddVariantHit(ctx context.Context, key string, destination string) error {
+	db.hitsLock.Lock()
+	defer db.hitsLock.Unlock()
+
+	db.hits[key] = addHit(db.hits[key], destination)
+	return nil
+}
+
+// FlushHits writes the variant hits counted since the last flush every
+// interval until ctx is done. Close writes the remaining ones.
+func (db *DB) FlushHits(ctx context.Context, interval time.Duration) {
+	flushEvery(ctx, interval, func() error {
+		return db.flushHits(context.Background())
+	})
+}
+
+// flushHits adds the pending hits to the table with a single statement. On
+// failure they are kept for the next flush.
+func (db *DB) flushHits(ctx context.Context) error {
+	db.hitsLock.Lock()
+	pending := db.hits
+	db.hits = make(map[string]map[string]int64)
+	db.hitsLock.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	keys, destinations, counts := make([]string, 0), make([]string, 0), make([]int64, 0)
+	for key, hits := range pending {
+		for destination, count := range hits {
+			keys = append(keys, key)
+			destinations = append(destinations, destination)
+			counts = append(counts, count)
+		}
+	}
+
+	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
+	defer cancel()
+
+	query := `INSERT INTO cuttlink_variant_hits(id, destination, hits)
+		SELECT id::integer, destination, hits FROM unnest($1::text[], $2::text[], $3::bigint[]) AS t(id, destination, hits)
+		ON CONFLICT (id, destination) DO UPDATE SET hits = cuttlink_variant_hits.hits + EXCLUDED.hits`
+	if _, err := db.storage.ExecContext(ctxDB, query, keys, destinations, counts); err != nil {
+		db.hitsLock.Lock()
+		for key, hits := range pending {
+			for destination, count := range hits {
+				if db.hits[key] == nil {
+					db.hits[key] = make(map[string]int64)
+				}
+				db.hits[key][destination] += count
+			}
+		}
+		db.hitsLock.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+func (db *DB) GetVariantHits(ctx context.Context, key string) (map[string]int64, error) {
+	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
+	defer cancel()
+
+	query := "SELECT destination, hits FROM cuttlink_variant_hits WHERE id=$1"
+	items := make([]struct {
+		Destination string `db:"destination"`
+		Hits        int64  `db:"hits"`
+	}, 0)
+	if err := db.storage.SelectContext(ctxDB, &items, query, key); err != nil {
 		return nil, err
 	}
 
-	return result, nil
+	data := make(map[string]int64)
+	for _, item := range items {
+		data[item.Destination] = item.Hits
+	}
+	db.hitsLock.Lock()
+	for destination, count := range db.hits[key] {
+		data[destination] += count
+	}
+	db.hitsLock.Unlock()
+
+	return data, nil
 }
 
 func (db *DB) UpdateBatchURL(ctx context.Context, task workers.RemovalTask) error {
@@ -363,7 +891,7 @@ func (db *DB) UpdateBatchURL(ctx context.Context, task workers.RemovalTask) erro
 	}
 	defer tx.Rollback()
 
-	query := "UPDATE cuttlink SET is_deleted = TRUE WHERE id = any($1) AND user_id = $2"
+	query := "UPDATE cuttlink SET is_deleted = TRUE WHERE id = any($1) AND " + dbEditableBy("$2")
 	stmt, err := tx.PrepareContext(ctxDB, query)
 	if err != nil {
 		return err
@@ -376,6 +904,65 @@ func (db *DB) UpdateBatchURL(ctx context.Context, task workers.RemovalTask) erro
 	return tx.Commit()
 }
 
+func (db *DB) GetHealthTargets(ctx context.Context) ([]workers.HealthTarget, error) {
+	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
+	defer cancel()
+
+	query := "SELECT id, original_url, rules, variants FROM cuttlink WHERE is_deleted=FALSE ORDER BY id"
+	items := make([]Row, 0)
+	if err := db.storage.SelectContext(ctxDB, &items, query); err != nil {
+		return nil, err
+	}
+
+	data := make([]workers.HealthTarget, 0, len(items))
+	for item := range items {
+		data = append(data, healthTargets(items[item])...)
+	}
+
+	return data, nil
+}
+
+// healthTargets lists every destination of the link once, the default one
+// first.
+func healthTargets(row Row) []workers.HealthTarget {
+	destinations := []string{row.Value}
+	for _, rule := range row.Options.Rules {
+		destinations = append(destinations, rule.Destination)
+	}
+	for _, variant := range row.Options.Variants {
+		destinations = append(destinations, variant.Destination)
+	}
+
+	seen := make(map[string]bool, len(destinations))
+	targets := make([]workers.HealthTarget, 0, len(destinations))
+	for _, destination := range destinations {
+		if destination != "" && !seen[destination] {
+			seen[destination] = true
+			targets = append(targets, workers.HealthTarget{Key: row.Key, URL: destination})
+		}
+	}
+	return targets
+}
+
+func (db *DB) SetURLHealth(ctx context.Context, key string, status workers.HealthStatus) error {
+	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
+	defer cancel()
+
+	query := "UPDATE cuttlink SET last_status=$1, last_checked_at=$2, is_broken=$3 WHERE id=$4"
+	_, err := db.storage.ExecContext(ctxDB, query, status.StatusCode, status.CheckedAt, status.IsBroken, key)
+	return err
+}
+
+func (db *DB) SetURLMetadata(ctx context.Context, key string, meta metadata.Metadata) error {
+	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
+	defer cancel()
+
+	page := newPage(meta)
+	query := "UPDATE cuttlink SET page_title=$1, page_description=$2, favicon_url=$3 WHERE id=$4"
+	_, err := db.storage.ExecContext(ctxDB, query, page.PageTitle, page.PageDescription, page.FaviconURL, key)
+	return err
+}
+
 func (db *DB) Ping(ctx context.Context) error {
 	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
 	defer cancel()
@@ -383,8 +970,87 @@ func (db *DB) Ping(ctx context.Context) error {
 	return db.storage.PingContext(ctxDB)
 }
 
+// Close writes the unflushed variant hits, then closes the connections.
 func (db *DB) Close() error {
-	return db.storage.Close()
+	flushErr := db.flushHits(context.Background())
+	if err := db.storage.Close(); err != nil {
+		return err
+	}
+	return flushErr
+}
+
+// DisplayValue is the URL as the user submitted it, before normalisation.
+func (r Row) DisplayValue() string {
+	if r.Original != "" {
+		return r.Original
+	}
+	return r.Value
+}
+
+func newHealth(status workers.HealthStatus) Health {
+	checkedAt := status.CheckedAt
+	return Health{
+		LastStatus:    status.StatusCode,
+		LastCheckedAt: &checkedAt,
+		IsBroken:      status.IsBroken,
+	}
+}
+
+// newPage prefers the Open Graph title, which sites usually keep free of
+// the "| Site name" suffixes found in <title>.
+func newPage(meta metadata.Metadata) Page {
+	title := meta.OGTitle
+	if title == "" {
+		title = meta.Title
+	}
+	return Page{
+		PageTitle:       title,
+		PageDescription: meta.OGDescription,
+		FaviconURL:      meta.FaviconURL,
+	}
+}
+
+// sortRows orders rows by numeric key, i.e. by creation.
+func sortRows(rows []Row) {
+	sort.Slice(rows, func(i, j int) bool {
+		a, errA := strconv.Atoi(rows[i].Key)
+		b, errB := strconv.Atoi(rows[j].Key)
+		if errA != nil || errB != nil {
+			return rows[i].Key < rows[j].Key
+		}
+		return a < b
+	})
+}
+
+// flushEvery calls flush every interval until ctx is done.
+func flushEvery(ctx context.Context, interval time.Duration, flush func() error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := flush(); err != nil {
+				log.Printf("unable to flush variant hits: %v", err)
+			}
+		}
+	}
+}
+
+func addHit(hits map[string]int64, destination string) map[string]int64 {
+	data := copyHits(hits)
+	data[destination]++
+	return data
+}
+
+func copyHits(hits map[string]int64) map[string]int64 {
+	data := make(map[string]int64, len(hits))
+	for destination, count := range hits {
+		data[destination] = count
+	}
+	return data
 }
 
 func peekIntegerFromStack(data []Row) int {
@@ -0,0 +1,328 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const transferRecord = "transfer"
+
+var (
+	ErrUnknownTransfer = errors.New("unknown transfer")
+	ErrTransferClosed  = errors.New("transfer already accepted, cancelled or expired")
+)
+
+// Transfer hands links from one user to another once the recipient accepts
+// it with the one-time token, of which only the SHA-256 is kept.
+type Transfer struct {
+	ID         string     `db:"id" json:"id"`
+	FromUserID string     `db:"from_user_id" json:"from_user_id"`
+	ToUserID   string     `db:"to_user_id" json:"to_user_id"`
+	Keys       KeyList    `db:"keys" json:"keys"`
+	TokenHash  string     `db:"token_hash" json:"token_hash"`
+	CreatedAt  time.Time  `db:"created_at" json:"created_at"`
+	ExpiresAt  time.Time  `db:"expires_at" json:"expires_at"`
+	AcceptedAt *time.Time `db:"accepted_at" json:"accepted_at,omitempty"`
+	CanceledAt *time.Time `db:"canceled_at" json:"canceled_at,omitempty"`
+}
+
+// KeyList is a list of link keys, stored as a JSON array.
+type KeyList []string
+
+func (t Transfer) IsOpen(now time.Time) bool {
+	return t.AcceptedAt == nil && t.CanceledAt == nil && now.Before(t.ExpiresAt)
+}
+
+func (keys KeyList) Value() (driver.Value, error) {
+	if keys == nil {
+		keys = KeyList{}
+	}
+	return json.Marshal(keys)
+}
+
+func (keys *KeyList) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*keys = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, keys)
+	case string:
+		return json.Unmarshal([]byte(v), keys)
+	default:
+		return fmt.Errorf("unsupported key list type %T", src)
+	}
+}
+
+func (ms *InMemoryStorage) CreateTransfer(ctx context.Context, transfer Transfer) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	if err := checkTransferKeys(ms.urls, transfer); err != nil {
+		return err
+	}
+	ms.transfers[transfer.ID] = transfer
+	return nil
+}
+
+func (ms *InMemoryStorage) AcceptTransfer(ctx context.Context, tokenHash string, userID string, now time.Time) (*Transfer, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	transfer, err := openTransfer(ms.transfers, ms.urls, tokenHash, userID, now)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range transfer.Keys {
+		row := ms.urls[key]
+		row.UUID = transfer.ToUserID
+		ms.urls[key] = row
+	}
+	transfer.AcceptedAt = &now
+	ms.transfers[transfer.ID] = transfer
+	return &transfer, nil
+}
+
+func (ms *InMemoryStorage) CancelTransfer(ctx context.Context, id string, userID string, now time.Time) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	transfer, err := cancelTransfer(ms.transfers, id, userID, now)
+	if err != nil {
+		return err
+	}
+	ms.transfers[id] = transfer
+	return nil
+}
+
+func (fs *FileStorage) CreateTransfer(ctx context.Context, transfer Transfer) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	if err := checkTransferKeys(fs.urls, transfer); err != nil {
+		return err
+	}
+	fs.transfers[transfer.ID] = transfer
+	return fs.storage.InsertRecord(transferRecord, transfer)
+}
+
+// AcceptTransfer appends the new state of every row together with the
+// accepted transfer in one write, and only then applies them in memory.
+func (fs *FileStorage) AcceptTransfer(ctx context.Context, tokenHash string, userID string, now time.Time) (*Transfer, error) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	transfer, err := openTransfer(fs.transfers, fs.urls, tokenHash, userID, now)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]Row, len(transfer.Keys))
+	for i, key := range transfer.Keys {
+		rows[i] = fs.urls[key]
+		rows[i].UUID = transfer.ToUserID
+	}
+	transfer.AcceptedAt = &now
+	if err := fs.storage.InsertBatch(rows, transferRecord, transfer); err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		fs.urls[row.Key] = row
+	}
+	fs.transfers[transfer.ID] = transfer
+	return &transfer, nil
+}
+
+func (fs *FileStorage) CancelTransfer(ctx context.Context, id string, userID string, now time.Time) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	transfer, err := cancelTransfer(fs.transfers, id, userID, now)
+	if err != nil {
+		return err
+	}
+	fs.transfers[id] = transfer
+	return fs.storage.InsertRecord(transferRecord, transfer)
+}
+
+func (db *DB) CreateTransfer(ctx context.Context, transfer Transfer) error {
+	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
+	defer cancel()
+
+	tx, err := db.storage.BeginTxx(ctxDB, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := dbCheckTransferKeys(ctxDB, tx, transfer, false); err != nil {
+		return err
+	}
+	query := `INSERT INTO cuttlink_transfers(id, from_user_id, to_user_id, keys, token_hash, created_at, expires_at)
+		VALUES(:id, :from_user_id, :to_user_id, :keys, :token_hash, :created_at, :expires_at)`
+	if _, err := tx.NamedExecContext(ctxDB, query, transfer); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// AcceptTransfer locks the transfer and its rows, so that concurrent accepts
+// and edits of the links can't interleave with the change of owner.
+func (db *DB) AcceptTransfer(ctx context.Context, tokenHash string, userID string, now time.Time) (*Transfer, error) {
+	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
+	defer cancel()
+
+	tx, err := db.storage.BeginTxx(ctxDB, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var transfer Transfer
+	query := "SELECT * FROM cuttlink_transfers WHERE token_hash=$1 FOR UPDATE"
+	if err := tx.GetContext(ctxDB, &transfer, query, tokenHash); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUnknownTransfer
+		}
+		return nil, err
+	}
+	if transfer.ToUserID != userID {
+		return nil, ErrUnknownTransfer
+	}
+	if !transfer.IsOpen(now) {
+		return nil, ErrTransferClosed
+	}
+	if err := dbCheckTransferKeys(ctxDB, tx, transfer, true); err != nil {
+		return nil, err
+	}
+
+	query = "UPDATE cuttlink SET user_id=$1 WHERE id = any($2)"
+	if _, err := tx.ExecContext(ctxDB, query, transfer.ToUserID, []string(transfer.Keys)); err != nil {
+		return nil, err
+	}
+	transfer.AcceptedAt = &now
+	query = "UPDATE cuttlink_transfers SET accepted_at=$1 WHERE id=$2"
+	if _, err := tx.ExecContext(ctxDB, query, now, transfer.ID); err != nil {
+		return nil, err
+	}
+
+	return &transfer, tx.Commit()
+}
+
+func (db *DB) CancelTransfer(ctx context.Context, id string, userID string, now time.Time) error {
+	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
+	defer cancel()
+
+	var transfer Transfer
+	if err := db.storage.GetContext(ctxDB, &transfer, "SELECT * FROM cuttlink_transfers WHERE id=$1", id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUnknownTransfer
+		}
+		return err
+	}
+	if transfer.FromUserID != userID {
+		return ErrUnknownTransfer
+	}
+
+	query := `UPDATE cuttlink_transfers SET canceled_at=$1
+		WHERE id=$2 AND accepted_at IS NULL AND canceled_at IS NULL AND expires_at > $1`
+	result, err := db.storage.ExecContext(ctxDB, query, now, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrTransferClosed
+	}
+	return err
+}
+
+// dbCheckTransferKeys is checkTransferKeys in SQL, optionally locking the
+// rows until the end of the transaction.
+func dbCheckTransferKeys(ctx context.Context, tx interface {
+	SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+}, transfer Transfer, lock bool) error {
+	query := "SELECT id, user_id, workspace_id, is_deleted FROM cuttlink WHERE id = any($1)"
+	if lock {
+		query += " FOR UPDATE"
+	}
+	rows := make([]struct {
+		Key         string `db:"id"`
+		UUID        string `db:"user_id"`
+		WorkspaceID string `db:"workspace_id"`
+		IsDeleted   bool   `db:"is_deleted"`
+	}, 0)
+	if err := tx.SelectContext(ctx, &rows, query, []string(transfer.Keys)); err != nil {
+		return err
+	}
+	urls := make(map[string]Row, len(rows))
+	for _, row := range rows {
+		urls[row.Key] = Row{Key: row.Key, UUID: row.UUID, WorkspaceID: row.WorkspaceID, IsDeleted: row.IsDeleted}
+	}
+	return checkTransferKeys(urls, transfer)
+}
+
+// checkTransferKeys requires every key to be a live link of the sender
+// outside of workspaces, which are managed through membership instead.
+func checkTransferKeys(urls map[string]Row, transfer Transfer) error {
+	for _, key := range transfer.Keys {
+		row, ok := urls[key]
+		if !ok || row.IsDeleted {
+			return fmt.Errorf("%w: %s", ErrInvalidKey, key)
+		}
+		if row.UUID != transfer.FromUserID || row.WorkspaceID != "" {
+			return fmt.Errorf("%w: %s", ErrNotOwner, key)
+		}
+	}
+	return nil
+}
+
+// openTransfer finds the open transfer of the recipient. Other users get
+// ErrUnknownTransfer, so that a leaked token reveals nothing.
+func openTransfer(transfers map[string]Transfer, urls map[string]Row, tokenHash string, userID string, now time.Time) (Transfer, error) {
+	for _, transfer := range transfers {
+		if transfer.TokenHash != tokenHash {
+			continue
+		}
+		if transfer.ToUserID != userID {
+			return transfer, ErrUnknownTransfer
+		}
+		if !transfer.IsOpen(now) {
+			return transfer, ErrTransferClosed
+		}
+		return transfer, checkTransferKeys(urls, transfer)
+	}
+	return Transfer{}, ErrUnknownTransfer
+}
+
+func cancelTransfer(transfers map[string]Transfer, id string, userID string, now time.Time) (Transfer, error) {
+	transfer, ok := transfers[id]
+	if !ok || transfer.FromUserID != userID {
+		return transfer, ErrUnknownTransfer
+	}
+	if !transfer.IsOpen(now) {
+		return transfer, ErrTransferClosed
+	}
+	transfer.CanceledAt = &now
+	return transfer, nil
+}
+
+func loadTransfers(fs *File) (map[string]Transfer, error) {
+	records, err := fs.LoadRecords(transferRecord)
+	if err != nil {
+		return nil, err
+	}
+	transfers := make(map[string]Transfer)
+	for _, record := range records {
+		var transfer Transfer
+		if err := json.Unmarshal(record, &transfer); err == nil {
+			transfers[transfer.ID] = transfer
+		}
+	}
+	return transfers, nil
+}
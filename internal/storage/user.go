@@ -0,0 +1,257 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+const userRecord = "user"
+
+var (
+	ErrUnknownUser   = errors.New("unknown user")
+	ErrDuplicateUser = errors.New("username or email already registered")
+)
+
+// User is a registered account. Its ID takes the place of the anonymous
+// session UUID as the owner of links and API keys.
+type User struct {
+	ID           string    `db:"id" json:"id"`
+	Username     string    `db:"username" json:"username"`
+	Email        string    `db:"email" json:"email"`
+	PasswordHash string    `db:"password_hash" json:"password_hash"`
+	CreatedAt    time.Time `db:"created_at" json:"created_at"`
+}
+
+func (ms *InMemoryStorage) CreateUser(ctx context.Context, user User) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	if findUser(ms.users, user.Username) != nil || findUser(ms.users, user.Email) != nil {
+		return ErrDuplicateUser
+	}
+	ms.users[user.ID] = user
+	return nil
+}
+
+func (ms *InMemoryStorage) GetUserByLogin(ctx context.Context, login string) (*User, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	if user := findUser(ms.users, login); user != nil {
+		return user, nil
+	}
+	return nil, ErrUnknownUser
+}
+
+func (ms *InMemoryStorage) GetUserByID(ctx context.Context, id string) (*User, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	if user, ok := ms.users[id]; ok {
+		return &user, nil
+	}
+	return nil, ErrUnknownUser
+}
+
+func (ms *InMemoryStorage) ClaimSession(ctx context.Context, sessionID string, userID string) (int, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	claimed := 0
+	for key, row := range ms.urls {
+		if row.UUID == sessionID {
+			row.UUID = userID
+			ms.urls[key] = row
+			claimed++
+		}
+	}
+	for id, key := range ms.apiKeys {
+		if key.UserID == sessionID {
+			key.UserID = userID
+			ms.apiKeys[id] = key
+		}
+	}
+	claimMemberships(ms.members, sessionID, userID)
+	return claimed, nil
+}
+
+func (fs *FileStorage) CreateUser(ctx context.Context, user User) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	if findUser(fs.users, user.Username) != nil || findUser(fs.users, user.Email) != nil {
+		return ErrDuplicateUser
+	}
+	fs.users[user.ID] = user
+	return fs.storage.InsertRecord(userRecord, user)
+}
+
+func (fs *FileStorage) GetUserByLogin(ctx context.Context, login string) (*User, error) {
+	fs.RLock()
+	defer fs.RUnlock()
+
+	if user := findUser(fs.users, login); user != nil {
+		return user, nil
+	}
+	return nil, ErrUnknownUser
+}
+
+func (fs *FileStorage) GetUserByID(ctx context.Context, id string) (*User, error) {
+	fs.RLock()
+	defer fs.RUnlock()
+
+	if user, ok := fs.users[id]; ok {
+		return &user, nil
+	}
+	return nil, ErrUnknownUser
+}
+
+func (fs *FileStorage) ClaimSession(ctx context.Context, sessionID string, userID string) (int, error) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	claimed := 0
+	for key, row := range fs.urls {
+		if row.UUID != sessionID {
+			continue
+		}
+		row.UUID = userID
+		fs.urls[key] = row
+		if err := fs.storage.InsertFS(row); err != nil {
+			return claimed, err
+		}
+		claimed++
+	}
+	for id, key := range fs.apiKeys {
+		if key.UserID != sessionID {
+			continue
+		}
+		key.UserID = userID
+		fs.apiKeys[id] = key
+		if err := fs.storage.InsertRecord(apiKeyRecord, key); err != nil {
+			return claimed, err
+		}
+	}
+	removed, members := claimMemberships(fs.members, sessionID, userID)
+	for _, member := range removed {
+		member.Role = ""
+		members = append(members, member)
+	}
+	values := make([]interface{}, len(members))
+	for i := range members {
+		values[i] = members[i]
+	}
+	return claimed, fs.storage.InsertBatch(nil, workspaceMemberRecord, values...)
+}
+
+func (db *DB) CreateUser(ctx context.Context, user User) error {
+	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
+	defer cancel()
+
+	query := `INSERT INTO cuttlink_users(id, username, email, password_hash, created_at)
+		VALUES(:id, :username, :email, :password_hash, :created_at)`
+	_, err := db.storage.NamedExecContext(ctxDB, query, user)
+	if err != nil && strings.Contains(err.Error(), "duplicate key value violates unique constraint") {
+		return ErrDuplicateUser
+	}
+	return err
+}
+
+func (db *DB) GetUserByLogin(ctx context.Context, login string) (*User, error) {
+	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
+	defer cancel()
+
+	query := "SELECT * FROM cuttlink_users WHERE LOWER(username)=LOWER($1) OR LOWER(email)=LOWER($1)"
+	var user User
+	if err := db.storage.GetContext(ctxDB, &user, query, login); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUnknownUser
+		}
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (db *DB) GetUserByID(ctx context.Context, id string) (*User, error) {
+	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
+	defer cancel()
+
+	var user User
+	if err := db.storage.GetContext(ctxDB, &user, "SELECT * FROM cuttlink_users WHERE id=$1", id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUnknownUser
+		}
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (db *DB) ClaimSession(ctx context.Context, sessionID string, userID string) (int, error) {
+	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
+	defer cancel()
+
+	tx, err := db.storage.BeginTx(ctxDB, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctxDB, "UPDATE cuttlink SET user_id=$1 WHERE user_id=$2", userID, sessionID)
+	if err != nil {
+		return 0, err
+	}
+	claimed, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctxDB, "UPDATE cuttlink_api_keys SET user_id=$1 WHERE user_id=$2", userID, sessionID); err != nil {
+		return 0, err
+	}
+	query := `UPDATE cuttlink_workspace_members a SET role=s.role FROM cuttlink_workspace_members s
+		WHERE a.user_id=$1 AND s.user_id=$2 AND s.workspace_id=a.workspace_id
+		AND array_position(ARRAY['viewer', 'editor', 'owner'], s.role) > array_position(ARRAY['viewer', 'editor', 'owner'], a.role)`
+	if _, err := tx.ExecContext(ctxDB, query, userID, sessionID); err != nil {
+		return 0, err
+	}
+	query = `UPDATE cuttlink_workspace_members SET user_id=$1 WHERE user_id=$2 AND workspace_id NOT IN (
+		SELECT workspace_id FROM cuttlink_workspace_members WHERE user_id=$1)`
+	if _, err := tx.ExecContext(ctxDB, query, userID, sessionID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctxDB, "DELETE FROM cuttlink_workspace_members WHERE user_id=$1", sessionID); err != nil {
+		return 0, err
+	}
+
+	return int(claimed), tx.Commit()
+}
+
+func loadUsers(fs *File) (map[string]User, error) {
+	records, err := fs.LoadRecords(userRecord)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]User)
+	for _, record := range records {
+		var user User
+		if err := json.Unmarshal(record, &user); err == nil {
+			users[user.ID] = user
+		}
+	}
+	return users, nil
+}
+
+// findUser matches login against usernames and emails case-insensitively.
+func findUser(users map[string]User, login string) *User {
+	for _, user := range users {
+		if strings.EqualFold(user.Username, login) || strings.EqualFold(user.Email, login) {
+			return &user
+		}
+	}
+	return nil
+}
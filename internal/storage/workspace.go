@@ -0,0 +1,648 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	workspaceRecord       = "workspace"
+	workspaceMemberRecord = "workspace_member"
+
+	RoleOwner  = "owner"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+)
+
+var (
+	ErrUnknownWorkspace = errors.New("unknown workspace")
+	ErrNotMember        = errors.New("not a member of the workspace")
+	ErrLastOwner        = errors.New("workspace must keep at least one owner")
+)
+
+var roleRanks = map[string]int{
+	RoleViewer: 1,
+	RoleEditor: 2,
+	RoleOwner:  3,
+}
+
+// Workspace owns links on behalf of its members, so that links outlive the
+// membership of whoever created them. Role is the role of the user the
+// workspace was loaded for.
+type Workspace struct {
+	ID        string    `db:"id" json:"id"`
+	Name      string    `db:"name" json:"name"`
+	CreatedBy string    `db:"created_by" json:"created_by"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	Role      string    `db:"role" json:"-"`
+}
+
+// Member grants a user a role in a workspace. In the file log a member
+// record without a role marks the removal of the member.
+type Member struct {
+	WorkspaceID string    `db:"workspace_id" json:"workspace_id"`
+	UserID      string    `db:"user_id" json:"user_id"`
+	Role        string    `db:"role" json:"role"`
+	CreatedAt   time.Time `db:"created_at" json:"created_at"`
+}
+
+func ValidRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// RoleAllows reports whether role grants at least the rights of required:
+// viewers read, editors also change and delete links, owners also manage
+// members.
+func RoleAllows(role string, required string) bool {
+	return role != "" && roleRanks[role] >= roleRanks[required]
+}
+
+func (ms *InMemoryStorage) CreateWorkspace(ctx context.Context, workspace Workspace) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	createWorkspace(ms.workspaces, ms.members, workspace)
+	return nil
+}
+
+func (ms *InMemoryStorage) GetUserWorkspaces(ctx context.Context, userID string) ([]Workspace, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	return userWorkspaces(ms.workspaces, ms.members, userID), nil
+}
+
+func (ms *InMemoryStorage) GetWorkspaceRole(ctx context.Context, workspaceID string, userID string) (string, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	return workspaceRole(ms.workspaces, ms.members, workspaceID, userID)
+}
+
+func (ms *InMemoryStorage) GetWorkspaceMembers(ctx context.Context, workspaceID string) ([]Member, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	return workspaceMembers(ms.workspaces, ms.members, workspaceID)
+}
+
+func (ms *InMemoryStorage) SetWorkspaceMember(ctx context.Context, member Member) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	_, err := setWorkspaceMember(ms.workspaces, ms.members, member)
+	return err
+}
+
+func (ms *InMemoryStorage) RemoveWorkspaceMember(ctx context.Context, workspaceID string, userID string) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	_, err := removeWorkspaceMember(ms.members, workspaceID, userID)
+	return err
+}
+
+func (ms *InMemoryStorage) GetURLRole(ctx context.Context, key string, userID string) (string, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	row, ok := ms.urls[key]
+	if !ok {
+		return "", ErrInvalidKey
+	}
+	if role := linkRole(row, userID, ms.members); role != "" {
+		return role, nil
+	}
+	return "", ErrNotOwner
+}
+
+func (ms *InMemoryStorage) MoveURLs(ctx context.Context, keys []string, workspaceID string, userID string) ([]string, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	if _, ok := ms.workspaces[workspaceID]; !ok {
+		return nil, ErrUnknownWorkspace
+	}
+	moved := make([]string, 0, len(keys))
+	for _, key := range keys {
+		row, ok := ms.urls[key]
+		if !ok || row.IsDeleted || !RoleAllows(linkRole(row, userID, ms.members), RoleEditor) {
+			continue
+		}
+		row.WorkspaceID = workspaceID
+		ms.urls[key] = row
+		moved = append(moved, key)
+	}
+	return moved, nil
+}
+
+func (fs *FileStorage) CreateWorkspace(ctx context.Context, workspace Workspace) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	member := createWorkspace(fs.workspaces, fs.members, workspace)
+	if err := fs.storage.InsertRecord(workspaceRecord, workspace); err != nil {
+		return err
+	}
+	return fs.storage.InsertRecord(workspaceMemberRecord, member)
+}
+
+func (fs *FileStorage) GetUserWorkspaces(ctx context.Context, userID string) ([]Workspace, error) {
+	fs.RLock()
+	defer fs.RUnlock()
+
+	return userWorkspaces(fs.workspaces, fs.members, userID), nil
+}
+
+func (fs *FileStorage) GetWorkspaceRole(ctx context.Context, workspaceID string, userID string) (string, error) {
+	fs.RLock()
+	defer fs.RUnlock()
+
+	return workspaceRole(fs.workspaces, fs.members, workspaceID, userID)
+}
+
+func (fs *FileStorage) GetWorkspaceMembers(ctx context.Context, workspaceID string) ([]Member, error) {
+	fs.RLock()
+	defer fs.RUnlock()
+
+	return workspaceMembers(fs.workspaces, fs.members, workspaceID)
+}
+
+func (fs *FileStorage) SetWorkspaceMember(ctx context.Context, member Member) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	member, err := setWorkspaceMember(fs.workspaces, fs.members, member)
+	if err != nil {
+		return err
+	}
+	return fs.storage.InsertRecord(workspaceMemberRecord, member)
+}
+
+func (fs *FileStorage) RemoveWorkspaceMember(ctx context.Context, workspaceID string, userID string) error {
+	fs.Lock()
+	defer fs.Unlock()
+
+	member, err := removeWorkspaceMember(fs.members, workspaceID, userID)
+	if err != nil {
+		return err
+	}
+	member.Role = ""
+	return fs.storage.InsertRecord(workspaceMemberRecord, member)
+}
+
+func (fs *FileStorage) GetURLRole(ctx context.Context, key string, userID string) (string, error) {
+	fs.RLock()
+	defer fs.RUnlock()
+
+	row, ok := fs.urls[key]
+	if !ok {
+		return "", ErrInvalidKey
+	}
+	if role := linkRole(row, userID, fs.members); role != "" {
+		return role, nil
+	}
+	return "", ErrNotOwner
+}
+
+func (fs *FileStorage) MoveURLs(ctx context.Context, keys []string, workspaceID string, userID string) ([]string, error) {
+	fs.Lock()
+	defer fs.Unlock()
+
+	if _, ok := fs.workspaces[workspaceID]; !ok {
+		return nil, ErrUnknownWorkspace
+	}
+	moved := make([]string, 0, len(keys))
+	for _, key := range keys {
+		row, ok := fs.urls[key]
+		if !ok || row.IsDeleted || !RoleAllows(linkRole(row, userID, fs.members), RoleEditor) {
+			continue
+		}
+		row.WorkspaceID = workspaceID
+		fs.urls[key] = row
+		if err := fs.storage.InsertFS(row); err != nil {
+			return moved, err
+		}
+		moved = append(moved, key)
+	}
+	return moved, nil
+}
+
+func (db *DB) CreateWorkspace(ctx context.Context, workspace Workspace) error {
+	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
+	defer cancel()
+
+	tx, err := db.storage.BeginTxx(ctxDB, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO cuttlink_workspaces(id, name, created_by, created_at)
+		VALUES(:id, :name, :created_by, :created_at)`
+	if _, err := tx.NamedExecContext(ctxDB, query, workspace); err != nil {
+		return err
+	}
+	query = `INSERT INTO cuttlink_workspace_members(workspace_id, user_id, role, created_at)
+		VALUES(:workspace_id, :user_id, :role, :created_at)`
+	if _, err := tx.NamedExecContext(ctxDB, query, ownerOf(workspace)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *DB) GetUserWorkspaces(ctx context.Context, userID string) ([]Workspace, error) {
+	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
+	defer cancel()
+
+	query := `SELECT w.id, w.name, w.created_by, w.created_at, m.role FROM cuttlink_workspaces w
+		JOIN cuttlink_workspace_members m ON m.workspace_id = w.id
+		WHERE m.user_id=$1 ORDER BY w.created_at, w.id`
+	items := make([]Workspace, 0)
+	if err := db.storage.SelectContext(ctxDB, &items, query, userID); err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+func (db *DB) GetWorkspaceRole(ctx context.Context, workspaceID string, userID string) (string, error) {
+	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
+	defer cancel()
+
+	query := `SELECT COALESCE(m.role, '') FROM cuttlink_workspaces w
+		LEFT JOIN cuttlink_workspace_members m ON m.workspace_id = w.id AND m.user_id=$2
+		WHERE w.id=$1`
+	var role string
+	if err := db.storage.GetContext(ctxDB, &role, query, workspaceID, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrUnknownWorkspace
+		}
+		return "", err
+	}
+	if role == "" {
+		return "", ErrNotMember
+	}
+
+	return role, nil
+}
+
+func (db *DB) GetWorkspaceMembers(ctx context.Context, workspaceID string) ([]Member, error) {
+	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
+	defer cancel()
+
+	var exists bool
+	if err := db.storage.GetContext(ctxDB, &exists, "SELECT EXISTS(SELECT 1 FROM cuttlink_workspaces WHERE id=$1)", workspaceID); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrUnknownWorkspace
+	}
+
+	query := "SELECT * FROM cuttlink_workspace_members WHERE workspace_id=$1 ORDER BY created_at, user_id"
+	items := make([]Member, 0)
+	if err := db.storage.SelectContext(ctxDB, &items, query, workspaceID); err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+func (db *DB) SetWorkspaceMember(ctx context.Context, member Member) error {
+	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
+	defer cancel()
+
+	tx, err := db.storage.BeginTxx(ctxDB, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := dbLockWorkspace(ctxDB, tx, member.WorkspaceID); err != nil {
+		return err
+	}
+	if member.Role != RoleOwner {
+		if err := dbKeepsOwner(ctxDB, tx, member.WorkspaceID, member.UserID); err != nil {
+			return err
+		}
+	}
+	query := `INSERT INTO cuttlink_workspace_members(workspace_id, user_id, role, created_at)
+		VALUES(:workspace_id, :user_id, :role, :created_at)
+		ON CONFLICT (workspace_id, user_id) DO UPDATE SET role = EXCLUDED.role`
+	if _, err := tx.NamedExecContext(ctxDB, query, member); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *DB) RemoveWorkspaceMember(ctx context.Context, workspaceID string, userID string) error {
+	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
+	defer cancel()
+
+	tx, err := db.storage.BeginTxx(ctxDB, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := dbLockWorkspace(ctxDB, tx, workspaceID); err != nil {
+		return err
+	}
+	if err := dbKeepsOwner(ctxDB, tx, workspaceID, userID); err != nil {
+		return err
+	}
+	query := "DELETE FROM cuttlink_workspace_members WHERE workspace_id=$1 AND user_id=$2"
+	result, err := tx.ExecContext(ctxDB, query, workspaceID, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrNotMember
+	}
+
+	return tx.Commit()
+}
+
+// dbLockWorkspace serializes membership changes of the workspace until the
+// transaction ends, so that owner checks can't race.
+func dbLockWorkspace(ctx context.Context, tx *sqlx.Tx, workspaceID string) error {
+	var id string
+	if err := tx.GetContext(ctx, &id, "SELECT id FROM cuttlink_workspaces WHERE id=$1 FOR UPDATE", workspaceID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUnknownWorkspace
+		}
+		return err
+	}
+	return nil
+}
+
+// dbKeepsOwner fails with ErrLastOwner when userID is the only owner.
+func dbKeepsOwner(ctx context.Context, tx *sqlx.Tx, workspaceID string, userID string) error {
+	query := `SELECT COUNT(*) = 1 AND BOOL_OR(user_id = $2) FROM cuttlink_workspace_members
+		WHERE workspace_id=$1 AND role='owner'`
+	var last sql.NullBool
+	if err := tx.GetContext(ctx, &last, query, workspaceID, userID); err != nil {
+		return err
+	}
+	if last.Valid && last.Bool {
+		return ErrLastOwner
+	}
+	return nil
+}
+
+func (db *DB) GetURLRole(ctx context.Context, key string, userID string) (string, error) {
+	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
+	defer cancel()
+
+	query := `SELECT CASE
+			WHEN c.workspace_id = '' AND c.user_id = $2 THEN 'owner'
+			WHEN c.workspace_id = '' THEN ''
+			ELSE COALESCE(m.role, '')
+		END
+		FROM cuttlink c
+		LEFT JOIN cuttlink_workspace_members m ON m.workspace_id = c.workspace_id AND m.user_id = $2
+		WHERE c.id=$1`
+	var role string
+	if err := db.storage.GetContext(ctxDB, &role, query, key, userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrInvalidKey
+		}
+		return "", err
+	}
+	if role == "" {
+		return "", ErrNotOwner
+	}
+
+	return role, nil
+}
+
+func (db *DB) MoveURLs(ctx context.Context, keys []string, workspaceID string, userID string) ([]string, error) {
+	ctxDB, cancel := context.WithTimeout(ctx, dbResponseTimeout)
+	defer cancel()
+
+	var exists bool
+	if err := db.storage.GetContext(ctxDB, &exists, "SELECT EXISTS(SELECT 1 FROM cuttlink_workspaces WHERE id=$1)", workspaceID); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrUnknownWorkspace
+	}
+
+	query := `UPDATE cuttlink SET workspace_id=$1 WHERE id = any($2) AND is_deleted=FALSE AND ` + dbEditableBy("$3") + `
+		RETURNING id`
+	moved := make([]string, 0, len(keys))
+	if err := db.storage.SelectContext(ctxDB, &moved, query, workspaceID, keys, userID); err != nil {
+		return nil, err
+	}
+
+	return moved, nil
+}
+
+// dbEditableBy is the SQL condition for links the user in param may change:
+// their own links outside of workspaces and links of workspaces where they
+// are an owner or editor.
+func dbEditableBy(param string) string {
+	return `((workspace_id = '' AND user_id = ` + param + `) OR workspace_id IN (
+		SELECT workspace_id FROM cuttlink_workspace_members
+		WHERE user_id = ` + param + ` AND role IN ('owner', 'editor')))`
+}
+
+// dbVisibleTo is like dbEditableBy, but for any role.
+func dbVisibleTo(param string) string {
+	return `((workspace_id = '' AND user_id = ` + param + `) OR workspace_id IN (
+		SELECT workspace_id FROM cuttlink_workspace_members WHERE user_id = ` + param + `))`
+}
+
+// linkRole is the role of the user for a link: owner of their own links,
+// their membership role for links of a workspace, or none. Callers hold the
+// storage lock, the members are changed by other requests.
+func linkRole(row Row, userID string, members map[string]map[string]Member) string {
+	if row.WorkspaceID == "" {
+		if row.UUID == userID {
+			return RoleOwner
+		}
+		return ""
+	}
+	return members[row.WorkspaceID][userID].Role
+}
+
+func ownerOf(workspace Workspace) Member {
+	return Member{
+		WorkspaceID: workspace.ID,
+		UserID:      workspace.CreatedBy,
+		Role:        RoleOwner,
+		CreatedAt:   workspace.CreatedAt,
+	}
+}
+
+func createWorkspace(workspaces map[string]Workspace, members map[string]map[string]Member, workspace Workspace) Member {
+	owner := ownerOf(workspace)
+	workspaces[workspace.ID] = workspace
+	members[workspace.ID] = map[string]Member{owner.UserID: owner}
+	return owner
+}
+
+func userWorkspaces(workspaces map[string]Workspace, members map[string]map[string]Member, userID string) []Workspace {
+	data := make([]Workspace, 0)
+	for id, workspace := range workspaces {
+		if member, ok := members[id][userID]; ok {
+			workspace.Role = member.Role
+			data = append(data, workspace)
+		}
+	}
+	sort.Slice(data, func(i, j int) bool {
+		if data[i].CreatedAt.Equal(data[j].CreatedAt) {
+			return data[i].ID < data[j].ID
+		}
+		return data[i].CreatedAt.Before(data[j].CreatedAt)
+	})
+	return data
+}
+
+func workspaceRole(workspaces map[string]Workspace, members map[string]map[string]Member, workspaceID string, userID string) (string, error) {
+	if _, ok := workspaces[workspaceID]; !ok {
+		return "", ErrUnknownWorkspace
+	}
+	member, ok := members[workspaceID][userID]
+	if !ok {
+		return "", ErrNotMember
+	}
+	return member.Role, nil
+}
+
+func workspaceMembers(workspaces map[string]Workspace, members map[string]map[string]Member, workspaceID string) ([]Member, error) {
+	if _, ok := workspaces[workspaceID]; !ok {
+		return nil, ErrUnknownWorkspace
+	}
+	data := make([]Member, 0, len(members[workspaceID]))
+	for _, member := range members[workspaceID] {
+		data = append(data, member)
+	}
+	sort.Slice(data, func(i, j int) bool {
+		if data[i].CreatedAt.Equal(data[j].CreatedAt) {
+			return data[i].UserID < data[j].UserID
+		}
+		return data[i].CreatedAt.Before(data[j].CreatedAt)
+	})
+	return data, nil
+}
+
+// setWorkspaceMember adds the member or changes the role of an existing one,
+// who keeps the original join time. The last owner can't be demoted.
+func setWorkspaceMember(workspaces map[string]Workspace, members map[string]map[string]Member, member Member) (Member, error) {
+	if _, ok := workspaces[member.WorkspaceID]; !ok {
+		return member, ErrUnknownWorkspace
+	}
+	if member.Role != RoleOwner && isLastOwner(members[member.WorkspaceID], member.UserID) {
+		return member, ErrLastOwner
+	}
+	if existing, ok := members[member.WorkspaceID][member.UserID]; ok {
+		member.CreatedAt = existing.CreatedAt
+	}
+	if members[member.WorkspaceID] == nil {
+		members[member.WorkspaceID] = make(map[string]Member)
+	}
+	members[member.WorkspaceID][member.UserID] = member
+	return member, nil
+}
+
+func removeWorkspaceMember(members map[string]map[string]Member, workspaceID string, userID string) (Member, error) {
+	member, ok := members[workspaceID][userID]
+	if !ok {
+		return member, ErrNotMember
+	}
+	if isLastOwner(members[workspaceID], userID) {
+		return member, ErrLastOwner
+	}
+	delete(members[workspaceID], userID)
+	return member, nil
+}
+
+// isLastOwner reports whether userID is the only owner among the members.
+func isLastOwner(members map[string]Member, userID string) bool {
+	if members[userID].Role != RoleOwner {
+		return false
+	}
+	for id, member := range members {
+		if id != userID && member.Role == RoleOwner {
+			return false
+		}
+	}
+	return true
+}
+
+// claimMemberships hands the workspace memberships of an anonymous session
+// to the account. Where the account is a member already it keeps the higher
+// of both roles, so that no workspace loses its owner. It returns the
+// dropped session memberships and the memberships of the account that were
+// added or changed.
+func claimMemberships(members map[string]map[string]Member, sessionID string, userID string) ([]Member, []Member) {
+	removed, claimed := make([]Member, 0), make([]Member, 0)
+	for workspaceID, workspaceMembers := range members {
+		member, ok := workspaceMembers[sessionID]
+		if !ok {
+			continue
+		}
+		delete(workspaceMembers, sessionID)
+		removed = append(removed, member)
+
+		existing, ok := workspaceMembers[userID]
+		if ok && roleRanks[existing.Role] >= roleRanks[member.Role] {
+			continue
+		}
+		if ok {
+			member.CreatedAt = existing.CreatedAt
+		}
+		member.UserID = userID
+		members[workspaceID][userID] = member
+		claimed = append(claimed, member)
+	}
+	return removed, claimed
+}
+
+// loadWorkspaces replays the workspace and member records.
+func loadWorkspaces(fs *File) (map[string]Workspace, map[string]map[string]Member, error) {
+	workspaces := make(map[string]Workspace)
+	members := make(map[string]map[string]Member)
+
+	records, err := fs.LoadRecords(workspaceRecord)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, record := range records {
+		var workspace Workspace
+		if err := json.Unmarshal(record, &workspace); err == nil {
+			workspaces[workspace.ID] = workspace
+		}
+	}
+
+	records, err = fs.LoadRecords(workspaceMemberRecord)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, record := range records {
+		var member Member
+		if err := json.Unmarshal(record, &member); err != nil {
+			continue
+		}
+		if members[member.WorkspaceID] == nil {
+			members[member.WorkspaceID] = make(map[string]Member)
+		}
+		if member.Role == "" {
+			delete(members[member.WorkspaceID], member.UserID)
+			continue
+		}
+		members[member.WorkspaceID][member.UserID] = member
+	}
+
+	return workspaces, members, nil
+}
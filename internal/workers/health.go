@@ -0,0 +1,210 @@
+package workers
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/avtorsky/cuttlink/internal/metadata"
+)
+
+const healthBodyLimit = 64 * 1024
+
+// HealthTarget is one destination of a link, a link with rules or variants
+// has several.
+type HealthTarget struct {
+	Key string
+	URL string
+}
+
+type HealthStatus struct {
+	StatusCode int
+	CheckedAt  time.Time
+	IsBroken   bool
+}
+
+type HealthStore interface {
+	GetHealthTargets(ctx context.Context) ([]HealthTarget, error)
+	SetURLHealth(ctx context.Context, key string, status HealthStatus) error
+}
+
+// HealthConfig bounds the checker: at most Concurrency requests in flight,
+// one request per host every HostInterval and Timeout per request. With
+// BlockPrivate set it neither connects nor follows redirects to private
+// networks, so that links can't be used to probe internal hosts.
+type HealthConfig struct {
+	Interval     time.Duration
+	Concurrency  int
+	HostInterval time.Duration
+	Timeout      time.Duration
+	UserAgent    string
+	BlockPrivate bool
+}
+
+type HealthWorker struct {
+	service HealthStore
+	client  *http.Client
+	config  HealthConfig
+}
+
+func NewHealthWorker(service HealthStore, config HealthConfig) *HealthWorker {
+	if config.Concurrency < 1 {
+		config.Concurrency = 1
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+	if config.UserAgent == "" {
+		config.UserAgent = "cuttlink-healthcheck/1.0"
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = metadata.GuardedDialer(config.Timeout, config.BlockPrivate).DialContext
+	return &HealthWorker{
+		service: service,
+		client: &http.Client{
+			Timeout:       config.Timeout,
+			Transport:     transport,
+			CheckRedirect: metadata.CheckRedirect(config.BlockPrivate),
+		},
+		config: config,
+	}
+}
+
+func (w *HealthWorker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		w.RunOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce checks every active destination once. Targets are grouped by host
+// so that a single slow or rate limited host doesn't block the others. A link
+// is stored as broken when any of its destinations is.
+func (w *HealthWorker) RunOnce(ctx context.Context) {
+	targets, err := w.service.GetHealthTargets(ctx)
+	if err != nil {
+		log.Printf("unable to load health targets: %v", err)
+		return
+	}
+
+	statuses := make([]*HealthStatus, len(targets))
+	hosts := make(map[string][]int)
+	for i, target := range targets {
+		u, err := url.Parse(target.URL)
+		if err != nil {
+			statuses[i] = &HealthStatus{CheckedAt: time.Now().UTC(), IsBroken: true}
+			continue
+		}
+		hosts[u.Host] = append(hosts[u.Host], i)
+	}
+
+	sem := make(chan struct{}, w.config.Concurrency)
+	wg := sync.WaitGroup{}
+	for _, hostTargets := range hosts {
+		wg.Add(1)
+		go func(hostTargets []int) {
+			defer wg.Done()
+			for n, i := range hostTargets {
+				if n > 0 && !sleep(ctx, w.config.HostInterval) {
+					return
+				}
+				select {
+				case sem <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+				status := w.Check(ctx, targets[i].URL)
+				<-sem
+				statuses[i] = &status
+			}
+		}(hostTargets)
+	}
+	wg.Wait()
+
+	for key, status := range linkHealth(targets, statuses) {
+		if err := w.service.SetURLHealth(ctx, key, status); err != nil {
+			log.Printf("unable to store health of %s: %v", key, err)
+		}
+	}
+}
+
+// linkHealth combines the statuses of each link's destinations: the first
+// broken one, or else the first one. Links not checked in full are left out.
+func linkHealth(targets []HealthTarget, statuses []*HealthStatus) map[string]HealthStatus {
+	result := make(map[string]HealthStatus)
+	skipped := make(map[string]bool)
+	for i, target := range targets {
+		status := statuses[i]
+		if status == nil || skipped[target.Key] {
+			skipped[target.Key] = true
+			delete(result, target.Key)
+			continue
+		}
+		if current, ok := result[target.Key]; !ok || (!current.IsBroken && status.IsBroken) {
+			result[target.Key] = *status
+		}
+	}
+	return result
+}
+
+// Check requests the destination with HEAD, falling back to GET for servers
+// that don't support it. Network errors, 404, 410 and 5xx mark it broken;
+// 401, 403 and 429 only say the checker itself was turned away.
+func (w *HealthWorker) Check(ctx context.Context, rawURL string) HealthStatus {
+	status := HealthStatus{CheckedAt: time.Now().UTC()}
+
+	code, err := w.request(ctx, http.MethodHead, rawURL)
+	if err != nil || code == http.StatusMethodNotAllowed || code == http.StatusNotImplemented {
+		code, err = w.request(ctx, http.MethodGet, rawURL)
+	}
+	if err != nil {
+		status.IsBroken = true
+		return status
+	}
+
+	status.StatusCode = code
+	status.IsBroken = code == http.StatusNotFound || code == http.StatusGone || code >= 500
+	return status
+}
+
+func (w *HealthWorker) request(ctx context.Context, method string, rawURL string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", w.config.UserAgent)
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, healthBodyLimit))
+
+	return res.StatusCode, nil
+}
+
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
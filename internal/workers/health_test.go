@@ -0,0 +1,125 @@
+package workers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type healthStore struct {
+	sync.Mutex
+	targets []HealthTarget
+	results map[string]HealthStatus
+}
+
+func (hs *healthStore) GetHealthTargets(ctx context.Context) ([]HealthTarget, error) {
+	return hs.targets, nil
+}
+
+func (hs *healthStore) SetURLHealth(ctx context.Context, key string, status HealthStatus) error {
+	hs.Lock()
+	defer hs.Unlock()
+	hs.results[key] = status
+	return nil
+}
+
+func TestHealthWorker__RunOnce(t *testing.T) {
+	var inFlight, maxInFlight int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			m := atomic.LoadInt32(&maxInFlight)
+			if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+
+		switch r.URL.Path {
+		case "/ok":
+			w.WriteHeader(http.StatusOK)
+		case "/nohead":
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		case "/forbidden":
+			w.WriteHeader(http.StatusForbidden)
+		case "/error":
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	store := &healthStore{
+		targets: []HealthTarget{
+			{Key: "2", URL: ts.URL + "/ok"},
+			{Key: "3", URL: ts.URL + "/nohead"},
+			{Key: "4", URL: ts.URL + "/forbidden"},
+			{Key: "5", URL: ts.URL + "/error"},
+			{Key: "6", URL: ts.URL + "/gone"},
+			{Key: "7", URL: closed.URL + "/ok"},
+			{Key: "8", URL: ts.URL + "/ok"},
+			{Key: "8", URL: ts.URL + "/error"},
+			{Key: "9", URL: ts.URL + "/forbidden"},
+			{Key: "9", URL: ts.URL + "/ok"},
+		},
+		results: make(map[string]HealthStatus),
+	}
+	worker := NewHealthWorker(store, HealthConfig{
+		Interval:    time.Hour,
+		Concurrency: 2,
+		Timeout:     time.Second,
+	})
+	worker.RunOnce(context.Background())
+
+	tests := []struct {
+		key    string
+		code   int
+		broken bool
+	}{
+		{key: "2", code: 200, broken: false},
+		{key: "3", code: 200, broken: false},
+		{key: "4", code: 403, broken: false},
+		{key: "5", code: 502, broken: true},
+		{key: "6", code: 404, broken: true},
+		{key: "7", code: 0, broken: true},
+		{key: "8", code: 502, broken: true},
+		{key: "9", code: 403, broken: false},
+	}
+	for _, tt := range tests {
+		status, ok := store.results[tt.key]
+		assert.True(t, ok, "target %s should be checked", tt.key)
+		assert.Equal(t, tt.code, status.StatusCode, "status codes of %s should be equal", tt.key)
+		assert.Equal(t, tt.broken, status.IsBroken, "broken flags of %s should be equal", tt.key)
+		assert.False(t, status.CheckedAt.IsZero())
+	}
+	assert.LessOrEqual(t, atomic.LoadInt32(&maxInFlight), int32(1), "one host should be checked sequentially")
+}
+
+func TestHealthWorker__blockPrivate(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	worker := NewHealthWorker(&healthStore{}, HealthConfig{Timeout: time.Second, BlockPrivate: true})
+	status := worker.Check(context.Background(), ts.URL)
+	assert.True(t, status.IsBroken, "private destinations should not be probed")
+	assert.Equal(t, 0, status.StatusCode)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&requests))
+}
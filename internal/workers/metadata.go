@@ -0,0 +1,70 @@
+package workers
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/avtorsky/cuttlink/internal/metadata"
+)
+
+type MetadataTask struct {
+	Key string
+	URL string
+}
+
+type MetadataStore interface {
+	SetURLMetadata(ctx context.Context, key string, meta metadata.Metadata) error
+}
+
+// MetadataWorker fetches destination pages in the background with at most
+// Concurrency requests in flight. Failures are logged and the link is left
+// without metadata.
+type MetadataWorker struct {
+	service     MetadataStore
+	fetcher     metadata.Fetcher
+	Tasks       <-chan MetadataTask
+	concurrency int
+}
+
+func NewMetadataWorker(service MetadataStore, fetcher metadata.Fetcher, tasks <-chan MetadataTask, concurrency int) *MetadataWorker {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &MetadataWorker{
+		service:     service,
+		fetcher:     fetcher,
+		Tasks:       tasks,
+		concurrency: concurrency,
+	}
+}
+
+func (w *MetadataWorker) Run(ctx context.Context) {
+	wg := sync.WaitGroup{}
+	for i := 0; i < w.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case task := <-w.Tasks:
+					w.Add(ctx, task)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (w *MetadataWorker) Add(ctx context.Context, task MetadataTask) {
+	meta, err := w.fetcher.Fetch(ctx, task.URL)
+	if err != nil {
+		log.Printf("unable to fetch metadata of %s: %v", task.Key, err)
+		return
+	}
+	if err := w.service.SetURLMetadata(ctx, task.Key, meta); err != nil {
+		log.Printf("unable to store metadata of %s: %v", task.Key, err)
+	}
+}
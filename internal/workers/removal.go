@@ -5,9 +5,13 @@ import (
 	"sync"
 )
 
+// RemovalTask carries the client of the request along with the keys, so that
+// the deletion can be audited once it is done.
 type RemovalTask struct {
-	Keys []string
-	UUID string
+	Keys      []string
+	UUID      string
+	ClientIP  string
+	UserAgent string
 }
 
 type RemovalWorker struct {
@@ -26,12 +30,16 @@ func New(worker Remover, tasks <-chan RemovalTask) *RemovalWorker {
 	}
 }
 
+// Run removes until ctx is done, then finishes the tasks already queued and
+// those in progress before returning. Senders must have stopped by then.
+// Tasks don't run on ctx, so that stopping doesn't cut them off halfway.
 func (w *RemovalWorker) Run(ctx context.Context) {
 	wg := sync.WaitGroup{}
 
 	for {
 		select {
 		case <-ctx.Done():
+			w.drain()
 			wg.Wait()
 			return
 
@@ -39,12 +47,23 @@ func (w *RemovalWorker) Run(ctx context.Context) {
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				w.Add(ctx, task)
+				w.Add(context.Background(), task)
 			}()
 		}
 	}
 }
 
+func (w *RemovalWorker) drain() {
+	for {
+		select {
+		case task := <-w.Tasks:
+			w.Add(context.Background(), task)
+		default:
+			return
+		}
+	}
+}
+
 func (w *RemovalWorker) Add(ctx context.Context, task RemovalTask) {
 	w.service.UpdateBatchURL(ctx, task)
 }
@@ -0,0 +1,39 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type removalStore struct {
+	sync.Mutex
+	removed []string
+}
+
+func (rs *removalStore) UpdateBatchURL(ctx context.Context, task RemovalTask) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	rs.Lock()
+	defer rs.Unlock()
+	rs.removed = append(rs.removed, task.Keys...)
+	return nil
+}
+
+func TestRemovalWorker__RunDrains(t *testing.T) {
+	store := &removalStore{}
+	tasks := make(chan RemovalTask, 10)
+	for i := 0; i < cap(tasks); i++ {
+		tasks <- RemovalTask{Keys: []string{fmt.Sprint(i)}, UUID: "u"}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	New(store, tasks).Run(ctx)
+	assert.Len(t, store.removed, cap(tasks), "queued tasks should be done before Run returns")
+	assert.Len(t, tasks, 0)
+}